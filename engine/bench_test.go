@@ -13,10 +13,12 @@ import (
 	"github.com/efficientgo/core/testutil"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 
 	"github.com/thanos-community/promql-engine/engine"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
 )
 
 func BenchmarkChunkDecoding(b *testing.B) {
@@ -351,6 +353,48 @@ func BenchmarkMergeSelectorsOptimizer(b *testing.B) {
 
 }
 
+func BenchmarkChunkQueryable(b *testing.B) {
+	// Two days of samples, so that each series has many chunks.
+	load := `load 30s`
+	for i := 0; i < 100; i++ {
+		load += fmt.Sprintf(`
+  http_requests_total{pod="p%d"} %d+1x5760`, i, i)
+	}
+	test, err := promql.NewTest(b, load)
+	testutil.Ok(b, err)
+	defer test.Close()
+	testutil.Ok(b, test.Run())
+
+	start := time.Unix(0, 0)
+	end := start.Add(48 * time.Hour)
+	step := 6 * time.Hour
+
+	for _, query := range []string{
+		"sum(http_requests_total)",
+		"sum(rate(http_requests_total[5m]))",
+	} {
+		for _, tcase := range []struct {
+			name      string
+			queryable storage.Queryable
+		}{
+			{name: "samples", queryable: test.Storage()},
+			{name: "chunks", queryable: engstore.NewChunkQueryable(test.Storage())},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", query, tcase.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					ng := engine.New(engine.Opts{DisableFallback: true})
+					qry, err := ng.NewRangeQuery(tcase.queryable, nil, query, start, end, step)
+					testutil.Ok(b, err)
+
+					res := qry.Exec(context.Background())
+					testutil.Ok(b, res.Err)
+				}
+			})
+		}
+	}
+}
+
 func executeRangeQuery(b *testing.B, q string, test *promql.Test, start time.Time, end time.Time, step time.Duration) *promql.Result {
 	return executeRangeQueryWithOpts(b, q, test, start, end, step, engine.Opts{})
 }
@@ -10,6 +10,7 @@ import (
 	"math"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/efficientgo/core/errors"
@@ -17,6 +18,8 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
@@ -24,9 +27,13 @@ import (
 	v1 "github.com/prometheus/prometheus/web/api/v1"
 
 	"github.com/thanos-community/promql-engine/execution"
+	"github.com/thanos-community/promql-engine/execution/function"
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/execution/warnings"
 	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type Opts struct {
@@ -39,6 +46,85 @@ type Opts struct {
 	// in the new engine, instead of falling back to prometheus engine.
 	DisableFallback bool
 
+	// DisableLookback enables mode where selectors only return samples which are exactly at the evaluation
+	// timestamp of each step, instead of looking back by EngineOpts.LookbackDelta.
+	// NOTE: Queries which fall back to the prometheus engine will still use the lookback delta.
+	DisableLookback bool
+
+	// DisableResultSorting returns the series of range query results in the order in which operators produce them,
+	// instead of sorting them by their labels. Sorted results are deterministic and match those of Prometheus,
+	// which makes them suitable for comparing and caching, but sorting has a cost for queries returning many series.
+	// NOTE: Results of queries which use the ResultCache or fall back to the prometheus engine are always sorted.
+	DisableResultSorting bool
+
+	// KeepMetricNames disables dropping metric names in operations such as arithmetic and functions.
+	// It is meant for debugging which series produced which output and should not be used in production.
+	KeepMetricNames bool
+
+	// DisableRateExtrapolation makes rate, increase and delta return the raw change between the first
+	// and the last sample of each range, instead of extrapolating it to the boundaries of the range.
+	// Rates are divided by the time between these samples. It is meant for debugging and should not be used in production.
+	// NOTE: Queries which fall back to the prometheus engine will still extrapolate.
+	DisableRateExtrapolation bool
+
+	// EnableExperimentalFunctions contains the names of experimental functions which can be used in queries.
+	// Queries using other experimental functions fail with parse.ErrExperimentalFunction.
+	EnableExperimentalFunctions []string
+
+	// MaxQueryMemoryBytes is the maximum number of bytes which a single query can check out from
+	// vector pools at the same time. Queries exceeding the limit fail with model.ErrMemoryLimitExceeded.
+	// If zero, the memory of queries is not limited.
+	MaxQueryMemoryBytes int64
+
+	// MaxQuerySeries is the maximum number of series which a single query can return. Queries exceeding
+	// the limit fail with exchange.ErrTooManySeries before they are evaluated. If zero, the number of series is not limited.
+	// NOTE: Queries which fall back to the prometheus engine are not limited.
+	MaxQuerySeries int
+
+	// MaxQuerySteps is the maximum number of steps at which a single query is evaluated, to protect against
+	// queries with very small steps over large ranges. Queries exceeding the limit fail with execution.ErrTooManySteps
+	// before they are evaluated. If zero, the number of steps is not limited.
+	MaxQuerySteps int64
+
+	// MaxSamplesPerWindow is the maximum number of samples which a range selector can buffer for one series
+	// in a single step, as a safety valve for wide ranges over high resolution series. Queries exceeding
+	// the limit fail with scan.ErrTooManySamplesInWindow. If zero, the number of samples in a window is not limited.
+	// NOTE: Queries which fall back to the prometheus engine are not limited.
+	MaxSamplesPerWindow int
+
+	// SnapshotTimeFn optionally returns the latest timestamp of samples which a query reads. It is called once
+	// for each query, so that all selectors of the query, and queries which are given the same time, read the
+	// same samples while new samples are ingested. If nil, or if it returns the zero time, samples are not limited.
+	// NOTE: Queries which fall back to the prometheus engine read all samples.
+	SnapshotTimeFn func() time.Time
+
+	// Clock optionally returns the current time of the engine, which instant queries given the zero time are
+	// evaluated at. Functions like time() and the start() and end() modifiers then return the time of the clock,
+	// which makes their results deterministic for tests and replays. If nil, the wall clock is used.
+	Clock func() time.Time
+
+	// CustomFunctions contains factories for operators of functions which are not part of PromQL, by function name.
+	// Since queries are parsed by the prometheus parser, custom functions also need to be added to parser.Functions.
+	// NOTE: Queries using custom functions can not fall back to the prometheus engine.
+	CustomFunctions map[string]query.FunctionFactory
+
+	// EnableAggregationPushdown enables pushing sum, min, max and group aggregations over selectors down to
+	// queriers which implement storage.AggregationPushdownQuerier, so that they can return partially aggregated series.
+	// The engine evaluates the aggregation again over the returned series, which is why other aggregations are not pushed down.
+	EnableAggregationPushdown bool
+
+	// SlowQueryLogger optionally logs queries which take longer than SlowQueryThreshold to execute, together with
+	// their plan and the number of evaluated steps and returned samples. If nil, slow queries are not logged.
+	// NOTE: Queries which fall back to the prometheus engine are not logged.
+	SlowQueryLogger    log.Logger
+	SlowQueryThreshold time.Duration
+
+	// ResultCache optionally stores the results of range queries by step. Range queries which overlap with
+	// a cached result, like queries of dashboards which shift their time range, only evaluate the missing steps.
+	// NOTE: Results are cached as they are evaluated, so the cache should not be used for time ranges which
+	// still receive new samples, like the most recent minutes. Queries with @ modifiers are not cached.
+	ResultCache ResultCache
+
 	// DebugWriter specifies output for debug (multi-line) information meant for humans debugging the engine.
 	// If nil, nothing will be printed.
 	// NOTE: Users will not check the errors, debug writing is best effort.
@@ -46,6 +132,10 @@ type Opts struct {
 }
 
 func New(opts Opts) v1.QueryEngine {
+	return newCompatibilityEngine(opts)
+}
+
+func newCompatibilityEngine(opts Opts) *compatibilityEngine {
 	if opts.Logger == nil {
 		opts.Logger = log.NewNopLogger()
 	}
@@ -53,6 +143,10 @@ func New(opts Opts) v1.QueryEngine {
 		opts.LookbackDelta = 5 * time.Minute
 		level.Debug(opts.Logger).Log("msg", "lookback delta is zero, setting to default value", "value", 5*time.Minute)
 	}
+	lookbackDelta := opts.LookbackDelta
+	if opts.DisableLookback {
+		lookbackDelta = 0
+	}
 
 	return &compatibilityEngine{
 		prom: promql.NewEngine(opts.EngineOpts),
@@ -67,7 +161,29 @@ func New(opts Opts) v1.QueryEngine {
 		disableFallback:   opts.DisableFallback,
 		disableOptimizers: opts.DisableOptimizers,
 		logger:            opts.Logger,
-		lookbackDelta:     opts.LookbackDelta,
+		lookbackDelta:     lookbackDelta,
+		keepMetricNames:   opts.KeepMetricNames,
+		disableSorting:    opts.DisableResultSorting,
+		maxMemoryBytes:    opts.MaxQueryMemoryBytes,
+		maxSeries:         opts.MaxQuerySeries,
+		maxSteps:          opts.MaxQuerySteps,
+
+		maxSamplesPerWindow: opts.MaxSamplesPerWindow,
+		snapshotTimeFn:      opts.SnapshotTimeFn,
+		clock:               opts.Clock,
+		customFunctions:     opts.CustomFunctions,
+
+		enableAggregationPushdown: opts.EnableAggregationPushdown,
+
+		resultCache: opts.ResultCache,
+
+		slowQueryLogger:    opts.SlowQueryLogger,
+		slowQueryThreshold: opts.SlowQueryThreshold,
+
+		noStepSubqueryIntervalFn: opts.NoStepSubqueryIntervalFn,
+		disableRateExtrapolation: opts.DisableRateExtrapolation,
+
+		enableExperimentalFunctions: opts.EnableExperimentalFunctions,
 	}
 }
 
@@ -80,6 +196,47 @@ type compatibilityEngine struct {
 	disableOptimizers bool
 	logger            log.Logger
 	lookbackDelta     time.Duration
+	keepMetricNames   bool
+	disableSorting    bool
+	maxMemoryBytes    int64
+	maxSeries         int
+	maxSteps          int64
+
+	maxSamplesPerWindow int
+	snapshotTimeFn      func() time.Time
+	clock               func() time.Time
+	customFunctions     map[string]query.FunctionFactory
+
+	enableAggregationPushdown bool
+
+	resultCache ResultCache
+
+	slowQueryLogger    log.Logger
+	slowQueryThreshold time.Duration
+
+	noStepSubqueryIntervalFn func(rangeMillis int64) int64
+	disableRateExtrapolation bool
+
+	enableExperimentalFunctions []string
+}
+
+// snapshotTime returns the latest timestamp of samples which a new query reads, or the zero time if not limited.
+func (e *compatibilityEngine) snapshotTime() time.Time {
+	if e.snapshotTimeFn == nil {
+		return time.Time{}
+	}
+	return e.snapshotTimeFn()
+}
+
+// evaluationTime returns ts, or the current time of the clock if ts is the zero time.
+func (e *compatibilityEngine) evaluationTime(ts time.Time) time.Time {
+	if !ts.IsZero() {
+		return ts
+	}
+	if e.clock == nil {
+		return time.Now()
+	}
+	return e.clock()
 }
 
 func (e *compatibilityEngine) SetQueryLogger(l promql.QueryLogger) {
@@ -87,6 +244,10 @@ func (e *compatibilityEngine) SetQueryLogger(l promql.QueryLogger) {
 }
 
 func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return e.newInstantQuery(engstore.NewSelectorPool(q), q, opts, qs, e.evaluationTime(ts))
+}
+
+func (e *compatibilityEngine) newInstantQuery(selectorPool *engstore.SelectorPool, q storage.Queryable, opts *promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
 	expr, err := parser.ParseExpr(qs)
 	if err != nil {
 		return nil, err
@@ -97,7 +258,30 @@ func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.
 		lplan = lplan.Optimize(logicalplan.DefaultOptimizers)
 	}
 
-	exec, err := execution.New(lplan.Expr(), q, ts, ts, 0, e.lookbackDelta)
+	memory := model.NewMemoryTracker(e.maxMemoryBytes)
+	samples := model.NewSamplesCounter()
+	exec, err := execution.NewWithSelectorPool(lplan.Expr(), selectorPool, &query.Options{
+		Start:           ts,
+		End:             ts,
+		Step:            0,
+		LookbackDelta:   e.lookbackDelta,
+		KeepMetricNames: e.keepMetricNames,
+		MemoryTracker:   memory,
+		SamplesCounter:  samples,
+		MaxSeries:       e.maxSeries,
+		MaxSteps:        e.maxSteps,
+
+		MaxSamplesPerWindow: e.maxSamplesPerWindow,
+		SnapshotTime:        e.snapshotTime(),
+		CustomFunctions:     e.customFunctions,
+
+		EnableAggregationPushdown: e.enableAggregationPushdown,
+
+		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+		DisableRateExtrapolation: e.disableRateExtrapolation,
+
+		EnableExperimentalFunctions: e.enableExperimentalFunctions,
+	})
 	if e.triggerFallback(err) {
 		e.queries.WithLabelValues("true").Inc()
 		return e.prom.NewInstantQuery(q, opts, qs, ts)
@@ -112,7 +296,7 @@ func (e *compatibilityEngine) NewInstantQuery(q storage.Queryable, opts *promql.
 	}
 
 	return &compatibilityQuery{
-		Query:  &Query{exec: exec},
+		Query:  &Query{exec: exec, memory: memory, samples: samples},
 		engine: e,
 		expr:   expr,
 		ts:     ts,
@@ -125,17 +309,51 @@ func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.Qu
 		return nil, err
 	}
 
+	if step == 0 {
+		step = query.DefaultStep(start, end)
+	}
+
 	// Use same check as Prometheus for range queries.
 	if expr.Type() != parser.ValueTypeVector && expr.Type() != parser.ValueTypeScalar {
 		return nil, errors.Newf("invalid expression type %q for range Query, must be Scalar or instant Vector", parser.DocumentedType(expr.Type()))
 	}
 
+	if e.resultCache != nil && isCacheable(expr) {
+		return e.newCachedRangeQuery(q, opts, qs, expr, start, end, step)
+	}
+	return e.newRangeQuery(q, opts, qs, expr, start, end, step)
+}
+
+func (e *compatibilityEngine) newRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, expr parser.Expr, start, end time.Time, step time.Duration) (promql.Query, error) {
 	lplan := logicalplan.New(expr, start, end)
 	if !e.disableOptimizers {
 		lplan = lplan.Optimize(logicalplan.DefaultOptimizers)
 	}
 
-	exec, err := execution.New(lplan.Expr(), q, start, end, step, e.lookbackDelta)
+	memory := model.NewMemoryTracker(e.maxMemoryBytes)
+	samples := model.NewSamplesCounter()
+	exec, err := execution.New(lplan.Expr(), q, &query.Options{
+		Start:           start,
+		End:             end,
+		Step:            step,
+		LookbackDelta:   e.lookbackDelta,
+		KeepMetricNames: e.keepMetricNames,
+		MemoryTracker:   memory,
+		SamplesCounter:  samples,
+		MaxSeries:       e.maxSeries,
+		MaxSteps:        e.maxSteps,
+
+		MaxSamplesPerWindow: e.maxSamplesPerWindow,
+		SnapshotTime:        e.snapshotTime(),
+		CustomFunctions:     e.customFunctions,
+
+		EnableAggregationPushdown: e.enableAggregationPushdown,
+
+		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+		DisableRateExtrapolation: e.disableRateExtrapolation,
+
+		EnableExperimentalFunctions: e.enableExperimentalFunctions,
+	})
 	if e.triggerFallback(err) {
 		e.queries.WithLabelValues("true").Inc()
 		return e.prom.NewRangeQuery(q, opts, qs, start, end, step)
@@ -150,14 +368,179 @@ func (e *compatibilityEngine) NewRangeQuery(q storage.Queryable, opts *promql.Qu
 	}
 
 	return &compatibilityQuery{
-		Query:  &Query{exec: exec},
+		Query:  &Query{exec: exec, memory: memory, samples: samples},
 		engine: e,
 		expr:   expr,
 	}, nil
 }
 
+// ExemplarQuerier is implemented by engines which can return exemplars
+// of the series selected by a query, such as the engine created by New.
+type ExemplarQuerier interface {
+	Exemplars(ctx context.Context, q storage.ExemplarQueryable, qs string, start, end time.Time) ([]exemplar.QueryResult, error)
+}
+
+// Exemplars returns the exemplars of series selected by the query qs when it is evaluated between start and end.
+// Selectors read exemplars from the same time range as samples, so the @ modifier and offsets are taken into account.
+func (e *compatibilityEngine) Exemplars(ctx context.Context, q storage.ExemplarQueryable, qs string, start, end time.Time) ([]exemplar.QueryResult, error) {
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return nil, err
+	}
+
+	querier, err := q.ExemplarQuerier(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lplan := logicalplan.New(expr, start, end)
+	return execution.Exemplars(lplan.Expr(), querier, &query.Options{
+		Start:         start,
+		End:           end,
+		LookbackDelta: e.lookbackDelta,
+
+		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+	})
+}
+
+// Validator is implemented by engines which can check queries
+// without evaluating them, such as the engine created by New.
+type Validator interface {
+	Validate(qs string, opts query.Options) error
+}
+
+// Validate parses qs and creates the operators for evaluating it with the time range in opts, without selecting
+// series or samples from storage. It returns errors for invalid queries and, if fallback is disabled, for
+// queries which are not supported by the engine. Errors which only occur during evaluation,
+// such as many-to-many matching, are not detected.
+// An instant query is validated if opts.End is not after opts.Start.
+func (e *compatibilityEngine) Validate(qs string, opts query.Options) error {
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return err
+	}
+
+	start, end := opts.Start, opts.End
+	if end.After(start) {
+		if expr.Type() != parser.ValueTypeVector && expr.Type() != parser.ValueTypeScalar {
+			return errors.Newf("invalid expression type %q for range Query, must be Scalar or instant Vector", parser.DocumentedType(expr.Type()))
+		}
+	} else {
+		end = start
+		opts.Step = 0
+	}
+
+	lplan := logicalplan.New(expr, start, end)
+	if !e.disableOptimizers {
+		lplan = lplan.Optimize(logicalplan.DefaultOptimizers)
+	}
+
+	opts.Start, opts.End = start, end
+	opts.LookbackDelta = e.lookbackDelta
+	opts.KeepMetricNames = e.keepMetricNames
+	opts.NoStepSubqueryIntervalFn = e.noStepSubqueryIntervalFn
+	opts.DisableRateExtrapolation = e.disableRateExtrapolation
+	opts.EnableExperimentalFunctions = e.enableExperimentalFunctions
+	opts.EnableAggregationPushdown = e.enableAggregationPushdown
+	_, err = execution.New(lplan.Expr(), noSelectQueryable, &opts)
+	if e.triggerFallback(err) {
+		return nil
+	}
+	return err
+}
+
+// CardinalityEstimator is implemented by engines which can estimate
+// the number of series returned by a query, such as the engine created by New.
+type CardinalityEstimator interface {
+	EstimateCardinality(ctx context.Context, q storage.Queryable, qs string, start, end time.Time) (int, error)
+}
+
+// EstimateCardinality estimates the number of series returned by the query qs when it is evaluated between start and end.
+// Only series and label values are selected from storage, which makes it possible to reject queries with a high
+// cardinality before evaluating them. An instant query is estimated if start and end are equal.
+func (e *compatibilityEngine) EstimateCardinality(ctx context.Context, q storage.Queryable, qs string, start, end time.Time) (int, error) {
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return 0, err
+	}
+
+	lplan := logicalplan.New(expr, start, end)
+	return execution.EstimateCardinality(ctx, lplan.Expr(), q, &query.Options{
+		Start:         start,
+		End:           end,
+		LookbackDelta: e.lookbackDelta,
+
+		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+	})
+}
+
+// noSelectQueryable fails queries which select from it, since validated queries are not evaluated.
+var noSelectQueryable = storage.QueryableFunc(func(context.Context, int64, int64) (storage.Querier, error) {
+	return nil, errors.New("storage can not be queried while validating a query")
+})
+
+// BatchEvaluator is a query engine which can also create batches of instant queries
+// evaluated at the same timestamp, such as the rules of a recording rule group.
+type BatchEvaluator struct {
+	*compatibilityEngine
+}
+
+// NewBatchEvaluator creates a BatchEvaluator. Since it also implements v1.QueryEngine,
+// it can be used instead of an engine created with New.
+func NewBatchEvaluator(opts Opts) *BatchEvaluator {
+	return &BatchEvaluator{compatibilityEngine: newCompatibilityEngine(opts)}
+}
+
+// NewInstantQueries creates instant queries for all expressions in qs, evaluated at ts, or at the
+// current time of the engine clock if ts is the zero time.
+// Selectors with the same matchers, time range and hints are shared between the queries,
+// so that series referenced by multiple queries are only selected from storage once.
+// Queries which fall back to the Prometheus engine do not share their selectors.
+func (b *BatchEvaluator) NewInstantQueries(q storage.Queryable, opts *promql.QueryOpts, qs []string, ts time.Time) ([]promql.Query, error) {
+	ts = b.evaluationTime(ts)
+	selectorPool := engstore.NewSelectorPool(q)
+	queries := make([]promql.Query, 0, len(qs))
+	for _, s := range qs {
+		instantQuery, err := b.newInstantQuery(selectorPool, q, opts, s, ts)
+		if err != nil {
+			for _, created := range queries {
+				created.Close()
+			}
+			return nil, err
+		}
+		queries = append(queries, instantQuery)
+	}
+	return queries, nil
+}
+
 type Query struct {
-	exec model.VectorOperator
+	exec    model.VectorOperator
+	memory  *model.MemoryTracker
+	samples *model.SamplesCounter
+}
+
+// releaseOnError returns the vectors to the pool of the root operator
+// if the query exceeded its memory limit.
+func (q *Query) releaseOnError(r []model.StepVector) error {
+	err := q.memory.Err()
+	if err == nil {
+		return nil
+	}
+	q.putVectors(r)
+	return err
+}
+
+// putVectors returns the vectors to the pool of the root operator.
+func (q *Query) putVectors(r []model.StepVector) {
+	for _, vector := range r {
+		q.exec.GetPool().PutStepVector(vector)
+	}
+	q.exec.GetPool().PutVectors(r)
+}
+
+// Memory returns the tracker of the memory which the query checked out from vector pools.
+func (q *Query) Memory() *model.MemoryTracker {
+	return q.memory
 }
 
 // Explain returns human-readable explanation of the created executor.
@@ -185,22 +568,39 @@ func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
 	ret = &promql.Result{
 		Value: promql.Vector{},
 	}
+	defer func() {
+		if ret.Err != nil {
+			q.Query.memory.Close()
+		}
+	}()
 	defer recoverEngine(q.engine.logger, q.expr, &ret.Err)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	q.cancel = cancel
 
-	resultSeries, err := q.Query.exec.Series(ctx)
-	if err != nil {
-		return newErrResult(ret, err)
+	ctx = warnings.NewContext(ctx)
+	defer func() { ret.Warnings = warnings.FromContext(ctx) }()
+
+	var steps, samples int
+	if q.engine.slowQueryLogger != nil {
+		start := time.Now()
+		defer func() { q.logIfSlow(time.Since(start), steps, samples, ret) }()
 	}
 
-	series := make([]promql.Series, len(resultSeries))
-	for i := 0; i < len(resultSeries); i++ {
-		series[i].Metric = resultSeries[i]
-		series[i].Points = make([]promql.Point, 0, 121) // Typically 1h of data.
+	// Series are streamed into the result, so that operators which can stream
+	// their series do not need to collect them before the result is created.
+	var series []promql.Series
+	if err := model.StreamSeries(ctx, q.Query.exec, func(_ uint64, lbls labels.Labels) error {
+		series = append(series, promql.Series{
+			Metric: lbls,
+			Points: make([]promql.Point, 0, 121), // Typically 1h of data.
+		})
+		return nil
+	}); err != nil {
+		return newErrResult(ret, err)
 	}
+	numSeries := len(series)
 
 loop:
 	for {
@@ -215,40 +615,18 @@ loop:
 			if r == nil {
 				break loop
 			}
+			if err := q.Query.releaseOnError(r); err != nil {
+				return newErrResult(ret, err)
+			}
+			steps += len(r)
+			for i := range r {
+				samples += len(r[i].Samples)
+			}
 
 			// Case where Series call might return nil, but samples are present.
 			// For example scalar(http_request_total) where http_request_total has multiple values.
-			if len(series) == 0 && len(r) != 0 {
-				numSeries := 0
-				for i := range r {
-					numSeries += len(r[i].Samples)
-				}
-
-				series = make([]promql.Series, numSeries)
-
-				for _, vector := range r {
-					for i := range vector.Samples {
-						series[i].Points = append(series[i].Points, promql.Point{
-							T: vector.T,
-							V: vector.Samples[i],
-						})
-					}
-					q.Query.exec.GetPool().PutStepVector(vector)
-				}
-				q.Query.exec.GetPool().PutVectors(r)
-				continue
-			}
-
-			for _, vector := range r {
-				for i, s := range vector.SampleIDs {
-					series[s].Points = append(series[s].Points, promql.Point{
-						T: vector.T,
-						V: vector.Samples[i],
-					})
-				}
-				q.Query.exec.GetPool().PutStepVector(vector)
-			}
-			q.Query.exec.GetPool().PutVectors(r)
+			series = appendPoints(series, r, numSeries == 0)
+			q.Query.putVectors(r)
 		}
 	}
 
@@ -261,7 +639,11 @@ loop:
 			}
 			resultMatrix = append(resultMatrix, s)
 		}
-		sort.Sort(resultMatrix)
+		// Series are sorted by their labels like in Prometheus, so that results
+		// do not depend on the order in which operators return series.
+		if !q.engine.disableSorting {
+			sort.Sort(resultMatrix)
+		}
 		ret.Value = resultMatrix
 		return ret
 	}
@@ -269,10 +651,18 @@ loop:
 	var result parser.Value
 	switch q.expr.Type() {
 	case parser.ValueTypeMatrix:
-		result = promql.Matrix(series)
+		// Same as in Prometheus, series without samples in their range are not returned.
+		matrix := make(promql.Matrix, 0, len(series))
+		for _, s := range series {
+			if len(s.Points) == 0 {
+				continue
+			}
+			matrix = append(matrix, s)
+		}
+		result = matrix
 	case parser.ValueTypeVector:
 		// Convert matrix with one value per series into vector.
-		vector := make(promql.Vector, 0, len(resultSeries))
+		vector := make(promql.Vector, 0, numSeries)
 		for i := range series {
 			if len(series[i].Points) == 0 {
 				continue
@@ -287,6 +677,14 @@ loop:
 				},
 			})
 		}
+		if call, ok := sortFunction(q.expr); ok {
+			switch call.Func.Name {
+			case "sort", "sort_desc":
+				function.SortByValue(vector, call.Func.Name == "sort_desc")
+			case "sort_by_label", "sort_by_label_desc":
+				function.SortByLabel(vector, call.Func.Name == "sort_by_label_desc", stringArgs(call.Args[1:])...)
+			}
+		}
 		result = vector
 	case parser.ValueTypeScalar:
 		v := math.NaN()
@@ -302,6 +700,44 @@ loop:
 	return ret
 }
 
+// sortFunction returns the call of the sort function which is evaluated last in expr, if any.
+// Sort functions in other parts of the query are ignored, since operators do not keep the order of samples.
+func sortFunction(expr parser.Expr) (*parser.Call, bool) {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return sortFunction(e.Expr)
+	case *parser.Call:
+		switch e.Func.Name {
+		case "sort", "sort_desc", "sort_by_label", "sort_by_label_desc":
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// stringArgs returns the values of the string literals in args. Since the logical plan
+// wraps step invariant arguments in place, literals are unwrapped first.
+func stringArgs(args parser.Expressions) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		arg = unwrapStringLiteral(arg)
+		if s, ok := arg.(*parser.StringLiteral); ok {
+			result = append(result, s.Val)
+		}
+	}
+	return result
+}
+
+func unwrapStringLiteral(expr parser.Expr) parser.Expr {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return unwrapStringLiteral(e.Expr)
+	case *parser.StepInvariantExpr:
+		return unwrapStringLiteral(e.Expr)
+	}
+	return expr
+}
+
 func newErrResult(r *promql.Result, err error) *promql.Result {
 	if r == nil {
 		r = &promql.Result{}
@@ -312,9 +748,39 @@ func newErrResult(r *promql.Result, err error) *promql.Result {
 	return r
 }
 
+// logIfSlow logs the query if it took longer than the slow query threshold of the engine.
+// TODO: Log the time spent in each operator and the number of samples read
+// from storage once operators are instrumented.
+func (q *compatibilityQuery) logIfSlow(duration time.Duration, steps, samples int, ret *promql.Result) {
+	if duration < q.engine.slowQueryThreshold {
+		return
+	}
+
+	var plan strings.Builder
+	explain(&plan, q.Query.exec, "", "")
+	keyvals := []interface{}{
+		"msg", "slow query",
+		"query", q.expr.String(),
+		"duration", duration,
+		"steps", steps,
+		"samples", samples,
+		"plan", plan.String(),
+	}
+	if ret != nil && ret.Err != nil {
+		keyvals = append(keyvals, "err", ret.Err)
+	}
+	level.Warn(q.engine.slowQueryLogger).Log(keyvals...)
+}
+
 func (q *compatibilityQuery) Statement() parser.Statement { return nil }
 
-func (q *compatibilityQuery) Stats() *stats.Statistics { return &stats.Statistics{} }
+// Stats returns the number of samples which the query processed. Same as in Prometheus, samples
+// are counted for every step at which they are selected, including the steps of subqueries.
+func (q *compatibilityQuery) Stats() *stats.Statistics {
+	samples := stats.NewQuerySamples(false)
+	samples.TotalSamples = q.Query.samples.Total()
+	return &stats.Statistics{Timers: stats.NewQueryTimers(), Samples: samples}
+}
 
 func (q *compatibilityQuery) Close() { q.Cancel() }
 
@@ -340,16 +806,24 @@ func recoverEngine(logger log.Logger, expr parser.Expr, errp *error) {
 	if e == nil {
 		return
 	}
+	// Vector pools panic when a query exceeds its memory limit, since operators can not return errors then.
+	if err, ok := e.(error); ok && errors.Is(err, model.ErrMemoryLimitExceeded) {
+		*errp = err
+		return
+	}
 
-	switch err := e.(type) {
-	case runtime.Error:
-		// Print the stack trace but do not inhibit the running application.
-		buf := make([]byte, 64<<10)
-		buf = buf[:runtime.Stack(buf, false)]
+	// Print the stack trace but do not inhibit the running application.
+	// Panics in operators which are evaluated concurrently are propagated
+	// to the goroutine executing the query, so they are recovered here as well.
+	buf := make([]byte, 64<<10)
+	buf = buf[:runtime.Stack(buf, false)]
 
-		level.Error(logger).Log("msg", "runtime panic in engine", "expr", expr.String(), "err", e, "stacktrace", string(buf))
+	level.Error(logger).Log("msg", "runtime panic in engine", "expr", expr.String(), "err", e, "stacktrace", string(buf))
+	if err, ok := e.(error); ok {
 		*errp = fmt.Errorf("unexpected error: %w", err)
+		return
 	}
+	*errp = fmt.Errorf("unexpected error: %v", e)
 }
 
 func explain(w io.Writer, o model.VectorOperator, indent, indentNext string) {
@@ -7,19 +7,38 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+	v1 "github.com/prometheus/prometheus/web/api/v1"
 	"go.uber.org/goleak"
 
 	"github.com/thanos-community/promql-engine/engine"
+	"github.com/thanos-community/promql-engine/execution"
+	"github.com/thanos-community/promql-engine/execution/exchange"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/scan"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 func TestMain(m *testing.M) {
@@ -60,1491 +79,4037 @@ func TestVectorSelectorWithGaps(t *testing.T) {
 	oldResult := q2.Exec(context.Background())
 	testutil.Ok(t, oldResult.Err)
 
-	testutil.Equals(t, oldResult, newResult)
+	assertResultsAlmostEqual(t, oldResult, newResult, comparisonEpsilon)
 
 }
 
-func storageWithSeries(series storage.Series) *storage.MockQueryable {
-	seriesSet := &testSeriesSet{series: series}
-	return &storage.MockQueryable{
-		MockQuerier: &storage.MockQuerier{
-			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
-				return seriesSet
+func TestDisableLookback(t *testing.T) {
+	load := `load 10s
+			foo 1 _ _ _ 2 _ 3 _ _ _ 4 5`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true, DisableLookback: true})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, "foo", time.Unix(0, 0), time.Unix(120, 0), 20*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	expected := promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings(labels.MetricName, "foo"),
+			Points: []promql.Point{
+				{T: 0, V: 1},
+				{T: 40000, V: 2},
+				{T: 60000, V: 3},
+				{T: 100000, V: 4},
 			},
 		},
 	}
+	testutil.Equals(t, expected, result.Value)
 }
 
-func TestQueriesAgainstOldEngine(t *testing.T) {
-	start := time.Unix(0, 0)
-	end := time.Unix(240, 0)
-	step := time.Second * 30
-	// Negative offset and at modifier are enabled by default
-	// since Prometheus v2.33.0 so we also enable them.
-	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
+func TestMaxQueryMemoryBytes(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x40
+			http_requests_total{pod="nginx-2"} 1+2x40
+			http_requests_total{pod="nginx-3"} 1+3x40
+			http_requests_total{pod="nginx-4"} 1+4x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		name        string
+		maxBytes    int64
+		expectedErr bool
+	}{
+		{name: "unlimited"},
+		{name: "below limit", maxBytes: 1 << 20},
+		{name: "above limit", maxBytes: 64, expectedErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{DisableFallback: true, MaxQueryMemoryBytes: tcase.maxBytes})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, "sum by (pod) (rate(http_requests_total[1m]))", time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			memory := q.(interface{ Memory() *model.MemoryTracker }).Memory()
+			// Vectors checked out by the query are released, also when it fails.
+			testutil.Equals(t, int64(0), memory.Usage())
+			if tcase.expectedErr {
+				testutil.NotOk(t, result.Err)
+				testutil.Assert(t, errors.Is(result.Err, model.ErrMemoryLimitExceeded), "unexpected error %v", result.Err)
+				testutil.Assert(t, memory.Peak() > tcase.maxBytes, "expected peak usage above limit")
+				return
+			}
+			testutil.Ok(t, result.Err)
+			testutil.Equals(t, 4, len(result.Value.(promql.Matrix)))
+		})
 	}
+}
 
-	cases := []struct {
-		load  string
-		name  string
-		query string
-		start time.Time
-		end   time.Time
-		step  time.Duration
+func TestMaxQuerySeries(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1", ns="a"} 1+1x40
+			http_requests_total{pod="nginx-2", ns="a"} 1+2x40
+			http_requests_total{pod="nginx-3", ns="b"} 1+3x40
+			http_requests_total{pod="nginx-4", ns="b"} 1+4x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		name        string
+		query       string
+		maxSeries   int
+		expectedErr bool
 	}{
-		{
-			name: "stddev_over_time",
-			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "stddev_over_time(http_requests_total[30s])",
+		{name: "unlimited", query: "http_requests_total"},
+		{name: "at limit", query: "http_requests_total", maxSeries: 4},
+		{name: "above limit", query: "http_requests_total", maxSeries: 3, expectedErr: true},
+		{name: "aggregation below limit", query: "sum by (ns) (http_requests_total)", maxSeries: 3},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{DisableFallback: true, MaxQuerySeries: tcase.maxSeries})
+			for _, q := range []func() (promql.Query, error){
+				func() (promql.Query, error) {
+					return newEngine.NewRangeQuery(test.Storage(), nil, tcase.query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				},
+				func() (promql.Query, error) {
+					return newEngine.NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(600, 0))
+				},
+			} {
+				q, err := q()
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				if tcase.expectedErr {
+					testutil.NotOk(t, result.Err)
+					testutil.Assert(t, errors.Is(result.Err, exchange.ErrTooManySeries), "unexpected error %v", result.Err)
+					continue
+				}
+				testutil.Ok(t, result.Err)
+			}
+		})
+	}
+}
+
+func TestMaxQuerySteps(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true, MaxQuerySteps: 11000})
+
+	// A step of 100ms over three days has more than 2.5 million steps.
+	_, err = newEngine.NewRangeQuery(test.Storage(), nil, "http_requests_total", time.Unix(0, 0), time.Unix(3*24*3600, 0), 100*time.Millisecond)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, execution.ErrTooManySteps), "unexpected error %v", err)
+	testutil.Equals(t, "2592001 steps exceed limit of 11000: query has too many steps", err.Error())
+
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, "http_requests_total", time.Unix(0, 0), time.Unix(3*24*3600, 0), time.Minute)
+	testutil.Ok(t, err)
+	defer q.Close()
+	testutil.Ok(t, q.Exec(context.Background()).Err)
+
+	q, err = newEngine.NewInstantQuery(test.Storage(), nil, "http_requests_total", time.Unix(600, 0))
+	testutil.Ok(t, err)
+	defer q.Close()
+	testutil.Ok(t, q.Exec(context.Background()).Err)
+}
+
+func TestSamplesStats(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x40
+			http_requests_total{pod="nginx-2"} 1+2x40
+			http_requests_total{pod="nginx-3"} 1+3x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableAtModifier: true}
+	oldEngine := promql.NewEngine(opts)
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	for _, qs := range []string{
+		"http_requests_total",
+		// Samples in overlapping ranges are counted for each range.
+		"rate(http_requests_total[5m])",
+		"sum by (pod) (rate(http_requests_total[2m]))",
+		"max_over_time(rate(http_requests_total[1m])[3m:30s])",
+		"rate(http_requests_total[1m] @ 300)",
+		"sum_over_time(http_requests_total[2m:30s] @ 300)",
+		"http_requests_total @ 100",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+			for _, newQuery := range []func(v1.QueryEngine) (promql.Query, error){
+				func(ng v1.QueryEngine) (promql.Query, error) {
+					return ng.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+				},
+				func(ng v1.QueryEngine) (promql.Query, error) {
+					return ng.NewInstantQuery(test.Storage(), nil, qs, end)
+				},
+			} {
+				q, err := newQuery(newEngine)
+				testutil.Ok(t, err)
+				defer q.Close()
+				testutil.Ok(t, q.Exec(context.Background()).Err)
+
+				oldQ, err := newQuery(oldEngine)
+				testutil.Ok(t, err)
+				defer oldQ.Close()
+				testutil.Ok(t, oldQ.Exec(context.Background()).Err)
+
+				testutil.Assert(t, oldQ.Stats().Samples.TotalSamples > 0, "expected samples to be counted")
+				testutil.Equals(t, oldQ.Stats().Samples.TotalSamples, q.Stats().Samples.TotalSamples)
+			}
+		})
+	}
+}
+
+func TestRangeFunctionsDropMetricName(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x40
+			http_requests_total{pod="nginx-2"} 1+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	for _, qs := range []string{
+		"rate(http_requests_total[5m])",
+		"increase(http_requests_total[5m])",
+		"rate(http_requests_total[5m:30s])",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 2, len(matrix))
+			for _, series := range matrix {
+				testutil.Equals(t, "", series.Metric.Get(labels.MetricName))
+				testutil.Equals(t, 1, series.Metric.Len())
+			}
+		})
+	}
+}
+
+func TestUnsortedSeriesLabels(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1", ns="a", zone="eu"} 1+1x40
+			http_requests_total{pod="nginx-2", ns="b", zone="eu"} 1+2x40
+			http_responses_total{pod="nginx-1", ns="a", zone="eu"} 2+1x40
+			http_responses_total{pod="nginx-2", ns="b", zone="us"} 2+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	oldEngine := promql.NewEngine(opts)
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	for _, qs := range []string{
+		"sum by (ns, pod) (http_requests_total)",
+		"http_requests_total / on (pod, ns) group_left http_responses_total",
+		"rate(http_requests_total[1m]) - ignoring (zone) rate(http_responses_total[1m])",
+		"max by (zone) (http_responses_total)",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+			q, err := newEngine.NewRangeQuery(&unsortedLabelsQueryable{Queryable: test.Storage()}, nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+
+			oldQ, err := oldEngine.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer oldQ.Close()
+			oldResult := oldQ.Exec(context.Background())
+			testutil.Ok(t, oldResult.Err)
+			testutil.Assert(t, len(oldResult.Value.(promql.Matrix)) > 0, "expected series in result")
+			testutil.Equals(t, oldResult.Value, result.Value)
+		})
+	}
+}
+
+func TestMaxSamplesPerWindow(t *testing.T) {
+	load := `load 10s
+			http_requests_total{pod="nginx-1"} 1+1x120
+			http_requests_total{pod="nginx-2"} 1+2x120`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		name        string
+		query       string
+		maxSamples  int
+		expectedErr bool
+	}{
+		{name: "unlimited", query: "rate(http_requests_total[5m])"},
+		{name: "at limit", query: "rate(http_requests_total[5m])", maxSamples: 31},
+		{name: "above limit", query: "rate(http_requests_total[5m])", maxSamples: 5, expectedErr: true},
+		{name: "short range below limit", query: "rate(http_requests_total[30s])", maxSamples: 5},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{DisableFallback: true, MaxSamplesPerWindow: tcase.maxSamples})
+			for _, q := range []func() (promql.Query, error){
+				func() (promql.Query, error) {
+					return newEngine.NewRangeQuery(test.Storage(), nil, tcase.query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				},
+				func() (promql.Query, error) {
+					return newEngine.NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(600, 0))
+				},
+			} {
+				q, err := q()
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				if tcase.expectedErr {
+					testutil.NotOk(t, result.Err)
+					testutil.Assert(t, errors.Is(result.Err, scan.ErrTooManySamplesInWindow), "unexpected error %v", result.Err)
+					continue
+				}
+				testutil.Ok(t, result.Err)
+			}
+		})
+	}
+}
+
+func TestSnapshotTime(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20
+			http_requests_total{pod="nginx-2"} 1+2x20`
+	// Samples up to the snapshot time at 300s are the same as in load.
+	snapshotLoad := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x10
+			http_requests_total{pod="nginx-2"} 1+2x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	snapshotTest, err := promql.NewTest(t, snapshotLoad)
+	testutil.Ok(t, err)
+	defer snapshotTest.Close()
+	testutil.Ok(t, snapshotTest.Run())
+
+	snapshotTime := time.Unix(300, 0)
+	newEngine := engine.New(engine.Opts{
+		DisableFallback: true,
+		SnapshotTimeFn:  func() time.Time { return snapshotTime },
+	})
+	oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10})
+
+	for _, qs := range []string{
+		"http_requests_total",
+		"http_requests_total offset 1m",
+		"rate(http_requests_total[2m])",
+		"last_over_time(http_requests_total[1m])",
+		"sum(count_over_time(http_requests_total[5m]))",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			for _, run := range []func(e v1.QueryEngine, q storage.Queryable) (promql.Query, error){
+				func(e v1.QueryEngine, q storage.Queryable) (promql.Query, error) {
+					return e.NewRangeQuery(q, nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				},
+				func(e v1.QueryEngine, q storage.Queryable) (promql.Query, error) {
+					return e.NewInstantQuery(q, nil, qs, time.Unix(360, 0))
+				},
+			} {
+				exec := func(e v1.QueryEngine, queryable storage.Queryable) *promql.Result {
+					q, err := run(e, queryable)
+					testutil.Ok(t, err)
+					defer q.Close()
+					result := q.Exec(context.Background())
+					testutil.Ok(t, result.Err)
+					// Samples of instant queries are not sorted.
+					if vector, ok := result.Value.(promql.Vector); ok {
+						sort.Slice(vector, func(i, j int) bool { return labels.Compare(vector[i].Metric, vector[j].Metric) < 0 })
+					}
+					return result
+				}
+
+				expected := exec(oldEngine, snapshotTest.Storage())
+				result := exec(newEngine, test.Storage())
+				testutil.Equals(t, expected.Value, result.Value)
+			}
+		})
+	}
+}
+
+func TestClock(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	now := time.Unix(300, 0)
+	ng := engine.New(engine.Opts{
+		EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableAtModifier: true},
+		DisableFallback: true,
+		Clock:           func() time.Time { return now },
+	})
+	for _, tc := range []struct {
+		query    string
+		expected float64
+	}{
+		{query: "time()", expected: 300},
+		{query: "http_requests_total", expected: 11},
+		{query: "sum(http_requests_total @ end())", expected: 11},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := ng.NewInstantQuery(test.Storage(), nil, tc.query, time.Time{})
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			switch v := result.Value.(type) {
+			case promql.Scalar:
+				testutil.Equals(t, now.UnixMilli(), v.T)
+				testutil.Equals(t, tc.expected, v.V)
+			case promql.Vector:
+				testutil.Equals(t, 1, len(v))
+				testutil.Equals(t, now.UnixMilli(), v[0].T)
+				testutil.Equals(t, tc.expected, v[0].V)
+			default:
+				t.Fatalf("unexpected result type %T", v)
+			}
+		})
+	}
+}
+
+func TestCustomFunctions(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20
+			http_requests_total{pod="nginx-2"} 1+3x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// The parser only parses functions it knows about.
+	parser.Functions["double"] = &parser.Function{
+		Name:       "double",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector},
+		ReturnType: parser.ValueTypeVector,
+	}
+	defer delete(parser.Functions, "double")
+
+	newEngine := engine.New(engine.Opts{
+		DisableFallback: true,
+		CustomFunctions: map[string]query.FunctionFactory{
+			"double": func(_ *parser.Call, args []model.VectorOperator, _ *query.Options) (model.VectorOperator, error) {
+				return &doubleOperator{VectorOperator: args[0]}, nil
+			},
 		},
-		{
-			name: "stdvar_over_time",
+	})
+
+	start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, "double(sum by (pod) (http_requests_total))", start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	q, err = newEngine.NewRangeQuery(test.Storage(), nil, "sum by (pod) (http_requests_total) * 2", start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	expected := q.Exec(context.Background())
+	testutil.Ok(t, expected.Err)
+	testutil.Equals(t, expected.Value, result.Value)
+
+	// Functions without an operator are still rejected.
+	newEngine = engine.New(engine.Opts{DisableFallback: true})
+	_, err = newEngine.NewRangeQuery(test.Storage(), nil, "double(http_requests_total)", start, end, step)
+	testutil.NotOk(t, err)
+}
+
+// doubleOperator doubles the samples of the operator it wraps.
+type doubleOperator struct {
+	model.VectorOperator
+}
+
+func (o *doubleOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*doubleOperator]", []model.VectorOperator{o.VectorOperator}
+}
+
+func (o *doubleOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	vectors, err := o.VectorOperator.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, vector := range vectors {
+		for i := range vector.Samples {
+			vector.Samples[i] *= 2
+		}
+	}
+	return vectors, nil
+}
+
+func TestOperatorPanicsAreRecovered(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20
+			http_requests_total{pod="nginx-2"} 1+3x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	parser.Functions["panicking"] = &parser.Function{
+		Name:       "panicking",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector},
+		ReturnType: parser.ValueTypeVector,
+	}
+	defer delete(parser.Functions, "panicking")
+
+	newEngine := engine.New(engine.Opts{
+		DisableFallback: true,
+		CustomFunctions: map[string]query.FunctionFactory{
+			"panicking": func(_ *parser.Call, args []model.VectorOperator, _ *query.Options) (model.VectorOperator, error) {
+				return &panickingOperator{VectorOperator: args[0]}, nil
+			},
+		},
+	})
+	for _, qs := range []string{
+		"panicking(http_requests_total)",
+		// Aggregations and binary operators evaluate their operands in other goroutines.
+		"sum(panicking(http_requests_total))",
+		"panicking(http_requests_total) + on (pod) http_requests_total",
+		"rate(panicking(http_requests_total)[1m:30s])",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.NotOk(t, result.Err)
+			testutil.Assert(t, strings.Contains(result.Err.Error(), "index out of range"), "unexpected error %v", result.Err)
+		})
+		t.Run(qs+"/series iterator", func(t *testing.T) {
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			it := q.(engine.SeriesIterable).SeriesIterator()
+			testutil.Assert(t, !it.Next(context.Background()), "expected no series")
+			testutil.NotOk(t, it.Err())
+			testutil.Assert(t, strings.Contains(it.Err().Error(), "index out of range"), "unexpected error %v", it.Err())
+			testutil.Assert(t, !it.Next(context.Background()), "expected no series after error")
+		})
+	}
+}
+
+// panickingOperator panics with an index out of range when producing steps.
+type panickingOperator struct {
+	model.VectorOperator
+}
+
+func (o *panickingOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*panickingOperator]", []model.VectorOperator{o.VectorOperator}
+}
+
+func (o *panickingOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	vectors, err := o.VectorOperator.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Accessing the step after the last one panics.
+	_ = vectors[len(vectors)]
+	return vectors, nil
+}
+
+func TestRangeQueryDefaultStep(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x120`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	start, end := time.Unix(0, 0), time.Unix(3600, 0)
+	testutil.Equals(t, 14*time.Second, query.DefaultStep(start, end))
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, "http_requests_total", start, end, 0)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	matrix := result.Value.(promql.Matrix)
+	testutil.Equals(t, 1, len(matrix))
+	testutil.Equals(t, 258, len(matrix[0].Points))
+	testutil.Equals(t, int64(14000), matrix[0].Points[1].T-matrix[0].Points[0].T)
+}
+
+func TestRangeQueryResultsAreSortedByLabels(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-3", ns="b"} 1+3x40
+			http_requests_total{pod="nginx-1", ns="c"} 1+1x40
+			http_requests_total{pod="nginx-4", ns="a"} 1+4x40
+			http_requests_total{pod="nginx-2", ns="b"} 1+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	for _, qs := range []string{
+		"http_requests_total",
+		"sum by (ns) (http_requests_total)",
+		"http_requests_total * on (pod) group_left http_requests_total",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			var firstResult promql.Matrix
+			for i := 0; i < 10; i++ {
+				q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				result, err := q.Exec(context.Background()).Matrix()
+				testutil.Ok(t, err)
+				q.Close()
+
+				for j := 1; j < len(result); j++ {
+					testutil.Assert(t, labels.Compare(result[j-1].Metric, result[j].Metric) < 0, "series %s is returned before %s", result[j-1].Metric, result[j].Metric)
+				}
+				if firstResult == nil {
+					firstResult = result
+					continue
+				}
+				testutil.Equals(t, firstResult, result)
+			}
+		})
+	}
+}
+
+func TestRangeQueryResultsWithoutSorting(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1", ns="c"} 1+1x40
+			http_requests_total{pod="nginx-2", ns="a"} 1+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	// The or operator returns the series of its left operand before those of its right operand.
+	qs := `http_requests_total{ns="c"} or http_requests_total{ns="a"}`
+	for _, tcase := range []struct {
+		disableSorting bool
+		expectedPods   []string
+	}{
+		{disableSorting: false, expectedPods: []string{"nginx-2", "nginx-1"}},
+		{disableSorting: true, expectedPods: []string{"nginx-1", "nginx-2"}},
+	} {
+		t.Run(fmt.Sprintf("disableSorting=%v", tcase.disableSorting), func(t *testing.T) {
+			newEngine := engine.New(engine.Opts{DisableFallback: true, DisableResultSorting: tcase.disableSorting})
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			result, err := q.Exec(context.Background()).Matrix()
+			testutil.Ok(t, err)
+
+			pods := make([]string, 0, len(result))
+			for _, s := range result {
+				pods = append(pods, s.Metric.Get("pod"))
+			}
+			testutil.Equals(t, tcase.expectedPods, pods)
+		})
+	}
+}
+
+func TestBinaryOperationWithTime(t *testing.T) {
+	load := `load 30s
+			foo 100+0x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	q, err := newEngine.NewRangeQuery(test.Storage(), nil, "foo - time()", start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	matrix := result.Value.(promql.Matrix)
+	testutil.Equals(t, 1, len(matrix))
+	testutil.Equals(t, 21, len(matrix[0].Points))
+	for i, p := range matrix[0].Points {
+		// The subtracted value is the evaluation time of each step.
+		testutil.Equals(t, float64(i*30), 100-p.V)
+	}
+}
+
+func TestInstantQueryAtStartAndEnd(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	ts := time.Unix(90, 0)
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	exec := func(qs string) *promql.Result {
+		q, err := newEngine.NewInstantQuery(test.Storage(), nil, qs, ts)
+		testutil.Ok(t, err)
+		t.Cleanup(q.Close)
+
+		result := q.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		return result
+	}
+
+	expected := exec("http_requests_total")
+	testutil.Equals(t, 2, len(expected.Value.(promql.Vector)))
+	for _, qs := range []string{"http_requests_total @ start()", "http_requests_total @ end()"} {
+		t.Run(qs, func(t *testing.T) {
+			testutil.Equals(t, expected.Value, exec(qs).Value)
+		})
+	}
+}
+
+func TestHistogramQuantileMalformedBucketLabel(t *testing.T) {
+	load := `load 30s
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="2"} 2+2x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 3+3x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="abc"} 4+4x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	qs := "histogram_quantile(0.9, rate(http_requests_duration_seconds_bucket[1m]))"
+	start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	q1, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+	testutil.Ok(t, err)
+	defer q1.Close()
+	newResult := q1.Exec(context.Background())
+	testutil.Ok(t, newResult.Err)
+
+	oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10})
+	q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+	testutil.Ok(t, err)
+	defer q2.Close()
+	oldResult := q2.Exec(context.Background())
+	testutil.Ok(t, oldResult.Err)
+
+	// The series with the malformed le label is dropped, same as in Prometheus.
+	testutil.Equals(t, oldResult.Value, newResult.Value)
+	testutil.Equals(t, 1, len(newResult.Warnings))
+	testutil.Assert(t, strings.Contains(newResult.Warnings[0].Error(), `malformed le label "abc"`), "unexpected warning %v", newResult.Warnings[0])
+}
+
+func storageWithSeries(series storage.Series) *storage.MockQueryable {
+	seriesSet := &testSeriesSet{series: series}
+	return &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				return seriesSet
+			},
+		},
+	}
+}
+
+// comparisonEpsilon is the relative difference which is allowed between values returned by both engines,
+// since summing samples in a different order, for example in sharded aggregations, can change the last bits of values.
+const comparisonEpsilon = 1e-12
+
+// assertResultsAlmostEqual fails the test if the results differ by more than the relative epsilon in any value.
+// NaN values are equal to each other, as long as they are either both stale markers or both not. Results which
+// are not equal are compared again with testutil.Equals, which prints their difference.
+func assertResultsAlmostEqual(t testing.TB, expected, result *promql.Result, epsilon float64) {
+	t.Helper()
+	if !resultsAlmostEqual(expected, result, epsilon) {
+		testutil.Equals(t, expected, result)
+	}
+}
+
+func resultsAlmostEqual(expected, result *promql.Result, epsilon float64) bool {
+	if !reflect.DeepEqual(expected.Err, result.Err) || !reflect.DeepEqual(expected.Warnings, result.Warnings) {
+		return false
+	}
+
+	switch expectedValue := expected.Value.(type) {
+	case promql.Matrix:
+		resultValue, ok := result.Value.(promql.Matrix)
+		if !ok || len(expectedValue) != len(resultValue) {
+			return false
+		}
+		for i := range expectedValue {
+			if !reflect.DeepEqual(expectedValue[i].Metric, resultValue[i].Metric) || len(expectedValue[i].Points) != len(resultValue[i].Points) {
+				return false
+			}
+			for j := range expectedValue[i].Points {
+				if !pointsAlmostEqual(expectedValue[i].Points[j], resultValue[i].Points[j], epsilon) {
+					return false
+				}
+			}
+		}
+		return true
+	case promql.Vector:
+		resultValue, ok := result.Value.(promql.Vector)
+		if !ok || len(expectedValue) != len(resultValue) {
+			return false
+		}
+		for i := range expectedValue {
+			if !reflect.DeepEqual(expectedValue[i].Metric, resultValue[i].Metric) || !pointsAlmostEqual(expectedValue[i].Point, resultValue[i].Point, epsilon) {
+				return false
+			}
+		}
+		return true
+	case promql.Scalar:
+		resultValue, ok := result.Value.(promql.Scalar)
+		return ok && pointsAlmostEqual(promql.Point{T: expectedValue.T, V: expectedValue.V}, promql.Point{T: resultValue.T, V: resultValue.V}, epsilon)
+	default:
+		return reflect.DeepEqual(expected.Value, result.Value)
+	}
+}
+
+func pointsAlmostEqual(expected, result promql.Point, epsilon float64) bool {
+	if expected.T != result.T {
+		return false
+	}
+	if math.IsNaN(expected.V) || math.IsNaN(result.V) {
+		return math.IsNaN(expected.V) && math.IsNaN(result.V) && value.IsStaleNaN(expected.V) == value.IsStaleNaN(result.V)
+	}
+	if expected.V == result.V {
+		return true
+	}
+	return math.Abs(expected.V-result.V) <= epsilon*math.Max(math.Abs(expected.V), math.Abs(result.V))
+}
+
+func TestQueriesAgainstOldEngine(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := time.Unix(240, 0)
+	step := time.Second * 30
+	// Negative offset and at modifier are enabled by default
+	// since Prometheus v2.33.0 so we also enable them.
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	cases := []struct {
+		load  string
+		name  string
+		query string
+		start time.Time
+		end   time.Time
+		step  time.Duration
+	}{
+		{
+			name: "stddev_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "stddev_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "stdvar_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "stdvar_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "changes",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "changes(http_requests_total[30s])",
+		},
+		{
+			name: "deriv",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "deriv(http_requests_total[30s])",
+		},
+		{
+			name: "sum",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum (http_requests_total)",
+		},
+		{
+			name: "sum_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "count",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "count(http_requests_total)",
+		},
+		{
+			name: "count_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "count_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "average",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "avg(http_requests_total)",
+		},
+		{
+			name: "avg_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "avg_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "max",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "max(http_requests_total)",
+		},
+		{
+			name: "max with only 1 sample",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} -1
+					http_requests_total{pod="nginx-2"} 1`,
+			query: "max(http_requests_total) by (pod)",
+		},
+		{
+			name: "max_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "max_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "min",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "min(http_requests_total)",
+		},
+		{
+			name: "min with only 1 sample",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} -1
+					http_requests_total{pod="nginx-2"} 1`,
+			query: "min(http_requests_total) by (pod)",
+		},
+		{
+			name: "min_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "min_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "count_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "count_over_time(http_requests_total[30s])",
+		},
+		{
+			name: "sum by pod",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18
+					http_requests_total{pod="nginx-3"} 1+2x20
+					http_requests_total{pod="nginx-4"} 1+2x50`,
+			query: "sum by (pod) (http_requests_total)",
+		},
+		{
+			name: "topk with k changing between steps",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x10
+					http_requests_total{pod="nginx-2", ns="a"} 0+3x10
+					http_requests_total{pod="nginx-3", ns="b"} 21-2x10
+					http_requests_total{pod="nginx-4", ns="b"} 5.5+0.5x10
+					k 1 2 3 0 -1 2 0.5 4 1`,
+			query: `topk(scalar(k), http_requests_total)`,
+		},
+		{
+			name: "topk by with literal k",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x10
+					http_requests_total{pod="nginx-2", ns="a"} 0+3x10
+					http_requests_total{pod="nginx-3", ns="b"} 21-2x10
+					http_requests_total{pod="nginx-4", ns="b"} 5.5+0.5x10`,
+			query: `topk by (ns) (1, http_requests_total)`,
+		},
+		{
+			name: "bottomk without with k changing between steps",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x10
+					http_requests_total{pod="nginx-2", ns="a"} 0+3x10
+					http_requests_total{pod="nginx-3", ns="b"} 21-2x10
+					http_requests_total{pod="nginx-4", ns="b"} 5.5+0.5x10
+					k 1 2 3 0 -1 2 1 4 1`,
+			query: `bottomk without (pod) (scalar(k), http_requests_total)`,
+		},
+		{
+			name: "sum by drops metric name",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", job="api"} 1+1x15
+					http_requests_total{pod="nginx-2", job="api"} 1+2x18
+					http_responses_total{pod="nginx-1", job="api"} 1+3x18`,
+			query: `sum by (job) ({__name__=~"http_.*"})`,
+		},
+		{
+			name: "sum by metric name",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", job="api"} 1+1x15
+					http_requests_total{pod="nginx-2", job="api"} 1+2x18
+					http_responses_total{pod="nginx-1", job="api"} 1+3x18`,
+			query: `sum by (__name__) ({__name__=~"http_.*"})`,
+		},
+		{
+			name: "sum without drops metric name",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", job="api"} 1+1x15
+					http_requests_total{pod="nginx-2", job="api"} 1+2x18
+					http_responses_total{pod="nginx-1", job="api"} 1+3x18`,
+			query: `sum without (pod) ({__name__=~"http_.*"})`,
+		},
+		{
+			name: "rate with irregular sample spacing",
+			load: `load 10s
+					http_requests_total{pod="nginx-1"} 0 1 _ _ _ _ 7 _ 9 10 _ _ _ _ _ _ _ _ 20 21 23 _ _ _ 30+1x8
+					http_requests_total{pod="nginx-2"} 1 _ 5 _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ 2 _ _ _ _ _ _ 8+2x8`,
+			query: `rate(http_requests_total[1m])`,
+			step:  10 * time.Second,
+			end:   time.Unix(300, 0),
+		},
+		{
+			name: "irate and increase with gaps larger than lookback",
+			load: `load 1m
+					http_requests_total{pod="nginx-1"} 0 1 _ _ _ _ _ _ 10 11 _ 14
+					http_requests_total{pod="nginx-2"} 5 _ _ _ _ _ _ _ _ _ 15 16`,
+			query: `irate(http_requests_total[10m]) + increase(http_requests_total[10m])`,
+			step:  time.Minute,
+			end:   time.Unix(720, 0),
+		},
+		{
+			name: "range functions with samples at window boundaries",
+			load: `load 1m
+					http_requests_total{pod="nginx-1"} 1 3 _ 10 11 _ _ 20`,
+			query: `rate(http_requests_total[1m]) + count_over_time(http_requests_total[1m]) + max_over_time(http_requests_total[2m])`,
+			step:  time.Minute,
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "absent_over_time with samples at window boundaries",
+			load: `load 1m
+					http_requests_total{pod="nginx-1"} 1 _ _ 4 _ _ _ 8`,
+			query: `absent_over_time(http_requests_total[1m])`,
+			step:  time.Minute,
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "absent_over_time with samples at unaligned window boundaries",
+			load: `load 45s
+					http_requests_total{pod="nginx-1"} 1 _ _ 4 _ _ _ 8`,
+			query: `absent_over_time(http_requests_total[90s])`,
+			step:  15 * time.Second,
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "aggregations with group members becoming stale",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+2x3 stale 10+1x5
+					http_requests_total{pod="nginx-3", ns="b"} 3 4 stale`,
+			query: `count by (ns) (http_requests_total) + sum by (ns) (http_requests_total) + avg by (ns) (http_requests_total)`,
+		},
+		{
+			name: "predict_linear",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1.1x40
+				http_requests_total{pod="nginx-2"} 2+2.3x50
+				http_requests_total{pod="nginx-3"} 10-0.7x50`,
+			query: "predict_linear(http_requests_total[2m], 600)",
+		},
+		{
+			name: "predict_linear with offset",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1.1x40
+				http_requests_total{pod="nginx-2"} 2+2.3x50`,
+			query: "predict_linear(http_requests_total[1m] offset 1m, -30)",
+		},
+		{
+			name: "binary operation with duplicate series on the one side which are not matched at the same steps",
+			load: `load 30s
+				foo{job="a", pod="nginx-1"} 1+1x10
+				foo{job="b", pod="nginx-2"} 1+2x10
+				bar{job="a", pod="nginx-1"} 1+1x4 stale
+				bar{job="a", pod="nginx-2"} _x5 1+1x5`,
+			query: `foo * on (job) bar`,
+		},
+		{
+			name: "many-to-one operation with duplicate series on the one side which are not matched at the same steps",
+			load: `load 30s
+				foo{job="a", pod="nginx-1"} 1+1x10
+				foo{job="a", pod="nginx-2"} 1+2x10
+				bar{job="a", pod="nginx-1"} 1+1x4 stale
+				bar{job="a", pod="nginx-2"} _x5 1+1x5`,
+			query: `foo * on (job) group_left bar`,
+		},
+		{
+			name: "rate with multiple counter resets in one window",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1 5 10 2 6 1 8 12 3 4 9 0 5 7 10 2 3 6 9 1 4
+				http_requests_total{pod="nginx-2"} 10 20 5 15 1 30 40 2 50 60 70 3 20 40 1 2 80 90 5 10 20`,
+			query: `rate(http_requests_total[5m])`,
+		},
+		{
+			name: "increase with multiple counter resets in one window",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1 5 10 2 6 1 8 12 3 4 9 0 5 7 10 2 3 6 9 1 4
+				http_requests_total{pod="nginx-2"} 10 20 5 15 1 30 40 2 50 60 70 3 20 40 1 2 80 90 5 10 20`,
+			query: `increase(http_requests_total[3m])`,
+		},
+		{
+			name: "absent for metric which exists for part of the range",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} _x5 1+1x5 stale
+				http_requests_total{pod="nginx-2"} _x8 1+1x2`,
+			query: `absent(http_requests_total{pod=~"nginx-.*"})`,
+		},
+		{
+			name: "absent with filtered selector for metric which exists for part of the range",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x3 stale _x6 1+1x2
+				http_requests_total{pod="nginx-2"} _x5 1`,
+			query: `absent(http_requests_total{pod="nginx-1"} > 2)`,
+		},
+		{
+			name: "sum of many series with fractional values",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 0.1+0.1x20
+				http_requests_total{pod="nginx-2"} 0.2+0.3x20
+				http_requests_total{pod="nginx-3"} 0.7+0.11x20
+				http_requests_total{pod="nginx-4"} 1e3+0.13x20
+				http_requests_total{pod="nginx-5"} 0.3+0.17x20
+				http_requests_total{pod="nginx-6"} 0.003+0.19x20
+				http_requests_total{pod="nginx-7"} 0.01+0.23x20
+				http_requests_total{pod="nginx-8"} 1.1+0.29x20`,
+			query: `sum(rate(http_requests_total[1m])) / sum(http_requests_total) + avg(http_requests_total)`,
+		},
+		{
+			name: "multi label grouping by",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15`,
+			query: `avg by (pod, ns) (avg_over_time(http_requests_total[2m]))`,
+		},
+		{
+			name: "multi label grouping without",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="a"} 1+1x15`,
+			query: `avg without (pod, ns) (avg_over_time(http_requests_total[2m]))`,
+		},
+		{
+			name: "query in the future",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum by (pod) (http_requests_total)",
+			start: time.Unix(400, 0),
+			end:   time.Unix(3000, 0),
+		},
+		{
+			name: "count_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1
+					http_requests_total{pod="nginx-1"} 1+1x30
+					http_requests_total{pod="nginx-2"} 1+2x600`,
+			query: `count_over_time(http_requests_total[10m])`,
+			start: time.Unix(60, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "rate",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "rate(http_requests_total[1m])",
+			start: time.Unix(0, 0),
+			end:   time.Unix(3000, 0),
+			step:  2 * time.Second,
+		},
+		{
+			name: "sum rate",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x4
+					http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "sum(rate(http_requests_total[1m]))",
+		},
+		{
+			name: "sum rate with stale series",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x40
+					http_requests_total{pod="nginx-2"} 1+2x50
+					http_requests_total{pod="nginx-4"} 1+2x50
+					http_requests_total{pod="nginx-5"} 1+2x50
+					http_requests_total{pod="nginx-6"} 1+2x50`,
+			query: "sum(rate(http_requests_total[1m]))",
+			start: time.Unix(421, 0),
+			end:   time.Unix(3230, 0),
+			step:  28 * time.Second,
+		},
+		{
+			name: "delta",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "delta(http_requests_total[1m])",
+			start: time.Unix(0, 0),
+			end:   time.Unix(3000, 0),
+			step:  2 * time.Second,
+		},
+		{
+			name: "increase",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "increase(http_requests_total[1m])",
+			start: time.Unix(0, 0),
+			end:   time.Unix(3000, 0),
+			step:  2 * time.Second,
+		},
+		{
+			name: "irate",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "irate(http_requests_total[1m])",
+			start: time.Unix(0, 0),
+			end:   time.Unix(3000, 0),
+			step:  2 * time.Second,
+		},
+		{
+			name: "idelta",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "idelta(http_requests_total[1m])",
+			start: time.Unix(0, 0),
+			end:   time.Unix(3000, 0),
+			step:  2 * time.Second,
+		},
+		{
+			name:  "number literal",
+			load:  "",
+			query: "34",
+		},
+		{
+			name:  "vector",
+			load:  "",
+			query: "vector(24)",
+		},
+		{
+			name: "binary operation with one-to-one matching",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x1
+				foo{method="get", code="404"} 2+1x2
+				foo{method="put", code="501"} 3+1x3
+				foo{method="put", code="500"} 1+1x4
+				foo{method="post", code="500"} 4+1x4
+				foo{method="post", code="404"} 5+1x5
+				bar{method="get"} 1+1x1
+				bar{method="del"} 2+1x2
+				bar{method="post"} 3+1x3`,
+			query: `foo{code="500"} + ignoring(code) bar`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			// Example from https://prometheus.io/docs/prometheus/latest/querying/operators/#many-to-one-and-one-to-many-vector-matches
+			name: "binary operation with group_left",
+			load: `load 30s
+				foo{method="get", code="500", path="/"} 1+1.1x30
+				foo{method="get", code="404", path="/"} 1+2.2x20
+				foo{method="put", code="501", path="/"} 4+3.4x60
+				foo{method="post", code="500", path="/"} 1+5.1x40
+				foo{method="post", code="404", path="/"} 2+3.7x40
+				bar{method="get", path="/a"} 3+7.4x10
+				bar{method="del", path="/b"} 8+6.1x30
+				bar{method="post", path="/c"} 1+2.1x40`,
+			query: `foo * ignoring(path, code) group_left bar`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			// Example from https://prometheus.io/docs/prometheus/latest/querying/operators/#many-to-one-and-one-to-many-vector-matches
+			name: "binary operation with group_right",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1.1x30
+				foo{method="get", code="404"} 1+2.2x20
+				foo{method="put", code="501"} 4+3.4x60
+				foo{method="post", code="500"} 1+5.1x40
+				foo{method="post", code="404"} 2+3.7x40
+				bar{method="get", path="/a"} 3+7.4x10
+				bar{method="del", path="/b"} 8+6.1x30
+				bar{method="post", path="/c"} 1+2.1x40`,
+			query: `bar * ignoring(code, path) group_right foo`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(3000, 0),
+			step:  2 * time.Second,
+		},
+		{
+			name: "binary operation with group_left and included labels",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1.1x30
+				foo{method="get", code="404"} 1+2.2x20
+				foo{method="put", code="501"} 4+3.4x60
+				foo{method="post", code="500"} 1+5.1x40
+				foo{method="post", code="404"} 2+3.7x40
+				bar{method="get", path="/a"} 3+7.4x10
+				bar{method="del", path="/b"} 8+6.1x30
+				bar{method="post", path="/c"} 1+2.1x40`,
+			query: `foo * ignoring(code, path) group_left(path) bar`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "binary operation with group_right and included labels",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1.1x30
+				foo{method="get", code="404"} 1+2.2x20
+				foo{method="put", code="501"} 4+3.4x60
+				foo{method="post", code="500"} 1+5.1x40
+				foo{method="post", code="404"} 2+3.7x40
+				bar{method="get", path="/a"} 3+7.4x10
+				bar{method="del", path="/b"} 8+6.1x30
+				bar{method="post", path="/c"} 1+2.1x40`,
+			query: `bar * ignoring(code, path) group_right(path) foo`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "binary operation with vector and scalar on the right",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1.1x30
+				foo{method="get", code="404"} 1+2.2x20`,
+			query: `sum(foo) * 2`,
+		},
+		{
+			name: "binary operation with vector and scalar on the left",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1.1x30
+				foo{method="get", code="404"} 1+2.2x20`,
+			query: `2 * sum(foo)`,
+		},
+		{
+			name: "complex binary operation",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1.1x30
+				foo{method="get", code="404"} 1+2.2x20`,
+			query: `1 - (100 * sum(foo{method="get"}) / sum(foo))`,
+		},
+		{
+			name: "vector binary op ==",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) == sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op on __name__",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18
+				bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} + on (__name__) foo{pod="nginx-2"}`,
+		},
+		{
+			name: "vector binary op on __name__ without match",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18
+				bar{pod="nginx-1"} 1+3x20`,
+			query: `foo + on (__name__) bar`,
+		},
+		{
+			name: "vector comparison on __name__",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18
+				bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} < on (__name__) foo{pod="nginx-2"}`,
+		},
+		{
+			name: "vector bool comparison on __name__",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18
+				bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} < bool on (__name__) foo{pod="nginx-2"}`,
+		},
+		{
+			name: "vector comparison ignoring pod",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18
+				bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} < ignoring (pod) foo{pod="nginx-2"}`,
+		},
+		{
+			name: "vector binary op with selector matching nothing",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18`,
+			query: `nonexistent * foo`,
+		},
+		{
+			name: "vector binary op with selectors matching nothing on both sides",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18`,
+			query: `nonexistent / on (pod) group_left nonexistent_too`,
+		},
+		{
+			name: "binary operation with group_left without included labels",
+			load: `load 30s
+				foo{pod="nginx-1", le="0.1"} 1+1x15
+				foo{pod="nginx-1", le="+Inf"} 2+2x15
+				foo{pod="nginx-2", le="0.1"} 1+3x18
+				bar{pod="nginx-1"} 1+4x18
+				bar{pod="nginx-2"} 2+5x18`,
+			query: `foo / ignoring(le) group_left bar`,
+		},
+		{
+			name: "binary operation with group_left without included labels on pod",
+			load: `load 30s
+				foo{pod="nginx-1", le="0.1"} 1+1x15
+				foo{pod="nginx-1", le="+Inf"} 2+2x15
+				foo{pod="nginx-2", le="0.1"} 1+3x18
+				bar{pod="nginx-1", series="1"} 1+4x18
+				bar{pod="nginx-2", series="2"} 2+5x18`,
+			query: `foo / on(pod) group_left() bar`,
+		},
+		{
+			name: "binary operation with group_right without included labels",
+			load: `load 30s
+				foo{pod="nginx-1", le="0.1"} 1+1x15
+				foo{pod="nginx-1", le="+Inf"} 2+2x15
+				foo{pod="nginx-2", le="0.1"} 1+3x18
+				bar{pod="nginx-1"} 1+4x18
+				bar{pod="nginx-2"} 2+5x18`,
+			query: `bar - ignoring(le) group_right foo`,
+		},
+		{
+			name: "aggregation over binary op with selector matching nothing",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18`,
+			query: `sum by (pod) (foo - nonexistent)`,
+		},
+		{
+			name: "vector or",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+				bar{pod="nginx-2"} 1+2x18
+				bar{pod="nginx-3"} 1+3x18`,
+			query: `foo or bar`,
+		},
+		{
+			name: "vector or on pod",
+			load: `load 30s
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+				bar{pod="nginx-2", series="1"} 1+2x18
+				bar{pod="nginx-3", series="2"} 1+3x18`,
+			query: `foo or on (pod) bar`,
+		},
+		{
+			name: "vector or with the same series on both sides",
+			load: `load 30s
+				foo{pod="nginx-1"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+				foo{pod="nginx-2"} 1+2x18`,
+			query: `foo{pod="nginx-1"} or foo`,
+		},
+		{
+			name: "vector binary op !=",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) != sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op >",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) > sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op > scalar",
+			load: `load 30s
+				foo{method="get", code="500"} 1+2x40
+				bar{method="get", code="404"} 1+1x30`,
+			query: `sum(foo) by (method) > 10`,
+		},
+		{
+			name: "scalar < vector binary op",
+			load: `load 30s
+				foo{method="get", code="500"} 1+2x40
+				bar{method="get", code="404"} 1+1x30`,
+			query: `10 < sum(foo) by (method)`,
+		},
+		{
+			name: "vector binary op <",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) < sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op >=",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) >= sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op <=",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) <= sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op ^",
+			load: `load 30s
+				foo{method="get", code="500"} 1+1x40
+				bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) ^ sum(bar) by (method)`,
+		},
+		{
+			name: "vector binary op %",
+			load: `load 30s
+				foo{method="get", code="500"} 1+2x40
+				bar{method="get", code="404"} 1+1x30`,
+			query: `sum(foo) by (method) % sum(bar) by (method)`,
+		},
+		{
+			name:  "scalar binary op == true",
+			load:  ``,
+			query: `1 == bool 1`,
+		},
+		{
+			name:  "scalar binary op == false",
+			load:  ``,
+			query: `1 != bool 2`,
+		},
+		{
+			name:  "scalar binary op !=",
+			load:  ``,
+			query: `1 != bool 1`,
+		},
+		{
+			name:  "scalar binary op >",
+			load:  ``,
+			query: `1 > bool 0`,
+		},
+		{
+			name:  "scalar binary op <",
+			load:  ``,
+			query: `1 > bool 2`,
+		},
+		{
+			name:  "scalar binary op >=",
+			load:  ``,
+			query: `1 >= bool 0`,
+		},
+		{
+			name:  "scalar binary op <=",
+			load:  ``,
+			query: `1 <= bool 2`,
+		},
+		{
+			name: "vector binary op > bool scalar",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total > bool 10`,
+		},
+		{
+			name: "vector binary op > scalar keeps metric name",
+			load: `load 30s
+			foo{pod="nginx-1"} 1+1x15
+			foo{pod="nginx-2"} 1+2x18`,
+			query: `foo > 5`,
+		},
+		{
+			name:  "time",
+			load:  ``,
+			query: `time()`,
+		},
+		{
+			name: "vector binary op - time",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total - time()`,
+		},
+		{
+			name:  "scalar binary op % 0",
+			load:  ``,
+			query: `2 % 2`,
+		},
+		{
+			name:  "scalar binary op % 1",
+			load:  ``,
+			query: `1 % 2`,
+		},
+		{
+			name:  "scalar binary op ^",
+			load:  ``,
+			query: `2 ^ 2`,
+		},
+		{
+			name:  "empty series",
+			load:  "",
+			query: "http_requests_total",
+		},
+		{
+			name:  "empty series with func",
+			load:  "",
+			query: "sum(http_requests_total)",
+		},
+		{
+			name: "empty result",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total{pod="nginx-3"}`,
+		},
+		{
+			name: "last_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `last_over_time(http_requests_total[30s])`,
+		},
+		{
+			name: "group",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `group(http_requests_total)`,
+		},
+		{
+			name: "resets",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 100-1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `resets(http_requests_total[5m])`,
+		},
+		{
+			name: "present_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `present_over_time(http_requests_total[30s])`,
+		},
+		{
+			name: "complex binary with aggregation",
+			load: `load 30s
+					grpc_server_handled_total{pod="nginx-1", grpc_method="Series", grpc_code="105"} 1+1x15
+					grpc_server_handled_total{pod="nginx-2", grpc_method="Series", grpc_code="105"} 1+1x15
+					grpc_server_handled_total{pod="nginx-3", grpc_method="Series", grpc_code="105"} 1+1x15
+					prometheus_tsdb_head_samples_appended_total{pod="nginx-1", tenant="tenant-1"} 1+2x18
+					prometheus_tsdb_head_samples_appended_total{pod="nginx-2", tenant="tenant-2"} 1+2x18
+					prometheus_tsdb_head_samples_appended_total{pod="nginx-3", tenant="tenant-3"} 1+2x18`,
+			query: `
+	sum by (grpc_method, grpc_code) (
+		sum by (pod, grpc_method, grpc_code) (
+			rate(grpc_server_handled_total{grpc_method="Series", pod=~".+"}[1m])
+		)
+		+ on (pod) group_left() max by (pod) (
+			prometheus_tsdb_head_samples_appended_total{pod=~".+"}
+		)
+	)`,
+		},
+		{
+			name:  "unary sub operation for scalar",
+			load:  ``,
+			query: `-(1 + 5)`,
+		},
+		{
+			name: "unary sub operation for vector",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `-http_requests_total`,
+		},
+		{
+			name: "unary add operation for vector",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `+http_requests_total`,
+		},
+		{
+			name: "unary sub operation for rate",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `-rate(http_requests_total[1m])`,
+		},
+		{
+			name: "unary add operation for rate",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `+rate(http_requests_total[1m])`,
+		},
+		{
+			name: "vector positive offset",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total offset 30s`,
+			start: time.Unix(600, 0),
+			end:   time.Unix(1200, 0),
+		},
+		{
+			name: "vector negative offset",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total offset -30s`,
+			start: time.Unix(600, 0),
+			end:   time.Unix(1200, 0),
+		},
+		{
+			name: "matrix negative offset with sum_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x25
+					http_requests_total{pod="nginx-2"} 1+2x28`,
+			query: `sum_over_time(http_requests_total[5m] offset 5m)`,
+			start: time.Unix(600, 0),
+			end:   time.Unix(6000, 0),
+		},
+		{
+			name: "matrix negative offset with count_over_time",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `count_over_time(http_requests_total[5m] offset -2m)`,
+			start: time.Unix(600, 0),
+			end:   time.Unix(6000, 0),
+		},
+		{
+			name: "@ vector time 10s",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 10",
+		},
+		{
+			name: "@ vector before start",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 30",
+			start: time.Unix(300, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "@ vector before start with negative offset",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 30 offset -1m",
+			start: time.Unix(300, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "rate @ before start",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "rate(http_requests_total[1m] @ 60)",
+			start: time.Unix(300, 0),
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "@ vector time 120s",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 120",
+		},
+		{
+			name: "@ vector time 360s",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 360",
+		},
+		{
+			name: "@ vector start",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ start()",
+		},
+		{
+			name: "@ vector end",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ end()",
+		},
+		{
+			name: "count_over_time @ start",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "count_over_time(http_requests_total[5m] @ start())",
+		},
+		{
+			name: "sum_over_time @ end",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum_over_time(http_requests_total[5m] @ start())",
+		},
+		{
+			name: "avg_over_time @ 180s",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "avg_over_time(http_requests_total[4m] @ 180)",
+		},
+		{
+			name: "@ vector 240s offset 2m",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 240 offset 2m",
+		},
+		{
+			name: "avg_over_time @ 120s offset -2m",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 120 offset -2m",
+		},
+		{
+			name: "sum_over_time @ 180s offset 2m",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum_over_time(http_requests_total[5m] @ 180 offset 2m)",
+		},
+		{
+			name: "binary op between selectors with @ modifier",
+			load: `load 30s
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-1"} 1+3x18`,
+			query: "foo @ 120 + bar @ 120",
+		},
+		{
+			name: "aggregation over binary op with @ modifier",
+			load: `load 30s
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18`,
+			query: "sum(foo @ 120 * 2) + 1",
+		},
+		{
+			name: "selector merge",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="nginx"} 1+1x15
+					http_requests_total{pod="nginx-2", ns="nginx"} 1+2x18
+					http_requests_total{pod="nginx-3", ns="nginx"} 1+2x21`,
+			query: `http_requests_total{pod=~"nginx-1", ns="nginx"} / on() group_left() sum(http_requests_total{ns="nginx"})`,
+		},
+		{
+			name: "selector merge with different ranges",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", ns="nginx"} 2+2x16
+					http_requests_total{pod="nginx-2", ns="nginx"} 2+4x18
+					http_requests_total{pod="nginx-3", ns="nginx"} 2+6x20`,
+			query: `
+	rate(http_requests_total{pod=~"nginx-1", ns="nginx"}[2m])
+	+ on() group_left()
+	sum(http_requests_total{ns="nginx"})`,
+		},
+		// Result is correct but this likely fails due to https://github.com/golang/go/issues/12025.
+		// TODO(saswatamcode): Test NaN cases separately. https://github.com/thanos-community/promql-engine/issues/88
+		// {
+		// 	name: "scalar func with NaN",
+		// 	load: `load 30s
+		//  	http_requests_total{pod="nginx-1"} 1+1x15
+		//  	http_requests_total{pod="nginx-2"} 1+2x18`,
+		// 	query: `scalar(http_requests_total)`,
+		// },
+		{
+			name: "scalar func with aggr",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `scalar(max(http_requests_total))`,
+		},
+		{
+			name: "scalar func with number",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "stdvar_over_time(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `scalar(max(http_requests_total)) + 10`,
 		},
 		{
-			name: "changes",
+			name: "clamp",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "changes(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(http_requests_total, 5, 10)`,
 		},
 		{
-			name: "deriv",
+			name: "clamp_min",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "deriv(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, 10)`,
 		},
 		{
-			name: "sum",
+			name: "clamp with literal and non-literal bounds",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum (http_requests_total)",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(http_requests_total, scalar(min(http_requests_total)), 10)`,
 		},
 		{
-			name: "sum_over_time",
+			name: "complex func query",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum_over_time(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(1 - http_requests_total, 10 - 5, 10)`,
 		},
 		{
-			name: "count",
+			name: "func within func query",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "count(http_requests_total)",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(irate(http_requests_total[30s]), 10 - 5, 10)`,
 		},
 		{
-			name: "count_over_time",
+			name: "aggr within func query",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "count_over_time(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(rate(http_requests_total[30s]), 10 - 5, 10)`,
 		},
 		{
-			name: "average",
+			name: "func with scalar arg that selects storage",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "avg(http_requests_total)",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)))`,
 		},
 		{
-			name: "avg_over_time",
+			name: "func with scalar arg that selects storage + number",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "avg_over_time(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)) + 10)`,
 		},
 		{
-			name: "max",
+			name: "name regex selector",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "max(http_requests_total)",
+			node_cpu_seconds_total{cpu="0"} 1+1x15
+			node_cpu_guest_seconds_total{cpu="0"} 1+2x18
+			node_memory_bytes{instance="a"} 1+3x18`,
+			query: `{__name__=~"node_cpu_.*"}`,
 		},
 		{
-			name: "max with only 1 sample",
+			name: "sum with name regex selector",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} -1
-					http_requests_total{pod="nginx-2"} 1`,
-			query: "max(http_requests_total) by (pod)",
+			node_cpu_seconds_total{cpu="0"} 1+1x15
+			node_cpu_guest_seconds_total{cpu="0"} 1+2x18
+			node_memory_bytes{instance="a"} 1+3x18`,
+			query: `sum({__name__=~"node_cpu_.*"})`,
 		},
 		{
-			name: "max_over_time",
+			name: "holt_winters",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "max_over_time(http_requests_total[30s])",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18
+			http_requests_total{pod="nginx-3"} 1 5 2 8 3 9 1 7 4 6`,
+			query: `holt_winters(http_requests_total[2m], 0.5, 0.3)`,
 		},
 		{
-			name: "min",
+			name: "histogram quantile",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "min(http_requests_total)",
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="2"} 2+2x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 3+3x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="1"} 1+2x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="2"} 2+3x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="+Inf"} 3+5x18`,
+			query: `histogram_quantile(0.9, rate(http_requests_duration_seconds_bucket[1m]))`,
 		},
 		{
-			name: "min with only 1 sample",
+			name: "histogram quantile of sum by le",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} -1
-					http_requests_total{pod="nginx-2"} 1`,
-			query: "min(http_requests_total) by (pod)",
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="2"} 2+2x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 3+3x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="1"} 1+2x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="2"} 2+3x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="+Inf"} 3+5x18`,
+			query: `histogram_quantile(0.5, sum by (le) (rate(http_requests_duration_seconds_bucket[1m])))`,
 		},
 		{
-			name: "min_over_time",
+			name: "histogram quantile with only +Inf bucket",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "min_over_time(http_requests_total[30s])",
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 1+1x18
+			http_requests_duration_seconds_bucket{pod="nginx-2", le="+Inf"} 0x18`,
+			query: `histogram_quantile(0.9, http_requests_duration_seconds_bucket)`,
 		},
 		{
-			name: "count_over_time",
+			name: "histogram quantile with missing +Inf bucket",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "count_over_time(http_requests_total[30s])",
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="2"} 2+2x18
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} _ _ _ _ _ _ _ _ 3+3x10`,
+			query: `histogram_quantile(0.9, http_requests_duration_seconds_bucket)`,
 		},
 		{
-			name: "sum by pod",
+			name: "histogram quantile without buckets",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18
-					http_requests_total{pod="nginx-3"} 1+2x20
-					http_requests_total{pod="nginx-4"} 1+2x50`,
-			query: "sum by (pod) (http_requests_total)",
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x5
+			http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 3+3x5`,
+			query: `histogram_quantile(0.9, http_requests_duration_seconds_bucket{pod="nginx-2"})`,
 		},
 		{
-			name: "multi label grouping by",
+			name: "absent_over_time for nonexistent metric",
 			load: `load 30s
-					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
-					http_requests_total{pod="nginx-2", ns="a"} 1+1x15`,
-			query: `avg by (pod, ns) (avg_over_time(http_requests_total[2m]))`,
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent_over_time(nonexistent{job="foo", pod=~"nginx-.*"}[1m])`,
 		},
 		{
-			name: "multi label grouping without",
+			name: "absent_over_time with gaps",
 			load: `load 30s
-					http_requests_total{pod="nginx-1", ns="a"} 1+1x15
-					http_requests_total{pod="nginx-2", ns="a"} 1+1x15`,
-			query: `avg without (pod, ns) (avg_over_time(http_requests_total[2m]))`,
+			http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+			http_requests_total{pod="nginx-2"} 1+1x15`,
+			query: `absent_over_time(http_requests_total{pod="nginx-1"}[1m])`,
 		},
 		{
-			name: "query in the future",
+			name: "count_over_time with gaps",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum by (pod) (http_requests_total)",
-			start: time.Unix(400, 0),
-			end:   time.Unix(3000, 0),
+			http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+			http_requests_total{pod="nginx-2"} 1+1x15`,
+			query: `count_over_time(http_requests_total[1m])`,
 		},
 		{
-			name: "count_over_time",
+			name: "label_replace renaming a metric",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1
-					http_requests_total{pod="nginx-1"} 1+1x30
-					http_requests_total{pod="nginx-2"} 1+2x600`,
-			query: `count_over_time(http_requests_total[10m])`,
-			start: time.Unix(60, 0),
-			end:   time.Unix(600, 0),
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total, "__name__", "http_requests", "", "")`,
 		},
 		{
-			name: "rate",
+			name: "label_replace renaming a metric with a captured value",
 			load: `load 30s
-				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "rate(http_requests_total[1m])",
-			start: time.Unix(0, 0),
-			end:   time.Unix(3000, 0),
-			step:  2 * time.Second,
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total, "__name__", "requests_$1", "pod", "nginx-(.*)")`,
 		},
 		{
-			name: "sum rate",
+			name: "label_replace with renamed metric in aggregation",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x4
-					http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "sum(rate(http_requests_total[1m]))",
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum by (__name__) (label_replace(http_requests_total, "__name__", "http_requests", "", ""))`,
 		},
 		{
-			name: "sum rate with stale series",
+			name: "label_replace with non-matching regex",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x40
-					http_requests_total{pod="nginx-2"} 1+2x50
-					http_requests_total{pod="nginx-4"} 1+2x50
-					http_requests_total{pod="nginx-5"} 1+2x50
-					http_requests_total{pod="nginx-6"} 1+2x50`,
-			query: "sum(rate(http_requests_total[1m]))",
-			start: time.Unix(421, 0),
-			end:   time.Unix(3230, 0),
-			step:  28 * time.Second,
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total{pod="nginx-1"}, "instance", "$1", "pod", "apache-(.*)") or label_replace(http_requests_total{pod="nginx-2"}, "instance", "$1", "pod", "nginx-(.*)")`,
 		},
 		{
-			name: "delta",
+			name: "label_replace modifying the source label in place",
 			load: `load 30s
-				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "delta(http_requests_total[1m])",
-			start: time.Unix(0, 0),
-			end:   time.Unix(3000, 0),
-			step:  2 * time.Second,
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total, "pod", "$1-suffix", "pod", "(.*)")`,
 		},
 		{
-			name: "increase",
+			name: "label_replace modifying the source label in place with aggregation",
 			load: `load 30s
-				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "increase(http_requests_total[1m])",
-			start: time.Unix(0, 0),
-			end:   time.Unix(3000, 0),
-			step:  2 * time.Second,
+			http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+			http_requests_total{pod="nginx-2", ns="b"} 1+2x18`,
+			query: `sum by (pod) (label_replace(http_requests_total, "pod", "$2-$1", "pod", "(.*)-(.*)"))`,
 		},
 		{
-			name: "irate",
+			name: "absent for nonexistent metric",
 			load: `load 30s
-				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "irate(http_requests_total[1m])",
-			start: time.Unix(0, 0),
-			end:   time.Unix(3000, 0),
-			step:  2 * time.Second,
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent(nonexistent{job="foo", pod=~"nginx-.*"})`,
 		},
 		{
-			name: "idelta",
+			name: "absent for existing metric",
 			load: `load 30s
-				http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "idelta(http_requests_total[1m])",
-			start: time.Unix(0, 0),
-			end:   time.Unix(3000, 0),
-			step:  2 * time.Second,
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent(http_requests_total{pod="nginx-1"})`,
 		},
 		{
-			name:  "number literal",
-			load:  "",
-			query: "34",
+			name: "absent over or-joined selectors",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent(nonexistent{job="x"} or nonexistent{job="y"})`,
 		},
 		{
-			name:  "vector",
-			load:  "",
-			query: "vector(24)",
+			name: "absent over or-joined selectors with gaps",
+			load: `load 30s
+			http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ _ _ _ _ _ _ 2
+			http_requests_total{pod="nginx-2"} 1+1x5`,
+			query: `absent(http_requests_total{pod="nginx-1"} or http_requests_total{pod="nginx-2"})`,
 		},
 		{
-			name: "binary operation with one-to-one matching",
+			name: "max_over_time over subquery of rate",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x1
-				foo{method="get", code="404"} 2+1x2
-				foo{method="put", code="501"} 3+1x3
-				foo{method="put", code="500"} 1+1x4
-				foo{method="post", code="500"} 4+1x4
-				foo{method="post", code="404"} 5+1x5
-				bar{method="get"} 1+1x1
-				bar{method="del"} 2+1x2
-				bar{method="post"} 3+1x3`,
-			query: `foo{code="500"} + ignoring(code) bar`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(600, 0),
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `max_over_time(rate(http_requests_total[1m])[2m:30s])`,
 		},
 		{
-			// Example from https://prometheus.io/docs/prometheus/latest/querying/operators/#many-to-one-and-one-to-many-vector-matches
-			name: "binary operation with group_left",
+			name: "avg_over_time over subquery with unaligned step",
 			load: `load 30s
-				foo{method="get", code="500", path="/"} 1+1.1x30
-				foo{method="get", code="404", path="/"} 1+2.2x20
-				foo{method="put", code="501", path="/"} 4+3.4x60
-				foo{method="post", code="500", path="/"} 1+5.1x40
-				foo{method="post", code="404", path="/"} 2+3.7x40
-				bar{method="get", path="/a"} 3+7.4x10
-				bar{method="del", path="/b"} 8+6.1x30
-				bar{method="post", path="/c"} 1+2.1x40`,
-			query: `foo * ignoring(path, code) group_left bar`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(600, 0),
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `avg_over_time(http_requests_total[3m:45s])`,
 		},
 		{
-			// Example from https://prometheus.io/docs/prometheus/latest/querying/operators/#many-to-one-and-one-to-many-vector-matches
-			name: "binary operation with group_right",
+			name: "sum_over_time over subquery with offset",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1.1x30
-				foo{method="get", code="404"} 1+2.2x20
-				foo{method="put", code="501"} 4+3.4x60
-				foo{method="post", code="500"} 1+5.1x40
-				foo{method="post", code="404"} 2+3.7x40
-				bar{method="get", path="/a"} 3+7.4x10
-				bar{method="del", path="/b"} 8+6.1x30
-				bar{method="post", path="/c"} 1+2.1x40`,
-			query: `bar * ignoring(code, path) group_right foo`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(3000, 0),
-			step:  2 * time.Second,
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum_over_time(sum by (pod) (http_requests_total)[5m:1m] offset 1m)`,
 		},
 		{
-			name: "binary operation with group_left and included labels",
+			name: "last_over_time over subquery",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1.1x30
-				foo{method="get", code="404"} 1+2.2x20
-				foo{method="put", code="501"} 4+3.4x60
-				foo{method="post", code="500"} 1+5.1x40
-				foo{method="post", code="404"} 2+3.7x40
-				bar{method="get", path="/a"} 3+7.4x10
-				bar{method="del", path="/b"} 8+6.1x30
-				bar{method="post", path="/c"} 1+2.1x40`,
-			query: `foo * ignoring(code, path) group_left(path) bar`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(600, 0),
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `last_over_time(http_requests_total[2m:20s])`,
 		},
 		{
-			name: "binary operation with group_right and included labels",
+			name: "max_over_time over subquery of rate with @ and offset",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1.1x30
-				foo{method="get", code="404"} 1+2.2x20
-				foo{method="put", code="501"} 4+3.4x60
-				foo{method="post", code="500"} 1+5.1x40
-				foo{method="post", code="404"} 2+3.7x40
-				bar{method="get", path="/a"} 3+7.4x10
-				bar{method="del", path="/b"} 8+6.1x30
-				bar{method="post", path="/c"} 1+2.1x40`,
-			query: `bar * ignoring(code, path) group_right(path) foo`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(600, 0),
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `max_over_time(rate(http_requests_total[1m] @ 150 offset 30s)[3m:30s])`,
 		},
 		{
-			name: "binary operation with vector and scalar on the right",
+			name: "nested subqueries",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1.1x30
-				foo{method="get", code="404"} 1+2.2x20`,
-			query: `sum(foo) * 2`,
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `max_over_time(min_over_time(http_requests_total[1m:15s])[3m:1m])`,
 		},
 		{
-			name: "binary operation with vector and scalar on the left",
+			name: "abs",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1.1x30
-				foo{method="get", code="404"} 1+2.2x20`,
-			query: `2 * sum(foo)`,
+			http_requests_total{pod="nginx-1"} -5+1x15
+			http_requests_total{pod="nginx-2"} 1-2x18`,
+			query: `abs(http_requests_total)`,
 		},
 		{
-			name: "complex binary operation",
+			name: "sgn",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1.1x30
-				foo{method="get", code="404"} 1+2.2x20`,
-			query: `1 - (100 * sum(foo{method="get"}) / sum(foo))`,
+			http_requests_total{pod="nginx-1"} -5+1x15
+			http_requests_total{pod="nginx-2"} 0 -0 0 -0 0
+			http_requests_total{pod="nginx-3"} 1-2x18`,
+			query: `sgn(http_requests_total)`,
+		},
+	}
+
+	disableOptimizerOpts := []bool{true, false}
+	lookbackDeltas := []time.Duration{30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute}
+	for _, lookbackDelta := range lookbackDeltas {
+		opts.LookbackDelta = lookbackDelta
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				test, err := promql.NewTest(t, tc.load)
+				testutil.Ok(t, err)
+				defer test.Close()
+
+				testutil.Ok(t, test.Run())
+
+				if tc.start.Equal(time.Time{}) {
+					tc.start = start
+				}
+				if tc.end.Equal(time.Time{}) {
+					tc.end = end
+				}
+				if tc.step == 0 {
+					tc.step = step
+				}
+				for _, disableOptimizers := range disableOptimizerOpts {
+					t.Run(fmt.Sprintf("disableOptimizers=%v", disableOptimizers), func(t *testing.T) {
+						for _, disableFallback := range []bool{false, true} {
+							t.Run(fmt.Sprintf("disableFallback=%v", disableFallback), func(t *testing.T) {
+								newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: disableFallback, DisableOptimizers: disableOptimizers})
+								q1, err := newEngine.NewRangeQuery(test.Storage(), nil, tc.query, tc.start, tc.end, tc.step)
+								testutil.Ok(t, err)
+								defer q1.Close()
+
+								newResult := q1.Exec(context.Background())
+								testutil.Ok(t, newResult.Err)
+
+								oldEngine := promql.NewEngine(opts)
+								q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, tc.query, tc.start, tc.end, tc.step)
+								testutil.Ok(t, err)
+								defer q2.Close()
+
+								oldResult := q2.Exec(context.Background())
+								testutil.Ok(t, oldResult.Err)
+
+								assertResultsAlmostEqual(t, oldResult, newResult, comparisonEpsilon)
+							})
+						}
+					})
+				}
+			})
+		}
+	}
+}
+
+func TestInstantQuery(t *testing.T) {
+	defaultQueryTime := time.Unix(50, 0)
+	// Negative offset and at modifier are enabled by default
+	// since Prometheus v2.33.0, so we also enable them.
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+
+	cases := []struct {
+		load      string
+		name      string
+		query     string
+		queryTime time.Time
+	}{
+		{
+			name: "increase plus offset",
+			load: `load 1s
+			http_requests_total{pod="nginx-1"} 1+1x180`,
+			queryTime: time.Unix(160, 0),
+			query:     "increase(http_requests_total[1m] offset 1m)",
 		},
 		{
-			name: "vector binary op ==",
+			name: "quantile by pod",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) == sum(bar) by (method)`,
+				       http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				       http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				       http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				       http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				       http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "quantile by (pod) (0.9, rate(http_requests_total[1m]))",
 		},
 		{
-			name: "vector binary op !=",
+			name: "quantile",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) != sum(bar) by (method)`,
+				       http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+				       http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+				       http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+				       http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+				       http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50	`,
+			query: "quantile(0.9, rate(http_requests_total[1m]))",
 		},
 		{
-			name: "vector binary op >",
+			name: "stdvar",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) > sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "stdvar(http_requests_total)",
 		},
 		{
-			name: "vector binary op > scalar",
+			name: "stdvar by pod",
 			load: `load 30s
-				foo{method="get", code="500"} 1+2x40
-				bar{method="get", code="404"} 1+1x30`,
-			query: `sum(foo) by (method) > 10`,
+						http_requests_total{pod="nginx-1"} 1
+						http_requests_total{pod="nginx-2"} 2
+						http_requests_total{pod="nginx-3"} 8
+						http_requests_total{pod="nginx-4"} 6`,
+			query: "stdvar by (pod) (http_requests_total)",
 		},
 		{
-			name: "scalar < vector binary op",
+			name: "stddev",
 			load: `load 30s
-				foo{method="get", code="500"} 1+2x40
-				bar{method="get", code="404"} 1+1x30`,
-			query: `10 < sum(foo) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "stddev(http_requests_total)",
 		},
 		{
-			name: "vector binary op <",
+			name: "stddev by pod",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) < sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1
+						http_requests_total{pod="nginx-2"} 2
+						http_requests_total{pod="nginx-3"} 8
+						http_requests_total{pod="nginx-4"} 6`,
+			query: "stddev by (pod) (http_requests_total)",
 		},
 		{
-			name: "vector binary op >=",
+			name: "sum by pod",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) >= sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "sum by (pod) (http_requests_total)",
 		},
 		{
-			name: "vector binary op <=",
+			name: "count",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) <= sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "count(http_requests_total)",
 		},
 		{
-			name: "vector binary op ^",
+			name: "average",
 			load: `load 30s
-				foo{method="get", code="500"} 1+1x40
-				bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) ^ sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "avg(http_requests_total)",
 		},
 		{
-			name: "vector binary op %",
+			name: "max",
 			load: `load 30s
-				foo{method="get", code="500"} 1+2x40
-				bar{method="get", code="404"} 1+1x30`,
-			query: `sum(foo) by (method) % sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "max(http_requests_total)",
 		},
 		{
-			name:  "scalar binary op == true",
-			load:  ``,
-			query: `1 == bool 1`,
+			name: "max with only 1 sample",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} -1
+						http_requests_total{pod="nginx-2"} 1`,
+			query: "max(http_requests_total) by (pod)",
 		},
 		{
-			name:  "scalar binary op == false",
-			load:  ``,
-			query: `1 != bool 2`,
+			name: "min",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "min(http_requests_total)",
 		},
 		{
-			name:  "scalar binary op !=",
-			load:  ``,
-			query: `1 != bool 1`,
+			name: "min with only 1 sample",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} -1
+						http_requests_total{pod="nginx-2"} 1`,
+			query: "min(http_requests_total) by (pod)",
 		},
 		{
-			name:  "scalar binary op >",
-			load:  ``,
-			query: `1 > bool 0`,
+			name: "rate",
+			load: `load 30s
+					http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+					http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+					http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+					http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
+					http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
+			query: "rate(http_requests_total[1m])",
 		},
 		{
-			name:  "scalar binary op <",
-			load:  ``,
-			query: `1 > bool 2`,
+			name: "sum rate",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "sum(rate(http_requests_total[1m]))",
+		},
+		{
+			name: "sum rate with single sample series",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4
+						http_requests_total{pod="nginx-3"} 0`,
+			query: "sum by (pod) (rate(http_requests_total[1m]))",
 		},
 		{
-			name:  "scalar binary op >=",
-			load:  ``,
-			query: `1 >= bool 0`,
+			name: "sum rate with stale series",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x20`,
+			query: "sum(rate(http_requests_total[1m]))",
 		},
 		{
-			name:  "scalar binary op <=",
-			load:  ``,
-			query: `1 <= bool 2`,
+			name: "delta",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "delta(http_requests_total[1m])",
 		},
 		{
-			name:  "scalar binary op % 0",
-			load:  ``,
-			query: `2 % 2`,
+			name: "increase",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "increase(http_requests_total[1m])",
 		},
+
 		{
-			name:  "scalar binary op % 1",
-			load:  ``,
-			query: `1 % 2`,
+			name: "sum irate",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x4`,
+			query: "sum(irate(http_requests_total[1m]))",
 		},
 		{
-			name:  "scalar binary op ^",
-			load:  ``,
-			query: `2 ^ 2`,
+			name: "sum irate with stale series",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x4
+						http_requests_total{pod="nginx-2"} 1+2x20`,
+			query: "sum(irate(http_requests_total[1m]))",
 		},
 		{
-			name:  "empty series",
+			name:  "number literal",
 			load:  "",
-			query: "http_requests_total",
+			query: "34",
 		},
 		{
-			name:  "empty series with func",
+			name:  "vector",
 			load:  "",
-			query: "sum(http_requests_total)",
-		},
-		{
-			name: "empty result",
-			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `http_requests_total{pod="nginx-3"}`,
+			query: "vector(24)",
 		},
 		{
-			name: "last_over_time",
+			name: "binary operation with vector and scalar on the right",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `last_over_time(http_requests_total[30s])`,
+					foo{method="get", code="500"} 1+1.1x30
+					foo{method="get", code="404"} 1+2.2x20`,
+			query: `foo * 2`,
 		},
 		{
-			name: "group",
+			name: "binary operation with vector and scalar on the left",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `group(http_requests_total)`,
+					foo{method="get", code="500"} 1+1.1x30
+					foo{method="get", code="404"} 1+2.2x20`,
+			query: `2 * foo`,
 		},
 		{
-			name: "resets",
+			name: "complex binary operation",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 100-1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `resets(http_requests_total[5m])`,
+					foo{method="get", code="500"} 1+1.1x30
+					foo{method="get", code="404"} 1+2.2x20`,
+			query: `1 - (100 * sum(foo{method="get"}) / sum(foo))`,
 		},
 		{
-			name: "present_over_time",
+			name: "vector binary op ==",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `present_over_time(http_requests_total[30s])`,
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) == sum(bar) by (method)`,
 		},
 		{
-			name: "complex binary with aggregation",
+			name: "vector binary op on __name__",
 			load: `load 30s
-					grpc_server_handled_total{pod="nginx-1", grpc_method="Series", grpc_code="105"} 1+1x15
-					grpc_server_handled_total{pod="nginx-2", grpc_method="Series", grpc_code="105"} 1+1x15
-					grpc_server_handled_total{pod="nginx-3", grpc_method="Series", grpc_code="105"} 1+1x15
-					prometheus_tsdb_head_samples_appended_total{pod="nginx-1", tenant="tenant-1"} 1+2x18
-					prometheus_tsdb_head_samples_appended_total{pod="nginx-2", tenant="tenant-2"} 1+2x18
-					prometheus_tsdb_head_samples_appended_total{pod="nginx-3", tenant="tenant-3"} 1+2x18`,
-			query: `
-	sum by (grpc_method, grpc_code) (
-		sum by (pod, grpc_method, grpc_code) (
-			rate(grpc_server_handled_total{grpc_method="Series", pod=~".+"}[1m])
-		)
-		+ on (pod) group_left() max by (pod) (
-			prometheus_tsdb_head_samples_appended_total{pod=~".+"}
-		)
-	)`,
-		},
-		{
-			name:  "unary sub operation for scalar",
-			load:  ``,
-			query: `-(1 + 5)`,
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} + on (__name__) foo{pod="nginx-2"}`,
 		},
 		{
-			name: "unary sub operation for vector",
+			name: "vector binary op on __name__ without match",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `-http_requests_total`,
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-1"} 1+3x20`,
+			query: `foo + on (__name__) bar`,
 		},
 		{
-			name: "unary add operation for vector",
+			name: "vector comparison on __name__",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `+http_requests_total`,
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} < on (__name__) foo{pod="nginx-2"}`,
 		},
 		{
-			name: "vector positive offset",
+			name: "vector bool comparison on __name__",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `http_requests_total offset 30s`,
-			start: time.Unix(600, 0),
-			end:   time.Unix(1200, 0),
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} < bool on (__name__) foo{pod="nginx-2"}`,
 		},
 		{
-			name: "vector negative offset",
+			name: "vector comparison ignoring pod",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `http_requests_total offset -30s`,
-			start: time.Unix(600, 0),
-			end:   time.Unix(1200, 0),
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-1"} 1+3x20`,
+			query: `foo{pod="nginx-1"} < ignoring (pod) foo{pod="nginx-2"}`,
 		},
 		{
-			name: "matrix negative offset with sum_over_time",
+			name: "vector binary op with selector matching nothing",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x25
-					http_requests_total{pod="nginx-2"} 1+2x28`,
-			query: `sum_over_time(http_requests_total[5m] offset 5m)`,
-			start: time.Unix(600, 0),
-			end:   time.Unix(6000, 0),
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18`,
+			query: `nonexistent * foo`,
 		},
 		{
-			name: "matrix negative offset with count_over_time",
+			name: "vector binary op with selectors matching nothing on both sides",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `count_over_time(http_requests_total[5m] offset -2m)`,
-			start: time.Unix(600, 0),
-			end:   time.Unix(6000, 0),
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18`,
+			query: `nonexistent / on (pod) group_left nonexistent_too`,
 		},
 		{
-			name: "@ vector time 10s",
+			name: "aggregation over binary op with selector matching nothing",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 10",
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1+2x18`,
+			query: `sum by (pod) (foo - nonexistent)`,
 		},
 		{
-			name: "@ vector time 120s",
+			name: "vector or",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 120",
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+					bar{pod="nginx-2"} 1+2x18
+					bar{pod="nginx-3"} 1+3x18`,
+			query: `foo or bar`,
 		},
 		{
-			name: "@ vector time 360s",
+			name: "vector or on pod",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 360",
+					foo{pod="nginx-1"} 1+1x15
+					foo{pod="nginx-2"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+					bar{pod="nginx-2", series="1"} 1+2x18
+					bar{pod="nginx-3", series="2"} 1+3x18`,
+			query: `foo or on (pod) bar`,
 		},
 		{
-			name: "@ vector start",
+			name: "vector or with the same series on both sides",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ start()",
+					foo{pod="nginx-1"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+					foo{pod="nginx-2"} 1+2x18`,
+			query: `foo{pod="nginx-1"} or foo`,
 		},
 		{
-			name: "@ vector end",
+			name: "vector binary op !=",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ end()",
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) != sum(bar) by (method)`,
 		},
 		{
-			name: "count_over_time @ start",
+			name: "vector binary op >",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "count_over_time(http_requests_total[5m] @ start())",
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) > sum(bar) by (method)`,
 		},
 		{
-			name: "sum_over_time @ end",
+			name: "vector binary op <",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum_over_time(http_requests_total[5m] @ start())",
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) < sum(bar) by (method)`,
 		},
 		{
-			name: "avg_over_time @ 180s",
+			name: "vector binary op >=",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "avg_over_time(http_requests_total[4m] @ 180)",
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) >= sum(bar) by (method)`,
 		},
 		{
-			name: "@ vector 240s offset 2m",
+			name: "vector binary op <=",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 240 offset 2m",
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) <= sum(bar) by (method)`,
 		},
 		{
-			name: "avg_over_time @ 120s offset -2m",
+			name: "vector binary op ^",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 120 offset -2m",
+					foo{method="get", code="500"} 1+1x40
+					bar{method="get", code="404"} 1+1.1x30`,
+			query: `sum(foo) by (method) ^ sum(bar) by (method)`,
 		},
 		{
-			name: "sum_over_time @ 180s offset 2m",
+			name: "vector binary op %",
 			load: `load 30s
-					http_requests_total{pod="nginx-1"} 1+1x15
-					http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum_over_time(http_requests_total[5m] @ 180 offset 2m)",
+					foo{method="get", code="500"} 1+2x40
+					bar{method="get", code="404"} 1+1x30`,
+			query: `sum(foo) by (method) % sum(bar) by (method)`,
 		},
 		{
-			name: "selector merge",
+			name: "vector binary op > scalar",
 			load: `load 30s
-					http_requests_total{pod="nginx-1", ns="nginx"} 1+1x15
-					http_requests_total{pod="nginx-2", ns="nginx"} 1+2x18
-					http_requests_total{pod="nginx-3", ns="nginx"} 1+2x21`,
-			query: `http_requests_total{pod=~"nginx-1", ns="nginx"} / on() group_left() sum(http_requests_total{ns="nginx"})`,
+					foo{method="get", code="500"} 1+2x40
+					bar{method="get", code="404"} 1+1x30`,
+			query: `sum(foo) by (method) > 10`,
 		},
 		{
-			name: "selector merge with different ranges",
+			name: "scalar < vector binary op",
 			load: `load 30s
-					http_requests_total{pod="nginx-1", ns="nginx"} 2+2x16
-					http_requests_total{pod="nginx-2", ns="nginx"} 2+4x18
-					http_requests_total{pod="nginx-3", ns="nginx"} 2+6x20`,
-			query: `
-	rate(http_requests_total{pod=~"nginx-1", ns="nginx"}[2m])
-	+ on() group_left()
-	sum(http_requests_total{ns="nginx"})`,
+					foo{method="get", code="500"} 1+2x40
+					bar{method="get", code="404"} 1+1x30`,
+			query: `10 < sum(foo) by (method)`,
 		},
-		// Result is correct but this likely fails due to https://github.com/golang/go/issues/12025.
-		// TODO(saswatamcode): Test NaN cases separately. https://github.com/thanos-community/promql-engine/issues/88
-		// {
-		// 	name: "scalar func with NaN",
-		// 	load: `load 30s
-		//  	http_requests_total{pod="nginx-1"} 1+1x15
-		//  	http_requests_total{pod="nginx-2"} 1+2x18`,
-		// 	query: `scalar(http_requests_total)`,
-		// },
 		{
-			name: "scalar func with aggr",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `scalar(max(http_requests_total))`,
+			name:  "scalar binary op == true",
+			load:  ``,
+			query: `1 == bool 1`,
 		},
 		{
-			name: "scalar func with number",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `scalar(max(http_requests_total)) + 10`,
+			name:  "scalar binary op == false",
+			load:  ``,
+			query: `1 != bool 2`,
 		},
 		{
-			name: "clamp",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(http_requests_total, 5, 10)`,
+			name:  "scalar binary op !=",
+			load:  ``,
+			query: `1 != bool 1`,
 		},
 		{
-			name: "clamp_min",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, 10)`,
+			name:  "scalar binary op >",
+			load:  ``,
+			query: `1 > bool 0`,
 		},
 		{
-			name: "complex func query",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(1 - http_requests_total, 10 - 5, 10)`,
+			name:  "scalar binary op <",
+			load:  ``,
+			query: `1 > bool 2`,
 		},
 		{
-			name: "func within func query",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(irate(http_requests_total[30s]), 10 - 5, 10)`,
+			name:  "scalar binary op >=",
+			load:  ``,
+			query: `1 >= bool 0`,
 		},
 		{
-			name: "aggr within func query",
-			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(rate(http_requests_total[30s]), 10 - 5, 10)`,
+			name:  "scalar binary op <=",
+			load:  ``,
+			query: `1 <= bool 2`,
 		},
 		{
-			name: "func with scalar arg that selects storage",
+			name: "vector binary op > bool scalar",
 			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)))`,
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total > bool 10`,
 		},
 		{
-			name: "func with scalar arg that selects storage + number",
+			name: "vector binary op > scalar keeps metric name",
 			load: `load 30s
-			http_requests_total{pod="nginx-1"} 1+1x15
-			http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)) + 10)`,
-		},
-	}
-
-	disableOptimizerOpts := []bool{true, false}
-	lookbackDeltas := []time.Duration{30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute}
-	for _, lookbackDelta := range lookbackDeltas {
-		opts.LookbackDelta = lookbackDelta
-		for _, tc := range cases {
-			t.Run(tc.name, func(t *testing.T) {
-				test, err := promql.NewTest(t, tc.load)
-				testutil.Ok(t, err)
-				defer test.Close()
-
-				testutil.Ok(t, test.Run())
-
-				if tc.start.Equal(time.Time{}) {
-					tc.start = start
-				}
-				if tc.end.Equal(time.Time{}) {
-					tc.end = end
-				}
-				if tc.step == 0 {
-					tc.step = step
-				}
-				for _, disableOptimizers := range disableOptimizerOpts {
-					t.Run(fmt.Sprintf("disableOptimizers=%v", disableOptimizers), func(t *testing.T) {
-						for _, disableFallback := range []bool{false, true} {
-							t.Run(fmt.Sprintf("disableFallback=%v", disableFallback), func(t *testing.T) {
-								newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: disableFallback, DisableOptimizers: disableOptimizers})
-								q1, err := newEngine.NewRangeQuery(test.Storage(), nil, tc.query, tc.start, tc.end, tc.step)
-								testutil.Ok(t, err)
-								defer q1.Close()
-
-								newResult := q1.Exec(context.Background())
-								testutil.Ok(t, newResult.Err)
-
-								oldEngine := promql.NewEngine(opts)
-								q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, tc.query, tc.start, tc.end, tc.step)
-								testutil.Ok(t, err)
-								defer q2.Close()
-
-								oldResult := q2.Exec(context.Background())
-								testutil.Ok(t, oldResult.Err)
-
-								testutil.Equals(t, oldResult, newResult)
-							})
-						}
-					})
-				}
-			})
-		}
-	}
-}
-
-func TestInstantQuery(t *testing.T) {
-	defaultQueryTime := time.Unix(50, 0)
-	// Negative offset and at modifier are enabled by default
-	// since Prometheus v2.33.0, so we also enable them.
-	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
-	}
-
-	cases := []struct {
-		load      string
-		name      string
-		query     string
-		queryTime time.Time
-	}{
-		{
-			name: "increase plus offset",
-			load: `load 1s
-			http_requests_total{pod="nginx-1"} 1+1x180`,
-			queryTime: time.Unix(160, 0),
-			query:     "increase(http_requests_total[1m] offset 1m)",
+				foo{pod="nginx-1"} 1+1x15
+				foo{pod="nginx-2"} 1+2x18`,
+			query: `foo > 5`,
 		},
 		{
-			name: "quantile by pod",
-			load: `load 30s
-				       http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				       http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				       http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				       http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				       http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "quantile by (pod) (0.9, rate(http_requests_total[1m]))",
+			name:  "time",
+			load:  ``,
+			query: `time()`,
 		},
 		{
-			name: "quantile",
+			name: "vector binary op - time",
 			load: `load 30s
-				       http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-				       http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-				       http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-				       http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-				       http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50	`,
-			query: "quantile(0.9, rate(http_requests_total[1m]))",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total - time()`,
 		},
 		{
-			name: "stdvar",
-			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "stdvar(http_requests_total)",
+			name:  "scalar binary op % 0",
+			load:  ``,
+			query: `2 % 2`,
 		},
 		{
-			name: "stdvar by pod",
-			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1
-						http_requests_total{pod="nginx-2"} 2
-						http_requests_total{pod="nginx-3"} 8
-						http_requests_total{pod="nginx-4"} 6`,
-			query: "stdvar by (pod) (http_requests_total)",
+			name:  "scalar binary op % 1",
+			load:  ``,
+			query: `1 % 2`,
 		},
 		{
-			name: "stddev",
-			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "stddev(http_requests_total)",
+			name:  "scalar binary op ^",
+			load:  ``,
+			query: `2 ^ 2`,
 		},
 		{
-			name: "stddev by pod",
-			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1
-						http_requests_total{pod="nginx-2"} 2
-						http_requests_total{pod="nginx-3"} 8
-						http_requests_total{pod="nginx-4"} 6`,
-			query: "stddev by (pod) (http_requests_total)",
+			name:  "empty series",
+			load:  "",
+			query: "http_requests_total",
 		},
 		{
-			name: "sum by pod",
-			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "sum by (pod) (http_requests_total)",
+			name:  "empty series with func",
+			load:  "",
+			query: "sum(http_requests_total)",
 		},
 		{
-			name: "count",
+			name: "empty result",
 			load: `load 30s
 						http_requests_total{pod="nginx-1"} 1+1x15
 						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "count(http_requests_total)",
+			query: `http_requests_total{pod="nginx-3"}`,
 		},
 		{
-			name: "average",
+			name: "last_over_time",
 			load: `load 30s
 						http_requests_total{pod="nginx-1"} 1+1x15
 						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "avg(http_requests_total)",
+			query: `last_over_time(http_requests_total[30s])`,
 		},
 		{
-			name: "max",
+			name: "group",
 			load: `load 30s
 						http_requests_total{pod="nginx-1"} 1+1x15
 						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "max(http_requests_total)",
+			query: `group(http_requests_total)`,
 		},
 		{
-			name: "max with only 1 sample",
+			name: "reset",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} -1
-						http_requests_total{pod="nginx-2"} 1`,
-			query: "max(http_requests_total) by (pod)",
+						http_requests_total{pod="nginx-1"} 100-1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `resets(http_requests_total[5m])`,
 		},
 		{
-			name: "min",
+			name: "present_over_time",
 			load: `load 30s
 						http_requests_total{pod="nginx-1"} 1+1x15
 						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "min(http_requests_total)",
+			query: `present_over_time(http_requests_total[30s])`,
 		},
 		{
-			name: "min with only 1 sample",
+			name:  "unary sub operation for scalar",
+			load:  ``,
+			query: `-(1 + 5)`,
+		},
+		{
+			name: "unary sub operation for vector",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} -1
-						http_requests_total{pod="nginx-2"} 1`,
-			query: "min(http_requests_total) by (pod)",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `-http_requests_total`,
 		},
 		{
-			name: "rate",
+			name: "unary add operation for vector",
 			load: `load 30s
-					http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
-					http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
-					http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
-					http_requests_total{pod="nginx-5", series="1"} 8.4+2.3x50
-					http_requests_total{pod="nginx-6", series="2"} 2.3+2.3x50`,
-			query: "rate(http_requests_total[1m])",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `+http_requests_total`,
 		},
 		{
-			name: "sum rate",
+			name: "unary sub operation for rate",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "sum(rate(http_requests_total[1m]))",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `-rate(http_requests_total[1m])`,
 		},
 		{
-			name: "sum rate with single sample series",
+			name: "unary add operation for rate",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4
-						http_requests_total{pod="nginx-3"} 0`,
-			query: "sum by (pod) (rate(http_requests_total[1m]))",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `+rate(http_requests_total[1m])`,
 		},
 		{
-			name: "sum rate with stale series",
+			name: "vector positive offset",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x20`,
-			query: "sum(rate(http_requests_total[1m]))",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total offset 30s`,
 		},
 		{
-			name: "delta",
+			name: "vector negative offset",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "delta(http_requests_total[1m])",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `http_requests_total offset -30s`,
 		},
 		{
-			name: "increase",
+			name: "matrix negative offset with sum_over_time",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "increase(http_requests_total[1m])",
+						http_requests_total{pod="nginx-1"} 1+1x25
+						http_requests_total{pod="nginx-2"} 1+2x28`,
+			query: `sum_over_time(http_requests_total[5m] offset 5m)`,
 		},
-
 		{
-			name: "sum irate",
+			name: "matrix negative offset with count_over_time",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x4`,
-			query: "sum(irate(http_requests_total[1m]))",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `count_over_time(http_requests_total[5m] offset -2m)`,
 		},
 		{
-			name: "sum irate with stale series",
+			name: "@ vector time 10s",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x4
-						http_requests_total{pod="nginx-2"} 1+2x20`,
-			query: "sum(irate(http_requests_total[1m]))",
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 10",
 		},
 		{
-			name:  "number literal",
-			load:  "",
-			query: "34",
+			name: "@ vector before start",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query:     "http_requests_total @ 30",
+			queryTime: time.Unix(500, 0),
 		},
 		{
-			name:  "vector",
-			load:  "",
-			query: "vector(24)",
+			name: "@ vector before start with negative offset",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query:     "http_requests_total @ 30 offset -1m",
+			queryTime: time.Unix(500, 0),
 		},
 		{
-			name: "binary operation with vector and scalar on the right",
+			name: "rate @ before start",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1.1x30
-					foo{method="get", code="404"} 1+2.2x20`,
-			query: `foo * 2`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query:     "rate(http_requests_total[1m] @ 60)",
+			queryTime: time.Unix(500, 0),
 		},
 		{
-			name: "binary operation with vector and scalar on the left",
+			name: "@ vector time 120s",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1.1x30
-					foo{method="get", code="404"} 1+2.2x20`,
-			query: `2 * foo`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 120",
 		},
 		{
-			name: "complex binary operation",
+			name: "@ vector time 360s",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1.1x30
-					foo{method="get", code="404"} 1+2.2x20`,
-			query: `1 - (100 * sum(foo{method="get"}) / sum(foo))`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 360",
 		},
 		{
-			name: "vector binary op ==",
+			name: "@ vector start",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) == sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ start()",
 		},
 		{
-			name: "vector binary op !=",
+			name: "@ vector end",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) != sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ end()",
 		},
 		{
-			name: "vector binary op >",
+			name: "count_over_time @ start",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) > sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "count_over_time(http_requests_total[5m] @ start())",
 		},
 		{
-			name: "vector binary op <",
+			name: "sum_over_time @ end",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) < sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum_over_time(http_requests_total[5m] @ start())",
 		},
 		{
-			name: "vector binary op >=",
+			name: "avg_over_time @ 180s",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) >= sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "avg_over_time(http_requests_total[4m] @ 180)",
 		},
 		{
-			name: "vector binary op <=",
+			name: "@ vector 240s offset 2m",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) <= sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 240 offset 2m",
 		},
 		{
-			name: "vector binary op ^",
+			name: "avg_over_time @ 120s offset -2m",
 			load: `load 30s
-					foo{method="get", code="500"} 1+1x40
-					bar{method="get", code="404"} 1+1.1x30`,
-			query: `sum(foo) by (method) ^ sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "http_requests_total @ 120 offset -2m",
 		},
 		{
-			name: "vector binary op %",
+			name: "sum_over_time @ 180s offset 2m",
 			load: `load 30s
-					foo{method="get", code="500"} 1+2x40
-					bar{method="get", code="404"} 1+1x30`,
-			query: `sum(foo) by (method) % sum(bar) by (method)`,
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "sum_over_time(http_requests_total[5m] @ 180 offset 2m)",
 		},
+		// Result is correct but this likely fails due to https://github.com/golang/go/issues/12025.
+		// TODO(saswatamcode): Test NaN cases separately. https://github.com/thanos-community/promql-engine/issues/88
+		// {
+		// 	name: "scalar func with NaN",
+		// 	load: `load 30s
+		//  	http_requests_total{pod="nginx-1"} 1+1x15
+		//  	http_requests_total{pod="nginx-2"} 1+2x18`,
+		// 	query: `scalar(http_requests_total)`,
+		// },
 		{
-			name: "vector binary op > scalar",
+			name: "scalar func with aggr",
 			load: `load 30s
-					foo{method="get", code="500"} 1+2x40
-					bar{method="get", code="404"} 1+1x30`,
-			query: `sum(foo) by (method) > 10`,
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `scalar(max(http_requests_total))`,
 		},
 		{
-			name: "scalar < vector binary op",
+			name: "scalar func with number",
 			load: `load 30s
-					foo{method="get", code="500"} 1+2x40
-					bar{method="get", code="404"} 1+1x30`,
-			query: `10 < sum(foo) by (method)`,
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `scalar(max(http_requests_total)) + 10`,
 		},
 		{
-			name:  "scalar binary op == true",
-			load:  ``,
-			query: `1 == bool 1`,
+			name: "clamp",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(http_requests_total, 5, 10)`,
 		},
 		{
-			name:  "scalar binary op == false",
-			load:  ``,
-			query: `1 != bool 2`,
+			name: "clamp_min",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, 10)`,
 		},
 		{
-			name:  "scalar binary op !=",
-			load:  ``,
-			query: `1 != bool 1`,
+			name: "clamp with literal and non-literal bounds",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(http_requests_total, scalar(min(http_requests_total)), 10)`,
 		},
 		{
-			name:  "scalar binary op >",
-			load:  ``,
-			query: `1 > bool 0`,
+			name: "complex func query",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(1 - http_requests_total, 10 - 5, 10)`,
 		},
 		{
-			name:  "scalar binary op <",
-			load:  ``,
-			query: `1 > bool 2`,
+			name: "func within func query",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(irate(http_requests_total[30s]), 10 - 5, 10)`,
 		},
 		{
-			name:  "scalar binary op >=",
-			load:  ``,
-			query: `1 >= bool 0`,
+			name: "aggr within func query",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp(rate(http_requests_total[30s]), 10 - 5, 10)`,
 		},
 		{
-			name:  "scalar binary op <=",
-			load:  ``,
-			query: `1 <= bool 2`,
+			name: "func with scalar arg that selects storage",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)))`,
 		},
 		{
-			name:  "scalar binary op % 0",
-			load:  ``,
-			query: `2 % 2`,
+			name: "func with scalar arg that selects storage + number",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)) + 10)`,
 		},
 		{
-			name:  "scalar binary op % 1",
-			load:  ``,
-			query: `1 % 2`,
+			name: "name regex selector",
+			load: `load 30s
+				node_cpu_seconds_total{cpu="0"} 1+1x15
+				node_cpu_guest_seconds_total{cpu="0"} 1+2x18
+				node_memory_bytes{instance="a"} 1+3x18`,
+			query: `{__name__=~"node_cpu_.*"}`,
 		},
 		{
-			name:  "scalar binary op ^",
-			load:  ``,
-			query: `2 ^ 2`,
+			name: "sum with name regex selector",
+			load: `load 30s
+				node_cpu_seconds_total{cpu="0"} 1+1x15
+				node_cpu_guest_seconds_total{cpu="0"} 1+2x18
+				node_memory_bytes{instance="a"} 1+3x18`,
+			query: `sum({__name__=~"node_cpu_.*"})`,
 		},
 		{
-			name:  "empty series",
-			load:  "",
-			query: "http_requests_total",
+			name: "holt_winters",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18
+				http_requests_total{pod="nginx-3"} 1 5 2 8 3 9 1 7 4 6`,
+			query: `holt_winters(http_requests_total[2m], 0.5, 0.3)`,
 		},
 		{
-			name:  "empty series with func",
-			load:  "",
-			query: "sum(http_requests_total)",
+			name: "histogram quantile of sum by le",
+			load: `load 30s
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x18
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="2"} 2+2x18
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 3+3x18
+				http_requests_duration_seconds_bucket{pod="nginx-2", le="1"} 1+2x18
+				http_requests_duration_seconds_bucket{pod="nginx-2", le="2"} 2+3x18
+				http_requests_duration_seconds_bucket{pod="nginx-2", le="+Inf"} 3+5x18`,
+			query: `histogram_quantile(0.5, sum by (le) (rate(http_requests_duration_seconds_bucket[1m])))`,
 		},
 		{
-			name: "empty result",
+			name: "histogram quantile with only +Inf bucket",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `http_requests_total{pod="nginx-3"}`,
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 1+1x18`,
+			query: `histogram_quantile(0.9, http_requests_duration_seconds_bucket)`,
 		},
 		{
-			name: "last_over_time",
+			name: "histogram quantile with missing +Inf bucket",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `last_over_time(http_requests_total[30s])`,
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x18
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="2"} 2+2x18
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} _ _ _ _ _ _ _ _ 3+3x10`,
+			query: `histogram_quantile(0.9, http_requests_duration_seconds_bucket)`,
 		},
 		{
-			name: "group",
+			name: "histogram quantile without buckets",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `group(http_requests_total)`,
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="1"} 1+1x5
+				http_requests_duration_seconds_bucket{pod="nginx-1", le="+Inf"} 3+3x5`,
+			query: `histogram_quantile(0.9, http_requests_duration_seconds_bucket{pod="nginx-2"})`,
 		},
 		{
-			name: "reset",
+			name: "absent_over_time for nonexistent metric",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 100-1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `resets(http_requests_total[5m])`,
+				http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent_over_time(nonexistent{job="foo", pod=~"nginx-.*"}[1m])`,
 		},
 		{
-			name: "present_over_time",
+			name: "absent_over_time with gaps",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `present_over_time(http_requests_total[30s])`,
+				http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+				http_requests_total{pod="nginx-2"} 1+1x15`,
+			query: `absent_over_time(http_requests_total{pod="nginx-1"}[1m])`,
 		},
 		{
-			name:  "unary sub operation for scalar",
-			load:  ``,
-			query: `-(1 + 5)`,
+			name: "count_over_time with gaps",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ 2 _ _ _ _ _ 3
+				http_requests_total{pod="nginx-2"} 1+1x15`,
+			query: `count_over_time(http_requests_total[1m])`,
 		},
 		{
-			name: "unary sub operation for vector",
+			name: "bare range selector",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `-http_requests_total`,
+				up{job="api", instance="a"} 1+0x20
+				up{job="api", instance="b"} 0 1 _ _ 1 0 1`,
+			query:     `up[5m]`,
+			queryTime: time.Unix(200, 0),
 		},
 		{
-			name: "unary add operation for vector",
+			name: "bare range selector with offset",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `+http_requests_total`,
+				up{job="api", instance="a"} 1+1x20
+				up{job="api", instance="b"} 0 1 _ _ 1 0 1`,
+			query: `up[1m] offset 30s`,
 		},
 		{
-			name: "vector positive offset",
+			name: "bare range selector with @",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `http_requests_total offset 30s`,
+				up{job="api", instance="a"} 1+1x20
+				up{job="api", instance="b"} 0 1 _ _ 1 0 1`,
+			query: `up[2m] @ 120`,
 		},
 		{
-			name: "vector negative offset",
+			name: "bare range selector without samples in range",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `http_requests_total offset -30s`,
+				up{job="api", instance="a"} 1+1x20
+				up{job="api", instance="b"} 0 1`,
+			query: `up{instance="b"}[1m] offset 1m`,
 		},
 		{
-			name: "matrix negative offset with sum_over_time",
+			name: "label_replace renaming a metric",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x25
-						http_requests_total{pod="nginx-2"} 1+2x28`,
-			query: `sum_over_time(http_requests_total[5m] offset 5m)`,
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total, "__name__", "http_requests", "", "")`,
 		},
 		{
-			name: "matrix negative offset with count_over_time",
+			name: "label_replace renaming a metric with a captured value",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `count_over_time(http_requests_total[5m] offset -2m)`,
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total, "__name__", "requests_$1", "pod", "nginx-(.*)")`,
 		},
 		{
-			name: "@ vector time 10s",
+			name: "label_replace with renamed metric in aggregation",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 10",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum by (__name__) (label_replace(http_requests_total, "__name__", "http_requests", "", ""))`,
 		},
 		{
-			name: "@ vector time 120s",
+			name: "label_replace with non-matching regex",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 120",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total{pod="nginx-1"}, "instance", "$1", "pod", "apache-(.*)") or label_replace(http_requests_total{pod="nginx-2"}, "instance", "$1", "pod", "nginx-(.*)")`,
 		},
 		{
-			name: "@ vector time 360s",
+			name: "label_replace modifying the source label in place",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 360",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `label_replace(http_requests_total, "pod", "$1-suffix", "pod", "(.*)")`,
 		},
 		{
-			name: "@ vector start",
+			name: "label_replace modifying the source label in place with aggregation",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ start()",
+				http_requests_total{pod="nginx-1", ns="a"} 1+1x15
+				http_requests_total{pod="nginx-2", ns="b"} 1+2x18`,
+			query: `sum by (pod) (label_replace(http_requests_total, "pod", "$2-$1", "pod", "(.*)-(.*)"))`,
 		},
 		{
-			name: "@ vector end",
+			name: "absent for nonexistent metric",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ end()",
+				http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent(nonexistent{job="foo", pod=~"nginx-.*"})`,
 		},
 		{
-			name: "count_over_time @ start",
+			name: "absent for existing metric",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "count_over_time(http_requests_total[5m] @ start())",
+				http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent(http_requests_total{pod="nginx-1"})`,
 		},
 		{
-			name: "sum_over_time @ end",
+			name: "absent over or-joined selectors",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum_over_time(http_requests_total[5m] @ start())",
+				http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: `absent(nonexistent{job="x"} or nonexistent{job="y"})`,
 		},
 		{
-			name: "avg_over_time @ 180s",
+			name: "absent over or-joined selectors with gaps",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "avg_over_time(http_requests_total[4m] @ 180)",
+				http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ _ _ _ _ _ _ 2
+				http_requests_total{pod="nginx-2"} 1+1x5`,
+			query: `absent(http_requests_total{pod="nginx-1"} or http_requests_total{pod="nginx-2"})`,
 		},
 		{
-			name: "@ vector 240s offset 2m",
+			name: "max_over_time over subquery of rate",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 240 offset 2m",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `max_over_time(rate(http_requests_total[1m])[2m:30s])`,
 		},
 		{
-			name: "avg_over_time @ 120s offset -2m",
+			name: "avg_over_time over subquery with unaligned step",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "http_requests_total @ 120 offset -2m",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `avg_over_time(http_requests_total[3m:45s])`,
 		},
 		{
-			name: "sum_over_time @ 180s offset 2m",
+			name: "sum_over_time over subquery with offset",
 			load: `load 30s
-						http_requests_total{pod="nginx-1"} 1+1x15
-						http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: "sum_over_time(http_requests_total[5m] @ 180 offset 2m)",
+				http_requests_total{pod="nginx-1"} 1+1x15
+				http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `sum_over_time(sum by (pod) (http_requests_total)[5m:1m] offset 1m)`,
 		},
-		// Result is correct but this likely fails due to https://github.com/golang/go/issues/12025.
-		// TODO(saswatamcode): Test NaN cases separately. https://github.com/thanos-community/promql-engine/issues/88
-		// {
-		// 	name: "scalar func with NaN",
-		// 	load: `load 30s
-		//  	http_requests_total{pod="nginx-1"} 1+1x15
-		//  	http_requests_total{pod="nginx-2"} 1+2x18`,
-		// 	query: `scalar(http_requests_total)`,
-		// },
 		{
-			name: "scalar func with aggr",
+			name: "last_over_time over subquery",
 			load: `load 30s
 				http_requests_total{pod="nginx-1"} 1+1x15
 				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `scalar(max(http_requests_total))`,
+			query: `last_over_time(http_requests_total[2m:20s])`,
 		},
 		{
-			name: "scalar func with number",
+			name: "nested subqueries",
 			load: `load 30s
 				http_requests_total{pod="nginx-1"} 1+1x15
 				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `scalar(max(http_requests_total)) + 10`,
+			query: `max_over_time(min_over_time(http_requests_total[1m:15s])[3m:1m])`,
+		},
+		{
+			name: "abs",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} -5+1x15
+				http_requests_total{pod="nginx-2"} 1-2x18`,
+			query: `abs(http_requests_total)`,
 		},
 		{
-			name: "clamp",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(http_requests_total, 5, 10)`,
+			name: "sgn",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} -5+1x15
+				http_requests_total{pod="nginx-2"} 0 -0 0 -0 0
+				http_requests_total{pod="nginx-3"} 1-2x18`,
+			query: `sgn(http_requests_total)`,
+		},
+	}
+
+	disableOptimizers := []bool{true, false}
+	lookbackDeltas := []time.Duration{30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute}
+	for _, withoutOptimizers := range disableOptimizers {
+		t.Run(fmt.Sprintf("disableOptimizers=%t", withoutOptimizers), func(t *testing.T) {
+			for _, lookbackDelta := range lookbackDeltas {
+				opts.LookbackDelta = lookbackDelta
+				for _, tc := range cases {
+					t.Run(tc.name, func(t *testing.T) {
+						test, err := promql.NewTest(t, tc.load)
+						testutil.Ok(t, err)
+						defer test.Close()
+
+						testutil.Ok(t, test.Run())
+
+						for _, disableFallback := range []bool{false, true} {
+							t.Run(fmt.Sprintf("disableFallback=%v", disableFallback), func(t *testing.T) {
+								var queryTime time.Time = defaultQueryTime
+								if tc.queryTime != (time.Time{}) {
+									queryTime = tc.queryTime
+								}
+
+								newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: disableFallback})
+								q1, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
+								testutil.Ok(t, err)
+								defer q1.Close()
+
+								newResult := q1.Exec(context.Background())
+								testutil.Ok(t, newResult.Err)
+
+								oldEngine := promql.NewEngine(opts)
+								q2, err := oldEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
+								testutil.Ok(t, err)
+								defer q2.Close()
+
+								oldResult := q2.Exec(context.Background())
+								testutil.Ok(t, oldResult.Err)
+
+								assertResultsAlmostEqual(t, oldResult, newResult, comparisonEpsilon)
+							})
+						}
+					})
+				}
+			}
+		})
+	}
+}
+
+func TestSeriesIterator(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1", series="1"} 1+1x15
+			http_requests_total{pod="nginx-2", series="2"} 1+2x18
+			http_requests_total{pod="nginx-3", series="3"} 1+3x4
+			http_requests_total{pod="nginx-4", series="4"} _ _ _ _ _ _ 1+4x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	start := time.Unix(0, 0)
+	end := time.Unix(600, 0)
+	step := 30 * time.Second
+	// Range queries are evaluated in batches of 10 steps by default.
+	batchDuration := 10 * step.Milliseconds()
+	for _, query := range []string{
+		"http_requests_total",
+		"sum by (pod) (http_requests_total)",
+		"rate(http_requests_total[1m])",
+		"http_requests_total > 10",
+		"scalar(sum(http_requests_total))",
+	} {
+		t.Run(query, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			newEngine := engine.New(engine.Opts{DisableFallback: true})
+			q1, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			expected := q1.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			q2, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+
+			// Series are yielded once for every batch of steps, so fragments of series with the same labels are merged.
+			it := q2.(engine.SeriesIterable).SeriesIterator()
+			result := promql.Matrix{}
+			indexes := make(map[string]int)
+			var fragments int
+			for it.Next(ctx) {
+				s := it.At()
+				fragments++
+				testutil.Assert(t, len(s.Points) > 0, "fragment of %s has no points", s.Metric)
+				first, last := s.Points[0].T, s.Points[len(s.Points)-1].T
+				testutil.Assert(t, first/batchDuration == last/batchDuration, "fragment of %s spans more than one batch of steps", s.Metric)
+
+				i, ok := indexes[s.Metric.String()]
+				if !ok {
+					i = len(result)
+					indexes[s.Metric.String()] = i
+					result = append(result, promql.Series{Metric: s.Metric})
+				} else {
+					previous := result[i].Points[len(result[i].Points)-1].T
+					testutil.Assert(t, first/batchDuration > previous/batchDuration, "fragments of %s are not yielded in the order of their batches", s.Metric)
+				}
+				result[i].Points = append(result[i].Points, s.Points...)
+			}
+			testutil.Ok(t, it.Err())
+			sort.Sort(result)
+
+			testutil.Equals(t, expected.Value, result)
+			// The query has more steps than a single batch, so at least one series is split into fragments.
+			testutil.Assert(t, fragments > len(result), "no series was split into fragments")
+		})
+	}
+
+	t.Run("close before last series", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		newEngine := engine.New(engine.Opts{DisableFallback: true})
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, "http_requests_total", start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		it := q.(engine.SeriesIterable).SeriesIterator()
+		testutil.Assert(t, it.Next(ctx), "expected a series")
+		it.Close()
+		testutil.Assert(t, !it.Next(ctx), "expected no series after close")
+		testutil.Ok(t, it.Err())
+	})
+}
+
+func TestKeepMetricNames(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, qs := range []string{
+		"http_requests_total * 2",
+		"2 * http_requests_total",
+		"-http_requests_total",
+		"abs(http_requests_total)",
+		"rate(http_requests_total[1m])",
+		"http_requests_total / on (pod) http_requests_total",
+		"http_requests_total / ignoring (pod) group_left sum(http_requests_total)",
+	} {
+		for _, keepMetricNames := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/keepMetricNames=%v", qs, keepMetricNames), func(t *testing.T) {
+				newEngine := engine.New(engine.Opts{DisableFallback: true, KeepMetricNames: keepMetricNames})
+				q, err := newEngine.NewInstantQuery(test.Storage(), nil, qs, time.Unix(60, 0))
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+
+				vector, err := result.Vector()
+				testutil.Ok(t, err)
+				testutil.Assert(t, len(vector) > 0, "expected non-empty result")
+				for _, sample := range vector {
+					testutil.Equals(t, keepMetricNames, sample.Metric.Has(labels.MetricName))
+				}
+			})
+		}
+	}
+}
+
+func TestHoltWintersWithNaNInWindow(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1 2 NaN 4 5 6 7 8 9 10 11 12
+			http_requests_total{pod="nginx-2"} NaN 2 3 4 5 6 7 8 9 10 11 12
+			http_requests_total{pod="nginx-3"} 1 2 3 4 5 6 7 8 9 10 11 NaN`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	query := `holt_winters(http_requests_total[2m], 0.5, 0.3)`
+	start, end, step := time.Unix(0, 0), time.Unix(400, 0), 30*time.Second
+
+	oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10})
+	q1, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer q1.Close()
+	expected, err := q1.Exec(context.Background()).Matrix()
+	testutil.Ok(t, err)
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	q2, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer q2.Close()
+	result, err := q2.Exec(context.Background()).Matrix()
+	testutil.Ok(t, err)
+
+	// NaN samples make every result whose window contains them NaN, which
+	// is why results can not be compared with testutil.Equals.
+	var numNaN int
+	testutil.Equals(t, len(expected), len(result))
+	for i := range expected {
+		testutil.Equals(t, expected[i].Metric, result[i].Metric)
+		testutil.Equals(t, len(expected[i].Points), len(result[i].Points))
+		for j, p := range expected[i].Points {
+			testutil.Equals(t, p.T, result[i].Points[j].T)
+			if math.IsNaN(p.V) {
+				testutil.Assert(t, math.IsNaN(result[i].Points[j].V), "expected NaN at %d for %s, got %v", p.T, expected[i].Metric, result[i].Points[j].V)
+				numNaN++
+				continue
+			}
+			testutil.Equals(t, p.V, result[i].Points[j].V)
+		}
+	}
+	testutil.Assert(t, numNaN > 0, "expected results with NaN")
+}
+
+func TestDoubleExponentialSmoothing(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18
+			http_requests_total{pod="nginx-3"} 1 4 2 8 5 7 3 9 1 6`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	start, end, step := time.Unix(0, 0), time.Unix(400, 0), 30*time.Second
+	newEngine := engine.New(engine.Opts{DisableFallback: true, EnableExperimentalFunctions: []string{"double_exponential_smoothing"}})
+	exec := func(query string) promql.Matrix {
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		result, err := q.Exec(context.Background()).Matrix()
+		testutil.Ok(t, err)
+		return result
+	}
+
+	// double_exponential_smoothing is the new name of holt_winters.
+	expected := exec(`holt_winters(http_requests_total[2m], 0.5, 0.3)`)
+	testutil.Assert(t, len(expected) > 0, "expected non-empty result")
+	testutil.Equals(t, expected, exec(`double_exponential_smoothing(http_requests_total[2m], 0.5, 0.3)`))
+
+	_, err = newEngine.NewRangeQuery(test.Storage(), nil, `double_exponential_smoothing(http_requests_total[2m], 1, 0.3)`, start, end, step)
+	testutil.NotOk(t, err)
+}
+func TestVectorOfScalarWithMultipleSeries(t *testing.T) {
+	// The second series is stale from 120s on, after which scalar returns the value of the first one.
+	load := `load 30s
+			up{job="a"} 1 2 3 4 5 6 7 8 9 10 11
+			up{job="b"} 1 1 1 1 stale`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	query := `vector(scalar(up))`
+	start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+
+	oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10})
+	q1, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer q1.Close()
+	expected, err := q1.Exec(context.Background()).Matrix()
+	testutil.Ok(t, err)
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true})
+	q2, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+	testutil.Ok(t, err)
+	defer q2.Close()
+	result, err := q2.Exec(context.Background()).Matrix()
+	testutil.Ok(t, err)
+
+	// Steps at which up has two series return NaN, which can not be compared with testutil.Equals.
+	testutil.Equals(t, 1, len(expected))
+	testutil.Equals(t, 1, len(result))
+	testutil.Equals(t, labels.Labels{}, result[0].Metric)
+	testutil.Equals(t, len(expected[0].Points), len(result[0].Points))
+	for i, p := range expected[0].Points {
+		testutil.Equals(t, p.T, result[0].Points[i].T)
+		if p.T < 120000 {
+			testutil.Assert(t, math.IsNaN(p.V), "expected NaN at %d from prometheus, got %v", p.T, p.V)
+			testutil.Assert(t, math.IsNaN(result[0].Points[i].V), "expected NaN at %d, got %v", p.T, result[0].Points[i].V)
+			continue
+		}
+		testutil.Equals(t, p.V, result[0].Points[i].V)
+	}
+
+	q3, err := newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(60, 0))
+	testutil.Ok(t, err)
+	defer q3.Close()
+	vector, err := q3.Exec(context.Background()).Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(vector))
+	testutil.Equals(t, labels.Labels{}, vector[0].Metric)
+	testutil.Assert(t, math.IsNaN(vector[0].V), "expected NaN, got %v", vector[0].V)
+}
+
+func TestSortWithNaN(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 3
+			http_requests_total{pod="nginx-2"} NaN
+			http_requests_total{pod="nginx-3"} -1
+			http_requests_total{pod="nginx-4"} 10
+			http_requests_total{pod="nginx-5"} NaN
+			http_requests_total{pod="nginx-6"} 0`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, query := range []string{
+		"sort(http_requests_total)",
+		"sort_desc(http_requests_total)",
+		"(sort(http_requests_total))",
+		"sort(-http_requests_total)",
+		"sort_desc(http_requests_total * 2)",
+	} {
+		t.Run(query, func(t *testing.T) {
+			oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10})
+			q1, err := oldEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q1.Close()
+			expected, err := q1.Exec(context.Background()).Vector()
+			testutil.Ok(t, err)
+
+			newEngine := engine.New(engine.Opts{DisableFallback: true})
+			q2, err := newEngine.NewInstantQuery(test.Storage(), nil, query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q2.Close()
+			result, err := q2.Exec(context.Background()).Vector()
+			testutil.Ok(t, err)
+
+			// NaN values can not be compared with testutil.Equals.
+			testutil.Equals(t, len(expected), len(result))
+			for i := range expected {
+				testutil.Equals(t, expected[i].Metric, result[i].Metric)
+				if math.IsNaN(expected[i].V) {
+					testutil.Assert(t, math.IsNaN(result[i].V), "expected NaN for %s, got %v", result[i].Metric, result[i].V)
+					continue
+				}
+				testutil.Equals(t, expected[i].Point, result[i].Point)
+			}
+			// NaN values are sorted last in both orders.
+			testutil.Assert(t, math.IsNaN(result[len(result)-1].V) && math.IsNaN(result[len(result)-2].V), "NaN values are not sorted last")
+		})
+	}
+}
+
+func TestSortByLabel(t *testing.T) {
+	load := `load 30s
+			http_requests_total{instance="b", job="api"} 1
+			http_requests_total{instance="a", job="web"} 2
+			http_requests_total{instance="b", job="db"} 3
+			http_requests_total{job="api"} 4
+			http_requests_total{instance="a", job="api"} 5`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{
+		DisableFallback:             true,
+		EnableExperimentalFunctions: []string{"sort_by_label", "sort_by_label_desc"},
+	})
+	for _, tcase := range []struct {
+		query    string
+		expected []float64
+	}{
+		// Series without an instance label are sorted first.
+		{query: `sort_by_label(http_requests_total, "instance", "job")`, expected: []float64{4, 5, 2, 1, 3}},
+		{query: `sort_by_label_desc(http_requests_total, "instance", "job")`, expected: []float64{3, 1, 2, 5, 4}},
+		// Series with equal values for all labels are sorted by their label sets.
+		{query: `sort_by_label(http_requests_total, "job")`, expected: []float64{5, 1, 4, 3, 2}},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+			result, err := q.Exec(context.Background()).Vector()
+			testutil.Ok(t, err)
+
+			values := make([]float64, 0, len(result))
+			for _, s := range result {
+				values = append(values, s.V)
+			}
+			testutil.Equals(t, tcase.expected, values)
+		})
+	}
+
+	t.Run("range query", func(t *testing.T) {
+		q1, err := newEngine.NewRangeQuery(test.Storage(), nil, `sort_by_label_desc(http_requests_total, "instance")`, time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer q1.Close()
+		result := q1.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+
+		q2, err := newEngine.NewRangeQuery(test.Storage(), nil, "http_requests_total", time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer q2.Close()
+		expected := q2.Exec(context.Background())
+		testutil.Ok(t, expected.Err)
+
+		// Same as sort, sorting by labels does not change the result of range queries.
+		testutil.Equals(t, expected.Value, result.Value)
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		_, err := engine.New(engine.Opts{DisableFallback: true}).NewInstantQuery(test.Storage(), nil, `sort_by_label(http_requests_total, "job")`, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, errors.Is(err, parse.ErrExperimentalFunction), "unexpected error %v", err)
+	})
+}
+
+func TestLimitFunctions(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x10
+			http_requests_total{pod="nginx-2"} _ _ 1+2x8
+			http_requests_total{pod="nginx-3"} 1+3x10
+			http_requests_total{pod="nginx-4"} 1+4x10
+			http_requests_total{pod="nginx-5"} 1+5x10
+			http_requests_total{pod="nginx-6"} 1+6x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{
+		DisableFallback:             true,
+		EnableExperimentalFunctions: []string{"limitk", "limit_ratio"},
+	})
+	start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+	execRange := func(t *testing.T, qs string) (promql.Matrix, storage.Warnings) {
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		result := q.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		return result.Value.(promql.Matrix), result.Warnings
+	}
+	all, _ := execRange(t, "http_requests_total")
+
+	t.Run("limitk", func(t *testing.T) {
+		// The first series by labels are kept in every step, nginx-2 only has samples in later steps.
+		result, _ := execRange(t, "limitk(2, http_requests_total)")
+		expected := promql.Matrix{
+			all[0],
+			all[1],
+			{Metric: all[2].Metric, Points: all[2].Points[:2]},
+		}
+		testutil.Equals(t, expected, result)
+	})
+
+	t.Run("limit_ratio", func(t *testing.T) {
+		// Series are selected by the hashes of their labels, same as in Prometheus.
+		var expected, complement promql.Matrix
+		for _, s := range all {
+			if float64(s.Metric.Hash())/float64(math.MaxUint64) < 0.5 {
+				expected = append(expected, s)
+			} else {
+				complement = append(complement, s)
+			}
+		}
+		result, _ := execRange(t, "limit_ratio(0.5, http_requests_total)")
+		testutil.Equals(t, expected, result)
+		result, _ = execRange(t, "limit_ratio(-0.5, http_requests_total)")
+		testutil.Equals(t, complement, result)
+
+		result, warns := execRange(t, "limit_ratio(2, http_requests_total)")
+		testutil.Equals(t, all, result)
+		testutil.Equals(t, 1, len(warns))
+	})
+}
+
+func TestInfoFunction(t *testing.T) {
+	load := `load 30s
+			http_requests_total{instance="a:80", job="api"} 1+1x10
+			http_requests_total{instance="b:80", job="api"} 1+2x10
+			http_requests_total{instance="c:80", job="api"} 1+3x10
+			target_info{instance="a:80", job="api", k8s_cluster="east", version="1"} 1x10
+			target_info{instance="b:80", job="api", k8s_cluster="west"} _ _ _ _ _ 1x5
+			build_info{instance="a:80", job="api", version="2.0"} 1x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	newEngine := engine.New(engine.Opts{DisableFallback: true, EnableExperimentalFunctions: []string{"info"}})
+	sample := func(v float64, t int64, lbls ...string) promql.Sample {
+		return promql.Sample{Metric: labels.FromStrings(append([]string{labels.MetricName, "http_requests_total", "job", "api"}, lbls...)...), Point: promql.Point{T: t, V: v}}
+	}
+	for _, tcase := range []struct {
+		query    string
+		ts       int64
+		expected promql.Vector
+	}{
+		{
+			query: "info(http_requests_total)",
+			expected: promql.Vector{
+				sample(1, 0, "instance", "a:80", "k8s_cluster", "east", "version", "1"),
+				sample(1, 0, "instance", "b:80"),
+				sample(1, 0, "instance", "c:80"),
+			},
 		},
 		{
-			name: "clamp_min",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, 10)`,
+			// Data labels are added once the info series starts.
+			query: "info(http_requests_total)",
+			ts:    200000,
+			expected: promql.Vector{
+				sample(7, 200000, "instance", "a:80", "k8s_cluster", "east", "version", "1"),
+				sample(13, 200000, "instance", "b:80", "k8s_cluster", "west"),
+				sample(19, 200000, "instance", "c:80"),
+			},
 		},
 		{
-			name: "complex func query",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(1 - http_requests_total, 10 - 5, 10)`,
+			// Only the selected data labels are added, and series without them are dropped.
+			query: `info(http_requests_total, {k8s_cluster=~".+"})`,
+			expected: promql.Vector{
+				sample(1, 0, "instance", "a:80", "k8s_cluster", "east"),
+			},
 		},
 		{
-			name: "func within func query",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(irate(http_requests_total[30s]), 10 - 5, 10)`,
+			query: `info(http_requests_total, {__name__="build_info"})`,
+			expected: promql.Vector{
+				sample(1, 0, "instance", "a:80", "version", "2.0"),
+				sample(1, 0, "instance", "b:80"),
+				sample(1, 0, "instance", "c:80"),
+			},
 		},
+	} {
+		t.Run(fmt.Sprintf("%s@%d", tcase.query, tcase.ts), func(t *testing.T) {
+			q, err := newEngine.NewInstantQuery(test.Storage(), nil, tcase.query, time.UnixMilli(tcase.ts))
+			testutil.Ok(t, err)
+			defer q.Close()
+			result, err := q.Exec(context.Background()).Vector()
+			testutil.Ok(t, err)
+			sort.Slice(result, func(i, j int) bool { return labels.Compare(result[i].Metric, result[j].Metric) < 0 })
+			testutil.Equals(t, tcase.expected, result)
+		})
+	}
+
+	t.Run("range query", func(t *testing.T) {
+		q, err := newEngine.NewRangeQuery(test.Storage(), nil, "info(http_requests_total)", time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer q.Close()
+		result := q.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+
+		// The series of instance b is split at the step in which its info series starts.
+		var series []string
+		for _, s := range result.Value.(promql.Matrix) {
+			series = append(series, fmt.Sprintf("%s %d-%d", s.Metric.Get("k8s_cluster"), s.Points[0].T, s.Points[len(s.Points)-1].T))
+		}
+		testutil.Equals(t, []string{"east 0-300000", " 0-120000", "west 150000-300000", " 0-300000"}, series)
+	})
+}
+
+func TestBinaryOperationMatchingErrors(t *testing.T) {
+	load := `load 30s
+			foo{job="a", pod="nginx-1"} 1+1x10
+			foo{job="b", pod="nginx-2"} 1+2x10
+			bar{job="a", pod="nginx-1"} 1+3x10
+			bar{job="a", pod="nginx-2"} 1+4x10
+			bar{job="b", pod="nginx-3"} 1+5x10
+			baz{job="a", pod="nginx-1"} 1+1x4 stale
+			baz{job="a", pod="nginx-2"} _x5 1+1x5`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		query       string
+		expectedErr string
+	}{
 		{
-			name: "aggr within func query",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp(rate(http_requests_total[30s]), 10 - 5, 10)`,
+			query:       `foo * on (job) bar`,
+			expectedErr: `found duplicate series for the match group {job="a"} on the right hand-side of the operation: [{__name__="bar", job="a", pod="nginx-2"}, {__name__="bar", job="a", pod="nginx-1"}];many-to-many matching not allowed: matching labels must be unique on one side`,
 		},
 		{
-			name: "func with scalar arg that selects storage",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)))`,
+			query:       `bar * on (job) group_right foo`,
+			expectedErr: `found duplicate series for the match group {job="a"} on the left hand-side of the operation: [{__name__="bar", job="a", pod="nginx-2"}, {__name__="bar", job="a", pod="nginx-1"}];many-to-many matching not allowed: matching labels must be unique on one side`,
 		},
 		{
-			name: "func with scalar arg that selects storage + number",
-			load: `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x15
-				http_requests_total{pod="nginx-2"} 1+2x18`,
-			query: `clamp_min(http_requests_total, scalar(max(http_requests_total)) + 10)`,
+			query:       `bar * ignoring (pod) foo`,
+			expectedErr: `multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)`,
 		},
+		// Duplicate series which do not have samples at the same steps can be matched.
+		{query: `foo * on (job) baz`},
+		{query: `bar * on (job) group_left baz`},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+			oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10})
+			newEngine := engine.New(engine.Opts{DisableFallback: true})
+			for _, e := range []v1.QueryEngine{oldEngine, newEngine} {
+				for _, create := range []func() (promql.Query, error){
+					func() (promql.Query, error) {
+						return e.NewRangeQuery(test.Storage(), nil, tcase.query, start, end, step)
+					},
+					func() (promql.Query, error) {
+						return e.NewInstantQuery(test.Storage(), nil, tcase.query, time.Unix(60, 0))
+					},
+				} {
+					q, err := create()
+					testutil.Ok(t, err)
+					result := q.Exec(context.Background())
+					q.Close()
+					if tcase.expectedErr == "" {
+						testutil.Ok(t, result.Err)
+						continue
+					}
+					testutil.NotOk(t, result.Err)
+					// Prometheus reports duplicate series in the order in which they are returned from storage,
+					// which is the order in which series were created and is not deterministic for loaded series.
+					if e == oldEngine && result.Err.Error() == swapDuplicateSeries(tcase.expectedErr) {
+						continue
+					}
+					testutil.Equals(t, tcase.expectedErr, result.Err.Error())
+				}
+			}
+		})
 	}
+}
 
-	disableOptimizers := []bool{true, false}
-	lookbackDeltas := []time.Duration{30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute}
-	for _, withoutOptimizers := range disableOptimizers {
-		t.Run(fmt.Sprintf("disableOptimizers=%t", withoutOptimizers), func(t *testing.T) {
-			for _, lookbackDelta := range lookbackDeltas {
-				opts.LookbackDelta = lookbackDelta
-				for _, tc := range cases {
-					t.Run(tc.name, func(t *testing.T) {
-						test, err := promql.NewTest(t, tc.load)
-						testutil.Ok(t, err)
-						defer test.Close()
-
-						testutil.Ok(t, test.Run())
-
-						for _, disableFallback := range []bool{false, true} {
-							t.Run(fmt.Sprintf("disableFallback=%v", disableFallback), func(t *testing.T) {
-								var queryTime time.Time = defaultQueryTime
-								if tc.queryTime != (time.Time{}) {
-									queryTime = tc.queryTime
-								}
+// swapDuplicateSeries returns a duplicate series error with the two series in the opposite order.
+func swapDuplicateSeries(msg string) string {
+	start, end := strings.Index(msg, "[{"), strings.Index(msg, "}]")
+	if start < 0 || end < start {
+		return msg
+	}
+	series := strings.SplitN(msg[start+1:end+1], "}, {", 2)
+	if len(series) != 2 {
+		return msg
+	}
+	return msg[:start+1] + "{" + series[1] + ", " + series[0] + "}" + msg[end+1:]
+}
 
-								newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: disableFallback})
-								q1, err := newEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
-								testutil.Ok(t, err)
-								defer q1.Close()
+func TestSubqueryWithAtModifier(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20
+			http_requests_total{pod="nginx-2"} 1+3x20`
 
-								newResult := q1.Exec(context.Background())
-								testutil.Ok(t, newResult.Err)
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
 
-								oldEngine := promql.NewEngine(opts)
-								q2, err := oldEngine.NewInstantQuery(test.Storage(), nil, tc.query, queryTime)
-								testutil.Ok(t, err)
-								defer q2.Close()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableAtModifier: true, NoStepSubqueryIntervalFn: func(int64) int64 { return 30000 }}
+	oldEngine := promql.NewEngine(opts)
+	newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
+	for _, qs := range []string{
+		"sum_over_time(http_requests_total[2m:30s] @ 300)",
+		"rate(http_requests_total[2m:15s] @ 300 offset 1m)",
+		"max_over_time(sum(http_requests_total)[5m:1m] @ end())",
+		"sum_over_time(rate(http_requests_total[1m])[5m:] @ 200)",
+		"sum_over_time(rate(http_requests_total[1m] offset 30s)[5m:30s] @ 200 offset 1m)",
+		"max_over_time(rate(http_requests_total[1m] @ 150)[3m:30s] @ 240 offset 30s)",
+		"avg_over_time((http_requests_total @ 100 offset 1m)[2m:15s] @ 400)",
+		"min_over_time(max_over_time(http_requests_total[2m:30s] @ 300)[4m:1m] @ 500)",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+			q, err := newEngine.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
 
-								oldResult := q2.Exec(context.Background())
-								testutil.Ok(t, oldResult.Err)
+			oldQ, err := oldEngine.NewRangeQuery(test.Storage(), nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer oldQ.Close()
+			testutil.Equals(t, oldQ.Exec(context.Background()).Value, result.Value)
 
-								testutil.Equals(t, oldResult, newResult)
-							})
-						}
-					})
+			// The subquery is evaluated at the same time for every step.
+			matrix, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Assert(t, len(matrix) > 0, "expected series in result")
+			for _, series := range matrix {
+				testutil.Equals(t, 21, len(series.Points))
+				for _, p := range series.Points {
+					testutil.Equals(t, series.Points[0].V, p.V)
 				}
 			}
 		})
 	}
 }
 
+func TestCountOverTimeWithEmptyWindow(t *testing.T) {
+	// The window of 1m at 150s does not contain any sample.
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1 _ _ _ _ _ _ 2`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	ng := engine.New(engine.Opts{DisableFallback: true})
+	q, err := ng.NewRangeQuery(test.Storage(), nil, `count_over_time(http_requests_total[1m])`, time.Unix(0, 0), time.Unix(210, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	result := q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+	matrix, err := result.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(matrix))
+
+	// Empty windows produce no samples instead of a count of 0.
+	expected := []promql.Point{{T: 0, V: 1}, {T: 30000, V: 1}, {T: 60000, V: 1}, {T: 210000, V: 1}}
+	testutil.Equals(t, expected, matrix[0].Points)
+
+	q, err = ng.NewInstantQuery(test.Storage(), nil, `count_over_time(http_requests_total[1m])`, time.Unix(150, 0))
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	result = q.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+	vector, err := result.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(vector))
+}
+
+func TestDisableRateExtrapolation(t *testing.T) {
+	// The range of 2m at 100s starts 20s before the first sample and ends 10s after the last one,
+	// which is why extrapolated results differ from the change between the samples.
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1 3 10 15`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		query           string
+		nonExtrapolated float64
+	}{
+		{query: "rate(http_requests_total[2m])", nonExtrapolated: 14.0 / 90},
+		{query: "increase(http_requests_total[2m])", nonExtrapolated: 14},
+		{query: "delta(http_requests_total[2m])", nonExtrapolated: 14},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			queryTime := time.Unix(100, 0)
+			extrapolated := instantValue(t, engine.New(engine.Opts{DisableFallback: true}), test.Storage(), tcase.query, queryTime)
+			expected := instantValue(t, promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}), test.Storage(), tcase.query, queryTime)
+			testutil.Equals(t, expected, extrapolated)
+
+			nonExtrapolated := instantValue(t, engine.New(engine.Opts{DisableFallback: true, DisableRateExtrapolation: true}), test.Storage(), tcase.query, queryTime)
+			testutil.Equals(t, tcase.nonExtrapolated, nonExtrapolated)
+			testutil.Assert(t, extrapolated != nonExtrapolated, "expected extrapolated result to differ from %v", nonExtrapolated)
+		})
+	}
+}
+
+// instantValue returns the value of the single sample returned by qs at ts.
+func instantValue(t *testing.T, ng v1.QueryEngine, q storage.Queryable, qs string, ts time.Time) float64 {
+	query, err := ng.NewInstantQuery(q, nil, qs, ts)
+	testutil.Ok(t, err)
+	defer query.Close()
+
+	result := query.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+	vector, err := result.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(vector))
+	return vector[0].V
+}
+
 func TestQueryCancellation(t *testing.T) {
 	twelveHours := int64(12 * time.Hour.Seconds())
 
@@ -1798,19 +4363,41 @@ func TestSelectHintsSetCorrectly(t *testing.T) {
 				{Start: 185000, End: 190000, Func: "count_over_time", Step: 1000},
 			},
 		}, {
-			query: "count_over_time((foo offset 10s)[2m:1s] @ 100 offset 10s)", start: 300000, end: 500000,
+			query: "count_over_time((foo offset 10s)[2m:1s] @ 100 offset 10s)", start: 300000, end: 500000,
+			expected: []*storage.SelectHints{
+				{Start: -45000, End: 80000, Func: "count_over_time", Step: 1000},
+			},
+		}, {
+			query: "sum by (dim1) (foo)", start: 10000,
+			expected: []*storage.SelectHints{
+				{Start: 5000, End: 10000, Func: "sum", By: true, Grouping: []string{"dim1"}},
+			},
+		}, {
+			query: "sum without (dim1) (foo)", start: 10000,
+			expected: []*storage.SelectHints{
+				{Start: 5000, End: 10000, Func: "sum", Grouping: []string{"dim1"}},
+			},
+		}, {
+			query: "sum by (dim1) (foo * bar)", start: 10000,
+			expected: []*storage.SelectHints{
+				{Start: 5000, End: 10000},
+				{Start: 5000, End: 10000},
+			},
+		}, {
+			query: "sum by (dim1) (foo * 2)", start: 10000,
 			expected: []*storage.SelectHints{
-				{Start: -45000, End: 80000, Func: "count_over_time", Step: 1000},
+				{Start: 5000, End: 10000},
 			},
 		}, {
-			query: "sum by (dim1) (foo)", start: 10000,
+			query: "sum by (dim1) (-(foo))", start: 10000,
 			expected: []*storage.SelectHints{
-				{Start: 5000, End: 10000, Func: "sum", By: true, Grouping: []string{"dim1"}},
+				{Start: 5000, End: 10000, Func: "sum"},
 			},
 		}, {
-			query: "sum without (dim1) (foo)", start: 10000,
+			query: "sum by (dim1) (foo or bar)", start: 10000,
 			expected: []*storage.SelectHints{
-				{Start: 5000, End: 10000, Func: "sum", Grouping: []string{"dim1"}},
+				{Start: 5000, End: 10000},
+				{Start: 5000, End: 10000},
 			},
 		}, {
 			query: "sum by (dim1) (avg_over_time(foo[1s]))", start: 10000,
@@ -1890,63 +4477,659 @@ func TestSelectHintsSetCorrectly(t *testing.T) {
 				EnableAtModifier: true,
 			}
 
-			ng := engine.New(engine.Opts{EngineOpts: opts})
-			hintsRecorder := &hintRecordingQuerier{}
-			queryable := &storage.MockQueryable{MockQuerier: hintsRecorder}
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			hintsRecorder := &hintRecordingQuerier{}
+			queryable := &storage.MockQueryable{MockQuerier: hintsRecorder}
+
+			var (
+				query promql.Query
+				err   error
+			)
+			if tc.end == 0 {
+				query, err = ng.NewInstantQuery(queryable, nil, tc.query, timestamp.Time(tc.start))
+			} else {
+				query, err = ng.NewRangeQuery(queryable, nil, tc.query, timestamp.Time(tc.start), timestamp.Time(tc.end), time.Second)
+			}
+			testutil.Ok(t, err)
+
+			res := query.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+
+			testutil.Equals(t, tc.expected, hintsRecorder.hints)
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	// TODO(fpetkovski): Update this expression once we add support for label_join.
+	query := `label_join(http_requests_total{pod="nginx-1"}, "label", "-", "pod")`
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x1
+				http_requests_total{pod="nginx-2"} 1+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+
+	testutil.Ok(t, test.Run())
+
+	for _, disableFallback := range []bool{true, false} {
+		t.Run(fmt.Sprintf("disableFallback=%t", disableFallback), func(t *testing.T) {
+			opts := promql.EngineOpts{
+				Timeout:    2 * time.Second,
+				MaxSamples: math.MaxInt64,
+			}
+			newEngine := engine.New(engine.Opts{DisableFallback: disableFallback, EngineOpts: opts})
+			q1, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+			if disableFallback {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+				newResult := q1.Exec(context.Background())
+				testutil.Ok(t, newResult.Err)
+			}
+		})
+	}
+}
+
+func TestSelectorIteratorsAreCreatedLazily(t *testing.T) {
+	// Selectors are split into GOMAXPROCS / 2 shards.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	// All series end in the first batch of steps, so each iterator is exhausted
+	// before the one of the next series in the same shard is created.
+	const numSeries = 50
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < numSeries; i++ {
+		load.WriteString(fmt.Sprintf("http_requests_total{pod=\"nginx-%d\"} %d+%dx2\n", i, i, i))
+	}
+	test, err := promql.NewTest(t, load.String())
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, qs := range []string{"http_requests_total", "rate(http_requests_total[1m])"} {
+		t.Run(qs, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			expr, err := parser.ParseExpr(qs)
+			testutil.Ok(t, err)
+
+			queryable := &iteratorCountingQueryable{Queryable: test.Storage()}
+			op, err := execution.New(expr, queryable, &query.Options{
+				Start:         time.Unix(0, 0),
+				End:           time.Unix(600, 0),
+				Step:          30 * time.Second,
+				LookbackDelta: time.Minute,
+				StepsBatch:    10,
+			})
+			testutil.Ok(t, err)
+
+			series, err := op.Series(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, numSeries, len(series))
+			testutil.Equals(t, int64(0), atomic.LoadInt64(&queryable.created))
+
+			for {
+				vectors, err := op.Next(ctx)
+				testutil.Ok(t, err)
+				if vectors == nil {
+					break
+				}
+			}
+			testutil.Equals(t, int64(numSeries), atomic.LoadInt64(&queryable.created))
+			// Each of the 4 shards has at most one live iterator at a time.
+			peak := atomic.LoadInt64(&queryable.peak)
+			testutil.Assert(t, peak <= 4, "peak number of live iterators is %d", peak)
+		})
+	}
+}
+
+func TestShardedSelectorsDoNotShareIterators(t *testing.T) {
+	// Selectors are split into GOMAXPROCS / 2 shards.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < 50; i++ {
+		load.WriteString(fmt.Sprintf("http_requests_total{pod=\"nginx-%d\"} %d+%dx40\n", i, i, i))
+	}
+	test, err := promql.NewTest(t, load.String())
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		query             string
+		expectedIterators int64
+	}{
+		{query: "http_requests_total", expectedIterators: 50},
+		{query: "rate(http_requests_total[1m])", expectedIterators: 50},
+		{query: "http_requests_total * on (pod) rate(http_requests_total[1m])", expectedIterators: 100},
+		// Both selectors read the same selected series, but each of them creates its own iterators.
+		{query: `sum(http_requests_total) / sum(http_requests_total{pod=~"nginx-1.*"})`, expectedIterators: 61},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			queryable := &iteratorCountingQueryable{Queryable: test.Storage()}
+			ng := engine.New(engine.Opts{DisableFallback: true})
+			q, err := ng.NewRangeQuery(queryable, nil, tcase.query, time.Unix(0, 0), time.Unix(1200, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			result := q.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+
+			// Each series has a single iterator, which is only used by the shard owning the series.
+			testutil.Equals(t, tcase.expectedIterators, atomic.LoadInt64(&queryable.created))
+			testutil.Equals(t, int64(0), atomic.LoadInt64(&queryable.concurrent))
+		})
+	}
+}
+
+func TestOperatorReset(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20
+			http_requests_total{pod="nginx-2"} 1+2x20
+			http_requests_total{pod="nginx-3"} 1+3x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, qs := range []string{
+		"http_requests_total",
+		"rate(http_requests_total[1m])",
+		"sum by (pod) (http_requests_total) * 2",
+		"http_requests_total / on (pod) http_requests_total offset 1m",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			expr, err := parser.ParseExpr(qs)
+			testutil.Ok(t, err)
+
+			op, err := execution.New(expr, test.Storage(), &query.Options{
+				Start:         time.Unix(0, 0),
+				End:           time.Unix(600, 0),
+				Step:          30 * time.Second,
+				LookbackDelta: 5 * time.Minute,
+			})
+			testutil.Ok(t, err)
+
+			drain := func() []model.StepVector {
+				var result []model.StepVector
+				for {
+					vectors, err := op.Next(ctx)
+					testutil.Ok(t, err)
+					if vectors == nil {
+						return result
+					}
+					for _, v := range vectors {
+						result = append(result, model.StepVector{
+							T:         v.T,
+							SampleIDs: append([]uint64{}, v.SampleIDs...),
+							Samples:   append([]float64{}, v.Samples...),
+						})
+						op.GetPool().PutStepVector(v)
+					}
+					op.GetPool().PutVectors(vectors)
+				}
+			}
+
+			first := drain()
+			testutil.Equals(t, 21, len(first))
+
+			op.Reset()
+			testutil.Equals(t, first, drain())
+		})
+	}
+}
+
+func TestEvaluationAtTimestamps(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x20
+			http_requests_total{pod="nginx-2"} 1+2x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expr, err := parser.ParseExpr("sum(http_requests_total)")
+	testutil.Ok(t, err)
+
+	op, err := execution.New(expr, test.Storage(), &query.Options{
+		Timestamps:    []int64{0, 90000, 400000},
+		LookbackDelta: 5 * time.Minute,
+	})
+	testutil.Ok(t, err)
+
+	var result []model.StepVector
+	for {
+		vectors, err := op.Next(ctx)
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		for _, v := range vectors {
+			result = append(result, model.StepVector{
+				T:         v.T,
+				SampleIDs: append([]uint64{}, v.SampleIDs...),
+				Samples:   append([]float64{}, v.Samples...),
+			})
+		}
+	}
+
+	expected := []model.StepVector{
+		{T: 0, SampleIDs: []uint64{0}, Samples: []float64{2}},
+		{T: 90000, SampleIDs: []uint64{0}, Samples: []float64{11}},
+		{T: 400000, SampleIDs: []uint64{0}, Samples: []float64{41}},
+	}
+	testutil.Equals(t, expected, result)
+
+	_, err = execution.New(expr, test.Storage(), &query.Options{Timestamps: []int64{0, 90000, 60000}})
+	testutil.NotOk(t, err)
+}
+
+func TestAbsentAtTimestamps(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x5`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expr, err := parser.ParseExpr(`absent(http_requests_total{pod="nginx-2"})`)
+	testutil.Ok(t, err)
+
+	op, err := execution.New(expr, test.Storage(), &query.Options{
+		Timestamps:    []int64{0, 7000, 250000},
+		LookbackDelta: 5 * time.Minute,
+	})
+	testutil.Ok(t, err)
+
+	var result []model.StepVector
+	for {
+		vectors, err := op.Next(ctx)
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		for _, v := range vectors {
+			result = append(result, model.StepVector{
+				T:         v.T,
+				SampleIDs: append([]uint64{}, v.SampleIDs...),
+				Samples:   append([]float64{}, v.Samples...),
+			})
+		}
+	}
+
+	expected := []model.StepVector{
+		{T: 0, SampleIDs: []uint64{0}, Samples: []float64{1}},
+		{T: 7000, SampleIDs: []uint64{0}, Samples: []float64{1}},
+		{T: 250000, SampleIDs: []uint64{0}, Samples: []float64{1}},
+	}
+	testutil.Equals(t, expected, result)
+}
+
+func TestBatchEvaluatorSharesSelectors(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x15
+			http_requests_total{pod="nginx-2"} 1+2x18`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	rules := []string{
+		`http_requests_total{pod="nginx-1"} * 2`,
+		`http_requests_total{pod="nginx-1"} + 1`,
+	}
+	ts := time.Unix(90, 0)
+	evaluator := engine.NewBatchEvaluator(engine.Opts{DisableFallback: true})
+	queryable := &selectCountingQueryable{Queryable: test.Storage()}
+	queries, err := evaluator.NewInstantQueries(queryable, nil, rules, ts)
+	testutil.Ok(t, err)
+	testutil.Equals(t, len(rules), len(queries))
+
+	for i, q := range queries {
+		result := q.Exec(context.Background())
+		testutil.Ok(t, result.Err)
+		q.Close()
+
+		expected, err := evaluator.NewInstantQuery(test.Storage(), nil, rules[i], ts)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected.Exec(context.Background()).Value, result.Value)
+		expected.Close()
+	}
+	testutil.Equals(t, int64(1), atomic.LoadInt64(&queryable.selects))
+}
+
+func TestExemplars(t *testing.T) {
+	exemplars, err := tsdb.NewCircularExemplarStorage(100, tsdb.NewExemplarMetrics(nil))
+	testutil.Ok(t, err)
+
+	nginx1 := labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-1")
+	nginx2 := labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-2")
+	for _, ts := range []int64{30000, 330000, 600000} {
+		for _, lbls := range []labels.Labels{nginx1, nginx2} {
+			testutil.Ok(t, exemplars.AddExemplar(lbls, exemplar.Exemplar{
+				Labels: labels.FromStrings("trace_id", fmt.Sprintf("%s-%d", lbls.Get("pod"), ts)),
+				Value:  1,
+				Ts:     ts,
+				HasTs:  true,
+			}))
+		}
+	}
+
+	traceIDs := func(results []exemplar.QueryResult) map[string][]string {
+		ids := make(map[string][]string)
+		for _, r := range results {
+			for _, e := range r.Exemplars {
+				ids[r.SeriesLabels.String()] = append(ids[r.SeriesLabels.String()], e.Labels.Get("trace_id"))
+			}
+		}
+		for _, v := range ids {
+			sort.Strings(v)
+		}
+		return ids
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		query    string
+		start    time.Time
+		end      time.Time
+		expected map[string][]string
+	}{
+		{
+			name:  "selector",
+			query: `http_requests_total{pod="nginx-1"}`,
+			start: time.Unix(400, 0),
+			end:   time.Unix(600, 0),
+			// The lookback delta extends the range to 100s.
+			expected: map[string][]string{
+				nginx1.String(): {"nginx-1-330000", "nginx-1-600000"},
+			},
+		},
+		{
+			name:  "range selector over both series",
+			query: `rate(http_requests_total[1m])`,
+			start: time.Unix(540, 0),
+			end:   time.Unix(600, 0),
+			expected: map[string][]string{
+				nginx1.String(): {"nginx-1-600000"},
+				nginx2.String(): {"nginx-2-600000"},
+			},
+		},
+		{
+			name:  "@ before start",
+			query: `http_requests_total{pod="nginx-2"} @ 60`,
+			start: time.Unix(500, 0),
+			end:   time.Unix(600, 0),
+			expected: map[string][]string{
+				nginx2.String(): {"nginx-2-30000"},
+			},
+		},
+		{
+			name:     "no matching series",
+			query:    `nonexistent`,
+			start:    time.Unix(0, 0),
+			end:      time.Unix(600, 0),
+			expected: map[string][]string{},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{LookbackDelta: 5 * time.Minute}})
+			querier, ok := ng.(engine.ExemplarQuerier)
+			testutil.Assert(t, ok)
+
+			results, err := querier.Exemplars(context.Background(), exemplars, tcase.query, tcase.start, tcase.end)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, traceIDs(results))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tcase := range []struct {
+		name            string
+		query           string
+		end             time.Time
+		disableFallback bool
+		expectedErr     error
+		expectErr       bool
+	}{
+		{
+			name:            "valid instant query",
+			query:           `sum by (pod) (rate(http_requests_total[1m]))`,
+			disableFallback: true,
+		},
+		{
+			name:            "valid range query",
+			query:           `http_requests_total / on (pod) group_left sum by (pod) (http_requests_total)`,
+			end:             time.Unix(600, 0),
+			disableFallback: true,
+		},
+		{
+			name:      "invalid syntax",
+			query:     `sum by (pod) (http_requests_total`,
+			expectErr: true,
+		},
+		{
+			name:      "range query with range vector",
+			query:     `http_requests_total[1m]`,
+			end:       time.Unix(600, 0),
+			expectErr: true,
+		},
+		{
+			name:            "unsupported function",
+			query:           `round(http_requests_total)`,
+			disableFallback: true,
+			expectedErr:     parse.ErrNotImplemented,
+		},
+		{
+			name:  "unsupported function with fallback",
+			query: `round(http_requests_total)`,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{DisableFallback: tcase.disableFallback})
+			validator, ok := ng.(engine.Validator)
+			testutil.Assert(t, ok)
+
+			// Validated queries are never evaluated, which is why there is no storage to select samples from.
+			err := validator.Validate(tcase.query, query.Options{Start: time.Unix(0, 0), End: tcase.end})
+			switch {
+			case tcase.expectedErr != nil:
+				testutil.Assert(t, errors.Is(err, tcase.expectedErr), "expected %v, got %v", tcase.expectedErr, err)
+			case tcase.expectErr:
+				testutil.NotOk(t, err)
+			default:
+				testutil.Ok(t, err)
+			}
+		})
+	}
+}
+
+func TestEstimateCardinality(t *testing.T) {
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&load, "high_card_metric{job=\"job-%d\", instance=\"%d\"} 1+1x20\n", i%5, i)
+	}
+	load.WriteString(`low_card_metric{job="job-0"} 1+1x20`)
+
+	test, err := promql.NewTest(t, load.String())
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		query    string
+		expected int
+	}{
+		{query: `sum by (job) (high_card_metric)`, expected: 5},
+		{query: `sum by (job, instance) (high_card_metric)`, expected: 100},
+		{query: `sum(high_card_metric)`, expected: 1},
+		{query: `high_card_metric{job="job-1"}`, expected: 20},
+		{query: `topk(2, high_card_metric)`, expected: 2},
+		{query: `topk by (job) (2, high_card_metric)`, expected: 10},
+		{query: `rate(high_card_metric[1m]) * 2`, expected: 100},
+		{query: `high_card_metric / on (job) group_left low_card_metric`, expected: 100},
+		{query: `max_over_time(sum by (job) (high_card_metric)[5m:30s])`, expected: 5},
+		{query: `nonexistent`, expected: 0},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{})
+			estimator, ok := ng.(engine.CardinalityEstimator)
+			testutil.Assert(t, ok)
+
+			estimate, err := estimator.EstimateCardinality(context.Background(), test.Storage(), tcase.query, time.Unix(0, 0), time.Unix(600, 0))
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, estimate)
+		})
+	}
+}
+
+// selectCountingQueryable counts the number of selects against storage.
+type selectCountingQueryable struct {
+	storage.Queryable
+	selects int64
+}
 
-			var (
-				query promql.Query
-				err   error
-			)
-			if tc.end == 0 {
-				query, err = ng.NewInstantQuery(queryable, nil, tc.query, timestamp.Time(tc.start))
-			} else {
-				query, err = ng.NewRangeQuery(queryable, nil, tc.query, timestamp.Time(tc.start), timestamp.Time(tc.end), time.Second)
-			}
-			testutil.Ok(t, err)
+func (q *selectCountingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &selectCountingQuerier{Querier: querier, counter: q}, nil
+}
 
-			res := query.Exec(context.Background())
-			testutil.Ok(t, res.Err)
+type selectCountingQuerier struct {
+	storage.Querier
+	counter *selectCountingQueryable
+}
 
-			testutil.Equals(t, tc.expected, hintsRecorder.hints)
-		})
+func (q *selectCountingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	atomic.AddInt64(&q.counter.selects, 1)
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+// iteratorCountingQueryable counts the number of iterators created
+// for selected series and keeps track of the peak number of live
+// iterators. An iterator is considered live until it is exhausted.
+// It also counts calls to iterators which happen while another
+// goroutine is using the same iterator.
+type iteratorCountingQueryable struct {
+	storage.Queryable
+
+	created    int64
+	live       int64
+	peak       int64
+	concurrent int64
+}
+
+func (q *iteratorCountingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
 	}
+	return &iteratorCountingQuerier{Querier: querier, counter: q}, nil
 }
 
-func TestFallback(t *testing.T) {
-	start := time.Unix(0, 0)
-	end := time.Unix(120, 0)
-	step := time.Second * 30
+func (q *iteratorCountingQueryable) onCreate() {
+	atomic.AddInt64(&q.created, 1)
+	live := atomic.AddInt64(&q.live, 1)
+	for {
+		peak := atomic.LoadInt64(&q.peak)
+		if live <= peak || atomic.CompareAndSwapInt64(&q.peak, peak, live) {
+			return
+		}
+	}
+}
 
-	// TODO(fpetkovski): Update this expression once we add support for sort_desc.
-	query := `sort_desc(http_requests_total{pod="nginx-1"})`
-	load := `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x1
-				http_requests_total{pod="nginx-2"} 1+2x40`
+type iteratorCountingQuerier struct {
+	storage.Querier
+	counter *iteratorCountingQueryable
+}
 
-	test, err := promql.NewTest(t, load)
-	testutil.Ok(t, err)
-	defer test.Close()
+func (q *iteratorCountingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &iteratorCountingSeriesSet{SeriesSet: q.Querier.Select(sortSeries, hints, matchers...), counter: q.counter}
+}
 
-	testutil.Ok(t, test.Run())
+type iteratorCountingSeriesSet struct {
+	storage.SeriesSet
+	counter *iteratorCountingQueryable
+}
 
-	for _, disableFallback := range []bool{true, false} {
-		t.Run(fmt.Sprintf("disableFallback=%t", disableFallback), func(t *testing.T) {
-			opts := promql.EngineOpts{
-				Timeout:    2 * time.Second,
-				MaxSamples: math.MaxInt64,
-			}
-			newEngine := engine.New(engine.Opts{DisableFallback: disableFallback, EngineOpts: opts})
-			q1, err := newEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
-			if disableFallback {
-				testutil.NotOk(t, err)
-			} else {
-				testutil.Ok(t, err)
-				newResult := q1.Exec(context.Background())
-				testutil.Ok(t, newResult.Err)
-			}
-		})
+func (s *iteratorCountingSeriesSet) At() storage.Series {
+	return &iteratorCountingSeries{Series: s.SeriesSet.At(), counter: s.counter}
+}
+
+type iteratorCountingSeries struct {
+	storage.Series
+	counter *iteratorCountingQueryable
+}
+
+func (s *iteratorCountingSeries) Iterator() chunkenc.Iterator {
+	s.counter.onCreate()
+	return &iteratorCountingIterator{Iterator: s.Series.Iterator(), counter: s.counter}
+}
+
+type iteratorCountingIterator struct {
+	chunkenc.Iterator
+	counter   *iteratorCountingQueryable
+	exhausted bool
+	inUse     int32
+}
+
+func (it *iteratorCountingIterator) Next() bool {
+	defer it.use()()
+	return it.track(it.Iterator.Next())
+}
+
+func (it *iteratorCountingIterator) Seek(t int64) bool {
+	defer it.use()()
+	return it.track(it.Iterator.Seek(t))
+}
+
+func (it *iteratorCountingIterator) At() (int64, float64) {
+	defer it.use()()
+	return it.Iterator.At()
+}
+
+// use marks the iterator as used until the returned function is called.
+func (it *iteratorCountingIterator) use() func() {
+	if !atomic.CompareAndSwapInt32(&it.inUse, 0, 1) {
+		atomic.AddInt64(&it.counter.concurrent, 1)
+		return func() {}
+	}
+	return func() { atomic.StoreInt32(&it.inUse, 0) }
+}
+
+func (it *iteratorCountingIterator) track(ok bool) bool {
+	if !ok && !it.exhausted {
+		it.exhausted = true
+		atomic.AddInt64(&it.counter.live, -1)
 	}
+	return ok
 }
 
 type testSeriesSet struct {
@@ -2023,3 +5206,497 @@ func TestEngineRecoversFromPanic(t *testing.T) {
 	})
 
 }
+
+func TestSlowQueryLogger(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x40
+			http_requests_total{pod="nginx-2"} 1+2x40`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		name      string
+		threshold time.Duration
+		logged    bool
+	}{
+		{name: "slow query", threshold: 10 * time.Millisecond, logged: true},
+		{name: "fast query", threshold: time.Hour},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var logs []map[string]interface{}
+			logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+				fields := make(map[string]interface{})
+				for i := 0; i < len(keyvals); i += 2 {
+					fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+				}
+				logs = append(logs, fields)
+				return nil
+			})
+			newEngine := engine.New(engine.Opts{DisableFallback: true, SlowQueryLogger: logger, SlowQueryThreshold: tcase.threshold})
+
+			queryable := &slowQueryable{Queryable: test.Storage(), delay: 20 * time.Millisecond}
+			q, err := newEngine.NewRangeQuery(queryable, nil, "sum(http_requests_total)", time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			testutil.Ok(t, q.Exec(context.Background()).Err)
+
+			if !tcase.logged {
+				testutil.Equals(t, 0, len(logs))
+				return
+			}
+			testutil.Equals(t, 1, len(logs))
+			testutil.Equals(t, "slow query", logs[0]["msg"])
+			testutil.Equals(t, "sum(http_requests_total)", logs[0]["query"])
+			testutil.Equals(t, 21, logs[0]["steps"])
+			testutil.Equals(t, 21, logs[0]["samples"])
+			testutil.Assert(t, logs[0]["duration"].(time.Duration) >= 20*time.Millisecond, "unexpected duration %v", logs[0]["duration"])
+			testutil.Assert(t, strings.Contains(logs[0]["plan"].(string), "[*aggregate] sum"), "unexpected plan %v", logs[0]["plan"])
+		})
+	}
+}
+
+// slowQueryable delays every select against storage.
+type slowQueryable struct {
+	storage.Queryable
+	delay time.Duration
+}
+
+func (q *slowQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQuerier{Querier: querier, delay: q.delay}, nil
+}
+
+type slowQuerier struct {
+	storage.Querier
+	delay time.Duration
+}
+
+func (q *slowQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	time.Sleep(q.delay)
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+func TestAggregationPushdown(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1", job="a"} 1+1x40
+			http_requests_total{pod="nginx-2", job="a"} 1+2x40
+			http_requests_total{pod="nginx-3", job="a"} 1+3x40
+			http_requests_total{pod="nginx-4", job="b"} 1+4x40
+			http_requests_total{pod="nginx-5", job="b"} 1+5x40 stale
+			http_requests_total{pod="nginx-6", job="c"} 1+6x20`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	for _, tcase := range []struct {
+		query      string
+		pushedDown bool
+	}{
+		{query: "sum by (job) (http_requests_total)", pushedDown: true},
+		{query: "max without (pod) (http_requests_total)", pushedDown: true},
+		{query: "min by (job) (http_requests_total)", pushedDown: true},
+		{query: "group by (job) (http_requests_total)", pushedDown: true},
+		{query: "count by (job) (http_requests_total)"},
+		{query: "avg by (job) (http_requests_total)"},
+		{query: "sum by (job) (http_requests_total offset 1m)"},
+		{query: "sum by (job) (rate(http_requests_total[1m]))"},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+			for _, run := range []func(e v1.QueryEngine, q storage.Queryable) (promql.Query, error){
+				func(e v1.QueryEngine, q storage.Queryable) (promql.Query, error) {
+					return e.NewRangeQuery(q, nil, tcase.query, start, end, step)
+				},
+				func(e v1.QueryEngine, q storage.Queryable) (promql.Query, error) {
+					return e.NewInstantQuery(q, nil, tcase.query, end)
+				},
+			} {
+				exec := func(opts engine.Opts, queryable storage.Queryable) *promql.Result {
+					q, err := run(engine.New(opts), queryable)
+					testutil.Ok(t, err)
+					defer q.Close()
+					result := q.Exec(context.Background())
+					testutil.Ok(t, result.Err)
+					// Samples of instant queries are not sorted.
+					if vector, ok := result.Value.(promql.Vector); ok {
+						sort.Slice(vector, func(i, j int) bool { return labels.Compare(vector[i].Metric, vector[j].Metric) < 0 })
+					}
+					return result
+				}
+
+				expected := exec(engine.Opts{DisableFallback: true}, test.Storage())
+				pushdown := &pushdownQueryable{Queryable: test.Storage(), numStores: 2}
+				result := exec(engine.Opts{DisableFallback: true, EnableAggregationPushdown: true}, pushdown)
+				testutil.Equals(t, expected.Value, result.Value)
+				testutil.Equals(t, tcase.pushedDown, atomic.LoadInt64(&pushdown.aggregatedSelects) > 0)
+			}
+		})
+	}
+}
+
+// pushdownQueryable partially aggregates series in storage with sum, min, max and group, as if
+// they were returned by numStores stores. Samples are aggregated at the steps of the query.
+type pushdownQueryable struct {
+	storage.Queryable
+	numStores         int
+	aggregatedSelects int64
+}
+
+func (q *pushdownQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &pushdownQuerier{Querier: querier, queryable: q}, nil
+}
+
+type pushdownQuerier struct {
+	storage.Querier
+	queryable *pushdownQueryable
+}
+
+func (q *pushdownQuerier) SelectAggregated(hints *storage.SelectHints, lookbackDelta int64, matchers ...*labels.Matcher) storage.SeriesSet {
+	atomic.AddInt64(&q.queryable.aggregatedSelects, 1)
+
+	var steps []int64
+	for ts := hints.Start + lookbackDelta; ts <= hints.End; ts += hints.Step {
+		steps = append(steps, ts)
+		if hints.Step == 0 {
+			break
+		}
+	}
+
+	type group struct {
+		labels labels.Labels
+		values []float64
+		exists []bool
+	}
+	groups := make(map[string]*group)
+	var series []storage.Series
+	addGroup := func(lbls labels.Labels, store int) *group {
+		key := fmt.Sprintf("%d/%s", store, lbls.String())
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: lbls, values: make([]float64, len(steps)), exists: make([]bool, len(steps))}
+			groups[key] = g
+		}
+		return g
+	}
+
+	set := q.Querier.Select(true, hints, matchers...)
+	for i := 0; set.Next(); i++ {
+		lb := labels.NewBuilder(set.At().Labels())
+		if hints.By {
+			lb.Keep(hints.Grouping...)
+		} else {
+			lb.Del(hints.Grouping...)
+			lb.Del(labels.MetricName)
+		}
+		g := addGroup(lb.Labels(nil), i%q.queryable.numStores)
+
+		var ts []int64
+		var vs []float64
+		it := set.At().Iterator()
+		for it.Next() {
+			t, v := it.At()
+			ts = append(ts, t)
+			vs = append(vs, v)
+		}
+		for j, step := range steps {
+			k := sort.Search(len(ts), func(k int) bool { return ts[k] > step }) - 1
+			if k < 0 || ts[k] <= step-lookbackDelta || value.IsStaleNaN(vs[k]) {
+				continue
+			}
+			v := vs[k]
+			switch {
+			case !g.exists[j]:
+				if hints.Func == "group" {
+					v = 1
+				}
+				g.values[j] = v
+			case hints.Func == "sum":
+				g.values[j] += v
+			case hints.Func == "max":
+				g.values[j] = math.Max(g.values[j], v)
+			case hints.Func == "min":
+				g.values[j] = math.Min(g.values[j], v)
+			}
+			g.exists[j] = true
+		}
+	}
+	if err := set.Err(); err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+
+	for _, g := range groups {
+		var samples []tsdbutil.Sample
+		for j, step := range steps {
+			if g.exists[j] {
+				samples = append(samples, pushdownSample{t: step, v: g.values[j]})
+			}
+		}
+		series = append(series, storage.NewListSeries(g.labels, samples))
+	}
+	return &pushdownSeriesSet{series: series, i: -1}
+}
+
+type pushdownSample struct {
+	t int64
+	v float64
+}
+
+func (s pushdownSample) T() int64   { return s.t }
+func (s pushdownSample) V() float64 { return s.v }
+
+type pushdownSeriesSet struct {
+	series []storage.Series
+	i      int
+}
+
+func (s *pushdownSeriesSet) Next() bool                 { s.i++; return s.i < len(s.series) }
+func (s *pushdownSeriesSet) At() storage.Series         { return s.series[s.i] }
+func (s *pushdownSeriesSet) Err() error                 { return nil }
+func (s *pushdownSeriesSet) Warnings() storage.Warnings { return nil }
+
+func TestResultCache(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1"} 1+1x60
+			http_requests_total{pod="nginx-2"} 1+2x30
+			http_requests_total{pod="nginx-3"} _x30 1+3x30`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	type timeRange struct{ start, end int64 }
+	for _, tcase := range []struct {
+		name  string
+		query string
+		// ranges are the time ranges of queries which are executed in order with the same cache, in seconds.
+		ranges []timeRange
+		// expectedSelects are the time ranges which are selected from storage by the last query, in seconds.
+		expectedSelects []timeRange
+	}{
+		{
+			name:            "no cached result",
+			ranges:          []timeRange{{start: 300, end: 900}},
+			expectedSelects: []timeRange{{start: 0, end: 900}},
+		},
+		{
+			name:   "same time range",
+			ranges: []timeRange{{start: 300, end: 900}, {start: 300, end: 900}},
+		},
+		{
+			name:            "shifted forward",
+			ranges:          []timeRange{{start: 300, end: 900}, {start: 600, end: 1200}},
+			expectedSelects: []timeRange{{start: 630, end: 1200}},
+		},
+		{
+			name:            "shifted backward",
+			ranges:          []timeRange{{start: 600, end: 1200}, {start: 300, end: 900}},
+			expectedSelects: []timeRange{{start: 0, end: 570}},
+		},
+		{
+			name:            "wider time range",
+			ranges:          []timeRange{{start: 600, end: 900}, {start: 300, end: 1200}},
+			expectedSelects: []timeRange{{start: 0, end: 570}, {start: 630, end: 1200}},
+		},
+		{
+			name:   "adjacent time range",
+			ranges: []timeRange{{start: 300, end: 600}, {start: 630, end: 900}, {start: 300, end: 900}},
+		},
+		{
+			name:            "steps at other timestamps",
+			ranges:          []timeRange{{start: 300, end: 900}, {start: 310, end: 910}},
+			expectedSelects: []timeRange{{start: 10, end: 910}},
+		},
+		{
+			name:            "shifted forward with @ end()",
+			query:           "sum(http_requests_total @ end())",
+			ranges:          []timeRange{{start: 300, end: 900}, {start: 600, end: 1200}},
+			expectedSelects: []timeRange{{start: 900, end: 1200}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			query := "sum(http_requests_total)"
+			if tcase.query != "" {
+				query = tcase.query
+			}
+			step := 30 * time.Second
+			cache := &mapResultCache{results: make(map[string]engine.CachedResult)}
+			newEngine := engine.New(engine.Opts{DisableFallback: true, ResultCache: cache})
+			oldEngine := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableAtModifier: true})
+
+			for i, r := range tcase.ranges {
+				queryable := &selectRecordingQueryable{Queryable: test.Storage()}
+				start, end := time.Unix(r.start, 0), time.Unix(r.end, 0)
+				q1, err := newEngine.NewRangeQuery(queryable, nil, query, start, end, step)
+				testutil.Ok(t, err)
+				result := q1.Exec(context.Background())
+				testutil.Ok(t, result.Err)
+				q1.Close()
+
+				q2, err := oldEngine.NewRangeQuery(test.Storage(), nil, query, start, end, step)
+				testutil.Ok(t, err)
+				expected := q2.Exec(context.Background())
+				testutil.Ok(t, expected.Err)
+				q2.Close()
+				testutil.Equals(t, expected.Value, result.Value)
+
+				if i == len(tcase.ranges)-1 {
+					var selects []timeRange
+					for _, h := range queryable.hints {
+						selects = append(selects, timeRange{start: h.Start / 1000, end: h.End / 1000})
+					}
+					sort.Slice(selects, func(i, j int) bool { return selects[i].start < selects[j].start })
+					testutil.Equals(t, tcase.expectedSelects, selects)
+				}
+			}
+		})
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+	load := `load 30s
+			http_requests_total{pod="nginx-1", ns="a"} 1+1x60
+			http_requests_total{pod="nginx-2", ns="b"} 1+2x60`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	start, end, step := time.Unix(300, 0), time.Unix(900, 0), 30*time.Second
+	for _, tcase := range []struct {
+		name           string
+		lookbackDelta  time.Duration
+		query          string
+		expectedSelect bool
+	}{
+		{
+			name:  "matchers in another order",
+			query: `sum(http_requests_total{ns=~"a|b", pod=~"nginx-.*"})`,
+		},
+		{
+			name:           "other lookback delta",
+			lookbackDelta:  time.Minute,
+			query:          `sum(http_requests_total{pod=~"nginx-.*", ns=~"a|b"})`,
+			expectedSelect: true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			// Engines share the cache, so that results are only reused if the keys of queries are the same.
+			cache := &mapResultCache{results: make(map[string]engine.CachedResult)}
+			first := engine.New(engine.Opts{DisableFallback: true, ResultCache: cache})
+			q, err := first.NewRangeQuery(test.Storage(), nil, `sum(http_requests_total{pod=~"nginx-.*", ns=~"a|b"})`, start, end, step)
+			testutil.Ok(t, err)
+			testutil.Ok(t, q.Exec(context.Background()).Err)
+			q.Close()
+
+			second := engine.New(engine.Opts{
+				EngineOpts:      promql.EngineOpts{LookbackDelta: tcase.lookbackDelta},
+				DisableFallback: true,
+				ResultCache:     cache,
+			})
+			queryable := &selectRecordingQueryable{Queryable: test.Storage()}
+			q, err = second.NewRangeQuery(queryable, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			testutil.Ok(t, q.Exec(context.Background()).Err)
+			q.Close()
+			testutil.Equals(t, tcase.expectedSelect, len(queryable.hints) > 0)
+		})
+	}
+}
+
+type mapResultCache struct {
+	mu      sync.Mutex
+	results map[string]engine.CachedResult
+}
+
+func (c *mapResultCache) Get(key string) (engine.CachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.results[key]
+	return result, ok
+}
+
+func (c *mapResultCache) Set(key string, result engine.CachedResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[key] = result
+}
+
+// selectRecordingQueryable records the hints of all selects against storage.
+type selectRecordingQueryable struct {
+	storage.Queryable
+	mu    sync.Mutex
+	hints []storage.SelectHints
+}
+
+func (q *selectRecordingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &selectRecordingQuerier{Querier: querier, queryable: q}, nil
+}
+
+type selectRecordingQuerier struct {
+	storage.Querier
+	queryable *selectRecordingQueryable
+}
+
+func (q *selectRecordingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	q.queryable.mu.Lock()
+	q.queryable.hints = append(q.queryable.hints, *hints)
+	q.queryable.mu.Unlock()
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+// unsortedLabelsQueryable returns series with labels in reverse order of their names.
+type unsortedLabelsQueryable struct {
+	storage.Queryable
+}
+
+func (q *unsortedLabelsQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &unsortedLabelsQuerier{Querier: querier}, nil
+}
+
+type unsortedLabelsQuerier struct {
+	storage.Querier
+}
+
+func (q *unsortedLabelsQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &unsortedLabelsSeriesSet{SeriesSet: q.Querier.Select(sortSeries, hints, matchers...)}
+}
+
+type unsortedLabelsSeriesSet struct {
+	storage.SeriesSet
+}
+
+func (s *unsortedLabelsSeriesSet) At() storage.Series {
+	return &unsortedLabelsSeries{Series: s.SeriesSet.At()}
+}
+
+type unsortedLabelsSeries struct {
+	storage.Series
+}
+
+func (s *unsortedLabelsSeries) Labels() labels.Labels {
+	lbls := s.Series.Labels().Copy()
+	sort.Sort(sort.Reverse(lbls))
+	return lbls
+}
@@ -60,6 +60,8 @@ func FuzzEngineQueryRangeMatrixFunctions(f *testing.F) {
 			query := fmt.Sprintf("%s(http_requests_total[%ds])", funcName, stepRange)
 			if funcName == "vector" {
 				query = fmt.Sprintf("vector(%d)", stepRange)
+			} else if parser.Functions[funcName].ArgTypes[0] == parser.ValueTypeVector {
+				query = fmt.Sprintf("%s(http_requests_total)", funcName)
 			}
 
 			newEngine := engine.New(engine.Opts{EngineOpts: opts, DisableFallback: true})
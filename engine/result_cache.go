@@ -0,0 +1,239 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/stats"
+
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// ResultCache stores the results of range queries. It needs to be safe for concurrent use.
+type ResultCache interface {
+	// Get returns the result which is cached for key, if any.
+	Get(key string) (CachedResult, bool)
+	// Set stores result for key, replacing the result which was cached for it before.
+	Set(key string, result CachedResult)
+}
+
+// CachedResult is the result of a range query which was evaluated at every step from Start to End.
+type CachedResult struct {
+	// Start and End are the timestamps of the first and the last step in milliseconds.
+	Start, End int64
+	Matrix     promql.Matrix
+}
+
+// resultCacheKey returns the key of results of the query qs evaluated with step. Results can only be
+// reused for queries which have the same step and whose steps are at the same timestamps, so the key
+// is created by logicalplan.CacheKey for the offset of the steps instead of the range of the query.
+func (e *compatibilityEngine) resultCacheKey(qs string, start time.Time, step time.Duration) (string, error) {
+	// The query is parsed again, since creating a plan modifies the expression.
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return "", err
+	}
+	alignment := time.UnixMilli(start.UnixMilli() % step.Milliseconds())
+	plan := logicalplan.New(expr, alignment, alignment).Optimize([]logicalplan.Optimizer{logicalplan.SortMatchers{}})
+	key := logicalplan.CacheKey(plan, &query.Options{
+		Start:         alignment,
+		End:           alignment,
+		Step:          step,
+		LookbackDelta: e.lookbackDelta,
+	})
+	return strconv.FormatUint(key, 16), nil
+}
+
+// isCacheable returns whether results of expr can be cached. Expressions with @ modifiers are not cached,
+// since start() and end() resolve to different timestamps for each time range which is evaluated.
+func isCacheable(expr parser.Expr) bool {
+	cacheable := true
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			if n.Timestamp != nil || n.StartOrEnd != 0 {
+				cacheable = false
+			}
+		case *parser.SubqueryExpr:
+			if n.Timestamp != nil || n.StartOrEnd != 0 {
+				cacheable = false
+			}
+		}
+		return nil
+	})
+	return cacheable
+}
+
+// newCachedRangeQuery creates a range query which only evaluates the steps which are not in the result cached
+// for the query. Since a cached result covers consecutive steps, at most the steps before and after it are evaluated.
+func (e *compatibilityEngine) newCachedRangeQuery(q storage.Queryable, opts *promql.QueryOpts, qs string, expr parser.Expr, start, end time.Time, step time.Duration) (promql.Query, error) {
+	key, err := e.resultCacheKey(qs, start, step)
+	if err != nil {
+		return nil, err
+	}
+	cq := &cachedRangeQuery{
+		cache: e.resultCache,
+		key:   key,
+		start: start.UnixMilli(),
+		end:   end.UnixMilli(),
+		step:  step.Milliseconds(),
+		qs:    qs,
+	}
+
+	type stepRange struct{ start, end int64 }
+	missing := []stepRange{{start: cq.start, end: cq.end}}
+	// Results which are adjacent to the range of the query are extended as well.
+	if cached, ok := cq.cache.Get(cq.key); ok && cached.Start <= cq.end+cq.step && cached.End >= cq.start-cq.step {
+		cq.cached = &cached
+		missing = missing[:0]
+		if cq.start < cached.Start {
+			missing = append(missing, stepRange{start: cq.start, end: cached.Start - cq.step})
+		}
+		if cq.end > cached.End {
+			missing = append(missing, stepRange{start: cached.End + cq.step, end: cq.end})
+		}
+	}
+
+	for _, r := range missing {
+		rangeQuery, err := e.newRangeQuery(q, opts, qs, expr, time.UnixMilli(r.start), time.UnixMilli(r.end), step)
+		if err != nil {
+			cq.Close()
+			return nil, err
+		}
+		cq.queries = append(cq.queries, rangeQuery)
+	}
+	return cq, nil
+}
+
+type cachedRangeQuery struct {
+	cache  ResultCache
+	key    string
+	cached *CachedResult
+
+	queries []promql.Query
+
+	start, end, step int64
+	qs               string
+}
+
+func (q *cachedRangeQuery) Exec(ctx context.Context) *promql.Result {
+	ret := &promql.Result{}
+	result := CachedResult{Start: q.start, End: q.end}
+	matrices := make([]promql.Matrix, 0, len(q.queries)+1)
+	if q.cached != nil {
+		if q.cached.Start < result.Start {
+			result.Start = q.cached.Start
+		}
+		if q.cached.End > result.End {
+			result.End = q.cached.End
+		}
+		matrices = append(matrices, q.cached.Matrix)
+	}
+	for _, rangeQuery := range q.queries {
+		r := rangeQuery.Exec(ctx)
+		ret.Warnings = append(ret.Warnings, r.Warnings...)
+		matrix, err := r.Matrix()
+		if err != nil {
+			ret.Err = err
+			return ret
+		}
+		matrices = append(matrices, matrix)
+	}
+
+	result.Matrix = mergeMatrices(matrices)
+	q.cache.Set(q.key, result)
+	ret.Value = selectSteps(result.Matrix, q.start, q.end)
+	return ret
+}
+
+// mergeMatrices merges matrices evaluated over disjoint time ranges into a new matrix.
+func mergeMatrices(matrices []promql.Matrix) promql.Matrix {
+	if len(matrices) == 1 {
+		return matrices[0]
+	}
+
+	var (
+		merged = make(promql.Matrix, 0)
+		// indexes are the positions of merged series by the hash of their labels.
+		// Series whose hashes collide are chained and told apart by their labels.
+		indexes = make(map[uint64][]int)
+	)
+	for _, matrix := range matrices {
+		for _, s := range matrix {
+			hash := s.Metric.Hash()
+			i := -1
+			for _, j := range indexes[hash] {
+				if labels.Equal(merged[j].Metric, s.Metric) {
+					i = j
+					break
+				}
+			}
+			if i < 0 {
+				i = len(merged)
+				indexes[hash] = append(indexes[hash], i)
+				merged = append(merged, promql.Series{Metric: s.Metric})
+			}
+			merged[i].Points = append(merged[i].Points, s.Points...)
+		}
+	}
+	for _, s := range merged {
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].T < s.Points[j].T })
+	}
+	sort.Sort(merged)
+	return merged
+}
+
+// selectSteps returns the points of matrix between start and end. The points of returned series
+// are copied, so that the cached matrix can not be modified through the result of a query.
+func selectSteps(matrix promql.Matrix, start, end int64) promql.Matrix {
+	result := make(promql.Matrix, 0, len(matrix))
+	for _, s := range matrix {
+		first := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T >= start })
+		last := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > end })
+		if first == last {
+			continue
+		}
+		points := make([]promql.Point, last-first)
+		copy(points, s.Points[first:last])
+		result = append(result, promql.Series{Metric: s.Metric, Points: points})
+	}
+	return result
+}
+
+func (q *cachedRangeQuery) Statement() parser.Statement { return nil }
+
+// Stats returns the number of samples which the queries of missing ranges processed.
+// Samples of cached steps are not processed again, so they are not counted.
+func (q *cachedRangeQuery) Stats() *stats.Statistics {
+	samples := stats.NewQuerySamples(false)
+	for _, rangeQuery := range q.queries {
+		if s := rangeQuery.Stats(); s != nil && s.Samples != nil {
+			samples.TotalSamples += s.Samples.TotalSamples
+		}
+	}
+	return &stats.Statistics{Timers: stats.NewQueryTimers(), Samples: samples}
+}
+
+func (q *cachedRangeQuery) Close() {
+	for _, rangeQuery := range q.queries {
+		rangeQuery.Close()
+	}
+}
+
+func (q *cachedRangeQuery) String() string { return q.qs }
+
+func (q *cachedRangeQuery) Cancel() {
+	for _, rangeQuery := range q.queries {
+		rangeQuery.Cancel()
+	}
+}
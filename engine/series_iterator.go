@@ -0,0 +1,160 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// SeriesIterable is implemented by queries of the engine which can yield their result one series at a time.
+type SeriesIterable interface {
+	SeriesIterator() *SeriesIterator
+}
+
+// SeriesIterator yields the result of a query one series at a time.
+// Operators produce samples step by step, so only one batch of steps is
+// buffered and transposed at a time. See At for how series are split by batches.
+type SeriesIterator struct {
+	query  *Query
+	exec   model.VectorOperator
+	logger log.Logger
+	expr   parser.Expr
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	loaded  bool
+	done    bool
+	err     error
+	labels  []labels.Labels
+	batch   []promql.Series
+	current int
+}
+
+// SeriesIterator returns an iterator over the series of the query result.
+// Series without any points are skipped. Unlike the result of Exec, series
+// are yielded in the order in which the operators produce them, and not sorted by labels.
+func (q *compatibilityQuery) SeriesIterator() *SeriesIterator {
+	return &SeriesIterator{query: q.Query, exec: q.Query.exec, logger: q.engine.logger, expr: q.expr, current: -1}
+}
+
+// Next advances the iterator to the next series with points. Operators are evaluated
+// with the context of the first call to Next until the iterator is closed.
+// It returns false when there are no more such series or an error occurred.
+func (it *SeriesIterator) Next(ctx context.Context) (ok bool) {
+	if it.done {
+		return false
+	}
+	defer recoverEngine(it.logger, it.expr, &it.err)
+	defer func() {
+		if !ok {
+			it.Close()
+		}
+		if it.err != nil {
+			it.query.memory.Close()
+		}
+	}()
+
+	if !it.loaded {
+		it.loaded = true
+		it.ctx, it.cancel = context.WithCancel(ctx)
+		if it.labels, it.err = it.exec.Series(it.ctx); it.err != nil {
+			return false
+		}
+	}
+
+	if it.current >= 0 {
+		it.batch[it.current] = promql.Series{}
+	}
+	for {
+		for it.current++; it.current < len(it.batch); it.current++ {
+			if len(it.batch[it.current].Points) > 0 {
+				return true
+			}
+		}
+		if it.err = it.loadBatch(ctx); it.err != nil || it.batch == nil {
+			return false
+		}
+	}
+}
+
+// At returns the points of the current series in the current batch of steps, which
+// is a fragment of the series. A series with points in several batches is yielded once
+// for each of them, and batches are yielded in the order of their steps. The points of
+// a whole series are therefore the points of all its fragments in the order they are yielded.
+func (it *SeriesIterator) At() promql.Series {
+	return it.batch[it.current]
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *SeriesIterator) Err() error {
+	return it.err
+}
+
+// Close stops the evaluation of the query and releases the buffered points.
+// Next returns false once the iterator is closed.
+func (it *SeriesIterator) Close() {
+	it.done = true
+	it.batch = nil
+	if it.cancel != nil {
+		it.cancel()
+	}
+}
+
+// loadBatch transposes the next batch of steps into series. The batch
+// is nil once the operators do not return any more steps.
+func (it *SeriesIterator) loadBatch(ctx context.Context) error {
+	it.batch, it.current = nil, -1
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r, err := it.exec.Next(it.ctx)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	if err := it.query.releaseOnError(r); err != nil {
+		return err
+	}
+
+	it.batch = make([]promql.Series, len(it.labels))
+	for i := range it.labels {
+		it.batch[i].Metric = it.labels[i]
+	}
+	it.batch = appendPoints(it.batch, r, len(it.labels) == 0)
+	it.query.putVectors(r)
+	return nil
+}
+
+// appendPoints appends the samples of vectors to the points of their series.
+// Operators without series, like scalar(), only produce samples, which
+// are appended to series by their position in the vectors instead.
+func appendPoints(series []promql.Series, vectors []model.StepVector, byPosition bool) []promql.Series {
+	for _, vector := range vectors {
+		for i := range vector.Samples {
+			s := i
+			if !byPosition {
+				s = int(vector.SampleIDs[i])
+			}
+			for s >= len(series) {
+				series = append(series, promql.Series{})
+			}
+			series[s].Points = append(series[s].Points, promql.Point{
+				T: vector.T,
+				V: vector.Samples[i],
+			})
+		}
+	}
+	return series
+}
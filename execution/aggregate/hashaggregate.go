@@ -29,6 +29,9 @@ type aggregate struct {
 	by          bool
 	labels      []string
 	aggregation parser.ItemType
+	// phis contains the quantiles which are calculated by an aggregate
+	// created with NewHashQuantiles.
+	phis []float64
 
 	once           sync.Once
 	tables         []aggregateTable
@@ -70,6 +73,9 @@ func NewHashAggregate(
 }
 
 func (a *aggregate) Explain() (me string, next []model.VectorOperator) {
+	if len(a.phis) > 0 {
+		return a.explainQuantiles(), []model.VectorOperator{a.next}
+	}
 	if a.by {
 		return fmt.Sprintf("[*aggregate] %v by (%v)", a.aggregation.String(), a.labels), []model.VectorOperator{a.next}
 	}
@@ -90,6 +96,10 @@ func (a *aggregate) GetPool() *model.VectorPool {
 	return a.vectorPool
 }
 
+func (a *aggregate) Reset() {
+	a.next.Reset()
+}
+
 func (a *aggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 	in, err := a.next.Next(ctx)
 	if err != nil {
@@ -131,7 +141,9 @@ func (a *aggregate) initializeTables(ctx context.Context) error {
 		err    error
 	)
 
-	if a.by && len(a.labels) == 0 {
+	if len(a.phis) > 0 {
+		tables, series, err = a.initializeQuantilesTables(ctx)
+	} else if a.by && len(a.labels) == 0 {
 		tables, series, err = a.initializeVectorizedTables(ctx)
 	} else {
 		tables, series, err = a.initializeScalarTables(ctx)
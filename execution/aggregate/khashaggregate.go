@@ -0,0 +1,237 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+)
+
+type kAggregate struct {
+	next    model.VectorOperator
+	paramOp model.VectorOperator
+
+	vectorPool *model.VectorPool
+
+	by          bool
+	labels      []string
+	aggregation parser.ItemType
+
+	once        sync.Once
+	series      []labels.Labels
+	inputToHeap []*samplesHeap
+	heaps       []*samplesHeap
+	compare     func(float64, float64) bool
+}
+
+// NewKHashAggregate creates an operator which evaluates topk and bottomk.
+// The value of k is read from paramOp in every step, since it can change between steps.
+// Steps in which k is smaller than 1 or NaN return no samples.
+func NewKHashAggregate(
+	points *model.VectorPool,
+	next model.VectorOperator,
+	paramOp model.VectorOperator,
+	aggregation parser.ItemType,
+	by bool,
+	labels []string,
+) (model.VectorOperator, error) {
+	var compare func(float64, float64) bool
+	switch aggregation {
+	case parser.TOPK:
+		compare = func(a, b float64) bool {
+			if math.IsNaN(a) && !math.IsNaN(b) {
+				return true
+			}
+			return a < b
+		}
+	case parser.BOTTOMK:
+		compare = func(a, b float64) bool {
+			if math.IsNaN(a) && !math.IsNaN(b) {
+				return true
+			}
+			return a > b
+		}
+	default:
+		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "aggregation %s is not topk or bottomk", aggregation.String())
+	}
+
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	slices.Sort(labels)
+	return &kAggregate{
+		next:        next,
+		paramOp:     paramOp,
+		vectorPool:  points,
+		by:          by,
+		labels:      labels,
+		aggregation: aggregation,
+		compare:     compare,
+	}, nil
+}
+
+func (a *kAggregate) Explain() (me string, next []model.VectorOperator) {
+	if a.by {
+		return fmt.Sprintf("[*kaggregate] %v by (%v)", a.aggregation.String(), a.labels), []model.VectorOperator{a.paramOp, a.next}
+	}
+	return fmt.Sprintf("[*kaggregate] %v without (%v)", a.aggregation.String(), a.labels), []model.VectorOperator{a.paramOp, a.next}
+}
+
+func (a *kAggregate) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	a.once.Do(func() { err = a.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return a.series, nil
+}
+
+func (a *kAggregate) GetPool() *model.VectorPool {
+	return a.vectorPool
+}
+
+func (a *kAggregate) Reset() {
+	a.next.Reset()
+	a.paramOp.Reset()
+}
+
+func (a *kAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
+	in, err := a.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil {
+		return nil, nil
+	}
+	args, err := a.paramOp.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.once.Do(func() { err = a.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	result := a.vectorPool.GetVectorBatch()
+	for i, vector := range in {
+		k := math.NaN()
+		if i < len(args) && len(args[i].Samples) > 0 {
+			k = args[i].Samples[0]
+		}
+		result = append(result, a.aggregate(vector, k))
+		a.next.GetPool().PutStepVector(vector)
+	}
+	a.next.GetPool().PutVectors(in)
+	for _, arg := range args {
+		a.paramOp.GetPool().PutStepVector(arg)
+	}
+	if args != nil {
+		a.paramOp.GetPool().PutVectors(args)
+	}
+
+	return result, nil
+}
+
+// aggregate returns the k largest or smallest samples of each group in vector.
+func (a *kAggregate) aggregate(vector model.StepVector, k float64) model.StepVector {
+	result := a.vectorPool.GetStepVector(vector.T)
+	if math.IsNaN(k) || k < 1 {
+		return result
+	}
+	// Groups can not contain more samples than the input vector.
+	size := len(vector.Samples)
+	if k < float64(size) {
+		size = int(k)
+	}
+
+	for i, sId := range vector.SampleIDs {
+		h := a.inputToHeap[sId]
+		if len(h.entries) < size {
+			heap.Push(h, entry{sId: sId, total: vector.Samples[i]})
+			continue
+		}
+		if a.compare(h.entries[0].total, vector.Samples[i]) {
+			h.entries[0] = entry{sId: sId, total: vector.Samples[i]}
+			heap.Fix(h, 0)
+		}
+	}
+
+	for _, h := range a.heaps {
+		for _, e := range h.entries {
+			result.SampleIDs = append(result.SampleIDs, e.sId)
+			result.Samples = append(result.Samples, e.total)
+		}
+		h.entries = h.entries[:0]
+	}
+	return result
+}
+
+func (a *kAggregate) init(ctx context.Context) error {
+	series, err := a.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	heapsByHash := make(map[uint64]*samplesHeap)
+	a.inputToHeap = make([]*samplesHeap, len(series))
+	buf := make([]byte, 1024)
+	for i := 0; i < len(series); i++ {
+		hash, _, _ := hashMetric(series[i], !a.by, a.labels, buf)
+		h, ok := heapsByHash[hash]
+		if !ok {
+			h = &samplesHeap{compare: a.compare}
+			heapsByHash[hash] = h
+			a.heaps = append(a.heaps, h)
+		}
+		a.inputToHeap[i] = h
+	}
+	a.vectorPool.SetStepSize(len(series))
+	a.series = series
+
+	return nil
+}
+
+type entry struct {
+	sId   uint64
+	total float64
+}
+
+// samplesHeap keeps the sample which is compared first at its root, so that
+// it can be replaced when a sample which should be kept instead is found.
+type samplesHeap struct {
+	entries []entry
+	compare func(float64, float64) bool
+}
+
+func (s samplesHeap) Len() int {
+	return len(s.entries)
+}
+
+func (s samplesHeap) Less(i, j int) bool {
+	return s.compare(s.entries[i].total, s.entries[j].total)
+}
+
+func (s samplesHeap) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+func (s *samplesHeap) Push(x interface{}) {
+	s.entries = append(s.entries, x.(entry))
+}
+
+func (s *samplesHeap) Pop() interface{} {
+	old := s.entries
+	el := old[len(old)-1]
+	s.entries = old[:len(old)-1]
+	return el
+}
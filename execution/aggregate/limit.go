@@ -0,0 +1,202 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+)
+
+type limitAggregate struct {
+	next    model.VectorOperator
+	paramOp model.VectorOperator
+
+	vectorPool *model.VectorPool
+
+	function string
+	warned   bool
+
+	once   sync.Once
+	series []labels.Labels
+	// ranks are the positions of series when they are sorted by their labels.
+	ranks []int
+	// offsets are the positions of series between 0 and 1 by the hashes of their labels.
+	offsets  []float64
+	selected []int
+}
+
+// NewLimitAggregate creates an operator which evaluates limitk and limit_ratio. Both keep a
+// subset of the input series with their original labels and values, which is selected the
+// same way as in Prometheus. limitk keeps the k first series by their labels in every step,
+// and limit_ratio keeps the series whose label hashes are in the ratio of the hash space.
+// The parameter is read from paramOp in every step, since it can change between steps.
+func NewLimitAggregate(
+	points *model.VectorPool,
+	next model.VectorOperator,
+	paramOp model.VectorOperator,
+	function string,
+) (model.VectorOperator, error) {
+	switch function {
+	case "limitk", "limit_ratio":
+	default:
+		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "function %s is not limitk or limit_ratio", function)
+	}
+	return &limitAggregate{
+		next:       next,
+		paramOp:    paramOp,
+		vectorPool: points,
+		function:   function,
+	}, nil
+}
+
+func (a *limitAggregate) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*limitAggregate] %s", a.function), []model.VectorOperator{a.paramOp, a.next}
+}
+
+func (a *limitAggregate) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	a.once.Do(func() { err = a.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return a.series, nil
+}
+
+func (a *limitAggregate) GetPool() *model.VectorPool {
+	return a.vectorPool
+}
+
+func (a *limitAggregate) Reset() {
+	a.next.Reset()
+	a.paramOp.Reset()
+}
+
+func (a *limitAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
+	in, err := a.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil {
+		return nil, nil
+	}
+	args, err := a.paramOp.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.once.Do(func() { err = a.init(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	result := a.vectorPool.GetVectorBatch()
+	for i, vector := range in {
+		param := math.NaN()
+		if i < len(args) && len(args[i].Samples) > 0 {
+			param = args[i].Samples[0]
+		}
+		if a.function == "limitk" {
+			result = append(result, a.limitK(vector, param))
+		} else {
+			result = append(result, a.limitRatio(ctx, vector, param))
+		}
+		a.next.GetPool().PutStepVector(vector)
+	}
+	a.next.GetPool().PutVectors(in)
+	for _, arg := range args {
+		a.paramOp.GetPool().PutStepVector(arg)
+	}
+	if args != nil {
+		a.paramOp.GetPool().PutVectors(args)
+	}
+
+	return result, nil
+}
+
+// limitK returns the samples of the k first series by their labels.
+// Steps in which k is smaller than 1 or NaN return no samples, same as for topk.
+func (a *limitAggregate) limitK(vector model.StepVector, k float64) model.StepVector {
+	result := a.vectorPool.GetStepVector(vector.T)
+	if math.IsNaN(k) || k < 1 {
+		return result
+	}
+
+	a.selected = a.selected[:0]
+	for i := range vector.SampleIDs {
+		a.selected = append(a.selected, i)
+	}
+	sort.Slice(a.selected, func(i, j int) bool {
+		return a.ranks[vector.SampleIDs[a.selected[i]]] < a.ranks[vector.SampleIDs[a.selected[j]]]
+	})
+	if k < float64(len(a.selected)) {
+		a.selected = a.selected[:int(k)]
+	}
+	for _, i := range a.selected {
+		result.SampleIDs = append(result.SampleIDs, vector.SampleIDs[i])
+		result.Samples = append(result.Samples, vector.Samples[i])
+	}
+	return result
+}
+
+// limitRatio returns the samples of series whose offsets are below a positive ratio, or at
+// least 1 plus a negative ratio, so that ratios r and -(1-r) select complementary series.
+// Ratios outside of [-1, 1] are capped with a warning. Steps with a ratio of NaN return no samples.
+func (a *limitAggregate) limitRatio(ctx context.Context, vector model.StepVector, ratio float64) model.StepVector {
+	result := a.vectorPool.GetStepVector(vector.T)
+	if math.IsNaN(ratio) || ratio == 0 {
+		return result
+	}
+	if ratio < -1 || ratio > 1 {
+		capped := math.Max(-1, math.Min(1, ratio))
+		if !a.warned {
+			a.warned = true
+			warnings.AddToContext(ctx, errors.Newf("limit_ratio: ratio value should be between -1 and 1, got %g, capping to %g", ratio, capped))
+		}
+		ratio = capped
+	}
+
+	for i, sID := range vector.SampleIDs {
+		offset := a.offsets[sID]
+		if (ratio >= 0 && offset < ratio) || (ratio < 0 && offset >= 1+ratio) {
+			result.SampleIDs = append(result.SampleIDs, sID)
+			result.Samples = append(result.Samples, vector.Samples[i])
+		}
+	}
+	return result
+}
+
+func (a *limitAggregate) init(ctx context.Context) error {
+	series, err := a.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	order := make([]int, len(series))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return labels.Compare(series[order[i]], series[order[j]]) < 0 })
+	a.ranks = make([]int, len(series))
+	for rank, i := range order {
+		a.ranks[i] = rank
+	}
+
+	a.offsets = make([]float64, len(series))
+	for i := range series {
+		a.offsets[i] = float64(series[i].Hash()) / float64(math.MaxUint64)
+	}
+	a.vectorPool.SetStepSize(len(series))
+	a.series = series
+
+	return nil
+}
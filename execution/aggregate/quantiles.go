@@ -0,0 +1,164 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/worker"
+)
+
+// QuantileLabel is the label which contains the phi of series returned by NewHashQuantiles.
+const QuantileLabel = "quantile"
+
+// NewHashQuantiles creates an aggregate which calculates multiple quantiles of each group
+// in a single pass. The samples of a group are buffered and sorted once per step, instead of
+// once per quantile as with separate quantile aggregations.
+//
+// One output series is returned for each group and phi. It has the labels of the group and
+// a QuantileLabel label with the phi formatted the same way as quantiles of summaries, e.g. "0.99".
+// A quantile label of the group is replaced.
+func NewHashQuantiles(
+	points *model.VectorPool,
+	next model.VectorOperator,
+	phis []float64,
+	by bool,
+	labels []string,
+	stepsBatch int,
+) (model.VectorOperator, error) {
+	if len(phis) == 0 {
+		return nil, errors.New("at least one quantile is required")
+	}
+
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	slices.Sort(labels)
+	a := &aggregate{
+		next:        next,
+		vectorPool:  points,
+		by:          by,
+		aggregation: parser.QUANTILE,
+		phis:        phis,
+		labels:      labels,
+		stepsBatch:  stepsBatch,
+	}
+	a.workers = worker.NewGroup(stepsBatch, a.workerTask)
+
+	return a, nil
+}
+
+func (a *aggregate) explainQuantiles() string {
+	if a.by {
+		return fmt.Sprintf("[*aggregate] %v%v by (%v)", a.aggregation.String(), a.phis, a.labels)
+	}
+	return fmt.Sprintf("[*aggregate] %v%v without (%v)", a.aggregation.String(), a.phis, a.labels)
+}
+
+func (a *aggregate) initializeQuantilesTables(ctx context.Context) ([]aggregateTable, []labels.Labels, error) {
+	series, err := a.next.Series(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inputCache := make([]uint64, len(series))
+	groupIDs := make(map[uint64]uint64)
+	groups := make([]labels.Labels, 0)
+	buf := make([]byte, 1024)
+	for i := 0; i < len(series); i++ {
+		hash, _, lbls := hashMetric(series[i], !a.by, a.labels, buf)
+		id, ok := groupIDs[hash]
+		if !ok {
+			id = uint64(len(groups))
+			groupIDs[hash] = id
+			groups = append(groups, lbls)
+		}
+		inputCache[i] = id
+	}
+
+	// The output series of a group are placed next to each other,
+	// in the same order as the phis.
+	series = make([]labels.Labels, 0, len(groups)*len(a.phis))
+	for _, group := range groups {
+		for _, phi := range a.phis {
+			lb := labels.NewBuilder(group)
+			lb.Set(QuantileLabel, strconv.FormatFloat(phi, 'f', -1, 64))
+			series = append(series, lb.Labels(nil))
+		}
+	}
+	a.vectorPool.SetStepSize(len(series))
+
+	tables := make([]aggregateTable, a.stepsBatch)
+	for i := range tables {
+		tables[i] = newQuantilesTable(inputCache, len(groups), a.phis)
+	}
+	return tables, series, nil
+}
+
+type quantilesTable struct {
+	timestamp int64
+	inputs    []uint64
+	phis      []float64
+	// points contains the buffered samples of each group.
+	points [][]float64
+}
+
+func newQuantilesTable(inputSampleIDs []uint64, numGroups int, phis []float64) *quantilesTable {
+	return &quantilesTable{
+		inputs: inputSampleIDs,
+		phis:   phis,
+		points: make([][]float64, numGroups),
+	}
+}
+
+func (t *quantilesTable) aggregate(vector model.StepVector) {
+	for i := range t.points {
+		t.points[i] = t.points[i][:0]
+	}
+	t.timestamp = vector.T
+	for i, sampleID := range vector.SampleIDs {
+		group := t.inputs[sampleID]
+		t.points[group] = append(t.points[group], vector.Samples[i])
+	}
+}
+
+func (t *quantilesTable) toVector(pool *model.VectorPool) model.StepVector {
+	result := pool.GetStepVector(t.timestamp)
+	for group, points := range t.points {
+		if len(points) == 0 {
+			continue
+		}
+		sort.Float64s(points)
+		for i, phi := range t.phis {
+			result.SampleIDs = append(result.SampleIDs, uint64(group*len(t.phis)+i))
+			result.Samples = append(result.Samples, phiQuantile(phi, points))
+		}
+	}
+	return result
+}
+
+func (t *quantilesTable) size() int {
+	return len(t.points) * len(t.phis)
+}
+
+// phiQuantile returns the same value as quantile for points which are already sorted.
+func phiQuantile(q float64, points []float64) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(+1)
+	}
+	return sortedQuantile(q, points)
+}
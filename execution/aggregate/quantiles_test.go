@@ -0,0 +1,110 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/aggregate"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/scan"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestHashQuantilesMatchSeparateQuantiles(t *testing.T) {
+	load := `load 30s
+		http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+		http_requests_total{pod="nginx-1", series="2"} 2+2.3x50
+		http_requests_total{pod="nginx-1", series="3"} 5+0.5x20
+		http_requests_total{pod="nginx-2", series="1"} 3+1x30
+		http_requests_total{pod="nginx-2", series="2"} 1+4x40
+		http_requests_total{pod="nginx-3", series="1"} 7x10`
+
+	test, err := promql.NewTest(t, load)
+	testutil.Ok(t, err)
+	defer test.Close()
+	testutil.Ok(t, test.Run())
+
+	const stepsBatch = 10
+	opts := &query.Options{
+		Start:         time.Unix(0, 0),
+		End:           time.Unix(1800, 0),
+		Step:          30 * time.Second,
+		LookbackDelta: 5 * time.Minute,
+		StepsBatch:    stepsBatch,
+	}
+	pool := engstore.NewSelectorPool(test.Storage())
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_requests_total")}
+	newSelector := func() model.VectorOperator {
+		selector := pool.GetSelector(opts.Start.UnixMilli()-opts.LookbackDelta.Milliseconds(), opts.End.UnixMilli(), opts.Step.Milliseconds(), matchers, storage.SelectHints{})
+		return scan.NewVectorSelector(model.NewVectorPool(stepsBatch), selector, opts, 0, 0, 1)
+	}
+
+	phis := []float64{0.5, 0.9, 0.99}
+	for _, tcase := range []struct {
+		name     string
+		by       bool
+		grouping []string
+	}{
+		{name: "by pod", by: true, grouping: []string{"pod"}},
+		{name: "without series", by: false, grouping: []string{"series"}},
+		{name: "no grouping", by: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			op, err := aggregate.NewHashQuantiles(model.NewVectorPool(stepsBatch), newSelector(), phis, tcase.by, tcase.grouping, stepsBatch)
+			testutil.Ok(t, err)
+			result := collect(t, op, "")
+
+			expected := make(map[string][]promql.Point)
+			for _, phi := range phis {
+				op, err := aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), newSelector(), parser.QUANTILE, &parser.NumberLiteral{Val: phi}, tcase.by, tcase.grouping, stepsBatch)
+				testutil.Ok(t, err)
+				for series, points := range collect(t, op, strconv.FormatFloat(phi, 'f', -1, 64)) {
+					expected[series] = points
+				}
+			}
+			testutil.Equals(t, expected, result)
+		})
+	}
+}
+
+// collect returns the points of each series of op, keyed by their labels.
+// If phi is not empty, it is added as the quantile label of each series.
+func collect(t *testing.T, op model.VectorOperator, phi string) map[string][]promql.Point {
+	ctx := context.Background()
+	series, err := op.Series(ctx)
+	testutil.Ok(t, err)
+	names := make([]string, len(series))
+	for i, s := range series {
+		if phi != "" {
+			s = labels.NewBuilder(s).Set(aggregate.QuantileLabel, phi).Labels(nil)
+		}
+		names[i] = s.String()
+	}
+
+	result := make(map[string][]promql.Point)
+	for {
+		vectors, err := op.Next(ctx)
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		for _, vector := range vectors {
+			for i, id := range vector.SampleIDs {
+				result[names[id]] = append(result[names[id]], promql.Point{T: vector.T, V: vector.Samples[i]})
+			}
+		}
+	}
+	return result
+}
@@ -23,6 +23,11 @@ type aggregateTable interface {
 	size() int
 }
 
+// scalarTable aggregates samples by adding each sample of a step to the accumulator of its group
+// as they are read from the input vector. Samples are not buffered per group, so memory does not
+// grow with the number of input series, except for quantile which has to keep all values.
+// Accumulators are reset in every step, so groups only contain the series which have a sample
+// in the step, and series which become stale drop out of their group.
 type scalarTable struct {
 	timestamp    int64
 	inputs       []uint64
@@ -89,8 +94,11 @@ func (t *scalarTable) size() int {
 func hashMetric(metric labels.Labels, without bool, grouping []string, buf []byte) (uint64, string, labels.Labels) {
 	buf = buf[:0]
 	if without {
+		// Same as in Prometheus, the metric name is always dropped from the output
+		// of aggregations using without, and it is not part of the hash.
 		lb := labels.NewBuilder(metric)
 		lb.Del(grouping...)
+		lb.Del(labels.MetricName)
 		key, bytes := metric.HashWithoutLabels(buf, grouping...)
 		return key, string(bytes), lb.Labels(nil)
 	}
@@ -319,7 +327,12 @@ func quantile(q float64, points []float64) float64 {
 		return math.Inf(+1)
 	}
 	sort.Float64s(points)
+	return sortedQuantile(q, points)
+}
 
+// sortedQuantile calculates the q quantile of points which are already sorted.
+// The quantile q has to be within the [0, 1] range and points can not be empty.
+func sortedQuantile(q float64, points []float64) float64 {
 	n := float64(len(points))
 	// When the quantile lies between two samples,
 	// we use a weighted average of the two samples.
@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// BenchmarkScalarTableMemory compares the memory used by scalar tables, which add each sample
+// to the accumulator of its group, with tables which buffer the samples of each group in a step.
+func BenchmarkScalarTableMemory(b *testing.B) {
+	const (
+		numSeries = 100000
+		numSteps  = 10
+	)
+	for _, numGroups := range []int{10, 1000} {
+		inputs := make([]uint64, numSeries)
+		outputs := make([]*model.Series, numGroups)
+		for i := range inputs {
+			inputs[i] = uint64(i % numGroups)
+		}
+		for i := range outputs {
+			outputs[i] = &model.Series{ID: uint64(i)}
+		}
+		vectors := make([]model.StepVector, numSteps)
+		for i := range vectors {
+			vectors[i] = model.StepVector{T: int64(i), SampleIDs: make([]uint64, numSeries), Samples: make([]float64, numSeries)}
+			for j := range inputs {
+				vectors[i].SampleIDs[j] = uint64(j)
+				vectors[i].Samples[j] = float64(j)
+			}
+		}
+		pool := model.NewVectorPool(numSteps)
+		pool.SetStepSize(numGroups)
+
+		for _, aggregation := range []parser.ItemType{parser.SUM, parser.AVG} {
+			newAccumulator, err := makeAccumulatorFunc(aggregation, nil)
+			testutil.Ok(b, err)
+
+			for _, tcase := range []struct {
+				name     string
+				newTable func() aggregateTable
+			}{
+				{
+					name:     "streaming",
+					newTable: func() aggregateTable { return newScalarTable(inputs, outputs, newAccumulator) },
+				},
+				{
+					name:     "buffering",
+					newTable: func() aggregateTable { return newBufferingTable(inputs, numGroups, aggregation) },
+				},
+			} {
+				b.Run(fmt.Sprintf("%s/groups=%d/%s", aggregation, numGroups, tcase.name), func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						table := tcase.newTable()
+						for _, vector := range vectors {
+							table.aggregate(vector)
+							pool.PutStepVector(table.toVector(pool))
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// bufferingTable buffers the samples of each group in a step before aggregating them.
+type bufferingTable struct {
+	timestamp   int64
+	inputs      []uint64
+	points      [][]float64
+	aggregation parser.ItemType
+}
+
+func newBufferingTable(inputs []uint64, numGroups int, aggregation parser.ItemType) *bufferingTable {
+	return &bufferingTable{inputs: inputs, points: make([][]float64, numGroups), aggregation: aggregation}
+}
+
+func (t *bufferingTable) aggregate(vector model.StepVector) {
+	for i := range t.points {
+		t.points[i] = t.points[i][:0]
+	}
+	t.timestamp = vector.T
+	for i, sampleID := range vector.SampleIDs {
+		group := t.inputs[sampleID]
+		t.points[group] = append(t.points[group], vector.Samples[i])
+	}
+}
+
+func (t *bufferingTable) toVector(pool *model.VectorPool) model.StepVector {
+	result := pool.GetStepVector(t.timestamp)
+	for group, points := range t.points {
+		if len(points) == 0 {
+			continue
+		}
+		var sum float64
+		for _, p := range points {
+			sum += p
+		}
+		if t.aggregation == parser.AVG {
+			sum /= float64(len(points))
+		}
+		result.SampleIDs = append(result.SampleIDs, uint64(group))
+		result.Samples = append(result.Samples, sum)
+	}
+	return result
+}
+
+func (t *bufferingTable) size() int {
+	return len(t.points)
+}
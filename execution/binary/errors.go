@@ -0,0 +1,25 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// errManyToOneMatching is returned when multiple series of both operands of a one-to-one operation match.
+var errManyToOneMatching = errors.New("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+
+// duplicateSeriesError returns the same error as Prometheus for series a and b on the one side of an operation,
+// which both match the group of matchedLabels. Labels are formatted like in Prometheus, with sorted labels in braces.
+// Prometheus reports the series in the order in which its operands return them, which for series selected from storage
+// depends on the order in which they were created. To keep the error deterministic, the series with the greater labels
+// is always reported first instead.
+func duplicateSeriesError(matchedLabels, a, b labels.Labels, oneSide string) error {
+	if labels.Compare(a, b) < 0 {
+		a, b = b, a
+	}
+	return errors.Newf("found duplicate series for the match group %s on the %s hand-side of the operation: [%s, %s]"+
+		";many-to-many matching not allowed: matching labels must be unique on one side", matchedLabels.String(), oneSide, a.String(), b.String())
+}
@@ -0,0 +1,44 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const labelSep = '\xff'
+
+// hashMatchingLabels calculates the matching signature of metric in a single pass over its labels.
+// If without is true, the signature includes all labels except the metric name and the grouping labels,
+// otherwise it includes only the grouping labels. The grouping labels have to be sorted.
+// The result is the same as the one from labels.Labels.HashWithoutLabels and labels.Labels.HashForLabels,
+// but the metric name does not have to be added to the grouping labels, which avoids an allocation per series.
+func hashMatchingLabels(buf []byte, metric labels.Labels, without bool, grouping []string) (uint64, []byte) {
+	buf = buf[:0]
+	j := 0
+	for _, l := range metric {
+		for j < len(grouping) && grouping[j] < l.Name {
+			j++
+		}
+		isGrouping := j < len(grouping) && grouping[j] == l.Name
+		if without {
+			if isGrouping || l.Name == labels.MetricName {
+				continue
+			}
+		} else if !isGrouping {
+			// All remaining labels sort after the last grouping label.
+			if j == len(grouping) {
+				break
+			}
+			continue
+		}
+
+		buf = append(buf, l.Name...)
+		buf = append(buf, labelSep)
+		buf = append(buf, l.Value...)
+		buf = append(buf, labelSep)
+	}
+	return xxhash.Sum64(buf), buf
+}
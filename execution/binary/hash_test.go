@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestHashMatchingLabels(t *testing.T) {
+	buf := make([]byte, 1024)
+	for _, metric := range []labels.Labels{
+		labels.EmptyLabels(),
+		labels.FromStrings(labels.MetricName, "foo"),
+		labels.FromStrings(labels.MetricName, "foo", "pod", "nginx-1"),
+		labels.FromStrings(labels.MetricName, "foo", "code", "200", "le", "0.1", "pod", "nginx-1", "zone", "eu"),
+		labels.FromStrings("a", "1", "pod", "nginx-1"),
+	} {
+		for _, grouping := range [][]string{
+			nil,
+			{"pod"},
+			{"code", "pod"},
+			{"a", "le", "zone"},
+			{labels.MetricName, "pod"},
+			{"missing"},
+		} {
+			t.Run(fmt.Sprintf("%s/%v", metric, grouping), func(t *testing.T) {
+				expected, _ := metric.HashWithoutLabels(buf, grouping...)
+				got, _ := hashMatchingLabels(buf, metric, true, grouping)
+				testutil.Equals(t, expected, got)
+
+				expected, _ = metric.HashForLabels(buf, grouping...)
+				got, _ = hashMatchingLabels(buf, metric, false, grouping)
+				testutil.Equals(t, expected, got)
+			})
+		}
+	}
+}
+
+func BenchmarkHashMatchingLabels(b *testing.B) {
+	const numSeries = 500000
+	series := make([]labels.Labels, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		series = append(series, labels.FromStrings(
+			labels.MetricName, "http_requests_total",
+			"cluster", "eu-west-1",
+			"container", "nginx",
+			"namespace", fmt.Sprintf("namespace-%d", i%100),
+			"pod", fmt.Sprintf("pod-%d", i),
+		))
+	}
+	grouping := []string{"namespace", "pod"}
+
+	for _, without := range []bool{false, true} {
+		b.Run(fmt.Sprintf("helpers/without=%t", without), func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 1024)
+			for n := 0; n < b.N; n++ {
+				for _, s := range series {
+					if without {
+						s.HashWithoutLabels(buf, append(grouping, labels.MetricName)...)
+					} else {
+						s.HashForLabels(buf, grouping...)
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("single pass/without=%t", without), func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 1024)
+			for n := 0; n < b.N; n++ {
+				for _, s := range series {
+					hashMatchingLabels(buf, s, without, grouping)
+				}
+			}
+		})
+	}
+}
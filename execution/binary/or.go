@@ -0,0 +1,214 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// orOperator evaluates the `or` set operator between two step vectors.
+// In each step, it returns all samples from the lhs and the samples from the rhs
+// which do not match any lhs sample in that step.
+type orOperator struct {
+	pool *model.VectorPool
+	once sync.Once
+
+	lhs            model.VectorOperator
+	rhs            model.VectorOperator
+	matching       *parser.VectorMatching
+	groupingLabels []string
+	interner       model.LabelsInterner
+
+	// series contains the output series of the operator. Series from the lhs
+	// keep their IDs and series from the rhs are placed after them.
+	series []labels.Labels
+	// lhsSignatures and rhsSignatures contain the matching signature of each input series.
+	lhsSignatures []uint64
+	rhsSignatures []uint64
+	// rhsOutputIDs points from the rhs series ID to the output series ID.
+	rhsOutputIDs []uint64
+	// lhsSeen contains the signatures of lhs samples in the current step.
+	lhsSeen map[uint64]struct{}
+}
+
+// NewOrOperator creates an operator which evaluates `lhs or rhs`.
+func NewOrOperator(
+	pool *model.VectorPool,
+	lhs model.VectorOperator,
+	rhs model.VectorOperator,
+	matching *parser.VectorMatching,
+	opts *query.Options,
+) model.VectorOperator {
+	groupings := make([]string, len(matching.MatchingLabels))
+	copy(groupings, matching.MatchingLabels)
+	slices.Sort(groupings)
+
+	return &orOperator{
+		pool:           pool,
+		lhs:            lhs,
+		rhs:            rhs,
+		matching:       matching,
+		groupingLabels: groupings,
+		interner:       opts.LabelsInterner,
+		lhsSeen:        make(map[uint64]struct{}),
+	}
+}
+
+func (o *orOperator) Explain() (me string, next []model.VectorOperator) {
+	if o.matching.On {
+		return fmt.Sprintf("[*orOperator] on %v", o.matching.MatchingLabels), []model.VectorOperator{o.lhs, o.rhs}
+	}
+	return fmt.Sprintf("[*orOperator] ignoring %v", o.matching.MatchingLabels), []model.VectorOperator{o.lhs, o.rhs}
+}
+
+func (o *orOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.initOutputs(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *orOperator) initOutputs(ctx context.Context) error {
+	lhsSeries, err := o.lhs.Series(ctx)
+	if err != nil {
+		return err
+	}
+	rhsSeries, err := o.rhs.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024)
+	series := make([]labels.Labels, 0, len(lhsSeries)+len(rhsSeries))
+	// lhsIDs is used for deduplicating rhs series which have
+	// the same labels as a lhs series.
+	lhsIDs := make(map[uint64][]uint64, len(lhsSeries))
+	o.lhsSignatures = make([]uint64, len(lhsSeries))
+	for i, s := range lhsSeries {
+		o.lhsSignatures[i] = o.signature(s, buf)
+		lhsIDs[s.Hash()] = append(lhsIDs[s.Hash()], uint64(i))
+		series = append(series, o.intern(s))
+	}
+
+	o.rhsSignatures = make([]uint64, len(rhsSeries))
+	o.rhsOutputIDs = make([]uint64, len(rhsSeries))
+	for i, s := range rhsSeries {
+		o.rhsSignatures[i] = o.signature(s, buf)
+		// A rhs series with the same labels as a lhs series also has the same
+		// signature, which means that both series can never be returned in the
+		// same step and they can share the output series.
+		if id, ok := findSeries(lhsSeries, lhsIDs[s.Hash()], s); ok {
+			o.rhsOutputIDs[i] = id
+			continue
+		}
+		o.rhsOutputIDs[i] = uint64(len(series))
+		series = append(series, o.intern(s))
+	}
+	o.series = series
+	o.pool.SetStepSize(len(lhsSeries) + len(rhsSeries))
+
+	return nil
+}
+
+func (o *orOperator) signature(s labels.Labels, buf []byte) uint64 {
+	h, _ := hashMatchingLabels(buf, s, !o.matching.On, o.groupingLabels)
+	return h
+}
+
+func (o *orOperator) intern(s labels.Labels) labels.Labels {
+	if o.interner == nil {
+		return s
+	}
+	return o.interner.Intern(s)
+}
+
+// findSeries returns the ID, out of candidates, of the series in series which is equal to s.
+func findSeries(series []labels.Labels, candidates []uint64, s labels.Labels) (uint64, bool) {
+	for _, id := range candidates {
+		if labels.Equal(series[id], s) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (o *orOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	lhs, err := o.lhs.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := o.rhs.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if lhs == nil && rhs == nil {
+		return nil, nil
+	}
+
+	o.once.Do(func() { err = o.initOutputs(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	// One of the operands can stop producing vectors before the other one,
+	// in which case the steps of the remaining operand are still returned.
+	numSteps := len(lhs)
+	if len(rhs) > numSteps {
+		numSteps = len(rhs)
+	}
+	batch := o.pool.GetVectorBatch()
+	for i := 0; i < numSteps; i++ {
+		var step model.StepVector
+		if i < len(lhs) {
+			step = o.pool.GetStepVector(lhs[i].T)
+		} else {
+			step = o.pool.GetStepVector(rhs[i].T)
+		}
+
+		for k := range o.lhsSeen {
+			delete(o.lhsSeen, k)
+		}
+		if i < len(lhs) {
+			for j, sampleID := range lhs[i].SampleIDs {
+				o.lhsSeen[o.lhsSignatures[sampleID]] = struct{}{}
+				step.SampleIDs = append(step.SampleIDs, sampleID)
+				step.Samples = append(step.Samples, lhs[i].Samples[j])
+			}
+		}
+		if i < len(rhs) {
+			for j, sampleID := range rhs[i].SampleIDs {
+				if _, ok := o.lhsSeen[o.rhsSignatures[sampleID]]; ok {
+					continue
+				}
+				step.SampleIDs = append(step.SampleIDs, o.rhsOutputIDs[sampleID])
+				step.Samples = append(step.Samples, rhs[i].Samples[j])
+			}
+		}
+		batch = append(batch, step)
+	}
+	putVectors(o.lhs, lhs)
+	putVectors(o.rhs, rhs)
+
+	return batch, nil
+}
+
+func (o *orOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *orOperator) Reset() {
+	o.lhs.Reset()
+	o.rhs.Reset()
+}
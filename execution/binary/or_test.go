@@ -0,0 +1,98 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestOrOperatorSeriesIDs(t *testing.T) {
+	lhs := newSeriesOperator(
+		[]labels.Labels{labels.FromStrings("pod", "nginx-1"), labels.FromStrings("pod", "nginx-2")},
+		[]uint64{0}, 0,
+	)
+	rhs := newSeriesOperator(
+		[]labels.Labels{labels.FromStrings("pod", "nginx-3"), labels.FromStrings("pod", "nginx-2"), labels.FromStrings("pod", "nginx-4")},
+		[]uint64{0, 1, 2}, 100,
+	)
+	matching := &parser.VectorMatching{Card: parser.CardManyToMany}
+	op := NewOrOperator(model.NewVectorPool(10), lhs, rhs, matching, &query.Options{})
+
+	ctx := context.Background()
+	series, err := op.Series(ctx)
+	testutil.Ok(t, err)
+	// Series from the lhs keep their IDs, and rhs series which are not in the lhs are placed after them
+	// in the order of the rhs. Rhs series with the same labels as a lhs series share its ID.
+	expected := []labels.Labels{
+		labels.FromStrings("pod", "nginx-1"),
+		labels.FromStrings("pod", "nginx-2"),
+		labels.FromStrings("pod", "nginx-3"),
+		labels.FromStrings("pod", "nginx-4"),
+	}
+	testutil.Equals(t, expected, series)
+
+	vectors, err := op.Next(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(vectors))
+	// The lhs series nginx-2 has no sample, so the sample of the rhs series nginx-2 is returned with its ID.
+	testutil.Equals(t, []uint64{0, 2, 1, 3}, vectors[0].SampleIDs)
+	testutil.Equals(t, []float64{0, 100, 101, 102}, vectors[0].Samples)
+	for _, id := range vectors[0].SampleIDs {
+		testutil.Assert(t, id < uint64(len(series)), "sample ID %d is not an output series", id)
+	}
+}
+
+// seriesOperator returns a single step with a sample for each of sampleIDs.
+// Values of samples are increasing, starting from firstValue.
+type seriesOperator struct {
+	pool       *model.VectorPool
+	series     []labels.Labels
+	sampleIDs  []uint64
+	firstValue float64
+	done       bool
+}
+
+func newSeriesOperator(series []labels.Labels, sampleIDs []uint64, firstValue float64) *seriesOperator {
+	pool := model.NewVectorPool(10)
+	pool.SetStepSize(len(series))
+	return &seriesOperator{pool: pool, series: series, sampleIDs: sampleIDs, firstValue: firstValue}
+}
+
+func (o *seriesOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*seriesOperator]", nil
+}
+
+func (o *seriesOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return o.series, nil
+}
+
+func (o *seriesOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *seriesOperator) Reset() {
+	o.done = false
+}
+
+func (o *seriesOperator) Next(_ context.Context) ([]model.StepVector, error) {
+	if o.done {
+		return nil, nil
+	}
+	o.done = true
+
+	vector := o.pool.GetStepVector(0)
+	for i, id := range o.sampleIDs {
+		vector.SampleIDs = append(vector.SampleIDs, id)
+		vector.Samples = append(vector.Samples, o.firstValue+float64(i))
+	}
+	return append(o.pool.GetVectorBatch(), vector), nil
+}
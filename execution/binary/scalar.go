@@ -6,12 +6,15 @@ package binary
 import (
 	"context"
 	"fmt"
+	"math"
 	"sync"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 type ScalarSide int
@@ -26,25 +29,33 @@ const (
 type scalarOperator struct {
 	seriesOnce sync.Once
 	series     []labels.Labels
-	scalar     float64
-
-	pool           *model.VectorPool
-	numberSelector model.VectorOperator
-	next           model.VectorOperator
-	getOperands    getOperandsFunc
-	operandValIdx  int
-	operation      operation
-	opName         string
+
+	pool          *model.VectorPool
+	scalar        model.VectorOperator
+	next          model.VectorOperator
+	getOperands   getOperandsFunc
+	operandValIdx int
+	operation     operation
+	opName        string
+	// dropMetricName is true when the operation drops the metric
+	// name of its series, which filtering comparisons do not.
+	dropMetricName bool
 }
 
 func NewScalar(
 	pool *model.VectorPool,
 	next model.VectorOperator,
-	numberSelector model.VectorOperator,
+	scalar model.VectorOperator,
 	op parser.ItemType,
 	scalarSide ScalarSide,
+	returnBool bool,
+	opts *query.Options,
 ) (*scalarOperator, error) {
-	binaryOperation, err := newOperation(op, scalarSide != ScalarSideBoth)
+	// Same rule as the Prometheus parser, since comparisons between scalars can not filter samples.
+	if scalarSide == ScalarSideBoth && op.IsComparisonOperator() && !returnBool {
+		return nil, errors.New("comparisons between scalars must use BOOL modifier")
+	}
+	binaryOperation, err := newOperation(op, scalarSide != ScalarSideBoth && !returnBool)
 	if err != nil {
 		return nil, err
 	}
@@ -57,28 +68,20 @@ func NewScalar(
 		operandValIdx = 1
 	}
 
-	// Cache the result of the number selector since it
-	// will not change during execution.
-	v, err := numberSelector.Next(context.Background())
-	if err != nil {
-		return nil, err
-	}
-	scalar := v[0].Samples[0]
-
 	return &scalarOperator{
 		pool:           pool,
 		next:           next,
 		scalar:         scalar,
-		numberSelector: numberSelector,
 		operation:      binaryOperation,
 		opName:         parser.ItemTypeStr[op],
 		getOperands:    getOperands,
 		operandValIdx:  operandValIdx,
+		dropMetricName: !opts.KeepMetricNames && (!op.IsComparisonOperator() || returnBool),
 	}, nil
 }
 
 func (o *scalarOperator) Explain() (me string, next []model.VectorOperator) {
-	return fmt.Sprintf("[*scalarOperator] %v %s", o.scalar, o.opName), []model.VectorOperator{o.next}
+	return fmt.Sprintf("[*scalarOperator] %s", o.opName), []model.VectorOperator{o.next, o.scalar}
 }
 
 func (o *scalarOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -98,16 +101,27 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	if in == nil {
 		return nil, nil
 	}
+	// The scalar is read for every step since it can change
+	// between steps, for example when using time().
+	scalars, err := o.scalar.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
 	o.seriesOnce.Do(func() { err = o.loadSeries(ctx) })
 	if err != nil {
 		return nil, err
 	}
 
 	out := o.pool.GetVectorBatch()
-	for _, vector := range in {
+	for v, vector := range in {
+		scalar := math.NaN()
+		if v < len(scalars) && len(scalars[v].Samples) > 0 {
+			scalar = scalars[v].Samples[0]
+		}
+
 		step := o.pool.GetStepVector(vector.T)
 		for i := range vector.Samples {
-			operands := o.getOperands(vector, i, o.scalar)
+			operands := o.getOperands(vector, i, scalar)
 			val, keep := o.operation(operands, o.operandValIdx)
 			if !keep {
 				continue
@@ -115,13 +129,13 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 			step.Samples = append(step.Samples, val)
 			step.SampleIDs = append(step.SampleIDs, vector.SampleIDs[i])
 		}
-		if len(step.Samples) == 0 {
-			continue
-		}
+		// Steps where all samples are filtered out are still returned, so that
+		// operators reading the output, like absent, see vectors for every step.
 		out = append(out, step)
 		o.next.GetPool().PutStepVector(vector)
 	}
 	o.next.GetPool().PutVectors(in)
+	putVectors(o.scalar, scalars)
 	return out, nil
 }
 
@@ -129,6 +143,11 @@ func (o *scalarOperator) GetPool() *model.VectorPool {
 	return o.pool
 }
 
+func (o *scalarOperator) Reset() {
+	o.next.Reset()
+	o.scalar.Reset()
+}
+
 func (o *scalarOperator) loadSeries(ctx context.Context) error {
 	vectorSeries, err := o.next.Series(ctx)
 	if err != nil {
@@ -137,7 +156,10 @@ func (o *scalarOperator) loadSeries(ctx context.Context) error {
 	series := make([]labels.Labels, len(vectorSeries))
 	for i := range vectorSeries {
 		if vectorSeries[i] != nil {
-			lbls := labels.NewBuilder(vectorSeries[i]).Del(labels.MetricName).Labels(nil)
+			lbls := vectorSeries[i]
+			if o.dropMetricName {
+				lbls = model.DropMetricName(lbls)
+			}
 			series[i] = lbls
 		}
 	}
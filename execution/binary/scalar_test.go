@@ -0,0 +1,60 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/scan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestScalarComparison(t *testing.T) {
+	opts := &query.Options{
+		Start:      time.Unix(0, 0),
+		End:        time.Unix(120, 0),
+		Step:       30 * time.Second,
+		StepsBatch: 10,
+	}
+	newScalar := func(op parser.ItemType, returnBool bool) (*scalarOperator, error) {
+		lhs := scan.NewNumberLiteralSelector(model.NewVectorPool(10), opts, 3)
+		rhs := scan.NewNumberLiteralSelector(model.NewVectorPool(10), opts, 2)
+		return NewScalar(model.NewVectorPool(10), lhs, rhs, op, ScalarSideBoth, returnBool, opts)
+	}
+
+	for _, tcase := range []struct {
+		op       parser.ItemType
+		expected float64
+	}{
+		{op: parser.GTR, expected: 1},
+		{op: parser.LTE, expected: 0},
+		{op: parser.EQLC, expected: 0},
+		{op: parser.NEQ, expected: 1},
+	} {
+		t.Run(tcase.op.String(), func(t *testing.T) {
+			_, err := newScalar(tcase.op, false)
+			testutil.NotOk(t, err)
+
+			op, err := newScalar(tcase.op, true)
+			testutil.Ok(t, err)
+
+			ctx := context.Background()
+			_, err = op.Series(ctx)
+			testutil.Ok(t, err)
+
+			vectors, err := op.Next(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, opts.NumSteps(), len(vectors))
+			for _, v := range vectors {
+				testutil.Equals(t, []float64{tcase.expected}, v.Samples)
+			}
+		})
+	}
+}
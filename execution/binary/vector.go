@@ -6,13 +6,16 @@ package binary
 import (
 	"context"
 	"fmt"
+	"math"
 	"sync"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"golang.org/x/exp/slices"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 // vectorOperator evaluates an expression between two step vectors.
@@ -26,6 +29,11 @@ type vectorOperator struct {
 	groupingLabels []string
 	operation      operation
 	opName         string
+	keepMetricName bool
+	// dropMetricName is true when the operation drops the metric
+	// name, which is the case for arithmetic and bool comparisons.
+	dropMetricName bool
+	interner       model.LabelsInterner
 
 	// series contains the output series of the operator
 	series []labels.Labels
@@ -35,6 +43,19 @@ type vectorOperator struct {
 	// table is used to calculate the binary operation of two step vectors between
 	// the lhs and rhs operator.
 	table *table
+
+	// lowCardSeries and lowCardGroups contain the labels and the match group of each series
+	// from the low cardinality operator, which are used to detect many-to-many matching.
+	lowCardSeries []labels.Labels
+	lowCardGroups []int
+	// highCardGroups contains the match group of each series from the high cardinality
+	// operator in one-to-one operations, which is used to detect many-to-one matching.
+	highCardGroups []int
+	// lowCardMatches and highCardMatches contain the timestamp of the step at which each match group
+	// was matched last by the low and high cardinality operators, and lowCardMatchIDs the matching series.
+	lowCardMatches  []int64
+	lowCardMatchIDs []uint64
+	highCardMatches []int64
 }
 
 func NewVectorOperator(
@@ -43,8 +64,10 @@ func NewVectorOperator(
 	rhs model.VectorOperator,
 	matching *parser.VectorMatching,
 	operation parser.ItemType,
+	returnBool bool,
+	opts *query.Options,
 ) (model.VectorOperator, error) {
-	op, err := newOperation(operation, true)
+	op, err := newOperation(operation, !returnBool)
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +86,9 @@ func NewVectorOperator(
 		groupingLabels: groupings,
 		operation:      op,
 		opName:         parser.ItemTypeStr[operation],
+		keepMetricName: opts.KeepMetricNames,
+		dropMetricName: !opts.KeepMetricNames && (!operation.IsComparisonOperator() || returnBool),
+		interner:       opts.LabelsInterner,
 	}, nil
 }
 
@@ -105,10 +131,14 @@ func (o *vectorOperator) initOutputs(ctx context.Context) error {
 	keepLabels := o.matching.Card != parser.CardOneToOne
 	highCardHashes, highCardInputMap := o.hashSeries(highCardSide, keepLabels, buf)
 	lowCardHashes, lowCardInputMap := o.hashSeries(lowCardSide, keepLabels, buf)
+	o.initMatchGroups(highCardSide, lowCardSide, highCardHashes, lowCardHashes)
 	output, highCardOutputIndex, lowCardOutputIndex := o.join(highCardHashes, highCardInputMap, lowCardHashes, lowCardInputMap, includeLabels)
 
 	series := make([]labels.Labels, len(output))
 	for _, s := range output {
+		if o.interner != nil {
+			s.Metric = o.interner.Intern(s.Metric)
+		}
 		series[s.ID] = s.Metric
 	}
 	o.series = series
@@ -145,8 +175,17 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	// we might want to drain or close the other one.
 	// We don't have a concept of closing an operator yet.
 	if len(lhs) == 0 || len(rhs) == 0 {
+		putVectors(o.lhs, lhs)
+		putVectors(o.rhs, rhs)
 		return nil, nil
 	}
+	// Both operands are evaluated over the same steps, so batches
+	// with a different number of steps can not be matched.
+	if len(lhs) != len(rhs) {
+		putVectors(o.lhs, lhs)
+		putVectors(o.rhs, rhs)
+		return nil, errors.Newf("binary operands returned batches with a different number of steps: %d and %d", len(lhs), len(rhs))
+	}
 
 	o.once.Do(func() { err = o.initOutputs(ctx) })
 	if err != nil {
@@ -154,24 +193,116 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	}
 
 	batch := o.pool.GetVectorBatch()
-	for i, vector := range lhs {
-		if i < len(rhs) {
-			step := o.table.execBinaryOperation(lhs[i], rhs[i])
-			batch = append(batch, step)
-			o.rhs.GetPool().PutStepVector(rhs[i])
+	for i := range lhs {
+		if err := o.validateMatches(lhs[i], rhs[i]); err != nil {
+			putVectors(o, batch)
+			putVectors(o.lhs, lhs)
+			putVectors(o.rhs, rhs)
+			return nil, err
 		}
-		o.lhs.GetPool().PutStepVector(vector)
+		batch = append(batch, o.table.execBinaryOperation(lhs[i], rhs[i]))
 	}
-	o.lhs.GetPool().PutVectors(lhs)
-	o.rhs.GetPool().PutVectors(rhs)
+	putVectors(o.lhs, lhs)
+	putVectors(o.rhs, rhs)
 
 	return batch, nil
 }
 
+// initMatchGroups assigns the series of both operators to match groups by their hashes.
+// Groups of high cardinality series are only needed for one-to-one operations.
+func (o *vectorOperator) initMatchGroups(highCardSide, lowCardSide []labels.Labels, highCardHashes, lowCardHashes map[uint64][]model.Series) {
+	groups := make(map[uint64]int, len(lowCardHashes))
+	o.lowCardSeries = lowCardSide
+	o.lowCardGroups = make([]int, len(lowCardSide))
+	for hash, series := range lowCardHashes {
+		groups[hash] = len(groups)
+		for _, s := range series {
+			o.lowCardGroups[s.ID] = groups[hash]
+		}
+	}
+	if o.matching.Card == parser.CardOneToOne {
+		o.highCardGroups = make([]int, len(highCardSide))
+		for hash, series := range highCardHashes {
+			group, ok := groups[hash]
+			if !ok {
+				group = len(groups)
+				groups[hash] = group
+			}
+			for _, s := range series {
+				o.highCardGroups[s.ID] = group
+			}
+		}
+	}
+
+	o.lowCardMatches = make([]int64, len(groups))
+	o.lowCardMatchIDs = make([]uint64, len(groups))
+	o.highCardMatches = make([]int64, len(groups))
+	for i := range o.lowCardMatches {
+		o.lowCardMatches[i] = math.MinInt64
+		o.highCardMatches[i] = math.MinInt64
+	}
+}
+
+// validateMatches returns the same errors as Prometheus when the low cardinality operator has more
+// than one sample in a match group, or when both operators of a one-to-one operation have more than one.
+func (o *vectorOperator) validateMatches(lhs, rhs model.StepVector) error {
+	highCard, lowCard, oneSide := lhs, rhs, "right"
+	if o.matching.Card == parser.CardOneToMany {
+		highCard, lowCard, oneSide = rhs, lhs, "left"
+	}
+
+	for _, sampleID := range lowCard.SampleIDs {
+		group := o.lowCardGroups[sampleID]
+		if o.lowCardMatches[group] == lowCard.T {
+			metric := o.lowCardSeries[sampleID]
+			matchedLabels := metric.MatchLabels(o.matching.On, o.matching.MatchingLabels...)
+			return duplicateSeriesError(matchedLabels, metric, o.lowCardSeries[o.lowCardMatchIDs[group]], oneSide)
+		}
+		o.lowCardMatches[group] = lowCard.T
+		o.lowCardMatchIDs[group] = sampleID
+	}
+
+	if o.highCardGroups == nil {
+		return nil
+	}
+	for _, sampleID := range highCard.SampleIDs {
+		group := o.highCardGroups[sampleID]
+		if o.lowCardMatches[group] != highCard.T {
+			continue
+		}
+		if o.highCardMatches[group] == highCard.T {
+			return errManyToOneMatching
+		}
+		o.highCardMatches[group] = highCard.T
+	}
+	return nil
+}
+
+// putVectors returns the vectors produced by an operator to its pool.
+func putVectors(o model.VectorOperator, vectors []model.StepVector) {
+	if vectors == nil {
+		return
+	}
+	for _, vector := range vectors {
+		o.GetPool().PutStepVector(vector)
+	}
+	o.GetPool().PutVectors(vectors)
+}
+
 func (o *vectorOperator) GetPool() *model.VectorPool {
 	return o.pool
 }
 
+func (o *vectorOperator) Reset() {
+	o.lhs.Reset()
+	o.rhs.Reset()
+	// Steps are evaluated again after a reset, so previous matches would be reported as duplicates.
+	for i := range o.lowCardMatches {
+		o.lowCardMatches[i] = math.MinInt64
+		o.highCardMatches[i] = math.MinInt64
+	}
+}
+
 // hashSeries calculates the hash of each series from an input operator.
 // Since series from the high cardinality operator can map to multiple output series,
 // hashSeries returns an index from hash to a slice of resulting series, and
@@ -182,7 +313,7 @@ func (o *vectorOperator) hashSeries(series []labels.Labels, keepLabels bool, buf
 	hashes := make(map[uint64][]model.Series)
 	inputIndex := make(map[uint64][]uint64)
 	for i, s := range series {
-		sig, lbls := signature(s, !o.matching.On, o.groupingLabels, keepLabels, buf)
+		sig, lbls := signature(s, !o.matching.On, o.groupingLabels, keepLabels, o.keepMetricName, o.dropMetricName, buf)
 		if _, ok := hashes[sig]; !ok {
 			hashes[sig] = make([]model.Series, 0, 1)
 			inputIndex[sig] = make([]uint64, 0, 1)
@@ -226,13 +357,17 @@ func (o *vectorOperator) join(
 		}
 	}
 
+	lowCardSize := 0
+	for _, series := range lowCardInputIndex {
+		lowCardSize += len(series)
+	}
+
 	highCardOutputIndex := make([]*uint64, outputSize)
-	lowCardOutputIndex := make([][]uint64, len(lowCardInputIndex))
+	lowCardOutputIndex := make([][]uint64, lowCardSize)
 	for hash, highCardSeries := range highCardHashes {
-		lowCardSeriesID := lowCardInputIndex[hash][0]
 		lowCardSeries := lowCardHashes[hash][0]
 		// Each low cardinality series can map to multiple output series.
-		lowCardOutputIndex[lowCardSeriesID] = make([]uint64, 0, len(highCardSeries))
+		lowCardOutputs := make([]uint64, 0, len(highCardSeries))
 
 		for i, output := range highCardSeries {
 			outputSeries := buildOutputSeries(uint64(len(outputIndex)), output, lowCardSeries, includeLabels)
@@ -240,33 +375,44 @@ func (o *vectorOperator) join(
 
 			highCardSeriesID := highCardInputIndex[hash][i]
 			highCardOutputIndex[highCardSeriesID] = &outputSeries.ID
-			lowCardOutputIndex[lowCardSeriesID] = append(lowCardOutputIndex[lowCardSeriesID], outputSeries.ID)
+			lowCardOutputs = append(lowCardOutputs, outputSeries.ID)
+		}
+		// Low cardinality series of the same group can be matched as long as they do not have samples
+		// at the same steps, which is validated for each step. They all map to the same output series,
+		// which take included labels from the first of them.
+		for _, lowCardSeriesID := range lowCardInputIndex[hash] {
+			lowCardOutputIndex[lowCardSeriesID] = lowCardOutputs
 		}
 	}
 
 	return outputIndex, highCardOutputIndex, lowCardOutputIndex
 }
 
-func signature(metric labels.Labels, without bool, grouping []string, keepOriginalLabels bool, buf []byte) (uint64, labels.Labels) {
-	buf = buf[:0]
-	lb := labels.NewBuilder(metric).Del(labels.MetricName)
+func signature(metric labels.Labels, without bool, grouping []string, keepOriginalLabels, keepMetricName, dropMetricName bool, buf []byte) (uint64, labels.Labels) {
+	lb := labels.NewBuilder(metric)
+	if dropMetricName {
+		lb.Del(labels.MetricName)
+	}
 	if without {
-		dropLabels := append(grouping, labels.MetricName)
-		key, _ := metric.HashWithoutLabels(buf, dropLabels...)
+		key, _ := hashMatchingLabels(buf, metric, true, grouping)
 		if !keepOriginalLabels {
-			lb.Del(dropLabels...)
+			lb.Del(grouping...)
 		}
 		return key, lb.Labels(nil)
 	}
 
 	if !keepOriginalLabels {
-		lb.Keep(grouping...)
+		if keepMetricName {
+			lb.Keep(append([]string{labels.MetricName}, grouping...)...)
+		} else {
+			lb.Keep(grouping...)
+		}
 	}
 	if len(grouping) == 0 {
 		return 0, lb.Labels(nil)
 	}
 
-	key, _ := metric.HashForLabels(buf, grouping...)
+	key, _ := hashMatchingLabels(buf, metric, false, grouping)
 	return key, lb.Labels(nil)
 }
 
@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestVectorOperatorMismatchedBatches(t *testing.T) {
+	for _, tcase := range []struct {
+		name          string
+		lhsSteps      int
+		rhsSteps      int
+		expectedSteps int
+		expectedErr   bool
+	}{
+		{name: "same number of steps", lhsSteps: 10, rhsSteps: 10, expectedSteps: 10},
+		{name: "rhs has more steps", lhsSteps: 5, rhsSteps: 10, expectedErr: true},
+		{name: "lhs has more steps", lhsSteps: 10, rhsSteps: 5, expectedErr: true},
+		{name: "rhs is empty", lhsSteps: 10, rhsSteps: 0},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			memory := model.NewMemoryTracker(0)
+			lhs := newStepsOperator(memory, tcase.lhsSteps)
+			rhs := newStepsOperator(memory, tcase.rhsSteps)
+			matching := &parser.VectorMatching{Card: parser.CardOneToOne}
+			op, err := NewVectorOperator(model.NewVectorPool(10), lhs, rhs, matching, parser.ADD, false, &query.Options{})
+			testutil.Ok(t, err)
+
+			ctx := context.Background()
+			_, err = op.Series(ctx)
+			testutil.Ok(t, err)
+
+			vectors, err := op.Next(ctx)
+			if tcase.expectedErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+			testutil.Equals(t, tcase.expectedSteps, len(vectors))
+			// Vectors from both operands have been returned to their pools.
+			testutil.Equals(t, int64(0), memory.Usage())
+		})
+	}
+}
+
+func TestSignatureKeepsLabelsForGroupModifiers(t *testing.T) {
+	lhs := labels.FromStrings(labels.MetricName, "foo", "le", "0.1", "pod", "nginx-1")
+	rhs := labels.FromStrings(labels.MetricName, "bar", "pod", "nginx-1")
+	buf := make([]byte, 1024)
+
+	// foo / ignoring(le) group_left bar
+	lhsKey, lhsLabels := signature(lhs, true, []string{"le"}, true, false, true, buf)
+	rhsKey, _ := signature(rhs, true, []string{"le"}, true, false, true, buf)
+	testutil.Equals(t, lhsKey, rhsKey)
+	// The ignored labels of the many side are kept in the output.
+	testutil.Equals(t, labels.FromStrings("le", "0.1", "pod", "nginx-1"), lhsLabels)
+
+	// foo / on(pod) group_left() bar
+	lhsKey, lhsLabels = signature(lhs, false, []string{"pod"}, true, false, true, buf)
+	rhsKey, _ = signature(rhs, false, []string{"pod"}, true, false, true, buf)
+	testutil.Equals(t, lhsKey, rhsKey)
+	testutil.Equals(t, labels.FromStrings("le", "0.1", "pod", "nginx-1"), lhsLabels)
+}
+
+// stepsOperator returns a single batch with a sample for one series in each step.
+type stepsOperator struct {
+	pool     *model.VectorPool
+	numSteps int
+	done     bool
+}
+
+func newStepsOperator(memory *model.MemoryTracker, numSteps int) *stepsOperator {
+	pool := model.NewVectorPool(10)
+	pool.SetStepSize(1)
+	pool.SetMemoryTracker(memory)
+	return &stepsOperator{pool: pool, numSteps: numSteps}
+}
+
+func (o *stepsOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*stepsOperator]", nil
+}
+
+func (o *stepsOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return []labels.Labels{labels.FromStrings("pod", "nginx-1")}, nil
+}
+
+func (o *stepsOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *stepsOperator) Reset() {
+	o.done = false
+}
+
+func (o *stepsOperator) Next(_ context.Context) ([]model.StepVector, error) {
+	if o.done || o.numSteps == 0 {
+		return nil, nil
+	}
+	o.done = true
+
+	vectors := o.pool.GetVectorBatch()
+	for i := 0; i < o.numSteps; i++ {
+		vector := o.pool.GetStepVector(int64(i) * 30000)
+		vector.SampleIDs = append(vector.SampleIDs, 0)
+		vector.Samples = append(vector.Samples, float64(i))
+		vectors = append(vectors, vector)
+	}
+	return vectors, nil
+}
@@ -0,0 +1,213 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// EstimateCardinality estimates the number of series returned by expr when it is evaluated with opts,
+// without selecting samples from storage. Selectors count the series matching their matchers, and
+// aggregations are estimated from the number of values of their grouping labels. Since samples are not
+// read, estimates assume that series exist in the whole time range of their selector and that binary
+// operations match as many series as possible.
+func EstimateCardinality(ctx context.Context, expr parser.Expr, queryable storage.Queryable, opts *query.Options) (int, error) {
+	e := &cardinalityEstimator{ctx: ctx, queryable: queryable}
+	return e.estimate(expr, opts)
+}
+
+type cardinalityEstimator struct {
+	ctx       context.Context
+	queryable storage.Queryable
+}
+
+func (e *cardinalityEstimator) estimate(expr parser.Expr, opts *query.Options) (int, error) {
+	switch n := expr.(type) {
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return 1, nil
+	case *parser.VectorSelector:
+		return e.countSeries(n, nil, opts, 0)
+	case *logicalplan.FilteredSelector:
+		return e.countSeries(n.VectorSelector, n.Filters, opts, 0)
+	case *parser.MatrixSelector:
+		vs, filters, err := unpackVectorSelector(n)
+		if err != nil {
+			return 0, err
+		}
+		return e.countSeries(vs, filters, opts, n.Range)
+	case *parser.ParenExpr:
+		return e.estimate(n.Expr, opts)
+	case *parser.UnaryExpr:
+		return e.estimate(n.Expr, opts)
+	case *parser.StepInvariantExpr:
+		return e.estimate(n.Expr, opts.WithEndTime(opts.Start))
+	case *parser.SubqueryExpr:
+		subqueryOpts, err := subqueryOptions(opts, n)
+		if err != nil {
+			return 0, err
+		}
+		return e.estimate(n.Expr, subqueryOpts)
+	case *parser.Call:
+		return e.estimateCall(n, opts)
+	case *parser.AggregateExpr:
+		return e.estimateAggregation(n, opts)
+	case *parser.BinaryExpr:
+		return e.estimateBinary(n, opts)
+	}
+	return 0, nil
+}
+
+func (e *cardinalityEstimator) estimateCall(n *parser.Call, opts *query.Options) (int, error) {
+	switch n.Func.Name {
+	case "absent", "absent_over_time", "scalar", "vector", "time":
+		return 1, nil
+	}
+	for _, arg := range n.Args {
+		if t := arg.Type(); t == parser.ValueTypeVector || t == parser.ValueTypeMatrix {
+			return e.estimate(arg, opts)
+		}
+	}
+	return 1, nil
+}
+
+func (e *cardinalityEstimator) estimateAggregation(n *parser.AggregateExpr, opts *query.Options) (int, error) {
+	input, err := e.estimate(n.Expr, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var groups int
+	switch {
+	case n.Without:
+		// Dropping labels can only be estimated from the actual series.
+		groups = input
+	case len(n.Grouping) == 0:
+		groups = 1
+	default:
+		groups, err = e.countGroups(n.Expr, n.Grouping, opts, input)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if groups > input {
+		groups = input
+	}
+
+	switch n.Op {
+	case parser.TOPK, parser.BOTTOMK:
+		k, ok := unwrapNumberLiteral(n.Param)
+		switch {
+		case !ok || k.Val*float64(groups) > float64(input):
+			return input, nil
+		case k.Val < 1:
+			return 0, nil
+		}
+		return int(k.Val) * groups, nil
+	case parser.COUNT_VALUES:
+		return input, nil
+	}
+	return groups, nil
+}
+
+func (e *cardinalityEstimator) estimateBinary(n *parser.BinaryExpr, opts *query.Options) (int, error) {
+	lhs, err := e.estimate(n.LHS, opts)
+	if err != nil {
+		return 0, err
+	}
+	rhs, err := e.estimate(n.RHS, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case n.LHS.Type() == parser.ValueTypeScalar:
+		return rhs, nil
+	case n.RHS.Type() == parser.ValueTypeScalar:
+		return lhs, nil
+	}
+	switch n.Op {
+	case parser.LOR:
+		return lhs + rhs, nil
+	case parser.LAND, parser.LUNLESS:
+		return lhs, nil
+	}
+	switch n.VectorMatching.Card {
+	case parser.CardManyToOne:
+		return lhs, nil
+	case parser.CardOneToMany:
+		return rhs, nil
+	}
+	if rhs < lhs {
+		return rhs, nil
+	}
+	return lhs, nil
+}
+
+// countSeries counts the series which match the selector in its time range.
+func (e *cardinalityEstimator) countSeries(vs *parser.VectorSelector, filters []*labels.Matcher, opts *query.Options, evalRange time.Duration) (int, error) {
+	start, end := getTimeRangesForVectorSelector(vs, opts, evalRange)
+	querier, err := e.queryable.Querier(e.ctx, start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer querier.Close()
+
+	// Same as for the series API, hints tell storage that samples are not needed.
+	hints := &storage.SelectHints{Start: start, End: end, Func: "series"}
+	set := querier.Select(false, hints, append(append([]*labels.Matcher{}, vs.LabelMatchers...), filters...)...)
+	var count int
+	for set.Next() {
+		count++
+	}
+	return count, set.Err()
+}
+
+// countGroups estimates the number of groups of an aggregation by grouping as the product of the number
+// of values of each grouping label, up to limit. Values are only looked up for operands which are selectors,
+// other operands are estimated to have limit groups.
+func (e *cardinalityEstimator) countGroups(expr parser.Expr, grouping []string, opts *query.Options, limit int) (int, error) {
+	var (
+		vs      *parser.VectorSelector
+		filters []*labels.Matcher
+	)
+	switch n := expr.(type) {
+	case *parser.VectorSelector:
+		vs = n
+	case *logicalplan.FilteredSelector:
+		vs, filters = n.VectorSelector, n.Filters
+	default:
+		return limit, nil
+	}
+
+	start, end := getTimeRangesForVectorSelector(vs, opts, 0)
+	querier, err := e.queryable.Querier(e.ctx, start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer querier.Close()
+
+	matchers := append(append([]*labels.Matcher{}, vs.LabelMatchers...), filters...)
+	groups := 1
+	for _, name := range grouping {
+		values, _, err := querier.LabelValues(name, matchers...)
+		if err != nil {
+			return 0, err
+		}
+		if len(values) > 0 {
+			groups *= len(values)
+		}
+		if groups >= limit {
+			return limit, nil
+		}
+	}
+	return groups, nil
+}
@@ -44,6 +44,19 @@ func (c *CancellableOperator) Series(ctx context.Context) ([]labels.Labels, erro
 	}
 }
 
+func (c *CancellableOperator) StreamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return model.StreamSeries(ctx, c.next, fn)
+	}
+}
+
 func (c *CancellableOperator) GetPool() *model.VectorPool {
 	return c.next.GetPool()
 }
+
+func (c *CancellableOperator) Reset() {
+	c.next.Reset()
+}
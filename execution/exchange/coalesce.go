@@ -7,7 +7,9 @@ import (
 	"context"
 	"sync"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-community/promql-engine/execution/model"
 )
@@ -24,9 +26,16 @@ func (c errorChan) getError() error {
 	return nil
 }
 
+// coalesceOperator merges the outputs of multiple operators into a single stream.
+// Series IDs of each operator are offset by the number of series in preceding
+// operators so that IDs from different operators do not collide.
 type coalesceOperator struct {
-	once   sync.Once
-	series []labels.Labels
+	once      sync.Once
+	offsets   []uint64
+	numSeries int
+
+	seriesOnce sync.Once
+	series     []labels.Labels
 
 	pool      *model.VectorPool
 	operators []model.VectorOperator
@@ -47,24 +56,82 @@ func (c *coalesceOperator) GetPool() *model.VectorPool {
 	return c.pool
 }
 
+func (c *coalesceOperator) Reset() {
+	for _, o := range c.operators {
+		o.Reset()
+	}
+}
+
 func (c *coalesceOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 	var err error
-	c.once.Do(func() { err = c.loadSeries(ctx) })
+	c.once.Do(func() { err = c.loadOffsets(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	c.seriesOnce.Do(func() {
+		series := make([]labels.Labels, 0, c.numSeries)
+		err = c.streamSeries(ctx, func(_ uint64, lbls labels.Labels) error {
+			series = append(series, lbls)
+			return nil
+		})
+		c.series = series
+	})
 	if err != nil {
 		return nil, err
 	}
 	return c.series, nil
 }
 
+// StreamSeries streams the series of each operator in turn, with their IDs offset like in Next.
+func (c *coalesceOperator) StreamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error {
+	var err error
+	c.once.Do(func() { err = c.loadOffsets(ctx) })
+	if err != nil {
+		return err
+	}
+	return c.streamSeries(ctx, fn)
+}
+
+func (c *coalesceOperator) streamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error {
+	for opIdx, o := range c.operators {
+		offset := c.offsets[opIdx]
+		if err := model.StreamSeries(ctx, o, func(id uint64, lbls labels.Labels) error {
+			return fn(id+offset, lbls)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *coalesceOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	var err error
+	c.once.Do(func() { err = c.loadOffsets(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
 	var out []model.StepVector = nil
 	var wg sync.WaitGroup
 	var mu sync.RWMutex
+	var (
+		panicMu  sync.Mutex
+		panicked any
+	)
 	var errChan = make(errorChan, len(c.operators))
-	for _, o := range c.operators {
+	for opIdx, o := range c.operators {
 		wg.Add(1)
-		go func(o model.VectorOperator) {
+		go func(opIdx int, o model.VectorOperator) {
 			defer wg.Done()
+			// Panics are propagated to the calling goroutine
+			// so that they can be recovered by the engine.
+			defer func() {
+				if r := recover(); r != nil {
+					panicMu.Lock()
+					panicked = r
+					panicMu.Unlock()
+				}
+			}()
 
 			in, err := o.Next(ctx)
 			if err != nil {
@@ -77,30 +144,42 @@ func (c *coalesceOperator) Next(ctx context.Context) ([]model.StepVector, error)
 			mu.RLock()
 			if len(in) > 0 && out == nil {
 				mu.RUnlock()
-				mu.Lock()
-				if len(in) > 0 && out == nil {
-					out = c.pool.GetVectorBatch()
-					for i := 0; i < len(in); i++ {
-						out = append(out, c.pool.GetStepVector(in[i].T))
+				func() {
+					// Checking out vectors panics when the memory limit is exceeded.
+					mu.Lock()
+					defer mu.Unlock()
+					if len(in) > 0 && out == nil {
+						out = c.pool.GetVectorBatch()
+						for i := 0; i < len(in); i++ {
+							out = append(out, c.pool.GetStepVector(in[i].T))
+						}
 					}
-				}
-				mu.Unlock()
+				}()
 			} else {
 				mu.RUnlock()
 			}
 
-			mu.Lock()
-			for i := 0; i < len(in); i++ {
-				out[i].Samples = append(out[i].Samples, in[i].Samples...)
-				out[i].SampleIDs = append(out[i].SampleIDs, in[i].SampleIDs...)
-				o.GetPool().PutStepVector(in[i])
-			}
-			mu.Unlock()
+			offset := c.offsets[opIdx]
+			func() {
+				// The lock is released with defer, so that a panic does not block other operators.
+				mu.Lock()
+				defer mu.Unlock()
+				for i := 0; i < len(in); i++ {
+					out[i].Samples = append(out[i].Samples, in[i].Samples...)
+					for _, id := range in[i].SampleIDs {
+						out[i].SampleIDs = append(out[i].SampleIDs, id+offset)
+					}
+					o.GetPool().PutStepVector(in[i])
+				}
+			}()
 			o.GetPool().PutVectors(in)
-		}(o)
+		}(opIdx, o)
 	}
 	wg.Wait()
 	close(errChan)
+	if panicked != nil {
+		panic(panicked)
+	}
 
 	if err := errChan.getError(); err != nil {
 		return nil, err
@@ -113,30 +192,53 @@ func (c *coalesceOperator) Next(ctx context.Context) ([]model.StepVector, error)
 	return out, nil
 }
 
-func (c *coalesceOperator) loadSeries(ctx context.Context) error {
-	size := 0
-	for i := 0; i < len(c.operators); i++ {
-		series, err := c.operators[i].Series(ctx)
-		if err != nil {
-			return err
-		}
-		size += len(series)
+// loadOffsets counts the series of all operators to offset their IDs by.
+func (c *coalesceOperator) loadOffsets(ctx context.Context) error {
+	// Series are loaded concurrently and the first error cancels
+	// the context of the remaining operators. They are only counted,
+	// so that operators which stream their series do not collect them.
+	var (
+		mu       sync.Mutex
+		panicked any
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	counts := make([]uint64, len(c.operators))
+	for i := range c.operators {
+		i := i
+		g.Go(func() (err error) {
+			// Panics are propagated to the calling goroutine
+			// so that they can be recovered by the engine.
+			defer func() {
+				if r := recover(); r != nil {
+					mu.Lock()
+					panicked = r
+					mu.Unlock()
+					err = errors.Newf("panic while loading series: %v", r)
+				}
+			}()
+
+			return model.StreamSeries(ctx, c.operators[i], func(uint64, labels.Labels) error {
+				counts[i]++
+				return nil
+			})
+		})
+	}
+	err := g.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+	if err != nil {
+		return err
 	}
 
-	idx := 0
-	result := make([]labels.Labels, size)
-	for _, o := range c.operators {
-		series, err := o.Series(ctx)
-		if err != nil {
-			return err
-		}
-		for i := 0; i < len(series); i++ {
-			result[idx] = series[i]
-			idx++
-		}
+	var size uint64
+	c.offsets = make([]uint64, len(c.operators))
+	for opIdx, count := range counts {
+		c.offsets[opIdx] = size
+		size += count
 	}
-	c.series = result
-	c.pool.SetStepSize(len(c.series))
+	c.numSeries = int(size)
+	c.pool.SetStepSize(c.numSeries)
 
 	return nil
 }
@@ -0,0 +1,251 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/aggregate"
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+const (
+	stepsBatch = 10
+	numSteps   = 25
+)
+
+func TestCoalesceShardedSumByPod(t *testing.T) {
+	series := make([]labels.Labels, 0, 18)
+	for i := 0; i < cap(series); i++ {
+		series = append(series, labels.FromStrings(labels.MetricName, "http_requests_total", "pod", fmt.Sprintf("nginx-%d", i)))
+	}
+	sampleValue := func(seriesID, step int) float64 {
+		return float64(seriesID*100 + step)
+	}
+
+	unsharded := newSeriesOperator(series, 0, sampleValue)
+	expected := drainSum(t, unsharded)
+
+	const numShards = 4
+	shards := make([]model.VectorOperator, 0, numShards)
+	for i := 0; i < numShards; i++ {
+		start := i * len(series) / numShards
+		end := (i + 1) * len(series) / numShards
+		shards = append(shards, newSeriesOperator(series[start:end], start, sampleValue))
+	}
+	coalesce := NewCoalesce(model.NewVectorPool(stepsBatch), shards...)
+
+	coalescedSeries, err := coalesce.Series(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, series, coalescedSeries)
+	testutil.Equals(t, expected, drainSum(t, coalesce))
+}
+
+func TestCoalesceStreamSeries(t *testing.T) {
+	series := make([]labels.Labels, 0, 18)
+	for i := 0; i < cap(series); i++ {
+		series = append(series, labels.FromStrings(labels.MetricName, "http_requests_total", "pod", fmt.Sprintf("nginx-%d", i)))
+	}
+	sampleValue := func(seriesID, step int) float64 {
+		return float64(seriesID*100 + step)
+	}
+	expected := drainSum(t, newSeriesOperator(series, 0, sampleValue))
+
+	const numShards = 4
+	shards := make([]model.VectorOperator, 0, numShards)
+	for i := 0; i < numShards; i++ {
+		start := i * len(series) / numShards
+		end := (i + 1) * len(series) / numShards
+		shards = append(shards, newSeriesOperator(series[start:end], start, sampleValue))
+	}
+	coalesce := NewCoalesce(model.NewVectorPool(stepsBatch), shards...)
+
+	// Series are streamed with the same IDs as the samples of Next.
+	var streamed []labels.Labels
+	testutil.Ok(t, model.StreamSeries(context.Background(), coalesce, func(id uint64, lbls labels.Labels) error {
+		testutil.Equals(t, uint64(len(streamed)), id)
+		streamed = append(streamed, lbls)
+		return nil
+	}))
+	testutil.Equals(t, series, streamed)
+	testutil.Equals(t, expected, drainSum(t, coalesce))
+}
+
+func TestCoalesceSeriesErrorCancelsOtherOperators(t *testing.T) {
+	errSeries := errors.New("failed to load series")
+	operators := []model.VectorOperator{
+		&blockingSeriesOperator{},
+		&errorSeriesOperator{err: errSeries},
+		&blockingSeriesOperator{},
+		&blockingSeriesOperator{},
+	}
+	coalesce := NewCoalesce(model.NewVectorPool(stepsBatch), operators...)
+
+	_, err := coalesce.Series(context.Background())
+	testutil.Equals(t, errSeries, err)
+	for _, o := range operators {
+		if blocking, ok := o.(*blockingSeriesOperator); ok {
+			testutil.Equals(t, context.Canceled, blocking.err)
+		}
+	}
+}
+
+func drainSum(t *testing.T, next model.VectorOperator) [][]float64 {
+	ctx := context.Background()
+	sum, err := aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), next, parser.SUM, nil, true, []string{"pod"}, stepsBatch)
+	testutil.Ok(t, err)
+
+	series, err := sum.Series(ctx)
+	testutil.Ok(t, err)
+
+	var result [][]float64
+	for {
+		vectors, err := sum.Next(ctx)
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		for _, v := range vectors {
+			testutil.Equals(t, len(series), len(v.Samples))
+			samples := make([]float64, len(series))
+			for i, id := range v.SampleIDs {
+				samples[id] = v.Samples[i]
+			}
+			result = append(result, samples)
+			sum.GetPool().PutStepVector(v)
+		}
+		sum.GetPool().PutVectors(vectors)
+	}
+	testutil.Equals(t, numSteps, len(result))
+	return result
+}
+
+func TestPanicsArePropagatedToCaller(t *testing.T) {
+	series := []labels.Labels{labels.FromStrings("pod", "nginx-1"), labels.FromStrings("pod", "nginx-2")}
+	sampleValue := func(seriesID, step int) float64 { return float64(step) }
+	for _, tcase := range []struct {
+		name     string
+		operator func() model.VectorOperator
+	}{
+		{
+			name: "coalesce",
+			operator: func() model.VectorOperator {
+				return NewCoalesce(model.NewVectorPool(stepsBatch),
+					newSeriesOperator(series[:1], 0, sampleValue),
+					&panickingOperator{seriesOperator: *newSeriesOperator(series[1:], 1, sampleValue)},
+				)
+			},
+		},
+		{
+			name: "concurrent",
+			operator: func() model.VectorOperator {
+				return NewConcurrent(&panickingOperator{seriesOperator: *newSeriesOperator(series, 0, sampleValue)}, 2)
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			operator := tcase.operator()
+			_, err := operator.Series(context.Background())
+			testutil.Ok(t, err)
+
+			defer func() {
+				testutil.Equals(t, "operator failed", recover())
+			}()
+			_, _ = operator.Next(context.Background())
+			t.Fatal("expected Next to panic")
+		})
+	}
+}
+
+// seriesOperator produces a sample for each of its series on every step.
+// Sample IDs are local to the operator and start from zero.
+type seriesOperator struct {
+	pool   *model.VectorPool
+	series []labels.Labels
+	step   int
+
+	firstSeriesID int
+	sampleValue   func(seriesID, step int) float64
+}
+
+func newSeriesOperator(series []labels.Labels, firstSeriesID int, sampleValue func(seriesID, step int) float64) *seriesOperator {
+	pool := model.NewVectorPool(stepsBatch)
+	pool.SetStepSize(len(series))
+	return &seriesOperator{
+		pool:          pool,
+		series:        series,
+		firstSeriesID: firstSeriesID,
+		sampleValue:   sampleValue,
+	}
+}
+
+func (o *seriesOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*seriesOperator]", nil
+}
+
+func (o *seriesOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return o.series, nil
+}
+
+func (o *seriesOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *seriesOperator) Reset() {
+	o.step = 0
+}
+
+func (o *seriesOperator) Next(_ context.Context) ([]model.StepVector, error) {
+	if o.step >= numSteps {
+		return nil, nil
+	}
+
+	vectors := o.pool.GetVectorBatch()
+	for i := 0; i < stepsBatch && o.step < numSteps; i++ {
+		vector := o.pool.GetStepVector(int64(o.step) * 30000)
+		for j := range o.series {
+			vector.SampleIDs = append(vector.SampleIDs, uint64(j))
+			vector.Samples = append(vector.Samples, o.sampleValue(o.firstSeriesID+j, o.step))
+		}
+		vectors = append(vectors, vector)
+		o.step++
+	}
+	return vectors, nil
+}
+
+// blockingSeriesOperator blocks in Series until its context is cancelled.
+type blockingSeriesOperator struct {
+	seriesOperator
+	err error
+}
+
+func (o *blockingSeriesOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	<-ctx.Done()
+	o.err = ctx.Err()
+	return nil, o.err
+}
+
+type errorSeriesOperator struct {
+	seriesOperator
+	err error
+}
+
+func (o *errorSeriesOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return nil, o.err
+}
+
+type panickingOperator struct {
+	seriesOperator
+}
+
+func (o *panickingOperator) Next(_ context.Context) ([]model.StepVector, error) {
+	panic("operator failed")
+}
@@ -16,6 +16,8 @@ import (
 type maybeStepVector struct {
 	err        error
 	stepVector []model.StepVector
+	// panicked is the value of a panic in the pulling goroutine.
+	panicked any
 }
 
 type concurrencyOperator struct {
@@ -41,10 +43,22 @@ func (c *concurrencyOperator) Series(ctx context.Context) ([]labels.Labels, erro
 	return c.next.Series(ctx)
 }
 
+func (c *concurrencyOperator) StreamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error {
+	return model.StreamSeries(ctx, c.next, fn)
+}
+
 func (c *concurrencyOperator) GetPool() *model.VectorPool {
 	return c.next.GetPool()
 }
 
+func (c *concurrencyOperator) Reset() {
+	// The buffer is closed once the pulling goroutine is done,
+	// so a new one is needed for the next execution.
+	c.next.Reset()
+	c.once = sync.Once{}
+	c.buffer = make(chan maybeStepVector, c.bufferSize)
+}
+
 func (c *concurrencyOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	c.once.Do(func() {
 		go c.pull(ctx)
@@ -55,6 +69,9 @@ func (c *concurrencyOperator) Next(ctx context.Context) ([]model.StepVector, err
 	if !ok {
 		return nil, nil
 	}
+	if r.panicked != nil {
+		panic(r.panicked)
+	}
 	if r.err != nil {
 		return nil, r.err
 	}
@@ -64,6 +81,13 @@ func (c *concurrencyOperator) Next(ctx context.Context) ([]model.StepVector, err
 
 func (c *concurrencyOperator) pull(ctx context.Context) {
 	defer close(c.buffer)
+	// Panics are propagated to the goroutine calling Next
+	// so that they can be recovered by the engine.
+	defer func() {
+		if r := recover(); r != nil {
+			c.buffer <- maybeStepVector{panicked: r}
+		}
+	}()
 
 	for {
 		select {
@@ -0,0 +1,53 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+var ErrTooManySeries = errors.New("query returns too many series")
+
+type seriesLimitOperator struct {
+	next  model.VectorOperator
+	limit int
+}
+
+// NewSeriesLimit creates an operator which fails with ErrTooManySeries
+// when next returns more than limit series, before any samples are evaluated.
+func NewSeriesLimit(next model.VectorOperator, limit int) model.VectorOperator {
+	return &seriesLimitOperator{next: next, limit: limit}
+}
+
+func (o *seriesLimitOperator) Explain() (string, []model.VectorOperator) {
+	return "[*seriesLimitOperator]", []model.VectorOperator{o.next}
+}
+
+func (o *seriesLimitOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	return o.next.Next(ctx)
+}
+
+func (o *seriesLimitOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) > o.limit {
+		return nil, errors.Wrapf(ErrTooManySeries, "%d series exceed limit of %d", len(series), o.limit)
+	}
+	return series, nil
+}
+
+func (o *seriesLimitOperator) GetPool() *model.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *seriesLimitOperator) Reset() {
+	o.next.Reset()
+}
@@ -43,24 +43,72 @@ import (
 
 const stepsBatch = 10
 
+var ErrTooManySteps = errors.New("query has too many steps")
+
 // New creates new physical query execution for a given query expression which represents logical plan.
 // TODO(bwplotka): Add definition (could be parameters for each execution operator) we can optimize - it would represent physical plan.
-func New(expr parser.Expr, queryable storage.Queryable, mint, maxt time.Time, step, lookbackDelta time.Duration) (model.VectorOperator, error) {
-	opts := &query.Options{
-		Start:         mint,
-		End:           maxt,
-		Step:          step,
-		LookbackDelta: lookbackDelta,
-		StepsBatch:    stepsBatch,
-	}
-	selectorPool := engstore.NewSelectorPool(queryable)
+func New(expr parser.Expr, queryable storage.Queryable, queryOpts *query.Options) (model.VectorOperator, error) {
+	return NewWithSelectorPool(expr, engstore.NewSelectorPool(queryable), queryOpts)
+}
+
+// NewWithSelectorPool creates new physical query execution which selects series using selectorPool.
+// Executions created with the same pool share selectors with the same matchers, time range and hints,
+// so that the series of each selector are only requested from storage once.
+func NewWithSelectorPool(expr parser.Expr, selectorPool *engstore.SelectorPool, queryOpts *query.Options) (model.VectorOperator, error) {
+	opts := *queryOpts
+	opts.StepsBatch = stepsBatch
+	if opts.Step == 0 && opts.End.After(opts.Start) {
+		opts.Step = query.DefaultStep(opts.Start, opts.End)
+	}
+	if len(opts.Timestamps) > 0 {
+		if err := validateTimestamps(expr, opts.Timestamps); err != nil {
+			return nil, err
+		}
+		opts.Start = time.UnixMilli(opts.Timestamps[0])
+		opts.End = time.UnixMilli(opts.Timestamps[len(opts.Timestamps)-1])
+	}
+	if steps := opts.TotalSteps(); opts.MaxSteps > 0 && steps > opts.MaxSteps {
+		return nil, errors.Wrapf(ErrTooManySteps, "%d steps exceed limit of %d", steps, opts.MaxSteps)
+	}
+
 	hints := storage.SelectHints{
-		Start: mint.UnixMilli(),
-		End:   maxt.UnixMilli(),
+		Start: opts.Start.UnixMilli(),
+		End:   opts.End.UnixMilli(),
 		// TODO(fpetkovski): Adjust the step for sub-queries once they are supported.
-		Step: step.Milliseconds(),
+		Step: opts.Step.Milliseconds(),
 	}
-	return newCancellableOperator(expr, selectorPool, opts, hints)
+	operator, err := newCancellableOperator(expr, selectorPool, &opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxSeries > 0 {
+		return exchange.NewSeriesLimit(operator, opts.MaxSeries), nil
+	}
+	return operator, nil
+}
+
+// validateTimestamps checks that timestamps are ascending and that the expression
+// only contains operators which can be evaluated at explicit timestamps.
+func validateTimestamps(expr parser.Expr, timestamps []int64) error {
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] <= timestamps[i-1] {
+			return errors.Newf("timestamps must be in ascending order, got %d after %d", timestamps[i], timestamps[i-1])
+		}
+	}
+
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.MatrixSelector, *parser.NumberLiteral, *parser.StepInvariantExpr, *parser.SubqueryExpr:
+			err = errors.Wrapf(parse.ErrNotSupportedExpr, "evaluating %T at explicit timestamps", node)
+		case *parser.Call:
+			if n.Func.Name == "time" {
+				err = errors.Wrapf(parse.ErrNotSupportedExpr, "evaluating %s at explicit timestamps", n)
+			}
+		}
+		return err
+	})
+	return err
 }
 
 func newCancellableOperator(expr parser.Expr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (*exchange.CancellableOperator, error) {
@@ -75,27 +123,57 @@ func newCancellableOperator(expr parser.Expr, selectorPool *engstore.SelectorPoo
 func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	switch e := expr.(type) {
 	case *parser.NumberLiteral:
-		return scan.NewNumberLiteralSelector(model.NewVectorPool(stepsBatch), opts, e.Val), nil
+		return scan.NewNumberLiteralSelector(newVectorPool(opts), opts, e.Val), nil
 
 	case *parser.VectorSelector:
 		start, end := getTimeRangesForVectorSelector(e, opts, 0)
 		hints.Start = start
 		hints.End = end
 		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints)
-		return newShardedVectorSelector(filter, opts, e.Offset)
+		return newShardedVectorSelector(filter, opts, selectorOffset(e, opts))
 
 	case *logicalplan.FilteredSelector:
 		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
 		hints.Start = start
 		hints.End = end
 		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, hints)
-		return newShardedVectorSelector(selector, opts, e.Offset)
+		return newShardedVectorSelector(selector, opts, selectorOffset(e.VectorSelector, opts))
 
 	case *parser.Call:
+		if function.IsExperimental(e.Func.Name) && !opts.ExperimentalFunctionEnabled(e.Func.Name) {
+			return nil, errors.Wrapf(parse.ErrExperimentalFunction, "%s needs to be enabled", e.Func.Name)
+		}
+		if err := validateCallArgs(e); err != nil {
+			return nil, err
+		}
 		// TODO(saswatamcode): Tracked in https://github.com/thanos-community/promql-engine/issues/23
 		// Based on the category we can create an apt query plan.
-		call, err := function.NewFunctionCall(e.Func)
+		switch e.Func.Name {
+		case "absent":
+			return newAbsentOperator(e, storage, opts, hints)
+		case "absent_over_time":
+			return newAbsentOverTimeOperator(e, storage, opts, hints)
+		case "histogram_quantile":
+			return newHistogramQuantileOperator(e, storage, opts, hints)
+		case "label_replace":
+			return newLabelReplaceOperator(e, storage, opts, hints)
+		case "time":
+			return function.NewTimeOperator(newVectorPool(opts), opts), nil
+		case "info":
+			return newInfoOperator(e, storage, opts, hints)
+		case "limitk", "limit_ratio":
+			return newLimitOperator(e, storage, opts, hints)
+		case "sort", "sort_desc", "sort_by_label", "sort_by_label_desc":
+			// Samples of instant queries are sorted when converting the result, and
+			// series of range queries are always sorted by their labels.
+			return newCancellableOperator(e.Args[0], storage, opts, hints)
+		}
+
+		call, err := function.NewFunctionCall(e.Func, opts)
 		if err != nil {
+			if factory, ok := opts.CustomFunctions[e.Func.Name]; ok {
+				return newCustomFunctionOperator(e, factory, storage, opts, hints)
+			}
 			return nil, err
 		}
 
@@ -121,33 +199,35 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 					return nil, err
 				}
 
-				start, end := getTimeRangesForVectorSelector(vs, opts, t.Range)
-				hints.Start = start
-				hints.End = end
-				hints.Range = t.Range.Milliseconds()
-				filter := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
+				scalarArgs, err := unpackScalarArgs(e, i)
+				if err != nil {
+					return nil, err
+				}
 
-				numShards := runtime.GOMAXPROCS(0) / 2
-				if numShards < 1 {
-					numShards = 1
+				return newShardedMatrixSelector(e, call, scalarArgs, t, vs, filters, storage, opts, hints), nil
+			case *parser.SubqueryExpr:
+				if call == nil {
+					return nil, parse.ErrNotImplemented
 				}
 
-				operators := make([]model.VectorOperator, 0, numShards)
-				for i := 0; i < numShards; i++ {
-					operator := exchange.NewConcurrent(
-						exchange.NewCancellable(
-							scan.NewMatrixSelector(model.NewVectorPool(stepsBatch), filter, call, e, opts, t.Range, vs.Offset, i, numShards),
-						), 2)
-					operators = append(operators, operator)
+				scalarArgs, err := unpackScalarArgs(e, i)
+				if err != nil {
+					return nil, err
 				}
 
-				return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+				return newSubqueryOperator(e, call, scalarArgs, t, storage, opts, hints)
 			}
 		}
 
 		// Does not have matrix arg so create functionOperator normally.
+		// Number literal arguments of functions with a vector argument are
+		// passed as constants, instead of being read from a child operator in every step.
+		foldLiterals := hasVectorArg(e)
 		nextOperators := make([]model.VectorOperator, len(e.Args))
 		for i := range e.Args {
+			if _, ok := unwrapNumberLiteral(e.Args[i]); ok && foldLiterals {
+				continue
+			}
 			next, err := newOperator(e.Args[i], storage, opts, hints)
 			if err != nil {
 				return nil, err
@@ -155,18 +235,38 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			nextOperators[i] = exchange.NewCancellable(next)
 		}
 
-		return function.NewfunctionOperator(e, call, nextOperators, stepsBatch)
+		return function.NewfunctionOperator(e, call, nextOperators, opts)
 
 	case *parser.AggregateExpr:
 		hints.Func = e.Op.String()
 		hints.Grouping = e.Grouping
 		hints.By = !e.Without
 
-		next, err := newCancellableOperator(e.Expr, storage, opts, hints)
+		var (
+			next model.VectorOperator
+			err  error
+		)
+		if vs, ok := e.Expr.(*parser.VectorSelector); ok && canPushdownAggregation(e.Op, vs, opts) {
+			next, err = newAggregatedVectorSelector(vs, storage, opts, hints)
+		} else {
+			next, err = newCancellableOperator(e.Expr, storage, opts, hints)
+		}
 		if err != nil {
 			return nil, err
 		}
-		a, err := aggregate.NewHashAggregate(model.NewVectorPool(stepsBatch), next, e.Op, e.Param, !e.Without, e.Grouping, stepsBatch)
+		if e.Op == parser.TOPK || e.Op == parser.BOTTOMK {
+			// Selectors in the parameter are not aggregated.
+			paramHints := hints
+			paramHints.Func = ""
+			paramHints.Grouping = nil
+			paramHints.By = false
+			paramOp, err := newCancellableOperator(e.Param, storage, opts, paramHints)
+			if err != nil {
+				return nil, err
+			}
+			return aggregate.NewKHashAggregate(newVectorPool(opts), next, paramOp, e.Op, !e.Without, e.Grouping)
+		}
+		a, err := aggregate.NewHashAggregate(newVectorPool(opts), next, e.Op, e.Param, !e.Without, e.Grouping, stepsBatch)
 		if err != nil {
 			return nil, err
 		}
@@ -174,6 +274,12 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		return exchange.NewConcurrent(exchange.NewCancellable(a), 2), nil
 
 	case *parser.BinaryExpr:
+		// Same as in Prometheus, grouping hints are only set for
+		// selectors which are direct operands of an aggregation,
+		// since operands of binary expressions can not be pre-aggregated.
+		hints.Func = ""
+		hints.Grouping = nil
+		hints.By = false
 		if e.LHS.Type() == parser.ValueTypeScalar || e.RHS.Type() == parser.ValueTypeScalar {
 			return newScalarBinaryOperator(e, storage, opts, hints)
 		}
@@ -181,6 +287,8 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		return newVectorBinaryOperator(e, storage, opts, hints)
 
 	case *parser.ParenExpr:
+		hints.Grouping = nil
+		hints.By = false
 		return newCancellableOperator(e.Expr, storage, opts, hints)
 
 	case *parser.StringLiteral:
@@ -188,33 +296,151 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		return nil, errors.Wrapf(parse.ErrNotImplemented, "got: %s", e)
 
 	case *parser.UnaryExpr:
+		hints.Grouping = nil
+		hints.By = false
 		next, err := newCancellableOperator(e.Expr, storage, opts, hints)
 		if err != nil {
 			return nil, err
 		}
 		switch e.Op {
 		case parser.ADD:
+			// Same as in Prometheus, unary plus keeps the metric name.
 			return next, nil
 		case parser.SUB:
-			return unary.NewUnaryNegation(next, stepsBatch)
+			return unary.NewUnaryNegation(next, opts)
 		default:
 			// This shouldn't happen as Op was validated when parsing already
 			// https://github.com/prometheus/prometheus/blob/v2.38.0/promql/parser/parse.go#L573.
 			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
 		}
 
+	case *parser.MatrixSelector:
+		// Range vectors can only be the result of instant queries, in which case
+		// all samples in the range of each series are returned.
+		vs, filters, err := unpackVectorSelector(e)
+		if err != nil {
+			return nil, err
+		}
+		start, end := getTimeRangesForVectorSelector(vs, opts, e.Range)
+		hints.Start = start
+		hints.End = end
+		hints.Range = e.Range.Milliseconds()
+		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
+		return scan.NewMatrixSelector(newVectorPool(opts), selector, nil, nil, nil, opts, e.Range, selectorOffset(vs, opts), 0, 1), nil
+
 	case *parser.StepInvariantExpr:
-		next, err := newCancellableOperator(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
+		// Range vectors are only evaluated at a single step.
+		if e.Expr.Type() == parser.ValueTypeMatrix {
+			return newOperator(e.Expr, storage, opts, hints)
+		}
+		nextOpts := opts.WithEndTime(opts.Start)
+		if opts.SamplesCounter != nil {
+			// Samples of the expression are counted separately, since they are counted for every step.
+			nextOpts.SamplesCounter = model.NewSamplesCounter()
+		}
+		next, err := newCancellableOperator(e.Expr, storage, nextOpts, hints)
 		if err != nil {
 			return nil, err
 		}
-		return step_invariant.NewStepInvariantOperator(model.NewVectorPool(stepsBatch), next, e.Expr, opts)
+		return step_invariant.NewStepInvariantOperator(newVectorPool(opts), next, e.Expr, opts, nextOpts.SamplesCounter)
 
 	default:
 		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
 	}
 }
 
+// validateCallArgs checks the number and types of the arguments of a function call with the same
+// rules and error messages as the prometheus parser. Calls in parsed queries are already checked by
+// the parser, but plans can also contain calls which were built or rewritten without parsing.
+func validateCallArgs(e *parser.Call) error {
+	nargs := len(e.Func.ArgTypes)
+	if e.Func.Variadic == 0 {
+		if nargs != len(e.Args) {
+			return errors.Newf("expected %d argument(s) in call to %q, got %d", nargs, e.Func.Name, len(e.Args))
+		}
+	} else {
+		na := nargs - 1
+		if na > len(e.Args) {
+			return errors.Newf("expected at least %d argument(s) in call to %q, got %d", na, e.Func.Name, len(e.Args))
+		} else if nargsmax := na + e.Func.Variadic; e.Func.Variadic > 0 && nargsmax < len(e.Args) {
+			return errors.Newf("expected at most %d argument(s) in call to %q, got %d", nargsmax, e.Func.Name, len(e.Args))
+		}
+	}
+
+	for i, arg := range e.Args {
+		if i >= nargs {
+			i = nargs - 1
+		}
+		if want := e.Func.ArgTypes[i]; arg.Type() != want {
+			return errors.Newf("expected type %s in call to function %q, got %s", parser.DocumentedType(want), e.Func.Name, parser.DocumentedType(arg.Type()))
+		}
+	}
+	return nil
+}
+
+// unpackScalarArgs returns the values of all arguments of a function call
+// except the matrix argument at matrixIdx. Only number literals are currently
+// supported as additional arguments to functions over range vectors.
+func unpackScalarArgs(e *parser.Call, matrixIdx int) ([]float64, error) {
+	args := make([]float64, 0, len(e.Args)-1)
+	for i, arg := range e.Args {
+		if i == matrixIdx {
+			continue
+		}
+		literal, ok := unwrapNumberLiteral(arg)
+		if !ok {
+			return nil, errors.Wrapf(parse.ErrNotImplemented, "got non-literal argument in %s", e)
+		}
+		args = append(args, literal.Val)
+	}
+
+	switch e.Func.Name {
+	case "holt_winters", "double_exponential_smoothing":
+		if sf := args[0]; sf <= 0 || sf >= 1 {
+			return nil, errors.Newf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+		}
+		if tf := args[1]; tf <= 0 || tf >= 1 {
+			return nil, errors.Newf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+		}
+	}
+	return args, nil
+}
+
+func hasVectorArg(e *parser.Call) bool {
+	for _, arg := range e.Args {
+		if arg.Type() == parser.ValueTypeVector {
+			return true
+		}
+	}
+	return false
+}
+
+func unwrapNumberLiteral(expr parser.Expr) (*parser.NumberLiteral, bool) {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		return e, true
+	case *parser.ParenExpr:
+		return unwrapNumberLiteral(e.Expr)
+	case *parser.StepInvariantExpr:
+		return unwrapNumberLiteral(e.Expr)
+	default:
+		return nil, false
+	}
+}
+
+func unwrapStringLiteral(expr parser.Expr) (*parser.StringLiteral, bool) {
+	switch e := expr.(type) {
+	case *parser.StringLiteral:
+		return e, true
+	case *parser.ParenExpr:
+		return unwrapStringLiteral(e.Expr)
+	case *parser.StepInvariantExpr:
+		return unwrapStringLiteral(e.Expr)
+	default:
+		return nil, false
+	}
+}
+
 func unpackVectorSelector(t *parser.MatrixSelector) (*parser.VectorSelector, []*labels.Matcher, error) {
 	switch t := t.VectorSelector.(type) {
 	case *parser.VectorSelector:
@@ -226,6 +452,306 @@ func unpackVectorSelector(t *parser.MatrixSelector) (*parser.VectorSelector, []*
 	}
 }
 
+func newShardedMatrixSelector(
+	e *parser.Call,
+	call function.FunctionCall,
+	scalarArgs []float64,
+	t *parser.MatrixSelector,
+	vs *parser.VectorSelector,
+	filters []*labels.Matcher,
+	storage *engstore.SelectorPool,
+	opts *query.Options,
+	hints storage.SelectHints,
+) model.VectorOperator {
+	start, end := getTimeRangesForVectorSelector(vs, opts, t.Range)
+	hints.Start = start
+	hints.End = end
+	hints.Range = t.Range.Milliseconds()
+	filter := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
+
+	numShards := runtime.GOMAXPROCS(0) / 2
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	operators := make([]model.VectorOperator, 0, numShards)
+	for i := 0; i < numShards; i++ {
+		operator := exchange.NewConcurrent(
+			exchange.NewCancellable(
+				scan.NewMatrixSelector(newVectorPool(opts), filter, call, e, scalarArgs, opts, t.Range, selectorOffset(vs, opts), i, numShards),
+			), 2)
+		operators = append(operators, operator)
+	}
+
+	return exchange.NewCoalesce(newVectorPool(opts), operators...)
+}
+
+// newAbsentOverTimeOperator creates an operator which counts the samples in the range
+// of the selector and produces a sample for each step without any.
+func newAbsentOverTimeOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	t, ok := e.Args[0].(*parser.MatrixSelector)
+	if !ok {
+		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
+	}
+	vs, filters, err := unpackVectorSelector(t)
+	if err != nil {
+		return nil, err
+	}
+
+	hints.Func = e.Func.Name
+	hints.Grouping = nil
+	hints.By = false
+
+	matchers := append(append([]*labels.Matcher{}, vs.LabelMatchers...), filters...)
+	next := newShardedMatrixSelector(e, function.Funcs["count_over_time"], nil, t, vs, filters, storage, opts, hints)
+	return function.NewAbsentOperator(e, newVectorPool(opts), next, matchers, opts), nil
+}
+
+func newAbsentOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	next, err := newCancellableOperator(e.Args[0], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same as in Prometheus, labels are only derived from the matchers of a
+	// plain selector. Other expressions, like selectors joined with `or`,
+	// produce a series without labels since their matchers are ambiguous.
+	var matchers []*labels.Matcher
+	switch t := e.Args[0].(type) {
+	case *parser.VectorSelector:
+		matchers = t.LabelMatchers
+	case *logicalplan.FilteredSelector:
+		matchers = append(append([]*labels.Matcher{}, t.LabelMatchers...), t.Filters...)
+	}
+	return function.NewAbsentOperator(e, newVectorPool(opts), next, matchers, opts), nil
+}
+
+func newLabelReplaceOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	args := make([]string, 0, len(e.Args)-1)
+	for _, arg := range e.Args[1:] {
+		literal, ok := unwrapStringLiteral(arg)
+		if !ok {
+			return nil, errors.Wrapf(parse.ErrNotImplemented, "got non-literal argument in %s", e)
+		}
+		args = append(args, literal.Val)
+	}
+
+	hints.Func = e.Func.Name
+	hints.Grouping = nil
+	hints.By = false
+	next, err := newCancellableOperator(e.Args[0], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return function.NewLabelReplaceOperator(e, next, args[0], args[1], args[2], args[3])
+}
+
+// newCustomFunctionOperator creates the operator of a call of a custom function with factory.
+func newCustomFunctionOperator(e *parser.Call, factory query.FunctionFactory, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	args := make([]model.VectorOperator, len(e.Args))
+	for i, arg := range e.Args {
+		switch arg.Type() {
+		case parser.ValueTypeString:
+			continue
+		case parser.ValueTypeMatrix:
+			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got range vector argument of custom function: %s", e)
+		}
+		next, err := newCancellableOperator(arg, storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = next
+	}
+	return factory(e, args, opts)
+}
+
+// newSubqueryOperator creates an operator which applies call over the range of subquery.
+// The inner expression of the subquery is evaluated with the options from subqueryOptions.
+func newSubqueryOperator(
+	e *parser.Call,
+	call function.FunctionCall,
+	scalarArgs []float64,
+	subquery *parser.SubqueryExpr,
+	storage *engstore.SelectorPool,
+	opts *query.Options,
+	hints storage.SelectHints,
+) (model.VectorOperator, error) {
+	subqueryOpts, err := subqueryOptions(opts, subquery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Points of the subquery are counted by the subquery operator instead.
+	subqueryOpts.SamplesCounter = nil
+	hints.Step = subqueryOpts.Step.Milliseconds()
+	next, err := newCancellableOperator(subquery.Expr, storage, subqueryOpts, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	operator := scan.NewSubqueryOperator(newVectorPool(opts), next, call, e, scalarArgs, opts, subquery.Range, subqueryOffset(subquery), subquery.Timestamp)
+	return exchange.NewConcurrent(exchange.NewCancellable(operator), 2), nil
+}
+
+// subqueryOptions returns the options for evaluating the inner expression of subquery.
+// Same as in Prometheus, inner steps are aligned to multiples of the subquery step, starting
+// from the first aligned step in the range of the first outer step and ending at the last outer step.
+// Both are shifted by the offset of the subquery. Subqueries with the @ modifier are only
+// evaluated at its timestamp, which is the same for all outer steps.
+func subqueryOptions(opts *query.Options, subquery *parser.SubqueryExpr) (*query.Options, error) {
+	step := subquery.Step
+	if step == 0 {
+		if opts.NoStepSubqueryIntervalFn == nil {
+			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got subquery without step: %s", subquery)
+		}
+		step = time.Duration(opts.NoStepSubqueryIntervalFn(subquery.Range.Milliseconds())) * time.Millisecond
+	}
+
+	var (
+		stepMillis = step.Milliseconds()
+		offset     = subqueryOffset(subquery).Milliseconds()
+		mint, maxt = opts.Start.UnixMilli(), opts.End.UnixMilli()
+	)
+	if subquery.Timestamp != nil {
+		mint, maxt = *subquery.Timestamp, *subquery.Timestamp
+	}
+	rangeStart := mint - offset - subquery.Range.Milliseconds()
+	start := stepMillis * (rangeStart / stepMillis)
+	if start < rangeStart {
+		start += stepMillis
+	}
+
+	result := *opts
+	result.Start = time.UnixMilli(start)
+	result.End = time.UnixMilli(maxt - offset)
+	result.Step = step
+	result.Timestamps = nil
+	return &result, nil
+}
+
+// subqueryOffset returns the offset of subquery relative to its evaluation time. The offset of subqueries with
+// the @ modifier is adjusted relative to the start of the query when planning, so the original offset is used
+// for them instead, since they are evaluated at the timestamp of the modifier.
+func subqueryOffset(subquery *parser.SubqueryExpr) time.Duration {
+	if subquery.Timestamp != nil {
+		return subquery.OriginalOffset
+	}
+	return subquery.Offset
+}
+
+// selectorOffset returns the offset of vs for evaluating it with opts.
+// Selectors with the @ modifier are step invariant and only evaluated at the start of opts,
+// which for selectors in subqueries is not the start of the query that their offset was set for.
+func selectorOffset(vs *parser.VectorSelector, opts *query.Options) time.Duration {
+	if vs.Timestamp == nil {
+		return vs.Offset
+	}
+	return vs.OriginalOffset + time.Duration(opts.Start.UnixMilli()-*vs.Timestamp)*time.Millisecond
+}
+
+func newHistogramQuantileOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	hints.Func = e.Func.Name
+	hints.Grouping = nil
+	hints.By = false
+
+	scalarOp, err := newCancellableOperator(e.Args[0], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	vectorOp, err := newCancellableOperator(e.Args[1], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return function.NewHistogramOperator(newVectorPool(opts), scalarOp, vectorOp, opts), nil
+}
+
+// newInfoOperator creates the operator of a call of info. Same as in Prometheus, the optional second argument
+// selects the info series. It selects target_info series unless it has a matcher on the metric name, and
+// its other matchers select the data labels which are added to series.
+func newInfoOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	var matchers []*labels.Matcher
+	if len(e.Args) > 1 {
+		switch t := e.Args[1].(type) {
+		case *parser.VectorSelector:
+			matchers = t.LabelMatchers
+		case *logicalplan.FilteredSelector:
+			matchers = append(append([]*labels.Matcher{}, t.LabelMatchers...), t.Filters...)
+		default:
+			return nil, errors.Newf("expected label selectors as the second argument to info, got %s", e.Args[1])
+		}
+	}
+
+	var (
+		dataMatchers []*labels.Matcher
+		infoMatchers []*labels.Matcher
+		hasName      bool
+	)
+	for _, m := range matchers {
+		if m.Name == labels.MetricName {
+			hasName = true
+		} else {
+			dataMatchers = append(dataMatchers, m)
+		}
+		infoMatchers = append(infoMatchers, m)
+	}
+	if !hasName {
+		infoMatchers = append(infoMatchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "target_info"))
+	}
+
+	hints.Func = ""
+	hints.Grouping = nil
+	hints.By = false
+	next, err := newCancellableOperator(e.Args[0], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	info, err := newCancellableOperator(&parser.VectorSelector{LabelMatchers: infoMatchers}, storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return function.NewInfoOperator(newVectorPool(opts), next, info, dataMatchers), nil
+}
+
+func newLimitOperator(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	// Series are kept with their original labels, so selectors can not be aggregated.
+	hints.Func = ""
+	hints.Grouping = nil
+	hints.By = false
+
+	paramOp, err := newCancellableOperator(e.Args[0], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	next, err := newCancellableOperator(e.Args[1], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate.NewLimitAggregate(newVectorPool(opts), next, paramOp, e.Func.Name)
+}
+
+// canPushdownAggregation returns whether op can be partially evaluated in storage for the series
+// of vs. This is only the case for aggregations which return the same result when they are evaluated
+// again over partial results, and for selectors which are evaluated at the steps of the query.
+func canPushdownAggregation(op parser.ItemType, vs *parser.VectorSelector, opts *query.Options) bool {
+	if !opts.EnableAggregationPushdown {
+		return false
+	}
+	switch op {
+	case parser.SUM, parser.MIN, parser.MAX, parser.GROUP:
+	default:
+		return false
+	}
+	return vs.OriginalOffset == 0 && vs.Timestamp == nil && vs.StartOrEnd == 0 && len(opts.Timestamps) == 0
+}
+
+func newAggregatedVectorSelector(e *parser.VectorSelector, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	start, end := getTimeRangesForVectorSelector(e, opts, 0)
+	hints.Start = start
+	hints.End = end
+	selector := storage.GetAggregatedSelector(start, end, opts.Step.Milliseconds(), opts.LookbackDelta.Milliseconds(), e.LabelMatchers, hints)
+	return newShardedVectorSelector(selector, opts, e.Offset)
+}
+
 func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration) (model.VectorOperator, error) {
 	numShards := runtime.GOMAXPROCS(0) / 2
 	if numShards < 1 {
@@ -236,11 +762,11 @@ func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Opti
 		operator := exchange.NewConcurrent(
 			exchange.NewCancellable(
 				scan.NewVectorSelector(
-					model.NewVectorPool(stepsBatch), selector, opts, offset, i, numShards)), 2)
+					newVectorPool(opts), selector, opts, offset, i, numShards)), 2)
 		operators = append(operators, operator)
 	}
 
-	return exchange.NewCoalesce(model.NewVectorPool(stepsBatch), operators...), nil
+	return exchange.NewCoalesce(newVectorPool(opts), operators...), nil
 }
 
 func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -252,7 +778,10 @@ func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 	if err != nil {
 		return nil, err
 	}
-	return binary.NewVectorOperator(model.NewVectorPool(stepsBatch), leftOperator, rightOperator, e.VectorMatching, e.Op)
+	if e.Op == parser.LOR {
+		return binary.NewOrOperator(newVectorPool(opts), leftOperator, rightOperator, e.VectorMatching, opts), nil
+	}
+	return binary.NewVectorOperator(newVectorPool(opts), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts)
 }
 
 func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -273,7 +802,13 @@ func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 		scalarSide = binary.ScalarSideLeft
 	}
 
-	return binary.NewScalar(model.NewVectorPool(stepsBatch), lhs, rhs, e.Op, scalarSide)
+	return binary.NewScalar(newVectorPool(opts), lhs, rhs, e.Op, scalarSide, e.ReturnBool, opts)
+}
+
+func newVectorPool(opts *query.Options) *model.VectorPool {
+	pool := model.NewVectorPool(stepsBatch)
+	pool.SetMemoryTracker(opts.MemoryTracker)
+	return pool
 }
 
 // Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/engine.go#L791.
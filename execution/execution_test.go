@@ -0,0 +1,442 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestSubqueryOptions(t *testing.T) {
+	for _, tcase := range []struct {
+		name  string
+		query string
+
+		// All times are in milliseconds.
+		start int64
+		end   int64
+		step  int64
+
+		expectedStart int64
+		expectedEnd   int64
+		expectedStep  int64
+	}{
+		{
+			name:          "aligned range",
+			query:         "max_over_time(foo[5m:1m])",
+			start:         0,
+			end:           240000,
+			step:          30000,
+			expectedStart: -300000,
+			expectedEnd:   240000,
+			expectedStep:  60000,
+		},
+		{
+			name:          "unaligned range",
+			query:         "max_over_time(foo[1m:45s])",
+			start:         200000,
+			end:           300000,
+			step:          30000,
+			expectedStart: 180000,
+			expectedEnd:   300000,
+			expectedStep:  45000,
+		},
+		{
+			name:          "unaligned negative range",
+			query:         "max_over_time(foo[5m:1m])",
+			start:         100000,
+			end:           100000,
+			expectedStart: -180000,
+			expectedEnd:   100000,
+			expectedStep:  60000,
+		},
+		{
+			name:          "offset",
+			query:         "max_over_time(foo[1m:30s] offset 1m)",
+			start:         200000,
+			end:           300000,
+			step:          30000,
+			expectedStart: 90000,
+			expectedEnd:   240000,
+			expectedStep:  30000,
+		},
+		{
+			name:          "without step",
+			query:         "max_over_time(foo[1m:])",
+			start:         200000,
+			end:           300000,
+			step:          30000,
+			expectedStart: 140000,
+			expectedEnd:   300000,
+			expectedStep:  10000,
+		},
+		{
+			name:          "@ modifier",
+			query:         "max_over_time(foo[1m:30s] @ 100 offset 10s)",
+			start:         200000,
+			end:           300000,
+			step:          30000,
+			expectedStart: 30000,
+			expectedEnd:   90000,
+			expectedStep:  30000,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.query)
+			testutil.Ok(t, err)
+
+			opts := &query.Options{
+				Start: time.UnixMilli(tcase.start),
+				End:   time.UnixMilli(tcase.end),
+				Step:  time.Duration(tcase.step) * time.Millisecond,
+				NoStepSubqueryIntervalFn: func(int64) int64 {
+					return 10000
+				},
+			}
+			expr = logicalplan.New(expr, opts.Start, opts.End).Expr()
+			if stepInvariant, ok := expr.(*parser.StepInvariantExpr); ok {
+				expr = stepInvariant.Expr
+			}
+			subquery := expr.(*parser.Call).Args[0].(*parser.SubqueryExpr)
+
+			subqueryOpts, err := subqueryOptions(opts, subquery)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedStart, subqueryOpts.Start.UnixMilli())
+			testutil.Equals(t, tcase.expectedEnd, subqueryOpts.End.UnixMilli())
+			testutil.Equals(t, tcase.expectedStep, subqueryOpts.Step.Milliseconds())
+
+			// The options of the enclosing query are not modified.
+			testutil.Equals(t, tcase.start, opts.Start.UnixMilli())
+		})
+	}
+
+	t.Run("without step and interval function", func(t *testing.T) {
+		expr, err := parser.ParseExpr("max_over_time(foo[1m:])")
+		testutil.Ok(t, err)
+
+		_, err = subqueryOptions(&query.Options{}, expr.(*parser.Call).Args[0].(*parser.SubqueryExpr))
+		testutil.NotOk(t, err)
+	})
+}
+
+func TestTimeRangesForVectorSelector(t *testing.T) {
+	for _, tcase := range []struct {
+		name      string
+		query     string
+		evalRange time.Duration
+
+		// All times are in milliseconds.
+		expectedStart int64
+		expectedEnd   int64
+	}{
+		{
+			name:          "selector",
+			query:         "foo",
+			expectedStart: 240000,
+			expectedEnd:   600000,
+		},
+		{
+			name:          "@ before start",
+			query:         "foo @ 30",
+			expectedStart: -30000,
+			expectedEnd:   30000,
+		},
+		{
+			name:          "@ after end",
+			query:         "foo @ 900",
+			expectedStart: 840000,
+			expectedEnd:   900000,
+		},
+		{
+			name:          "@ before start with negative offset",
+			query:         "foo @ 30 offset -2m",
+			expectedStart: 90000,
+			expectedEnd:   150000,
+		},
+		{
+			name:          "@ before start with offset",
+			query:         "foo @ 120 offset 1m",
+			expectedStart: 0,
+			expectedEnd:   60000,
+		},
+		{
+			name:          "range with @ before start",
+			query:         "rate(foo[2m] @ 60)",
+			evalRange:     2 * time.Minute,
+			expectedStart: -60000,
+			expectedEnd:   60000,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.query)
+			testutil.Ok(t, err)
+
+			opts := &query.Options{
+				Start:         time.Unix(300, 0),
+				End:           time.Unix(600, 0),
+				Step:          30 * time.Second,
+				LookbackDelta: time.Minute,
+			}
+			expr = logicalplan.New(expr, opts.Start, opts.End).Expr()
+
+			var selector *parser.VectorSelector
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					selector = vs
+				}
+				return nil
+			})
+			testutil.Assert(t, selector != nil)
+
+			start, end := getTimeRangesForVectorSelector(selector, opts, tcase.evalRange)
+			testutil.Equals(t, tcase.expectedStart, start)
+			testutil.Equals(t, tcase.expectedEnd, end)
+		})
+	}
+}
+
+func TestFunctionNumberLiteralArgsAreFolded(t *testing.T) {
+	for _, tcase := range []struct {
+		query                 string
+		expectedScalarOperand bool
+	}{
+		{query: "clamp_max(foo, 100)"},
+		{query: "clamp(foo, 0, (100))"},
+		{query: "clamp_min(foo, -1)"},
+		{query: "clamp_max(foo, scalar(bar))", expectedScalarOperand: true},
+		{query: "vector(1)", expectedScalarOperand: true},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.query)
+			testutil.Ok(t, err)
+			opts := &query.Options{
+				Start:         time.Unix(0, 0),
+				End:           time.Unix(600, 0),
+				Step:          30 * time.Second,
+				LookbackDelta: 5 * time.Minute,
+			}
+			expr = logicalplan.New(expr, opts.Start, opts.End).Expr()
+
+			op, err := New(expr, &storage.MockQueryable{MockQuerier: &storage.MockQuerier{}}, opts)
+			testutil.Ok(t, err)
+
+			var operators []string
+			var explain func(op model.VectorOperator)
+			explain = func(op model.VectorOperator) {
+				me, next := op.Explain()
+				operators = append(operators, me)
+				for _, n := range next {
+					explain(n)
+				}
+			}
+			explain(op)
+
+			var hasScalarOperand bool
+			for _, me := range operators {
+				if strings.HasPrefix(me, "[*numberLiteralSelector]") || strings.HasPrefix(me, "[*functionOperator] scalar") {
+					hasScalarOperand = true
+				}
+			}
+			testutil.Equals(t, tcase.expectedScalarOperand, hasScalarOperand, "operators: %v", operators)
+		})
+	}
+}
+
+func TestStreamSeriesMatchesSeries(t *testing.T) {
+	queryable := &storage.MockQueryable{MockQuerier: &storage.MockQuerier{
+		SelectMockFunction: func(bool, *storage.SelectHints, ...*labels.Matcher) storage.SeriesSet {
+			series := make([]storage.Series, 0, 20)
+			for i := 0; i < 20; i++ {
+				series = append(series, storage.MockSeries([]int64{0}, []float64{float64(i)}, []string{
+					labels.MetricName, "http_requests_total",
+					"namespace", fmt.Sprintf("namespace-%d", i%3),
+					"pod", fmt.Sprintf("pod-%d", i),
+				}))
+			}
+			return &sliceSeriesSet{series: series}
+		},
+	}}
+
+	for _, qs := range []string{
+		"http_requests_total",
+		"rate(http_requests_total[1m])",
+		"sum by (namespace) (http_requests_total)",
+		"http_requests_total * on (pod) http_requests_total",
+	} {
+		t.Run(qs, func(t *testing.T) {
+			expr, err := parser.ParseExpr(qs)
+			testutil.Ok(t, err)
+			opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), LookbackDelta: 5 * time.Minute}
+
+			// The order of series of some operators, like binary operators, differs between operators
+			// created for the same query, which is why series are streamed from the same operator.
+			op, err := New(expr, queryable, opts)
+			testutil.Ok(t, err)
+			var streamed []labels.Labels
+			testutil.Ok(t, model.StreamSeries(context.Background(), op, func(id uint64, lbls labels.Labels) error {
+				testutil.Equals(t, uint64(len(streamed)), id)
+				streamed = append(streamed, lbls)
+				return nil
+			}))
+			expected, err := op.Series(context.Background())
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(expected), len(streamed))
+			testutil.Equals(t, expected, streamed)
+
+			// Streaming stops at the first error of fn.
+			var numStreamed int
+			err = model.StreamSeries(context.Background(), op, func(uint64, labels.Labels) error {
+				numStreamed++
+				return errors.New("stop")
+			})
+			testutil.NotOk(t, err)
+			testutil.Equals(t, 1, numStreamed)
+		})
+	}
+}
+
+func BenchmarkLabelsInterner(b *testing.B) {
+	const numSeries = 10000
+	// Every select returns labels with newly allocated strings,
+	// similar to storage which decodes series from the network.
+	queryable := &storage.MockQueryable{MockQuerier: &storage.MockQuerier{
+		SelectMockFunction: func(bool, *storage.SelectHints, ...*labels.Matcher) storage.SeriesSet {
+			series := make([]storage.Series, 0, numSeries)
+			for i := 0; i < numSeries; i++ {
+				series = append(series, storage.MockSeries(nil, nil, []string{
+					strings.Clone(labels.MetricName), strings.Clone("http_requests_total"),
+					strings.Clone("cluster"), strings.Clone("eu-west-1"),
+					strings.Clone("namespace"), fmt.Sprintf("namespace-%d", i%10),
+					strings.Clone("pod"), fmt.Sprintf("pod-%d", i),
+				}))
+			}
+			return &sliceSeriesSet{series: series}
+		},
+	}}
+
+	for _, qs := range []string{"http_requests_total", "http_requests_total * http_requests_total"} {
+		expr, err := parser.ParseExpr(qs)
+		testutil.Ok(b, err)
+
+		for _, interning := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/interning=%t", qs, interning), func(b *testing.B) {
+				b.ReportAllocs()
+
+				// Keep the series of all queries alive to measure the retained memory.
+				retained := make([][]labels.Labels, b.N)
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					opts := &query.Options{
+						Start:         time.Unix(0, 0),
+						End:           time.Unix(0, 0),
+						LookbackDelta: 5 * time.Minute,
+					}
+					if interning {
+						opts.LabelsInterner = model.NewLabelsInterner()
+					}
+
+					op, err := New(expr, queryable, opts)
+					testutil.Ok(b, err)
+					retained[i], err = op.Series(context.Background())
+					testutil.Ok(b, err)
+				}
+				b.StopTimer()
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "retained-B/op")
+				runtime.KeepAlive(retained)
+			})
+		}
+	}
+}
+
+type sliceSeriesSet struct {
+	series []storage.Series
+	i      int
+}
+
+func (s *sliceSeriesSet) Next() bool {
+	s.i++
+	return s.i <= len(s.series)
+}
+
+func (s *sliceSeriesSet) At() storage.Series { return s.series[s.i-1] }
+
+func (s *sliceSeriesSet) Err() error { return nil }
+
+func (s *sliceSeriesSet) Warnings() storage.Warnings { return nil }
+
+func TestExperimentalFunctionsNeedToBeEnabled(t *testing.T) {
+	expr, err := parser.ParseExpr(`sort_by_label(foo, "pod")`)
+	testutil.Ok(t, err)
+	opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), LookbackDelta: 5 * time.Minute}
+
+	_, err = New(expr, storage.QueryableFunc(nil), opts)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, parse.ErrExperimentalFunction), "unexpected error %v", err)
+
+	opts.EnableExperimentalFunctions = []string{"sort_by_label"}
+	_, err = New(expr, storage.QueryableFunc(nil), opts)
+	testutil.Assert(t, !errors.Is(err, parse.ErrExperimentalFunction), "unexpected error %v", err)
+}
+
+func TestCallArgumentsAreValidated(t *testing.T) {
+	foo := &parser.VectorSelector{Name: "foo", LabelMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "foo")}}
+	for _, tcase := range []struct {
+		query string
+		expr  *parser.Call
+	}{
+		{
+			query: "scalar(foo[5m])",
+			expr:  &parser.Call{Func: parser.Functions["scalar"], Args: parser.Expressions{&parser.MatrixSelector{VectorSelector: foo, Range: 5 * time.Minute}}},
+		},
+		{
+			query: "rate(foo)",
+			expr:  &parser.Call{Func: parser.Functions["rate"], Args: parser.Expressions{foo}},
+		},
+		{
+			query: "abs(foo, foo)",
+			expr:  &parser.Call{Func: parser.Functions["abs"], Args: parser.Expressions{foo, foo}},
+		},
+		{
+			query: `round(foo, "1")`,
+			expr:  &parser.Call{Func: parser.Functions["round"], Args: parser.Expressions{foo, &parser.StringLiteral{Val: "1"}}},
+		},
+		{
+			query: "round(foo, 1, 2)",
+			expr:  &parser.Call{Func: parser.Functions["round"], Args: parser.Expressions{foo, &parser.NumberLiteral{Val: 1}, &parser.NumberLiteral{Val: 2}}},
+		},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			// Plans built without parsing are rejected with the same error as the parser returns.
+			_, parseErr := parser.ParseExpr(tcase.query)
+			testutil.NotOk(t, parseErr)
+
+			opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), LookbackDelta: 5 * time.Minute}
+			_, err := New(tcase.expr, storage.QueryableFunc(nil), opts)
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.HasSuffix(parseErr.Error(), err.Error()), "expected %q to end with %q", parseErr, err)
+		})
+	}
+}
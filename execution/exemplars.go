@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/logicalplan"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// Exemplars selects the exemplars of series which are read by the selectors in expr.
+// Each selector reads exemplars from the same time range from which
+// it reads samples when expr is evaluated with opts.
+func Exemplars(expr parser.Expr, querier storage.ExemplarQuerier, opts *query.Options) ([]exemplar.QueryResult, error) {
+	type timeRange struct{ start, end int64 }
+	var (
+		ranges   []timeRange
+		matchers = make(map[timeRange][][]*labels.Matcher)
+	)
+	err := walkSelectors(expr, opts, func(vs *parser.VectorSelector, filters []*labels.Matcher, opts *query.Options, evalRange time.Duration) {
+		start, end := getTimeRangesForVectorSelector(vs, opts, evalRange)
+		r := timeRange{start: start, end: end}
+		if _, ok := matchers[r]; !ok {
+			ranges = append(ranges, r)
+		}
+		matchers[r] = append(matchers[r], append(append([]*labels.Matcher{}, vs.LabelMatchers...), filters...))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Selectors with the same time range are selected together.
+	var result []exemplar.QueryResult
+	for _, r := range ranges {
+		exemplars, err := querier.Select(r.start, r.end, matchers[r]...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, exemplars...)
+	}
+	return result, nil
+}
+
+// walkSelectors calls f for every selector in expr with the options and range it is evaluated with.
+func walkSelectors(
+	expr parser.Node,
+	opts *query.Options,
+	f func(vs *parser.VectorSelector, filters []*labels.Matcher, opts *query.Options, evalRange time.Duration),
+) error {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		f(e, nil, opts, 0)
+		return nil
+	case *logicalplan.FilteredSelector:
+		f(e.VectorSelector, e.Filters, opts, 0)
+		return nil
+	case *parser.MatrixSelector:
+		vs, filters, err := unpackVectorSelector(e)
+		if err != nil {
+			return err
+		}
+		f(vs, filters, opts, e.Range)
+		return nil
+	case *parser.SubqueryExpr:
+		subqueryOpts, err := subqueryOptions(opts, e)
+		if err != nil {
+			return err
+		}
+		return walkSelectors(e.Expr, subqueryOpts, f)
+	case *parser.StepInvariantExpr:
+		return walkSelectors(e.Expr, opts.WithEndTime(opts.Start), f)
+	}
+
+	for _, child := range parser.Children(expr) {
+		if err := walkSelectors(child, opts, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// absentOperator produces a sample with value 1 for each step in which
+// its next operator does not produce any samples.
+type absentOperator struct {
+	once     sync.Once
+	funcExpr *parser.Call
+	series   []labels.Labels
+	pool     *model.VectorPool
+	next     model.VectorOperator
+
+	numSteps    int
+	mint        int64
+	maxt        int64
+	step        int64
+	currentStep int64
+	timestamps  []int64
+}
+
+// NewAbsentOperator creates an operator for evaluating absent functions.
+// The labels of the output series are derived from the equality matchers in matchers.
+func NewAbsentOperator(
+	funcExpr *parser.Call,
+	pool *model.VectorPool,
+	next model.VectorOperator,
+	matchers []*labels.Matcher,
+	opts *query.Options,
+) model.VectorOperator {
+	return &absentOperator{
+		funcExpr:    funcExpr,
+		series:      []labels.Labels{createLabelsForAbsentFunction(matchers)},
+		pool:        pool,
+		next:        next,
+		numSteps:    opts.NumSteps(),
+		mint:        opts.Start.UnixMilli(),
+		maxt:        opts.End.UnixMilli(),
+		step:        opts.Step.Milliseconds(),
+		currentStep: opts.Start.UnixMilli(),
+		timestamps:  opts.Timestamps,
+	}
+}
+
+func (o *absentOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*absentOperator] %v()", o.funcExpr.Func.Name), []model.VectorOperator{o.next}
+}
+
+func (o *absentOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	o.once.Do(func() { o.pool.SetStepSize(len(o.series)) })
+	return o.series, nil
+}
+
+func (o *absentOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *absentOperator) Reset() {
+	o.next.Reset()
+	o.currentStep = o.mint
+}
+
+func (o *absentOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	if o.currentStep > o.maxt {
+		return nil, nil
+	}
+	o.once.Do(func() { o.pool.SetStepSize(len(o.series)) })
+
+	// The next operator stops producing vectors early when it has no series,
+	// so steps are generated by the operator itself.
+	in, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := o.pool.GetVectorBatch()
+	ts := o.currentStep
+	for i := 0; i < o.numSteps && ts <= o.maxt; i++ {
+		vector := o.pool.GetStepVector(ts)
+		if i >= len(in) || len(in[i].Samples) == 0 {
+			vector.SampleIDs = append(vector.SampleIDs, 0)
+			vector.Samples = append(vector.Samples, 1)
+		}
+		vectors = append(vectors, vector)
+		ts = o.nextStep(ts)
+	}
+	for _, vector := range in {
+		o.next.GetPool().PutStepVector(vector)
+	}
+	if in != nil {
+		o.next.GetPool().PutVectors(in)
+	}
+
+	if len(o.timestamps) > 0 {
+		o.currentStep = ts
+		return vectors, nil
+	}
+	// For instant queries, set the step to a positive value
+	// so that the operator can terminate.
+	if o.step == 0 {
+		o.step = 1
+	}
+	o.currentStep += o.step * int64(o.numSteps)
+
+	return vectors, nil
+}
+
+// nextStep returns the evaluation timestamp which follows ts.
+// When evaluating at explicit timestamps, a timestamp after maxt
+// is returned once ts is the last one.
+func (o *absentOperator) nextStep(ts int64) int64 {
+	if len(o.timestamps) == 0 {
+		return ts + o.step
+	}
+	i := sort.Search(len(o.timestamps), func(i int) bool { return o.timestamps[i] > ts })
+	if i == len(o.timestamps) {
+		return o.maxt + 1
+	}
+	return o.timestamps[i]
+}
+
+// Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/functions.go#L1383.
+func createLabelsForAbsentFunction(matchers []*labels.Matcher) labels.Labels {
+	m := labels.Labels{}
+
+	empty := []string{}
+	for _, ma := range matchers {
+		if ma.Name == labels.MetricName {
+			continue
+		}
+		if ma.Type == labels.MatchEqual && !m.Has(ma.Name) {
+			m = labels.NewBuilder(m).Set(ma.Name, ma.Value).Labels(nil)
+		} else {
+			empty = append(empty, ma.Name)
+		}
+	}
+
+	for _, v := range empty {
+		m = labels.NewBuilder(m).Del(v).Labels(nil)
+	}
+	return m
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/thanos-community/promql-engine/execution/model"
 	"github.com/thanos-community/promql-engine/execution/parse"
+	"github.com/thanos-community/promql-engine/query"
 )
 
 // functionOperator returns []model.StepVector after processing input with desired function.
@@ -28,9 +29,15 @@ type functionOperator struct {
 
 	call         FunctionCall
 	scalarPoints [][]float64
+
+	keepMetricName bool
 }
 
-func NewfunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []model.VectorOperator, stepsBatch int) (model.VectorOperator, error) {
+// NewfunctionOperator creates an operator which applies call to the samples of its vector argument.
+// Operators in nextOps can be nil for scalar arguments which are number literals,
+// in which case the value of the literal is used in every step.
+func NewfunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []model.VectorOperator, opts *query.Options) (model.VectorOperator, error) {
+	stepsBatch := int(opts.StepsBatch)
 	scalarPoints := make([][]float64, stepsBatch)
 	for i := 0; i < stepsBatch; i++ {
 		scalarPoints[i] = make([]float64, len(nextOps)-1)
@@ -41,6 +48,8 @@ func NewfunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 		funcExpr:     funcExpr,
 		vectorIndex:  0,
 		scalarPoints: scalarPoints,
+
+		keepMetricName: opts.KeepMetricNames,
 	}
 
 	for i := range funcExpr.Args {
@@ -50,6 +59,23 @@ func NewfunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 		}
 	}
 
+	scalarIndex := 0
+	for i := range nextOps {
+		if i == f.vectorIndex {
+			continue
+		}
+		if nextOps[i] == nil {
+			literal, ok := unwrapNumberLiteral(funcExpr.Args[i])
+			if !ok {
+				return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got no operator for non-literal argument in %s", funcExpr)
+			}
+			for batchIndex := range scalarPoints {
+				scalarPoints[batchIndex][scalarIndex] = literal.Val
+			}
+		}
+		scalarIndex++
+	}
+
 	// Check selector type.
 	// TODO(saswatamcode): Add support for string and matrix.
 	switch funcExpr.Args[f.vectorIndex].Type() {
@@ -61,7 +87,12 @@ func NewfunctionOperator(funcExpr *parser.Call, call FunctionCall, nextOps []mod
 }
 
 func (o *functionOperator) Explain() (me string, next []model.VectorOperator) {
-	return fmt.Sprintf("[*functionOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args), o.nextOps
+	for _, op := range o.nextOps {
+		if op != nil {
+			next = append(next, op)
+		}
+	}
+	return fmt.Sprintf("[*functionOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args), next
 }
 
 func (o *functionOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -72,6 +103,14 @@ func (o *functionOperator) Series(ctx context.Context) ([]labels.Labels, error)
 	return o.series, nil
 }
 
+func (o *functionOperator) Reset() {
+	for _, next := range o.nextOps {
+		if next != nil {
+			next.Reset()
+		}
+	}
+}
+
 func (o *functionOperator) GetPool() *model.VectorPool {
 	return o.nextOps[o.vectorIndex].GetPool()
 }
@@ -97,6 +136,11 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 		if i == o.vectorIndex {
 			continue
 		}
+		// Constant arguments were already set when creating the operator.
+		if o.nextOps[i] == nil {
+			scalarIndex++
+			continue
+		}
 
 		scalarVectors, err := o.nextOps[i].Next(ctx)
 		if err != nil {
@@ -118,14 +162,19 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 	for batchIndex, vector := range vectors {
 		// scalar() depends on number of samples per vector and returns NaN if len(samples) != 1.
 		// So need to handle this separately here, instead of going via call which is per point.
+		// The ID of the returned sample is reset to 0 instead of keeping the ID of the input series,
+		// which can be any of the input series since shards of selectors load series concurrently.
 		if o.funcExpr.Func.Name == "scalar" {
-			if len(vector.Samples) <= 1 {
+			if len(vector.Samples) == 0 {
 				continue
 			}
 
 			vectors[batchIndex].Samples = vector.Samples[:1]
 			vectors[batchIndex].SampleIDs = vector.SampleIDs[:1]
-			vector.Samples[0] = math.NaN()
+			vector.SampleIDs[0] = 0
+			if len(vector.Samples) > 1 {
+				vector.Samples[0] = math.NaN()
+			}
 			continue
 		}
 
@@ -167,8 +216,8 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 		o.series = make([]labels.Labels, len(series))
 		for i, s := range series {
 			lbls := s
-			if o.funcExpr.Func.Name != "last_over_time" {
-				lbls = DropMetricName(s)
+			if o.funcExpr.Func.Name != "last_over_time" && !o.keepMetricName {
+				lbls = model.DropMetricName(s)
 			}
 
 			o.series[i] = lbls
@@ -178,6 +227,19 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 	return err
 }
 
+func unwrapNumberLiteral(expr parser.Expr) (*parser.NumberLiteral, bool) {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		return e, true
+	case *parser.ParenExpr:
+		return unwrapNumberLiteral(e.Expr)
+	case *parser.StepInvariantExpr:
+		return unwrapNumberLiteral(e.Expr)
+	default:
+		return nil, false
+	}
+}
+
 var InvalidSample = promql.Sample{Point: promql.Point{T: -1, V: 0}}
 
 type FunctionArgs struct {
@@ -337,6 +399,18 @@ var Funcs = map[string]FunctionCall{
 			},
 		}
 	},
+	"predict_linear": func(f FunctionArgs) promql.Sample {
+		if len(f.Points) < 2 || len(f.ScalarPoints) < 1 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: predictLinear(f.Points, f.ScalarPoints[0], f.StepTime),
+			},
+		}
+	},
 	"irate": func(f FunctionArgs) promql.Sample {
 		if len(f.Points) < 2 {
 			return InvalidSample
@@ -474,9 +548,99 @@ var Funcs = map[string]FunctionCall{
 			},
 		}
 	},
+	"holt_winters": holtWintersFunc,
+	// Newer Prometheus versions renamed holt_winters to double_exponential_smoothing.
+	"double_exponential_smoothing": holtWintersFunc,
+
+	"abs": simpleFunc(math.Abs),
+	"sgn": simpleFunc(func(v float64) float64 {
+		if v < 0 {
+			return -1
+		} else if v > 0 {
+			return 1
+		}
+		// Both zero and NaN are returned as they are.
+		return v
+	}),
+}
+
+// simpleFunc creates a FunctionCall which applies f to the value of a single instant sample.
+func simpleFunc(f func(float64) float64) FunctionCall {
+	return func(fa FunctionArgs) promql.Sample {
+		if len(fa.Points) == 0 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: fa.Labels,
+			Point: promql.Point{
+				T: fa.StepTime,
+				V: f(fa.Points[0].V),
+			},
+		}
+	}
 }
 
-func NewFunctionCall(f *parser.Function) (FunctionCall, error) {
+// nonExtrapolatedFuncs contains the functions which replace the ones in Funcs
+// when query.Options.DisableRateExtrapolation is set.
+var nonExtrapolatedFuncs = map[string]FunctionCall{
+	"rate":     nonExtrapolatedFunc(true, true),
+	"increase": nonExtrapolatedFunc(true, false),
+	"delta":    nonExtrapolatedFunc(false, false),
+}
+
+func holtWintersFunc(f FunctionArgs) promql.Sample {
+	if len(f.Points) < 2 || len(f.ScalarPoints) < 2 {
+		return InvalidSample
+	}
+
+	return promql.Sample{
+		Metric: f.Labels,
+		Point: promql.Point{
+			T: f.StepTime,
+			V: holtWinters(f.Points, f.ScalarPoints[0], f.ScalarPoints[1]),
+		},
+	}
+}
+
+func nonExtrapolatedFunc(isCounter, isRate bool) FunctionCall {
+	return func(f FunctionArgs) promql.Sample {
+		if len(f.Points) < 2 {
+			return InvalidSample
+		}
+		return promql.Sample{
+			Metric: f.Labels,
+			Point: promql.Point{
+				T: f.StepTime,
+				V: nonExtrapolatedRate(f.Points, isCounter, isRate),
+			},
+		}
+	}
+}
+
+// experimentalFunctions contains the functions which Prometheus only allows to be used
+// after enabling them, since their behavior can still change. The Prometheus parser
+// we depend on does not know them, the implemented ones are registered in parse.Functions.
+var experimentalFunctions = map[string]struct{}{
+	"double_exponential_smoothing": {},
+	"info":                         {},
+	"limitk":                       {},
+	"limit_ratio":                  {},
+	"mad_over_time":                {},
+	"sort_by_label":                {},
+	"sort_by_label_desc":           {},
+}
+
+// IsExperimental returns true if the function name needs to be enabled with
+// query.Options.EnableExperimentalFunctions before it can be used.
+func IsExperimental(name string) bool {
+	_, ok := experimentalFunctions[name]
+	return ok
+}
+
+func NewFunctionCall(f *parser.Function, opts *query.Options) (FunctionCall, error) {
+	if call, ok := nonExtrapolatedFuncs[f.Name]; ok && opts.DisableRateExtrapolation {
+		return call, nil
+	}
 	if call, ok := Funcs[f.Name]; ok {
 		return call, nil
 	}
@@ -493,6 +657,8 @@ func NewFunctionCall(f *parser.Function) (FunctionCall, error) {
 // It calculates the rate (allowing for counter resets if isCounter is true),
 // extrapolates if the first/last sample is close to the boundary, and returns
 // the result as either per-second (if isRate is true) or overall.
+// The spacing between samples is calculated from their actual timestamps,
+// so that gaps in the range are taken into account.
 func extrapolatedRate(samples []promql.Point, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64) float64 {
 	var (
 		rangeStart = stepTime - (selectRange + offset)
@@ -501,6 +667,8 @@ func extrapolatedRate(samples []promql.Point, isCounter, isRate bool, stepTime i
 
 	resultValue := samples[len(samples)-1].V - samples[0].V
 	if isCounter {
+		// Same as in Prometheus, the value before each counter reset in the range
+		// is added back, so that multiple resets in one range are accounted for.
 		var lastValue float64
 		for _, sample := range samples {
 			if sample.V < lastValue {
@@ -556,6 +724,27 @@ func extrapolatedRate(samples []promql.Point, isCounter, isRate bool, stepTime i
 	return resultValue
 }
 
+// nonExtrapolatedRate calculates the change between the first and the last sample,
+// allowing for counter resets if isCounter is true. If isRate is true, the change
+// is divided by the time between both samples in seconds.
+func nonExtrapolatedRate(samples []promql.Point, isCounter, isRate bool) float64 {
+	first, last := samples[0], samples[len(samples)-1]
+	resultValue := last.V - first.V
+	if isCounter {
+		var lastValue float64
+		for _, sample := range samples {
+			if sample.V < lastValue {
+				resultValue += lastValue
+			}
+			lastValue = sample.V
+		}
+	}
+	if isRate {
+		resultValue = resultValue / (float64(last.T-first.T) / 1000)
+	}
+	return resultValue
+}
+
 func instantValue(samples []promql.Point, isRate bool) (float64, bool) {
 	lastSample := samples[len(samples)-1]
 	previousSample := samples[len(samples)-2]
@@ -695,6 +884,13 @@ func deriv(points []promql.Point) float64 {
 	return slope
 }
 
+// predictLinear predicts the value of points duration seconds after stepTime. Same as in Prometheus,
+// the regression is computed relative to stepTime, which is close to the timestamps of points.
+func predictLinear(points []promql.Point, duration float64, stepTime int64) float64 {
+	slope, intercept := linearRegression(points, stepTime)
+	return slope*duration + intercept
+}
+
 func resets(points []promql.Point) float64 {
 	count := 0
 	prev := points[0].V
@@ -763,25 +959,39 @@ func KahanSumInc(inc, sum, c float64) (newSum, newC float64) {
 	return t, c
 }
 
-func DropMetricName(l labels.Labels) labels.Labels {
-	if len(l) == 0 {
-		return l
-	}
+// holtWinters calculates the smoothed value of the given points
+// using the smoothing factor sf and the trend factor tf.
+// Same as in Prometheus, NaN samples are not skipped, so a NaN makes the result NaN.
+// Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/functions.go#L221.
+func holtWinters(points []promql.Point, sf, tf float64) float64 {
+	var s0, s1, b float64
+	// Set initial values.
+	s1 = points[0].V
+	b = points[1].V - points[0].V
+
+	// Run the smoothing operation.
+	var x, y float64
+	for i := 1; i < len(points); i++ {
+		// Scale the raw value against the smoothing factor.
+		x = sf * points[i].V
+
+		// Scale the last smoothed value with the trend at this point.
+		b = calcTrendValue(i-1, tf, s0, s1, b)
+		y = (1 - sf) * (s1 + b)
+
+		s0, s1 = s1, x+y
+	}
+	return s1
+}
 
-	if len(l) == 1 {
-		if l[0].Name == labels.MetricName {
-			return labels.EmptyLabels()
-		}
-		return l
+// calcTrendValue calculates the trend value at the given index i in raw data d.
+func calcTrendValue(i int, tf, s0, s1, b float64) float64 {
+	if i == 0 {
+		return b
 	}
 
-	c := 0
-	for i := range l {
-		if l[i].Name == labels.MetricName {
-			c = i
-			break
-		}
-	}
+	x := tf * (s1 - s0)
+	y := (1 - tf) * b
 
-	return append(l[:c], l[c+1:]...)
+	return x + y
 }
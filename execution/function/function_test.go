@@ -0,0 +1,133 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestSimpleFunctions(t *testing.T) {
+	cases := []struct {
+		name     string
+		function string
+		input    float64
+		expected float64
+	}{
+		{name: "sgn of positive number", function: "sgn", input: 4.2, expected: 1},
+		{name: "sgn of negative number", function: "sgn", input: -4.2, expected: -1},
+		{name: "sgn of zero", function: "sgn", input: 0, expected: 0},
+		{name: "sgn of negative zero", function: "sgn", input: math.Copysign(0, -1), expected: math.Copysign(0, -1)},
+		{name: "sgn of NaN", function: "sgn", input: math.NaN(), expected: math.NaN()},
+		{name: "sgn of +Inf", function: "sgn", input: math.Inf(1), expected: 1},
+		{name: "sgn of -Inf", function: "sgn", input: math.Inf(-1), expected: -1},
+		{name: "abs of positive number", function: "abs", input: 4.2, expected: 4.2},
+		{name: "abs of negative number", function: "abs", input: -4.2, expected: 4.2},
+		{name: "abs of negative zero", function: "abs", input: math.Copysign(0, -1), expected: 0},
+		{name: "abs of NaN", function: "abs", input: math.NaN(), expected: math.NaN()},
+		{name: "abs of -Inf", function: "abs", input: math.Inf(-1), expected: math.Inf(1)},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			result := Funcs[tcase.function](FunctionArgs{
+				Points:   []promql.Point{{V: tcase.input}},
+				StepTime: 10,
+			})
+			testutil.Equals(t, int64(10), result.T)
+			if math.IsNaN(tcase.expected) {
+				testutil.Assert(t, math.IsNaN(result.V), "expected NaN, got %v", result.V)
+				return
+			}
+			testutil.Equals(t, tcase.expected, result.V)
+			testutil.Equals(t, math.Signbit(tcase.expected), math.Signbit(result.V))
+		})
+	}
+}
+
+func TestLinearRegressionWithLargeTimestamps(t *testing.T) {
+	// Samples increase by 1 every 30 seconds, starting at a recent Unix timestamp. Without normalizing
+	// timestamps, squares of timestamps in seconds lose the precision which is needed for the regression.
+	start := int64(1700000000000)
+	points := make([]promql.Point, 0, 11)
+	for i := 0; i <= 10; i++ {
+		points = append(points, promql.Point{T: start + int64(i)*30000, V: 1000 + float64(i)})
+	}
+	stepTime := points[len(points)-1].T
+
+	deriv := Funcs["deriv"](FunctionArgs{Points: points, StepTime: stepTime})
+	testutil.Equals(t, stepTime, deriv.T)
+	testutil.Equals(t, 1.0/30, deriv.V)
+
+	predicted := Funcs["predict_linear"](FunctionArgs{Points: points, StepTime: stepTime, ScalarPoints: []float64{300}})
+	testutil.Equals(t, stepTime, predicted.T)
+	testutil.Assert(t, math.Abs(predicted.V-1020) < 1e-9, "expected 1020, got %v", predicted.V)
+
+	// The same regression relative to the Unix epoch is inaccurate.
+	slope, _ := linearRegression(points, 0)
+	testutil.Assert(t, math.Abs(slope-1.0/30) > 1e-9, "expected inaccurate slope, got %v", slope)
+}
+
+func TestSortByLabel(t *testing.T) {
+	newVector := func() promql.Vector {
+		return promql.Vector{
+			{Metric: labels.FromStrings("job", "b", "pod", "nginx-2")},
+			{Metric: labels.FromStrings("job", "a", "pod", "nginx-2")},
+			{Metric: labels.FromStrings("pod", "nginx-3")},
+			{Metric: labels.FromStrings("job", "b", "pod", "nginx-1")},
+			{Metric: labels.FromStrings("job", "a", "pod", "nginx-1", "zone", "eu")},
+			{Metric: labels.FromStrings("job", "a", "pod", "nginx-1")},
+		}
+	}
+	metrics := func(vector promql.Vector) []labels.Labels {
+		result := make([]labels.Labels, 0, len(vector))
+		for _, s := range vector {
+			result = append(result, s.Metric)
+		}
+		return result
+	}
+
+	// Series with the same job are sorted by their full label sets, and series without a job sort first.
+	vector := newVector()
+	SortByLabel(vector, false, "job")
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("pod", "nginx-3"),
+		labels.FromStrings("job", "a", "pod", "nginx-1"),
+		labels.FromStrings("job", "a", "pod", "nginx-1", "zone", "eu"),
+		labels.FromStrings("job", "a", "pod", "nginx-2"),
+		labels.FromStrings("job", "b", "pod", "nginx-1"),
+		labels.FromStrings("job", "b", "pod", "nginx-2"),
+	}, metrics(vector))
+
+	vector = newVector()
+	SortByLabel(vector, true, "job")
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("job", "b", "pod", "nginx-2"),
+		labels.FromStrings("job", "b", "pod", "nginx-1"),
+		labels.FromStrings("job", "a", "pod", "nginx-2"),
+		labels.FromStrings("job", "a", "pod", "nginx-1", "zone", "eu"),
+		labels.FromStrings("job", "a", "pod", "nginx-1"),
+		labels.FromStrings("pod", "nginx-3"),
+	}, metrics(vector))
+
+	// The order does not depend on the order of the input.
+	for i := 0; i < 10; i++ {
+		vector = newVector()
+		rand.New(rand.NewSource(int64(i))).Shuffle(len(vector), func(i, j int) { vector[i], vector[j] = vector[j], vector[i] })
+		SortByLabel(vector, false, "pod", "job")
+		testutil.Equals(t, []labels.Labels{
+			labels.FromStrings("job", "a", "pod", "nginx-1"),
+			labels.FromStrings("job", "a", "pod", "nginx-1", "zone", "eu"),
+			labels.FromStrings("job", "b", "pod", "nginx-1"),
+			labels.FromStrings("job", "a", "pod", "nginx-2"),
+			labels.FromStrings("job", "b", "pod", "nginx-2"),
+			labels.FromStrings("pod", "nginx-3"),
+		}, metrics(vector))
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/execution/warnings"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+type histogramSeries struct {
+	outputID   int
+	upperBound float64
+}
+
+// histogramOperator is a function operator that calculates the quantile of classic histograms.
+type histogramOperator struct {
+	pool *model.VectorPool
+
+	once     sync.Once
+	series   []labels.Labels
+	scalarOp model.VectorOperator
+	vectorOp model.VectorOperator
+
+	// scalarPoints is a reusable buffer for points from the first argument of histogram_quantile.
+	scalarPoints []float64
+
+	// outputIndex is a mapping from input series ID to the output series ID and its upper boundary
+	// parsed from the le label. If outputIndex[i] is nil, then series i has no valid le label.
+	outputIndex []*histogramSeries
+
+	// seriesBuckets are the buckets for each individual output series.
+	seriesBuckets []buckets
+
+	keepMetricName bool
+}
+
+// NewHistogramOperator creates an operator for histogram_quantile. The quantile
+// is read from scalarOp and the buckets are read from vectorOp.
+func NewHistogramOperator(pool *model.VectorPool, scalarOp, vectorOp model.VectorOperator, opts *query.Options) model.VectorOperator {
+	return &histogramOperator{
+		pool:           pool,
+		scalarOp:       scalarOp,
+		vectorOp:       vectorOp,
+		scalarPoints:   make([]float64, opts.StepsBatch),
+		keepMetricName: opts.KeepMetricNames,
+	}
+}
+
+func (o *histogramOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*histogramOperator]", []model.VectorOperator{o.scalarOp, o.vectorOp}
+}
+
+func (o *histogramOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	return o.series, nil
+}
+
+func (o *histogramOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *histogramOperator) Reset() {
+	o.scalarOp.Reset()
+	o.vectorOp.Reset()
+}
+
+func (o *histogramOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	scalars, err := o.scalarOp.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := o.vectorOp.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range o.scalarPoints {
+		o.scalarPoints[i] = math.NaN()
+	}
+	for i, scalar := range scalars {
+		if len(scalar.Samples) > 0 {
+			o.scalarPoints[i] = scalar.Samples[0]
+		}
+		o.scalarOp.GetPool().PutStepVector(scalar)
+	}
+	if scalars != nil {
+		o.scalarOp.GetPool().PutVectors(scalars)
+	}
+
+	if len(vectors) == 0 {
+		return nil, nil
+	}
+
+	out := o.pool.GetVectorBatch()
+	for stepIndex, vector := range vectors {
+		o.resetBuckets()
+		for i, seriesID := range vector.SampleIDs {
+			outputSeries := o.outputIndex[seriesID]
+			// The series has an invalid le label.
+			if outputSeries == nil {
+				continue
+			}
+
+			o.seriesBuckets[outputSeries.outputID] = append(o.seriesBuckets[outputSeries.outputID], bucket{
+				upperBound: outputSeries.upperBound,
+				count:      vector.Samples[i],
+			})
+		}
+
+		step := o.pool.GetStepVector(vector.T)
+		for i, stepBuckets := range o.seriesBuckets {
+			// Output series can be without buckets if its input series have no samples in this step.
+			if len(stepBuckets) == 0 {
+				continue
+			}
+
+			step.SampleIDs = append(step.SampleIDs, uint64(i))
+			step.Samples = append(step.Samples, bucketQuantile(o.scalarPoints[stepIndex], stepBuckets))
+		}
+		out = append(out, step)
+		o.vectorOp.GetPool().PutStepVector(vector)
+	}
+	o.vectorOp.GetPool().PutVectors(vectors)
+
+	return out, nil
+}
+
+func (o *histogramOperator) loadSeries(ctx context.Context) error {
+	series, err := o.vectorOp.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Series are grouped by all labels except for le and the metric name.
+	outputIDs := make(map[uint64]int, len(series))
+	o.series = make([]labels.Labels, 0)
+	o.outputIndex = make([]*histogramSeries, len(series))
+	for i, s := range series {
+		le := s.Get(labels.BucketLabel)
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			warnings.AddToContext(ctx, errors.Newf("histogram_quantile: ignoring series %s with malformed %s label %q", s, labels.BucketLabel, le))
+			continue
+		}
+
+		lb := labels.NewBuilder(s).Del(labels.BucketLabel)
+		if !o.keepMetricName {
+			lb.Del(labels.MetricName)
+		}
+		lbls := lb.Labels(nil)
+
+		hash := lbls.Hash()
+		outputID, ok := outputIDs[hash]
+		if !ok {
+			o.series = append(o.series, lbls)
+			outputID = len(o.series) - 1
+			outputIDs[hash] = outputID
+		}
+		o.outputIndex[i] = &histogramSeries{outputID: outputID, upperBound: upperBound}
+	}
+	o.seriesBuckets = make([]buckets, len(o.series))
+	o.pool.SetStepSize(len(o.series))
+
+	return nil
+}
+
+func (o *histogramOperator) resetBuckets() {
+	for i := range o.seriesBuckets {
+		o.seriesBuckets[i] = o.seriesBuckets[i][:0]
+	}
+}
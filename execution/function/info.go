@@ -0,0 +1,272 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+)
+
+// identifyingLabels are the labels by which info series are joined with the input series, same as in Prometheus.
+var identifyingLabels = []string{"instance", "job"}
+
+// infoOperator adds the data labels of matching info series to the series of its next operator.
+// Since info series can start and end in the middle of the query, an input series is mapped
+// to one output series for each combination of info series which can match it at the same step.
+type infoOperator struct {
+	once sync.Once
+	pool *model.VectorPool
+	next model.VectorOperator
+	info model.VectorOperator
+
+	dataMatchers []*labels.Matcher
+
+	series []labels.Labels
+	// candidates are the info series of each input series by the name of their metric.
+	candidates [][][]uint64
+	// outputs are the output series of each input series for every combination of info series,
+	// indexed by the choice of an info series in each group of candidates, or -1 if they are dropped.
+	outputs     [][]int
+	infoSeries  []labels.Labels
+	activeInfos []bool
+}
+
+// NewInfoOperator creates an operator for evaluating the info function. The series of info are joined
+// with the series of next by their identifying labels, and their data labels are added to series which
+// do not have them already. If dataMatchers is not empty, only the data labels which they match on are
+// added, and series are dropped unless their labels match dataMatchers after adding the data labels.
+func NewInfoOperator(pool *model.VectorPool, next, info model.VectorOperator, dataMatchers []*labels.Matcher) model.VectorOperator {
+	return &infoOperator{
+		pool:         pool,
+		next:         next,
+		info:         info,
+		dataMatchers: dataMatchers,
+	}
+}
+
+func (o *infoOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*infoOperator]", []model.VectorOperator{o.next, o.info}
+}
+
+func (o *infoOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	return o.series, err
+}
+
+func (o *infoOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *infoOperator) Reset() {
+	o.next.Reset()
+	o.info.Reset()
+}
+
+func (o *infoOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil {
+		return nil, nil
+	}
+	infos, err := o.info.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := o.pool.GetVectorBatch()
+	for i, vector := range in {
+		var active []uint64
+		if i < len(infos) && infos[i].T == vector.T {
+			active = infos[i].SampleIDs
+		}
+		for _, id := range active {
+			o.activeInfos[id] = true
+		}
+
+		out := o.pool.GetStepVector(vector.T)
+		for j, sID := range vector.SampleIDs {
+			outID, err := o.outputSeries(sID)
+			if err != nil {
+				return nil, err
+			}
+			if outID < 0 {
+				continue
+			}
+			out.SampleIDs = append(out.SampleIDs, uint64(outID))
+			out.Samples = append(out.Samples, vector.Samples[j])
+		}
+		result = append(result, out)
+
+		for _, id := range active {
+			o.activeInfos[id] = false
+		}
+		o.next.GetPool().PutStepVector(vector)
+	}
+	o.next.GetPool().PutVectors(in)
+	for _, vector := range infos {
+		o.info.GetPool().PutStepVector(vector)
+	}
+	if infos != nil {
+		o.info.GetPool().PutVectors(infos)
+	}
+	return result, nil
+}
+
+// outputSeries returns the output series of the input series sID for the info series which are active in the current step.
+// Same as in Prometheus, an input series can not be joined with two series of the same info metric at the same time.
+func (o *infoOperator) outputSeries(sID uint64) (int, error) {
+	combination, radix := 0, 1
+	for _, group := range o.candidates[sID] {
+		choice := 0
+		for i, infoID := range group {
+			if !o.activeInfos[infoID] {
+				continue
+			}
+			if choice != 0 {
+				return 0, errors.Newf("found duplicate series for info metric %s: %s and %s", o.infoSeries[infoID].Get(labels.MetricName), o.infoSeries[group[choice-1]], o.infoSeries[infoID])
+			}
+			choice = i + 1
+		}
+		combination += choice * radix
+		radix *= len(group) + 1
+	}
+	return o.outputs[sID][combination], nil
+}
+
+func (o *infoOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+	infoSeries, err := o.info.Series(ctx)
+	if err != nil {
+		return err
+	}
+	o.infoSeries = infoSeries
+	o.activeInfos = make([]bool, len(infoSeries))
+
+	// Info series are grouped by their identifying labels, and by their metric name within each group.
+	infosByIdentity := make(map[string]map[string][]uint64)
+	for i, s := range infoSeries {
+		identity := identityOf(s)
+		if infosByIdentity[identity] == nil {
+			infosByIdentity[identity] = make(map[string][]uint64)
+		}
+		name := s.Get(labels.MetricName)
+		infosByIdentity[identity][name] = append(infosByIdentity[identity][name], uint64(i))
+	}
+
+	var (
+		outputIDs = make(map[string]int)
+		b         = labels.NewBuilder(nil)
+	)
+	o.candidates = make([][][]uint64, len(series))
+	o.outputs = make([][]int, len(series))
+	for i, s := range series {
+		byName := infosByIdentity[identityOf(s)]
+		names := make([]string, 0, len(byName))
+		for name := range byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		combinations := 1
+		for _, name := range names {
+			o.candidates[i] = append(o.candidates[i], byName[name])
+			combinations *= len(byName[name]) + 1
+		}
+
+		o.outputs[i] = make([]int, combinations)
+		for combination := range o.outputs[i] {
+			b.Reset(s)
+			rest := combination
+			for _, group := range o.candidates[i] {
+				if choice := rest % (len(group) + 1); choice > 0 {
+					o.addDataLabels(b, s, infoSeries[group[choice-1]])
+				}
+				rest /= len(group) + 1
+			}
+			lbls := b.Labels(nil)
+			if !o.matchesDataLabels(lbls) {
+				o.outputs[i][combination] = -1
+				continue
+			}
+			key := string(lbls.Bytes(nil))
+			outID, ok := outputIDs[key]
+			if !ok {
+				outID = len(o.series)
+				outputIDs[key] = outID
+				o.series = append(o.series, lbls)
+			}
+			o.outputs[i][combination] = outID
+		}
+	}
+	o.pool.SetStepSize(len(series))
+	return nil
+}
+
+// addDataLabels adds the data labels of info to b. Labels of the input series s are kept.
+func (o *infoOperator) addDataLabels(b *labels.Builder, s, info labels.Labels) {
+	for _, l := range info {
+		if l.Name == labels.MetricName || isIdentifyingLabel(l.Name) || s.Has(l.Name) {
+			continue
+		}
+		if len(o.dataMatchers) > 0 && !hasMatcher(o.dataMatchers, l.Name) {
+			continue
+		}
+		b.Set(l.Name, l.Value)
+	}
+}
+
+func (o *infoOperator) matchesDataLabels(lbls labels.Labels) bool {
+	for _, m := range o.dataMatchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func identityOf(s labels.Labels) string {
+	return fmt.Sprintf("%q", []string{s.Get(identifyingLabels[0]), s.Get(identifyingLabels[1])})
+}
+
+func isIdentifyingLabel(name string) bool {
+	for _, l := range identifyingLabels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMatcher(matchers []*labels.Matcher, name string) bool {
+	for _, m := range matchers {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	execmodel "github.com/thanos-community/promql-engine/execution/model"
+)
+
+// labelReplaceOperator evaluates label_replace by rewriting the labels of the series
+// of its next operator. Samples are passed through unchanged since each input series
+// corresponds to exactly one output series.
+type labelReplaceOperator struct {
+	once     sync.Once
+	funcExpr *parser.Call
+	next     execmodel.VectorOperator
+	series   []labels.Labels
+
+	dst         string
+	replacement string
+	src         string
+	regex       *regexp.Regexp
+
+	// duplicates points from the ID of a series to the ID of the first series
+	// with the same labels, for series which end up with equal labels after the replacement.
+	duplicates map[uint64]uint64
+}
+
+// NewLabelReplaceOperator creates an operator for evaluating
+// label_replace(next, dst, replacement, src, regex).
+// Same as in Prometheus, the destination label is set like any other label,
+// which means that the metric name can be changed by using __name__ as dst.
+func NewLabelReplaceOperator(
+	funcExpr *parser.Call,
+	next execmodel.VectorOperator,
+	dst, replacement, src, regex string,
+) (execmodel.VectorOperator, error) {
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return nil, errors.Newf("invalid regular expression in label_replace(): %s", regex)
+	}
+	if !model.LabelNameRE.MatchString(dst) {
+		return nil, errors.Newf("invalid destination label name in label_replace(): %s", dst)
+	}
+
+	return &labelReplaceOperator{
+		funcExpr:    funcExpr,
+		next:        next,
+		dst:         dst,
+		replacement: replacement,
+		src:         src,
+		regex:       re,
+	}, nil
+}
+
+func (o *labelReplaceOperator) Explain() (me string, next []execmodel.VectorOperator) {
+	return fmt.Sprintf("[*labelReplaceOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args[1:]), []execmodel.VectorOperator{o.next}
+}
+
+func (o *labelReplaceOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *labelReplaceOperator) GetPool() *execmodel.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *labelReplaceOperator) Reset() {
+	o.next.Reset()
+}
+
+func (o *labelReplaceOperator) Next(ctx context.Context) ([]execmodel.StepVector, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+
+	vectors, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.duplicates) == 0 {
+		return vectors, nil
+	}
+
+	for _, vector := range vectors {
+		seen := make(map[uint64]struct{}, len(vector.SampleIDs))
+		for _, id := range vector.SampleIDs {
+			if first, ok := o.duplicates[id]; ok {
+				id = first
+			}
+			if _, ok := seen[id]; ok {
+				return nil, errors.New("vector cannot contain metrics with the same labelset")
+			}
+			seen[id] = struct{}{}
+		}
+	}
+	return vectors, nil
+}
+
+func (o *labelReplaceOperator) loadSeries(ctx context.Context) error {
+	var err error
+	o.once.Do(func() {
+		series, loadErr := o.next.Series(ctx)
+		if loadErr != nil {
+			err = loadErr
+			return
+		}
+
+		ids := make(map[uint64][]uint64, len(series))
+		o.series = make([]labels.Labels, len(series))
+		for i, s := range series {
+			lbls := o.replace(s)
+			o.series[i] = lbls
+
+			h := lbls.Hash()
+			for _, id := range ids[h] {
+				if labels.Equal(o.series[id], lbls) {
+					if o.duplicates == nil {
+						o.duplicates = make(map[uint64]uint64)
+					}
+					o.duplicates[uint64(i)] = id
+					break
+				}
+			}
+			ids[h] = append(ids[h], uint64(i))
+		}
+	})
+	return err
+}
+
+// Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/functions.go#L1276.
+func (o *labelReplaceOperator) replace(lbls labels.Labels) labels.Labels {
+	// The value of the source label is read before the destination label is
+	// replaced, so that both can be the same label.
+	srcVal := lbls.Get(o.src)
+	indexes := o.regex.FindStringSubmatchIndex(srcVal)
+	if indexes == nil {
+		return lbls
+	}
+
+	res := o.regex.ExpandString([]byte{}, o.replacement, srcVal, indexes)
+	lb := labels.NewBuilder(lbls).Del(o.dst)
+	if len(res) > 0 {
+		lb.Set(o.dst, string(res))
+	}
+	return lb.Labels(nil)
+}
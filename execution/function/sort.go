@@ -0,0 +1,68 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// SortByValue sorts the samples of vector by their values, in descending order if desc is set.
+// Same as in Prometheus, NaN values are sorted last in both orders. Samples are sorted with the
+// same comparisons as in Prometheus, which puts samples with equal values in the same order.
+func SortByValue(vector promql.Vector, desc bool) {
+	if desc {
+		// NaN should sort to the bottom, so take ascending sort with NaN first and
+		// reverse it.
+		sort.Sort(sort.Reverse(vectorByValue(vector)))
+		return
+	}
+	// NaN should sort to the bottom, so take descending sort with NaN first and
+	// reverse it.
+	sort.Sort(sort.Reverse(vectorByReverseValue(vector)))
+}
+
+// SortByLabel sorts the samples of vector by the values of labelNames, in descending order if desc is set.
+// Missing labels sort like empty values. Same as in Prometheus, samples with equal values for all of labelNames
+// are sorted by their full label sets, so that the order does not depend on the order in which series are returned.
+func SortByLabel(vector promql.Vector, desc bool, labelNames ...string) {
+	sort.SliceStable(vector, func(i, j int) bool {
+		a, b := vector[i].Metric, vector[j].Metric
+		if desc {
+			a, b = b, a
+		}
+		for _, name := range labelNames {
+			if c := strings.Compare(a.Get(name), b.Get(name)); c != 0 {
+				return c < 0
+			}
+		}
+		return labels.Compare(a, b) < 0
+	})
+}
+
+type vectorByValue promql.Vector
+
+func (s vectorByValue) Len() int      { return len(s) }
+func (s vectorByValue) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s vectorByValue) Less(i, j int) bool {
+	if math.IsNaN(s[i].V) {
+		return true
+	}
+	return s[i].V < s[j].V
+}
+
+type vectorByReverseValue promql.Vector
+
+func (s vectorByReverseValue) Len() int      { return len(s) }
+func (s vectorByReverseValue) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s vectorByReverseValue) Less(i, j int) bool {
+	if math.IsNaN(s[i].V) {
+		return true
+	}
+	return s[i].V > s[j].V
+}
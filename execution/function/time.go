@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// timeOperator returns the evaluation time of each step in seconds.
+type timeOperator struct {
+	pool   *model.VectorPool
+	once   sync.Once
+	series []labels.Labels
+
+	numSteps    int
+	mint        int64
+	maxt        int64
+	step        int64
+	currentStep int64
+}
+
+func NewTimeOperator(pool *model.VectorPool, opts *query.Options) model.VectorOperator {
+	return &timeOperator{
+		pool:        pool,
+		numSteps:    opts.NumSteps(),
+		mint:        opts.Start.UnixMilli(),
+		maxt:        opts.End.UnixMilli(),
+		step:        opts.Step.Milliseconds(),
+		currentStep: opts.Start.UnixMilli(),
+	}
+}
+
+func (o *timeOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*timeOperator]", nil
+}
+
+func (o *timeOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	o.loadSeries()
+	return o.series, nil
+}
+
+func (o *timeOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *timeOperator) Reset() {
+	o.currentStep = o.mint
+}
+
+func (o *timeOperator) Next(_ context.Context) ([]model.StepVector, error) {
+	if o.currentStep > o.maxt {
+		return nil, nil
+	}
+	o.loadSeries()
+
+	vectors := o.pool.GetVectorBatch()
+	ts := o.currentStep
+	for currStep := 0; currStep < o.numSteps && ts <= o.maxt; currStep++ {
+		vector := o.pool.GetStepVector(ts)
+		vector.SampleIDs = append(vector.SampleIDs, 0)
+		vector.Samples = append(vector.Samples, float64(ts)/1000)
+		vectors = append(vectors, vector)
+		ts += o.step
+	}
+
+	// For instant queries, set the step to a positive value
+	// so that the operator can terminate.
+	if o.step == 0 {
+		o.step = 1
+	}
+	o.currentStep += o.step * int64(o.numSteps)
+
+	return vectors, nil
+}
+
+func (o *timeOperator) loadSeries() {
+	// time() returns a scalar, which is represented as a single series without labels.
+	o.once.Do(func() {
+		o.series = make([]labels.Labels, 1)
+		o.pool.SetStepSize(len(o.series))
+	})
+}
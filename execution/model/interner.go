@@ -0,0 +1,49 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// LabelsInterner deduplicates label names and values so that
+// identical strings across series share the same storage.
+type LabelsInterner interface {
+	// Intern returns a copy of lbls whose names and values are interned.
+	// The labels passed to Intern are not modified.
+	Intern(lbls labels.Labels) labels.Labels
+}
+
+// NewLabelsInterner creates a LabelsInterner which is safe for concurrent use.
+// Interned strings are kept for the lifetime of the interner, so it should
+// be scoped to a single query.
+func NewLabelsInterner() LabelsInterner {
+	return &labelsInterner{strings: make(map[string]string)}
+}
+
+type labelsInterner struct {
+	mu      sync.Mutex
+	strings map[string]string
+}
+
+func (i *labelsInterner) Intern(lbls labels.Labels) labels.Labels {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	result := make(labels.Labels, len(lbls))
+	for j, l := range lbls {
+		result[j] = labels.Label{Name: i.intern(l.Name), Value: i.intern(l.Value)}
+	}
+	return result
+}
+
+func (i *labelsInterner) intern(s string) string {
+	if interned, ok := i.strings[s]; ok {
+		return interned
+	}
+	i.strings[s] = s
+	return s
+}
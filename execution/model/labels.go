@@ -0,0 +1,29 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import "github.com/prometheus/prometheus/model/labels"
+
+// DropMetricName returns a copy of l without the metric name label.
+// The labels passed to DropMetricName are not modified, since they are usually
+// shared with other operators. Labels without a metric name are returned as they are,
+// except for nil labels which are returned as empty labels, same as with labels.Builder.
+// Since l is copied in order, the result is sorted whenever l is sorted.
+func DropMetricName(l labels.Labels) labels.Labels {
+	if l == nil {
+		return labels.EmptyLabels()
+	}
+	for i := range l {
+		if l[i].Name != labels.MetricName {
+			continue
+		}
+		if len(l) == 1 {
+			return labels.EmptyLabels()
+		}
+		out := make(labels.Labels, 0, len(l)-1)
+		out = append(out, l[:i]...)
+		return append(out, l[i+1:]...)
+	}
+	return l
+}
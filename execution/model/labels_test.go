@@ -0,0 +1,80 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestDropMetricName(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    labels.Labels
+		expected labels.Labels
+	}{
+		{
+			name:     "empty labels",
+			input:    labels.EmptyLabels(),
+			expected: labels.EmptyLabels(),
+		},
+		{
+			name:     "only metric name",
+			input:    labels.FromStrings(labels.MetricName, "foo"),
+			expected: labels.EmptyLabels(),
+		},
+		{
+			name:     "no metric name",
+			input:    labels.FromStrings("a", "1", "b", "2"),
+			expected: labels.FromStrings("a", "1", "b", "2"),
+		},
+		{
+			name:     "labels before and after metric name",
+			input:    labels.FromStrings("A", "1", labels.MetricName, "foo", "a", "2", "b", "3"),
+			expected: labels.FromStrings("A", "1", "a", "2", "b", "3"),
+		},
+		{
+			name:     "metric name is the last label",
+			input:    labels.FromStrings("A", "1", "B", "2", labels.MetricName, "foo"),
+			expected: labels.FromStrings("A", "1", "B", "2"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := tc.input.Copy()
+			result := DropMetricName(tc.input)
+			testutil.Equals(t, tc.expected, result)
+			testutil.Assert(t, sort.IsSorted(result), "labels are not sorted: %s", result)
+			testutil.Equals(t, input, tc.input)
+		})
+	}
+}
+
+func BenchmarkDropMetricName(b *testing.B) {
+	for _, numLabels := range []int{1, 5, 20} {
+		pairs := []string{labels.MetricName, "http_requests_total"}
+		for i := 0; i < numLabels; i++ {
+			pairs = append(pairs, fmt.Sprintf("label_%d", i), fmt.Sprintf("value_%d", i))
+		}
+		lbls := labels.FromStrings(pairs...)
+
+		b.Run(fmt.Sprintf("labels=%d/helper", numLabels), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				DropMetricName(lbls)
+			}
+		})
+		b.Run(fmt.Sprintf("labels=%d/builder", numLabels), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				labels.NewBuilder(lbls).Del(labels.MetricName).Labels(nil)
+			}
+		})
+	}
+}
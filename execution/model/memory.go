@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"sync/atomic"
+
+	"github.com/efficientgo/core/errors"
+)
+
+var ErrMemoryLimitExceeded = errors.New("query memory limit exceeded")
+
+// MemoryTracker tracks the approximate number of bytes which are checked out
+// from all vector pools of a query, together with the high-water mark.
+// It can be shared between pools and is safe for concurrent use.
+type MemoryTracker struct {
+	limit   int64
+	current int64
+	peak    int64
+	closed  int32
+}
+
+// NewMemoryTracker creates a tracker which fails queries once more than limit bytes
+// have been checked out from pools. Pools panic with ErrMemoryLimitExceeded when
+// vectors are checked out after the limit was exceeded, so that the query stops
+// immediately. The engine recovers the panic and fails the query with the error.
+// A limit of 0 disables the limit.
+func NewMemoryTracker(limit int64) *MemoryTracker {
+	return &MemoryTracker{limit: limit}
+}
+
+// Usage returns the number of bytes currently checked out.
+func (t *MemoryTracker) Usage() int64 {
+	return atomic.LoadInt64(&t.current)
+}
+
+// Peak returns the highest number of bytes which were checked out at the same time.
+func (t *MemoryTracker) Peak() int64 {
+	return atomic.LoadInt64(&t.peak)
+}
+
+// Err returns ErrMemoryLimitExceeded if the peak usage exceeded the limit.
+func (t *MemoryTracker) Err() error {
+	if t.limit > 0 && t.Peak() > t.limit {
+		return errors.Wrapf(ErrMemoryLimitExceeded, "peak usage of %d bytes exceeds limit of %d bytes", t.Peak(), t.limit)
+	}
+	return nil
+}
+
+// Close releases the memory of all vectors which are still checked out, since operators
+// of a failed query do not return their vectors to the pools. Memory is not tracked anymore
+// after the tracker was closed.
+func (t *MemoryTracker) Close() {
+	atomic.StoreInt32(&t.closed, 1)
+	atomic.StoreInt64(&t.current, 0)
+}
+
+func (t *MemoryTracker) allocate(bytes int64) {
+	if atomic.LoadInt32(&t.closed) == 1 {
+		return
+	}
+	current := atomic.AddInt64(&t.current, bytes)
+	for {
+		peak := atomic.LoadInt64(&t.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&t.peak, peak, current) {
+			return
+		}
+	}
+}
+
+func (t *MemoryTracker) release(bytes int64) {
+	if atomic.LoadInt32(&t.closed) == 1 {
+		return
+	}
+	// Slices of vectors which were not checked out from a pool can be
+	// returned, so we can end up releasing more memory than what was allocated.
+	for {
+		current := atomic.LoadInt64(&t.current)
+		next := current - bytes
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt64(&t.current, current, next) {
+			return
+		}
+	}
+}
@@ -22,4 +22,36 @@ type VectorOperator interface {
 
 	// Explain returns human-readable explanation of the current operator and optional nested operators.
 	Explain() (me string, next []VectorOperator)
+
+	// Reset rewinds the operator and all of its nested operators so that the next call
+	// to Next starts again from the first step.
+	// Reset must not be called concurrently with Next, and only after Next returned nil.
+	Reset()
+}
+
+// SeriesStreamer is implemented by operators which can return their series one at a time,
+// so that callers of operators with many output series do not need to hold all of them at once.
+type SeriesStreamer interface {
+	// StreamSeries calls fn with the ID and labels of each series that Series returns, in ascending order of IDs.
+	// If fn returns an error, no more series are streamed and the error is returned.
+	StreamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error
+}
+
+// StreamSeries streams the series of op with fn. If op does not implement SeriesStreamer,
+// its series are returned from Series and streamed afterwards.
+func StreamSeries(ctx context.Context, op VectorOperator, fn func(id uint64, lbls labels.Labels) error) error {
+	if streamer, ok := op.(SeriesStreamer); ok {
+		return streamer.StreamSeries(ctx, fn)
+	}
+
+	series, err := op.Series(ctx)
+	if err != nil {
+		return err
+	}
+	for i, s := range series {
+		if err := fn(uint64(i), s); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -4,6 +4,7 @@
 package model
 
 import (
+	"fmt"
 	"sync"
 )
 
@@ -13,6 +14,13 @@ type VectorPool struct {
 	stepSize  int
 	samples   sync.Pool
 	sampleIDs sync.Pool
+
+	memory *MemoryTracker
+
+	// returned contains the slices which were put back into the pool and not checked out again.
+	// It is only used when double returns are detected, see detectDoubleReturns.
+	mu       sync.Mutex
+	returned map[any]struct{}
 }
 
 func NewVectorPool(stepsBatch int) *VectorPool {
@@ -40,23 +48,54 @@ func NewVectorPool(stepsBatch int) *VectorPool {
 }
 
 func (p *VectorPool) GetVectorBatch() []StepVector {
-	return *p.vectors.Get().(*[]StepVector)
+	p.checkMemoryLimit()
+	vectors := *p.vectors.Get().(*[]StepVector)
+	if detectDoubleReturns {
+		p.checkOut(vectors)
+	}
+	return vectors
 }
 
 func (p *VectorPool) PutVectors(vector []StepVector) {
+	if detectDoubleReturns {
+		p.checkIn(vector, "vector batch")
+	}
 	vector = vector[:0]
 	p.vectors.Put(&vector)
 }
 
 func (p *VectorPool) GetStepVector(t int64) StepVector {
-	return StepVector{
+	v := StepVector{
 		T:         t,
 		SampleIDs: *p.sampleIDs.Get().(*[]uint64),
 		Samples:   *p.samples.Get().(*[]float64),
 	}
+	if detectDoubleReturns {
+		p.checkOut(v.SampleIDs)
+		p.checkOut(v.Samples)
+	}
+	if p.memory != nil {
+		v.checkedOutBytes = stepVectorBytes(v)
+		p.memory.allocate(v.checkedOutBytes)
+		p.checkMemoryLimit()
+	}
+	return v
 }
 
 func (p *VectorPool) PutStepVector(v StepVector) {
+	if detectDoubleReturns {
+		p.checkIn(v.SampleIDs, fmt.Sprintf("step vector at %d", v.T))
+		p.checkIn(v.Samples, fmt.Sprintf("step vector at %d", v.T))
+	}
+	if p.memory != nil {
+		// Slices can grow while they are checked out, their growth is tracked before they are released.
+		bytes := stepVectorBytes(v)
+		if grown := bytes - v.checkedOutBytes; v.checkedOutBytes > 0 && grown > 0 {
+			p.memory.allocate(grown)
+		}
+		p.memory.release(bytes)
+	}
+	v.checkedOutBytes = 0
 	v.SampleIDs = v.SampleIDs[:0]
 	v.Samples = v.Samples[:0]
 	p.sampleIDs.Put(&v.SampleIDs)
@@ -66,3 +105,74 @@ func (p *VectorPool) PutStepVector(v StepVector) {
 func (p *VectorPool) SetStepSize(n int) {
 	p.stepSize = n
 }
+
+// SetMemoryTracker sets the tracker which accounts for step vectors checked out from the pool.
+func (p *VectorPool) SetMemoryTracker(t *MemoryTracker) {
+	p.memory = t
+}
+
+// checkMemoryLimit panics with ErrMemoryLimitExceeded if the query exceeded its memory limit.
+// Operators can not return errors when checking out vectors, so the panic is recovered by the engine.
+func (p *VectorPool) checkMemoryLimit() {
+	if p.memory == nil {
+		return
+	}
+	if err := p.memory.Err(); err != nil {
+		panic(err)
+	}
+}
+
+func stepVectorBytes(v StepVector) int64 {
+	return int64(cap(v.SampleIDs))*8 + int64(cap(v.Samples))*8
+}
+
+// checkOut marks the backing array of slice as checked out from the pool.
+func (p *VectorPool) checkOut(slice any) {
+	key, ok := backingArray(slice)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.returned, key)
+}
+
+// checkIn marks the backing array of slice as returned to the pool and panics
+// if it was already returned without being checked out again.
+func (p *VectorPool) checkIn(slice any, desc string) {
+	key, ok := backingArray(slice)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.returned[key]; ok {
+		panic(fmt.Sprintf("%s was returned to the vector pool twice, it is still owned by the pool after the first return", desc))
+	}
+	if p.returned == nil {
+		p.returned = make(map[any]struct{})
+	}
+	p.returned[key] = struct{}{}
+}
+
+// backingArray returns a pointer to the first element of the backing array of slice.
+// Slices without capacity do not have a backing array and can not be tracked.
+// Since the pointer is kept in the set of returned slices, the array can not be
+// garbage collected and reused for another slice while it is tracked.
+func backingArray(slice any) (any, bool) {
+	switch s := slice.(type) {
+	case []StepVector:
+		if cap(s) > 0 {
+			return &s[:1][0], true
+		}
+	case []uint64:
+		if cap(s) > 0 {
+			return &s[:1][0], true
+		}
+	case []float64:
+		if cap(s) > 0 {
+			return &s[:1][0], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,11 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build pooldebug
+
+package model
+
+// detectDoubleReturns makes vector pools panic when the same vector is returned twice,
+// which would otherwise hand out the same memory to two operators. Since tracking returned
+// vectors is expensive, it is only enabled in builds with the pooldebug tag.
+var detectDoubleReturns = true
@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestVectorPoolDetectsDoubleReturns(t *testing.T) {
+	defer func(detect bool) { detectDoubleReturns = detect }(detectDoubleReturns)
+	detectDoubleReturns = true
+
+	pool := NewVectorPool(10)
+	pool.SetStepSize(2)
+
+	t.Run("step vector", func(t *testing.T) {
+		v := pool.GetStepVector(10)
+		v.SampleIDs = append(v.SampleIDs, 1)
+		v.Samples = append(v.Samples, 1)
+		pool.PutStepVector(v)
+
+		testutil.Equals(t, "step vector at 10 was returned to the vector pool twice, it is still owned by the pool after the first return", recoverPanic(func() {
+			pool.PutStepVector(v)
+		}))
+	})
+	t.Run("vector batch", func(t *testing.T) {
+		vectors := pool.GetVectorBatch()
+		pool.PutVectors(vectors)
+
+		testutil.Equals(t, "vector batch was returned to the vector pool twice, it is still owned by the pool after the first return", recoverPanic(func() {
+			pool.PutVectors(vectors)
+		}))
+	})
+	t.Run("vectors checked out again", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			v := pool.GetStepVector(int64(i))
+			vectors := pool.GetVectorBatch()
+			testutil.Equals(t, "", recoverPanic(func() {
+				pool.PutStepVector(v)
+				pool.PutVectors(vectors)
+			}))
+		}
+	})
+}
+
+func TestVectorPoolTracksMemory(t *testing.T) {
+	memory := NewMemoryTracker(64)
+	pool := NewVectorPool(10)
+	pool.SetStepSize(2)
+	pool.SetMemoryTracker(memory)
+
+	v := pool.GetStepVector(10)
+	testutil.Equals(t, stepVectorBytes(v), memory.Usage())
+	testutil.Equals(t, "", recoverPanic(func() { pool.GetVectorBatch() }))
+
+	// Growth of slices is tracked when the vector is returned.
+	for i := 0; i < 10; i++ {
+		v.SampleIDs = append(v.SampleIDs, uint64(i))
+		v.Samples = append(v.Samples, float64(i))
+	}
+	grown := stepVectorBytes(v)
+	pool.PutStepVector(v)
+	testutil.Equals(t, int64(0), memory.Usage())
+	testutil.Equals(t, grown, memory.Peak())
+
+	// Vectors can not be checked out anymore once the limit was exceeded.
+	msg := fmt.Sprintf("peak usage of %d bytes exceeds limit of 64 bytes: query memory limit exceeded", grown)
+	testutil.Equals(t, msg, recoverPanic(func() { pool.GetVectorBatch() }))
+	testutil.Equals(t, msg, recoverPanic(func() { pool.GetStepVector(20) }))
+
+	memory.Close()
+	testutil.Equals(t, int64(0), memory.Usage())
+}
+
+func recoverPanic(f func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+	f()
+	return ""
+}
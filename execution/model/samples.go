@@ -0,0 +1,36 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import "sync/atomic"
+
+// SamplesCounter counts the samples which are processed by the selectors of a query.
+// Same as in Prometheus, a sample is counted for every step at which it is selected,
+// so samples in overlapping ranges of range functions are counted for each range.
+// It can be shared between operators and is safe for concurrent use. Methods of a nil
+// counter do nothing.
+type SamplesCounter struct {
+	total int64
+}
+
+// NewSamplesCounter creates a counter without samples.
+func NewSamplesCounter() *SamplesCounter {
+	return &SamplesCounter{}
+}
+
+// Add adds n processed samples.
+func (c *SamplesCounter) Add(n int64) {
+	if c == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&c.total, n)
+}
+
+// Total returns the number of processed samples.
+func (c *SamplesCounter) Total() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.total)
+}
@@ -14,4 +14,8 @@ type StepVector struct {
 	T         int64
 	SampleIDs []uint64
 	Samples   []float64
+
+	// checkedOutBytes is the memory which was tracked when the vector was checked out
+	// from a pool, so that the growth of its slices can be tracked when it is returned.
+	checkedOutBytes int64
 }
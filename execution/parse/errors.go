@@ -19,3 +19,5 @@ func UnsupportedOperationErr(op parser.ItemType) error {
 }
 
 var ErrNotImplemented = errors.New("expression not implemented")
+
+var ErrExperimentalFunction = errors.New("experimental function is not enabled")
@@ -0,0 +1,58 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package parse
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Functions contains the functions of newer Prometheus versions which the engine implements,
+// but which the Prometheus parser we depend on does not know. Same as in Prometheus,
+// they are experimental and need to be enabled before queries can use them.
+var Functions = map[string]*parser.Function{
+	"double_exponential_smoothing": {
+		Name:       "double_exponential_smoothing",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeMatrix, parser.ValueTypeScalar, parser.ValueTypeScalar},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"info": {
+		Name:       "info",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeVector},
+		Variadic:   1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	// Prometheus evaluates limitk and limit_ratio as aggregations, which the parser we depend on
+	// can not be extended with. As functions, they evaluate all series of the vector as one group.
+	"limitk": {
+		Name:       "limitk",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeScalar, parser.ValueTypeVector},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"limit_ratio": {
+		Name:       "limit_ratio",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeScalar, parser.ValueTypeVector},
+		ReturnType: parser.ValueTypeVector,
+	},
+	"sort_by_label": {
+		Name:       "sort_by_label",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+	"sort_by_label_desc": {
+		Name:       "sort_by_label_desc",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeString},
+		Variadic:   -1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
+// The functions are registered with the Prometheus parser, so that queries using them can be parsed.
+func init() {
+	for name, f := range Functions {
+		if _, ok := parser.Functions[name]; !ok {
+			parser.Functions[name] = f
+		}
+	}
+}
@@ -29,7 +29,8 @@ type numberLiteralSelector struct {
 	val float64
 }
 
-func NewNumberLiteralSelector(pool *model.VectorPool, opts *query.Options, val float64) *numberLiteralSelector {
+// NewNumberLiteralSelector creates an operator which returns val with an empty labelset in every step.
+func NewNumberLiteralSelector(pool *model.VectorPool, opts *query.Options, val float64) model.VectorOperator {
 	return &numberLiteralSelector{
 		vectorPool:  pool,
 		numSteps:    opts.NumSteps(),
@@ -54,6 +55,10 @@ func (o *numberLiteralSelector) GetPool() *model.VectorPool {
 	return o.vectorPool
 }
 
+func (o *numberLiteralSelector) Reset() {
+	o.currentStep = o.mint
+}
+
 func (o *numberLiteralSelector) Next(context.Context) ([]model.StepVector, error) {
 	if o.currentStep > o.maxt {
 		return nil, nil
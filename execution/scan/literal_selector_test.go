@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestNumberLiteralSelector(t *testing.T) {
+	for _, tcase := range []struct {
+		name               string
+		opts               *query.Options
+		expectedTimestamps []int64
+		expectedBatchSizes []int
+	}{
+		{
+			name: "instant query",
+			opts: &query.Options{
+				Start:      time.Unix(600, 0),
+				End:        time.Unix(600, 0),
+				StepsBatch: 10,
+			},
+			expectedTimestamps: []int64{600000},
+			expectedBatchSizes: []int{1},
+		},
+		{
+			name: "range query",
+			opts: &query.Options{
+				Start:      time.Unix(0, 0),
+				End:        time.Unix(120, 0),
+				Step:       30 * time.Second,
+				StepsBatch: 2,
+			},
+			expectedTimestamps: []int64{0, 30000, 60000, 90000, 120000},
+			expectedBatchSizes: []int{2, 2, 1},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			op := NewNumberLiteralSelector(model.NewVectorPool(10), tcase.opts, 3)
+
+			ctx := context.Background()
+			series, err := op.Series(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, []labels.Labels{nil}, series)
+
+			var (
+				timestamps []int64
+				batchSizes []int
+			)
+			for {
+				vectors, err := op.Next(ctx)
+				testutil.Ok(t, err)
+				if vectors == nil {
+					break
+				}
+				batchSizes = append(batchSizes, len(vectors))
+				for _, vector := range vectors {
+					timestamps = append(timestamps, vector.T)
+					testutil.Equals(t, []uint64{0}, vector.SampleIDs)
+					testutil.Equals(t, []float64{3}, vector.Samples)
+				}
+			}
+			testutil.Equals(t, tcase.expectedTimestamps, timestamps)
+			testutil.Equals(t, tcase.expectedBatchSizes, batchSizes)
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/promql"
@@ -22,20 +23,41 @@ import (
 	"github.com/thanos-community/promql-engine/query"
 )
 
+var ErrTooManySamplesInWindow = errors.New("range window contains too many samples")
+
 type matrixScanner struct {
 	labels         labels.Labels
 	signature      uint64
 	previousPoints []promql.Point
+	series         storage.Series
 	samples        *storage.BufferedSeriesIterator
 }
 
+// iterator returns the scanner's buffered iterator, creating it on first use.
+func (s *matrixScanner) iterator(selectRange int64) *storage.BufferedSeriesIterator {
+	if s.samples == nil && s.series != nil {
+		s.samples = storage.NewBufferIterator(s.series.Iterator(), selectRange)
+	}
+	return s.samples
+}
+
+// release drops the references to the underlying series, its iterator and the retained points.
+func (s *matrixScanner) release() {
+	s.series = nil
+	s.samples = nil
+	s.previousPoints = nil
+}
+
 type matrixSelector struct {
 	funcExpr *parser.Call
 	storage  engstore.SeriesSelector
 	call     function.FunctionCall
+	args     []float64
 	scanners []matrixScanner
-	series   []labels.Labels
-	once     sync.Once
+	// series are only collected from the scanners once Series is called, since callers can also stream them.
+	series     []labels.Labels
+	seriesOnce sync.Once
+	once       sync.Once
 
 	vectorPool *model.VectorPool
 
@@ -47,16 +69,28 @@ type matrixSelector struct {
 	offset      int64
 	currentStep int64
 
+	// maxSampleTime is the latest timestamp of samples which are selected.
+	maxSampleTime int64
+	// maxWindowSamples is the maximum number of samples in the range of one step of a series, or zero if not limited.
+	maxWindowSamples int
+
 	shard     int
 	numShards int
+
+	keepMetricName bool
+	samples        *model.SamplesCounter
 }
 
 // NewMatrixSelector creates operator which selects vector of series over time.
+// If call is nil, the operator returns the samples in the range of each series instead,
+// which is only valid for instant queries. Each returned step vector then contains
+// the samples of all series at one timestamp, with step vectors ordered by their timestamps.
 func NewMatrixSelector(
 	pool *model.VectorPool,
 	selector engstore.SeriesSelector,
 	call function.FunctionCall,
 	funcExpr *parser.Call,
+	args []float64,
 	opts *query.Options,
 	selectRange, offset time.Duration,
 	shard, numShard int,
@@ -65,6 +99,7 @@ func NewMatrixSelector(
 	return &matrixSelector{
 		storage:    selector,
 		call:       call,
+		args:       args,
 		funcExpr:   funcExpr,
 		vectorPool: pool,
 
@@ -77,8 +112,14 @@ func NewMatrixSelector(
 		offset:      offset.Milliseconds(),
 		currentStep: opts.Start.UnixMilli(),
 
+		maxSampleTime:    opts.MaxSampleTime(),
+		maxWindowSamples: opts.MaxSamplesPerWindow,
+
 		shard:     shard,
 		numShards: numShard,
+
+		keepMetricName: opts.KeepMetricNames,
+		samples:        opts.SamplesCounter,
 	}
 }
 
@@ -94,13 +135,40 @@ func (o *matrixSelector) Series(ctx context.Context) ([]labels.Labels, error) {
 	if err := o.loadSeries(ctx); err != nil {
 		return nil, err
 	}
+	o.seriesOnce.Do(func() {
+		o.series = make([]labels.Labels, len(o.scanners))
+		for i := range o.scanners {
+			o.series[i] = o.scanners[i].labels
+		}
+	})
 	return o.series, nil
 }
 
+// StreamSeries streams the labels of the scanners, without collecting them like Series.
+func (o *matrixSelector) StreamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error {
+	if err := o.loadSeries(ctx); err != nil {
+		return err
+	}
+	for i := range o.scanners {
+		if err := fn(o.scanners[i].signature, o.scanners[i].labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (o *matrixSelector) GetPool() *model.VectorPool {
 	return o.vectorPool
 }
 
+func (o *matrixSelector) Reset() {
+	o.once = sync.Once{}
+	o.seriesOnce = sync.Once{}
+	o.scanners = nil
+	o.series = nil
+	o.currentStep = o.mint
+}
+
 func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	if o.currentStep > o.maxt {
 		return nil, nil
@@ -109,33 +177,54 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	if err := o.loadSeries(ctx); err != nil {
 		return nil, err
 	}
+	if o.call == nil {
+		return o.rangeVectors()
+	}
 
+	// Vectors are created for all steps up front, so that selectors
+	// which match no series still return an empty vector for each step.
 	vectors := o.vectorPool.GetVectorBatch()
 	ts := o.currentStep
+	for currStep, stepTs := 0, ts; currStep < o.numSteps && stepTs <= o.maxt; currStep++ {
+		vectors = append(vectors, o.vectorPool.GetStepVector(stepTs))
+		stepTs += o.step
+	}
+
+	var numSamples int64
+
 	for i := 0; i < len(o.scanners); i++ {
 		var (
-			series   = o.scanners[i]
+			series   = &o.scanners[i]
+			samples  = series.iterator(o.selectRange)
 			seriesTs = ts
 		)
 
 		for currStep := 0; currStep < o.numSteps && seriesTs <= o.maxt; currStep++ {
-			if len(vectors) <= currStep {
-				vectors = append(vectors, o.vectorPool.GetStepVector(seriesTs))
+			if samples == nil {
+				seriesTs += o.step
+				continue
 			}
 			maxt := seriesTs - o.offset
 			mint := maxt - o.selectRange
-			rangePoints := selectPoints(series.samples, mint, maxt, o.scanners[i].previousPoints)
+			if maxt > o.maxSampleTime {
+				maxt = o.maxSampleTime
+			}
+			rangePoints, err := selectPoints(samples, mint, maxt, series.previousPoints, o.maxWindowSamples)
+			if err != nil {
+				return nil, errors.Wrapf(err, "series %s", series.labels)
+			}
+			numSamples += int64(len(rangePoints))
 
-			// TODO(saswatamcode): Handle multi-arg functions for matrixSelectors.
-			// Also, allow operator to exist independently without being nested
+			// TODO(saswatamcode): Allow operator to exist independently without being nested
 			// under parser.Call by implementing new data model.
 			// https://github.com/thanos-community/promql-engine/issues/39
 			result := o.call(function.FunctionArgs{
-				Labels:      series.labels,
-				Points:      rangePoints,
-				StepTime:    seriesTs,
-				SelectRange: o.selectRange,
-				Offset:      o.offset,
+				Labels:       series.labels,
+				Points:       rangePoints,
+				StepTime:     seriesTs,
+				SelectRange:  o.selectRange,
+				ScalarPoints: o.args,
+				Offset:       o.offset,
 			})
 
 			if result.Point != function.InvalidSample.Point {
@@ -144,18 +233,26 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 				vectors[currStep].SampleIDs = append(vectors[currStep].SampleIDs, series.signature)
 			}
 
-			o.scanners[i].previousPoints = rangePoints
+			series.previousPoints = rangePoints
+			if o.step > 0 && isRangeExhausted(samples, rangePoints, maxt, seriesTs+o.step-o.offset-o.selectRange, o.maxSampleTime) {
+				series.release()
+				samples = nil
+				seriesTs += o.step
+				continue
+			}
 
 			// Only buffer stepRange milliseconds from the second step on.
 			stepRange := o.selectRange
 			if stepRange > o.step {
 				stepRange = o.step
 			}
-			series.samples.ReduceDelta(stepRange)
+			samples.ReduceDelta(stepRange)
 
 			seriesTs += o.step
 		}
 	}
+	o.samples.Add(numSamples)
+
 	// For instant queries, set the step to a positive value
 	// so that the operator can terminate.
 	if o.step == 0 {
@@ -166,6 +263,41 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	return vectors, nil
 }
 
+// rangeVectors returns the samples in the range of the first step
+// as one step vector for each timestamp at which samples exist.
+func (o *matrixSelector) rangeVectors() ([]model.StepVector, error) {
+	maxt := o.currentStep - o.offset
+	mint := maxt - o.selectRange
+	if maxt > o.maxSampleTime {
+		maxt = o.maxSampleTime
+	}
+
+	vectors := o.vectorPool.GetVectorBatch()
+	vectorIndexes := make(map[int64]int)
+	for i := range o.scanners {
+		series := &o.scanners[i]
+		points, err := selectPoints(series.iterator(o.selectRange), mint, maxt, nil, o.maxWindowSamples)
+		if err != nil {
+			return nil, errors.Wrapf(err, "series %s", series.labels)
+		}
+		o.samples.Add(int64(len(points)))
+		for _, p := range points {
+			idx, ok := vectorIndexes[p.T]
+			if !ok {
+				idx = len(vectors)
+				vectorIndexes[p.T] = idx
+				vectors = append(vectors, o.vectorPool.GetStepVector(p.T))
+			}
+			vectors[idx].SampleIDs = append(vectors[idx].SampleIDs, series.signature)
+			vectors[idx].Samples = append(vectors[idx].Samples, p.V)
+		}
+	}
+	sort.Slice(vectors, func(i, j int) bool { return vectors[i].T < vectors[j].T })
+	o.currentStep = o.maxt + 1
+
+	return vectors, nil
+}
+
 func (o *matrixSelector) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
@@ -176,21 +308,19 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 		}
 
 		o.scanners = make([]matrixScanner, len(series))
-		o.series = make([]labels.Labels, len(series))
 		for i, s := range series {
 			lbls := s.Labels()
-			if o.funcExpr.Func.Name != "last_over_time" {
-				lbls = function.DropMetricName(lbls)
+			if o.funcExpr != nil && o.funcExpr.Func.Name != "last_over_time" && !o.keepMetricName {
+				lbls = model.DropMetricName(lbls)
 			}
 
 			sort.Sort(lbls)
 
 			o.scanners[i] = matrixScanner{
 				labels:    lbls,
-				signature: s.Signature,
-				samples:   storage.NewBufferIterator(s.Iterator(), o.selectRange),
+				signature: uint64(i),
+				series:    s.Series,
 			}
-			o.series[i] = lbls
 		}
 		o.vectorPool.SetStepSize(len(series))
 	})
@@ -205,8 +335,14 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 // values). Any such points falling before mint are discarded; points that fall
 // into the [mint, maxt] range are retained; only points with later timestamps
 // are populated from the iterator.
-// TODO(fpetkovski): Add error handling and max samples limit.
-func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Point) []promql.Point {
+//
+// Same as in the Prometheus version we depend on, ranges are closed on both ends, so samples
+// at exactly mint and maxt are selected. This applies to all functions over range vectors,
+// including rate and absent_over_time, which is evaluated with count_over_time.
+//
+// If maxSamples is positive, ErrTooManySamplesInWindow is returned as soon as the range
+// contains more than maxSamples points.
+func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []promql.Point, maxSamples int) ([]promql.Point, error) {
 	if len(out) > 0 && out[len(out)-1].T >= mint {
 		// There is an overlap between previous and current ranges, retain common
 		// points. In most such cases:
@@ -233,15 +369,34 @@ func selectPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []pr
 		}
 		// Values in the buffer are guaranteed to be smaller than maxt.
 		if t >= mint {
+			if maxSamples > 0 && len(out) >= maxSamples {
+				return nil, errors.Wrapf(ErrTooManySamplesInWindow, "more than %d samples between %d and %d", maxSamples, mint, maxt)
+			}
 			out = append(out, promql.Point{T: t, V: v})
 		}
 	}
-	// The seeked sample might also be in the range.
+	// The seeked sample might also be in the range. It can already be retained from
+	// the previous range if maxt did not move, for example because it is capped at the snapshot time.
 	if ok {
 		t, v := it.At()
-		if t == maxt && !value.IsStaleNaN(v) {
+		if t == maxt && t >= mint && !value.IsStaleNaN(v) {
+			if maxSamples > 0 && len(out) >= maxSamples {
+				return nil, errors.Wrapf(ErrTooManySamplesInWindow, "more than %d samples between %d and %d", maxSamples, mint, maxt)
+			}
 			out = append(out, promql.Point{T: t, V: v})
 		}
 	}
-	return out
+	return out, nil
+}
+
+// isRangeExhausted returns true if no range starting at or after mint can contain samples
+// of the iterator. The iterator must have been seeked to maxt for selecting points, the
+// latest of which are passed in points, so that seeking it again does not advance it.
+func isRangeExhausted(it *storage.BufferedSeriesIterator, points []promql.Point, maxt, mint, maxSampleTime int64) bool {
+	if it.Seek(maxt) {
+		if t, _ := it.At(); t <= maxSampleTime {
+			return false
+		}
+	}
+	return len(points) == 0 || points[len(points)-1].T < mint
 }
@@ -0,0 +1,75 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+
+	"github.com/thanos-community/promql-engine/execution/function"
+	"github.com/thanos-community/promql-engine/execution/model"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestMatrixSelectorReleasesExhaustedSeries(t *testing.T) {
+	selector := seriesSelector{series: []engstore.SignedSeries{
+		{Series: listSeries(labels.FromStrings("pod", "nginx-1"), 0, 30000, 60000)},
+		{Series: listSeries(labels.FromStrings("pod", "nginx-2"), 0, 300000, 600000), Signature: 1},
+	}}
+	opts := &query.Options{
+		Start:         time.Unix(0, 0),
+		End:           time.Unix(600, 0),
+		Step:          30 * time.Second,
+		LookbackDelta: 5 * time.Minute,
+		StepsBatch:    10,
+	}
+	funcExpr := &parser.Call{Func: parser.Functions["count_over_time"]}
+	o := NewMatrixSelector(model.NewVectorPool(10), selector, function.Funcs["count_over_time"], funcExpr, nil, opts, time.Minute, 0, 0, 1).(*matrixSelector)
+
+	counts := make(map[uint64]float64)
+	for {
+		vectors, err := o.Next(context.Background())
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		for _, vector := range vectors {
+			for i, sID := range vector.SampleIDs {
+				counts[sID] += vector.Samples[i]
+			}
+		}
+
+		// The first series has no samples in the ranges of the remaining steps.
+		testutil.Assert(t, o.scanners[0].series == nil && o.scanners[0].samples == nil, "the exhausted series was not released")
+		testutil.Assert(t, o.scanners[0].previousPoints == nil, "the points of the exhausted series were not released")
+	}
+	testutil.Equals(t, map[uint64]float64{0: 9, 1: 7}, counts)
+	testutil.Assert(t, o.scanners[1].samples != nil, "the series with samples in the last range was released")
+}
+
+// listSeries returns a series with a sample at each of the timestamps. Unlike
+// storage.MockSeries, its iterator supports seeking.
+func listSeries(lbls labels.Labels, timestamps ...int64) storage.Series {
+	samples := make([]tsdbutil.Sample, 0, len(timestamps))
+	for i, t := range timestamps {
+		samples = append(samples, sample{t: t, v: float64(i)})
+	}
+	return storage.NewListSeries(lbls, samples)
+}
+
+type sample struct {
+	t int64
+	v float64
+}
+
+func (s sample) T() int64   { return s.t }
+func (s sample) V() float64 { return s.v }
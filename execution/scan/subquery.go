@@ -0,0 +1,243 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/function"
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+// subqueryOperator evaluates a function over the range of a subquery.
+// The inner expression is evaluated by the next operator which has to be
+// created with the options of the subquery.
+type subqueryOperator struct {
+	next     model.VectorOperator
+	pool     *model.VectorPool
+	call     function.FunctionCall
+	funcExpr *parser.Call
+	args     []float64
+
+	once   sync.Once
+	series []labels.Labels
+
+	// buffers contains the samples of each inner series which
+	// have not yet fallen out of the range of the subquery.
+	buffers [][]promql.Point
+	// lastT is the timestamp of the last step read from the next operator.
+	lastT     int64
+	exhausted bool
+
+	numSteps      int
+	mint          int64
+	maxt          int64
+	step          int64
+	subqueryRange int64
+	offset        int64
+	currentStep   int64
+	// timestamp is the timestamp of the @ modifier of the subquery, at
+	// which it is evaluated for all steps, or nil if it does not have one.
+	timestamp *int64
+
+	keepMetricName bool
+	samples        *model.SamplesCounter
+}
+
+// NewSubqueryOperator creates an operator which applies call over the range of a subquery.
+// The opts are the options of the enclosing query and not the options of the subquery.
+// If timestamp is not nil, the subquery is evaluated at timestamp for every step,
+// same as subqueries with the @ modifier.
+func NewSubqueryOperator(
+	pool *model.VectorPool,
+	next model.VectorOperator,
+	call function.FunctionCall,
+	funcExpr *parser.Call,
+	args []float64,
+	opts *query.Options,
+	subqueryRange, offset time.Duration,
+	timestamp *int64,
+) model.VectorOperator {
+	return &subqueryOperator{
+		next:     next,
+		pool:     pool,
+		call:     call,
+		funcExpr: funcExpr,
+		args:     args,
+		lastT:    math.MinInt64,
+
+		numSteps: opts.NumSteps(),
+		mint:     opts.Start.UnixMilli(),
+		maxt:     opts.End.UnixMilli(),
+		step:     opts.Step.Milliseconds(),
+
+		subqueryRange: subqueryRange.Milliseconds(),
+		offset:        offset.Milliseconds(),
+		currentStep:   opts.Start.UnixMilli(),
+		timestamp:     timestamp,
+
+		keepMetricName: opts.KeepMetricNames,
+		samples:        opts.SamplesCounter,
+	}
+}
+
+func (o *subqueryOperator) Explain() (me string, next []model.VectorOperator) {
+	return fmt.Sprintf("[*subqueryOperator] %v(%v)", o.funcExpr.Func.Name, o.funcExpr.Args), []model.VectorOperator{o.next}
+}
+
+func (o *subqueryOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *subqueryOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *subqueryOperator) Reset() {
+	o.next.Reset()
+	for i := range o.buffers {
+		o.buffers[i] = o.buffers[i][:0]
+	}
+	o.lastT = math.MinInt64
+	o.exhausted = false
+	o.currentStep = o.mint
+}
+
+func (o *subqueryOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	if o.currentStep > o.maxt {
+		return nil, nil
+	}
+
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
+
+	vectors := o.pool.GetVectorBatch()
+	ts := o.currentStep
+	for currStep := 0; currStep < o.numSteps && ts <= o.maxt; currStep++ {
+		evalTs := ts
+		if o.timestamp != nil {
+			evalTs = *o.timestamp
+		}
+		maxt := evalTs - o.offset
+		mint := maxt - o.subqueryRange
+		if err := o.collect(ctx, maxt); err != nil {
+			return nil, err
+		}
+
+		vector := o.pool.GetStepVector(ts)
+		for i := range o.buffers {
+			rangePoints := o.rangePoints(i, mint, maxt)
+			// Same as in Prometheus, the points of the subquery are counted instead of the samples of its inner expression.
+			o.samples.Add(int64(len(rangePoints)))
+			result := o.call(function.FunctionArgs{
+				Labels:       o.series[i],
+				Points:       rangePoints,
+				StepTime:     evalTs,
+				SelectRange:  o.subqueryRange,
+				ScalarPoints: o.args,
+				Offset:       o.offset,
+			})
+
+			if result.Point != function.InvalidSample.Point {
+				if o.timestamp == nil {
+					vector.T = result.T
+				}
+				vector.Samples = append(vector.Samples, result.V)
+				vector.SampleIDs = append(vector.SampleIDs, uint64(i))
+			}
+		}
+		vectors = append(vectors, vector)
+		ts += o.step
+	}
+
+	// For instant queries, set the step to a positive value
+	// so that the operator can terminate.
+	if o.step == 0 {
+		o.step = 1
+	}
+	o.currentStep += o.step * int64(o.numSteps)
+
+	return vectors, nil
+}
+
+// collect reads steps from the next operator until all steps up to maxt have been buffered.
+func (o *subqueryOperator) collect(ctx context.Context, maxt int64) error {
+	for !o.exhausted && o.lastT < maxt {
+		vectors, err := o.next.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if vectors == nil {
+			o.exhausted = true
+			return nil
+		}
+
+		for _, vector := range vectors {
+			for i, sampleID := range vector.SampleIDs {
+				o.buffers[sampleID] = append(o.buffers[sampleID], promql.Point{T: vector.T, V: vector.Samples[i]})
+			}
+			o.lastT = vector.T
+			o.next.GetPool().PutStepVector(vector)
+		}
+		o.next.GetPool().PutVectors(vectors)
+	}
+	return nil
+}
+
+// rangePoints drops points of series i before mint from its buffer
+// and returns the points which fall into [mint, maxt].
+func (o *subqueryOperator) rangePoints(i int, mint, maxt int64) []promql.Point {
+	points := o.buffers[i]
+	var drop int
+	for drop < len(points) && points[drop].T < mint {
+		drop++
+	}
+	if drop > 0 {
+		copy(points, points[drop:])
+		points = points[:len(points)-drop]
+		o.buffers[i] = points
+	}
+
+	var n int
+	for n < len(points) && points[n].T <= maxt {
+		n++
+	}
+	return points[:n]
+}
+
+func (o *subqueryOperator) loadSeries(ctx context.Context) error {
+	var err error
+	o.once.Do(func() {
+		series, seriesErr := o.next.Series(ctx)
+		if seriesErr != nil {
+			err = seriesErr
+			return
+		}
+
+		o.buffers = make([][]promql.Point, len(series))
+		o.series = make([]labels.Labels, len(series))
+		for i, s := range series {
+			lbls := s
+			if o.funcExpr.Func.Name != "last_over_time" && !o.keepMetricName {
+				lbls = model.DropMetricName(lbls)
+			}
+			o.series[i] = lbls
+		}
+		o.pool.SetStepSize(len(series))
+	})
+	return err
+}
@@ -6,9 +6,12 @@ package scan
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/efficientgo/core/errors"
+
 	"github.com/thanos-community/promql-engine/execution/model"
 	engstore "github.com/thanos-community/promql-engine/execution/storage"
 	"github.com/thanos-community/promql-engine/query"
@@ -22,13 +25,33 @@ import (
 type vectorScanner struct {
 	labels    labels.Labels
 	signature uint64
+	series    storage.Series
 	samples   *storage.MemoizedSeriesIterator
 }
 
+// iterator returns the scanner's sample iterator, creating it on first use.
+// Iterators are created lazily so that chunks are only decoded once the
+// operator starts producing samples, and are released as soon as the series
+// can no longer contribute to the result.
+func (s *vectorScanner) iterator(lookbackDelta int64) *storage.MemoizedSeriesIterator {
+	if s.samples == nil && s.series != nil {
+		s.samples = storage.NewMemoizedIterator(s.series.Iterator(), lookbackDelta)
+	}
+	return s.samples
+}
+
+// release drops the references to the underlying series and its iterator.
+func (s *vectorScanner) release() {
+	s.series = nil
+	s.samples = nil
+}
+
 type vectorSelector struct {
 	storage  engstore.SeriesSelector
 	scanners []vectorScanner
-	series   []labels.Labels
+	// series are only collected from the scanners once Series is called, since callers can also stream them.
+	series     []labels.Labels
+	seriesOnce sync.Once
 
 	once       sync.Once
 	vectorPool *model.VectorPool
@@ -40,6 +63,14 @@ type vectorSelector struct {
 	step          int64
 	currentStep   int64
 	offset        int64
+	timestamps    []int64
+
+	// maxSampleTime is the latest timestamp of samples which are selected.
+	maxSampleTime int64
+
+	interner model.LabelsInterner
+	retry    *query.RetryOptions
+	samples  *model.SamplesCounter
 
 	shard     int
 	numShards int
@@ -64,12 +95,40 @@ func NewVectorSelector(
 		lookbackDelta: queryOpts.LookbackDelta.Milliseconds(),
 		offset:        offset.Milliseconds(),
 		numSteps:      queryOpts.NumSteps(),
+		timestamps:    queryOpts.Timestamps,
+		maxSampleTime: queryOpts.MaxSampleTime(),
+
+		interner: queryOpts.LabelsInterner,
+		retry:    queryOpts.SeriesRetry,
+		samples:  queryOpts.SamplesCounter,
 
 		shard:     shard,
 		numShards: numShards,
 	}
 }
 
+// SelectorParams are the parameters which a selector uses to select samples.
+// All values are in milliseconds.
+type SelectorParams struct {
+	Mint          int64
+	Maxt          int64
+	Step          int64
+	LookbackDelta int64
+	Offset        int64
+}
+
+// Params returns the parameters of the selector. It is meant for tools
+// which need to explain why samples were or were not selected.
+func (o *vectorSelector) Params() SelectorParams {
+	return SelectorParams{
+		Mint:          o.mint,
+		Maxt:          o.maxt,
+		Step:          o.step,
+		LookbackDelta: o.lookbackDelta,
+		Offset:        o.offset,
+	}
+}
+
 func (o *vectorSelector) Explain() (me string, next []model.VectorOperator) {
 	return fmt.Sprintf("[*vectorSelector] {%v} %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
 }
@@ -78,13 +137,42 @@ func (o *vectorSelector) Series(ctx context.Context) ([]labels.Labels, error) {
 	if err := o.loadSeries(ctx); err != nil {
 		return nil, err
 	}
+	o.seriesOnce.Do(func() {
+		o.series = make([]labels.Labels, len(o.scanners))
+		for i := range o.scanners {
+			o.series[i] = o.scanners[i].labels
+		}
+	})
 	return o.series, nil
 }
 
+// StreamSeries streams the labels of the scanners, without collecting them like Series.
+func (o *vectorSelector) StreamSeries(ctx context.Context, fn func(id uint64, lbls labels.Labels) error) error {
+	if err := o.loadSeries(ctx); err != nil {
+		return err
+	}
+	for i := range o.scanners {
+		if err := fn(o.scanners[i].signature, o.scanners[i].labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (o *vectorSelector) GetPool() *model.VectorPool {
 	return o.vectorPool
 }
 
+func (o *vectorSelector) Reset() {
+	// Scanners are recreated when series are loaded again,
+	// which also creates new iterators for each series.
+	o.once = sync.Once{}
+	o.seriesOnce = sync.Once{}
+	o.scanners = nil
+	o.series = nil
+	o.currentStep = o.mint
+}
+
 func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 	if o.currentStep > o.maxt {
 		return nil, nil
@@ -94,72 +182,211 @@ func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	var vectors []model.StepVector
+	if len(o.scanners) == 1 {
+		vectors = o.selectSingleSeries(o.currentStep)
+	} else {
+		vectors = o.selectSeries(o.currentStep)
+	}
+	for _, vector := range vectors {
+		o.samples.Add(int64(len(vector.Samples)))
+	}
+	if len(o.timestamps) > 0 {
+		for i := 0; i < o.numSteps; i++ {
+			o.currentStep = o.nextStep(o.currentStep)
+		}
+		return vectors, nil
+	}
+
+	// For instant queries, move past maxt
+	// so that the operator can terminate.
+	if o.step == 0 {
+		o.currentStep = o.maxt + 1
+		return vectors, nil
+	}
+	o.currentStep += o.step * int64(o.numSteps)
+
+	return vectors, nil
+}
+
+// selectSeries returns the samples of all series in the batch of steps starting at ts.
+func (o *vectorSelector) selectSeries(ts int64) []model.StepVector {
+	// Vectors are created for all steps up front, so that selectors
+	// which match no series still return an empty vector for each step.
 	vectors := o.vectorPool.GetVectorBatch()
-	ts := o.currentStep
+	for currStep, stepTs := 0, ts; currStep < o.numSteps && stepTs <= o.maxt; currStep++ {
+		vectors = append(vectors, o.vectorPool.GetStepVector(stepTs))
+		stepTs = o.nextStep(stepTs)
+	}
+
 	for i := 0; i < len(o.scanners); i++ {
 		var (
-			series   = o.scanners[i]
+			series   = &o.scanners[i]
+			samples  = series.iterator(o.lookbackDelta)
 			seriesTs = ts
 		)
 
 		for currStep := 0; currStep < o.numSteps && seriesTs <= o.maxt; currStep++ {
-			if len(vectors) <= currStep {
-				vectors = append(vectors, o.vectorPool.GetStepVector(seriesTs))
+			if samples == nil {
+				seriesTs = o.nextStep(seriesTs)
+				continue
 			}
-			_, v, ok := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
+			_, v, ok := selectPoint(samples, seriesTs, o.lookbackDelta, o.offset, o.maxSampleTime)
 			if ok {
 				vectors[currStep].SampleIDs = append(vectors[currStep].SampleIDs, series.signature)
 				vectors[currStep].Samples = append(vectors[currStep].Samples, v)
+			} else if o.step > 0 && isExhausted(samples, seriesTs, o.lookbackDelta, o.offset, o.maxSampleTime) {
+				series.release()
+				samples = nil
 			}
-			seriesTs += o.step
+			seriesTs = o.nextStep(seriesTs)
 		}
 	}
-	// For instant queries, set the step to a positive value
-	// so that the operator can terminate.
-	if o.step == 0 {
-		o.step = 1
+	return vectors
+}
+
+// selectSingleSeries is a faster version of selectSeries for selectors with a single series,
+// as is common in alerting rules. Since each step vector contains at most one sample, samples
+// are selected while creating the vectors instead of iterating over all steps a second time.
+func (o *vectorSelector) selectSingleSeries(ts int64) []model.StepVector {
+	var (
+		series  = &o.scanners[0]
+		samples = series.iterator(o.lookbackDelta)
+	)
+
+	vectors := o.vectorPool.GetVectorBatch()
+	for currStep, stepTs := 0, ts; currStep < o.numSteps && stepTs <= o.maxt; currStep++ {
+		vector := o.vectorPool.GetStepVector(stepTs)
+		if samples != nil {
+			if _, v, ok := selectPoint(samples, stepTs, o.lookbackDelta, o.offset, o.maxSampleTime); ok {
+				vector.SampleIDs = append(vector.SampleIDs, series.signature)
+				vector.Samples = append(vector.Samples, v)
+			} else if o.step > 0 && isExhausted(samples, stepTs, o.lookbackDelta, o.offset, o.maxSampleTime) {
+				series.release()
+				samples = nil
+			}
+		}
+		vectors = append(vectors, vector)
+		stepTs = o.nextStep(stepTs)
 	}
-	o.currentStep += o.step * int64(o.numSteps)
+	return vectors
+}
 
-	return vectors, nil
+// nextStep returns the evaluation timestamp which follows ts.
+// When evaluating at explicit timestamps, a timestamp after maxt
+// is returned once ts is the last one.
+func (o *vectorSelector) nextStep(ts int64) int64 {
+	if len(o.timestamps) == 0 {
+		return ts + o.step
+	}
+	i := sort.Search(len(o.timestamps), func(i int) bool { return o.timestamps[i] > ts })
+	if i == len(o.timestamps) {
+		return o.maxt + 1
+	}
+	return o.timestamps[i]
 }
 
 func (o *vectorSelector) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
-		series, loadErr := o.storage.GetSeries(ctx, o.shard, o.numShards)
+		series, loadErr := getSeriesWithRetry(ctx, o.storage, o.shard, o.numShards, o.retry)
 		if loadErr != nil {
 			err = loadErr
 			return
 		}
 
 		o.scanners = make([]vectorScanner, len(series))
-		o.series = make([]labels.Labels, len(series))
 		for i, s := range series {
+			lbls := s.Labels()
+			if o.interner != nil {
+				lbls = o.interner.Intern(lbls)
+			}
 			o.scanners[i] = vectorScanner{
-				labels:    s.Labels(),
-				signature: s.Signature,
-				samples:   storage.NewMemoizedIterator(s.Iterator(), o.lookbackDelta),
+				labels:    lbls,
+				signature: uint64(i),
+				series:    s.Series,
 			}
-			o.series[i] = s.Labels()
 		}
 		o.vectorPool.SetStepSize(len(series))
 	})
 	return err
 }
 
+// getSeriesWithRetry gets series from the selector and retries
+// transient errors with exponential backoff if retry is set.
+func getSeriesWithRetry(ctx context.Context, selector engstore.SeriesSelector, shard, numShards int, retry *query.RetryOptions) ([]engstore.SignedSeries, error) {
+	series, err := selector.GetSeries(ctx, shard, numShards)
+	if err == nil || retry == nil {
+		return series, err
+	}
+
+	backoff := retry.MinBackoff
+	for i := 0; i < retry.MaxRetries && !isPermanent(err, retry); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+
+		series, err = selector.GetSeries(ctx, shard, numShards)
+		if err == nil {
+			return series, nil
+		}
+	}
+	return nil, err
+}
+
+func isPermanent(err error, retry *query.RetryOptions) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return retry.IsPermanent != nil && retry.IsPermanent(err)
+}
+
+// isExhausted returns true if the iterator can not produce any samples
+// for steps at or after ts.
+func isExhausted(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset, maxSampleTime int64) bool {
+	refTime := ts - offset
+	seekTime := refTime
+	if seekTime > maxSampleTime {
+		seekTime = maxSampleTime
+	}
+	if it.Seek(seekTime) {
+		if seekTime == refTime {
+			return false
+		}
+		// Samples after maxSampleTime are never selected, so the sample at
+		// maxSampleTime is the last one which later steps could select.
+		if t, _ := it.At(); t == seekTime {
+			return t < refTime-lookbackDelta
+		}
+	}
+	t, _, ok := it.PeekPrev()
+	return !ok || t < refTime-lookbackDelta
+}
+
+// selectPoint returns the latest sample of the iterator in the lookback window of ts.
+// Samples after maxSampleTime are ignored. Since selectors only move forward in time,
+// the iterator is never advanced past maxSampleTime.
 // TODO(fpetkovski): Add error handling and max samples limit.
-func selectPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset int64) (int64, float64, bool) {
+func selectPoint(it *storage.MemoizedSeriesIterator, ts, lookbackDelta, offset, maxSampleTime int64) (int64, float64, bool) {
 	refTime := ts - offset
+	seekTime := refTime
+	if seekTime > maxSampleTime {
+		seekTime = maxSampleTime
+	}
 	var t int64
 	var v float64
 
-	ok := it.Seek(refTime)
+	ok := it.Seek(seekTime)
 	if ok {
 		t, v = it.At()
 	}
 
-	if !ok || t > refTime {
+	if !ok || t > seekTime {
 		t, v, ok = it.PeekPrev()
 		if !ok || t < refTime-lookbackDelta {
 			return 0, 0, false
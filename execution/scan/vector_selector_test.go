@@ -0,0 +1,309 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	engstore "github.com/thanos-community/promql-engine/execution/storage"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestVectorSelectorParams(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		opts     *query.Options
+		offset   time.Duration
+		expected SelectorParams
+	}{
+		{
+			name: "range query",
+			opts: &query.Options{
+				Start:         time.Unix(60, 0),
+				End:           time.Unix(600, 0),
+				Step:          30 * time.Second,
+				LookbackDelta: 5 * time.Minute,
+				StepsBatch:    10,
+			},
+			offset:   time.Minute,
+			expected: SelectorParams{Mint: 60000, Maxt: 600000, Step: 30000, LookbackDelta: 300000, Offset: 60000},
+		},
+		{
+			name: "instant query",
+			opts: &query.Options{
+				Start:         time.Unix(600, 0),
+				End:           time.Unix(600, 0),
+				LookbackDelta: time.Minute,
+				StepsBatch:    10,
+			},
+			expected: SelectorParams{Mint: 600000, Maxt: 600000, LookbackDelta: 60000},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			op := NewVectorSelector(model.NewVectorPool(10), emptySelector{}, tcase.opts, tcase.offset, 0, 1)
+			selector, ok := op.(interface{ Params() SelectorParams })
+			testutil.Assert(t, ok)
+			testutil.Equals(t, tcase.expected, selector.Params())
+
+			// Evaluating the selector does not change its parameters.
+			for {
+				vectors, err := op.Next(context.Background())
+				testutil.Ok(t, err)
+				if vectors == nil {
+					break
+				}
+			}
+			testutil.Equals(t, tcase.expected, selector.Params())
+		})
+	}
+}
+
+func TestVectorSelectorWithoutSeries(t *testing.T) {
+	opts := &query.Options{
+		Start:         time.Unix(0, 0),
+		End:           time.Unix(600, 0),
+		Step:          30 * time.Second,
+		LookbackDelta: 5 * time.Minute,
+		StepsBatch:    10,
+	}
+	op := NewVectorSelector(model.NewVectorPool(10), emptySelector{}, opts, 0, 0, 1)
+
+	series, err := op.Series(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(series))
+
+	var batchSizes []int
+	ts := int64(0)
+	for {
+		vectors, err := op.Next(context.Background())
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		batchSizes = append(batchSizes, len(vectors))
+		for _, vector := range vectors {
+			testutil.Equals(t, ts, vector.T)
+			testutil.Equals(t, 0, len(vector.Samples))
+			ts += 30000
+		}
+	}
+	testutil.Equals(t, []int{10, 10, 1}, batchSizes)
+}
+
+func TestSelectorsStreamSeries(t *testing.T) {
+	selector := seriesSelector{series: []engstore.SignedSeries{
+		{Series: listSeries(labels.FromStrings("pod", "nginx-1"), 0, 30000)},
+		{Series: listSeries(labels.FromStrings("pod", "nginx-2"), 0, 30000), Signature: 1},
+	}}
+	opts := &query.Options{
+		Start:         time.Unix(0, 0),
+		End:           time.Unix(600, 0),
+		Step:          30 * time.Second,
+		LookbackDelta: 5 * time.Minute,
+		StepsBatch:    10,
+	}
+	for _, tcase := range []struct {
+		name string
+		op   model.VectorOperator
+	}{
+		{name: "vector selector", op: NewVectorSelector(model.NewVectorPool(10), selector, opts, 0, 0, 1)},
+		{name: "matrix selector", op: NewMatrixSelector(model.NewVectorPool(10), selector, nil, nil, nil, opts, time.Minute, 0, 0, 1)},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var streamed []labels.Labels
+			testutil.Ok(t, tcase.op.(model.SeriesStreamer).StreamSeries(context.Background(), func(id uint64, lbls labels.Labels) error {
+				testutil.Equals(t, uint64(len(streamed)), id)
+				streamed = append(streamed, lbls)
+				return nil
+			}))
+
+			// Streaming does not collect the series, which only happens once they are requested.
+			switch o := tcase.op.(type) {
+			case *vectorSelector:
+				testutil.Assert(t, o.series == nil, "streamed series were collected")
+			case *matrixSelector:
+				testutil.Assert(t, o.series == nil, "streamed series were collected")
+			}
+			series, err := tcase.op.Series(context.Background())
+			testutil.Ok(t, err)
+			testutil.Equals(t, series, streamed)
+		})
+	}
+}
+
+func TestVectorSelectorRetriesTransientErrors(t *testing.T) {
+	transientErr := errors.New("unavailable")
+	for _, tcase := range []struct {
+		name             string
+		err              error
+		failures         int
+		retry            *query.RetryOptions
+		expectedAttempts int
+		expectedErr      error
+	}{
+		{
+			name:             "fails once then succeeds",
+			err:              transientErr,
+			failures:         1,
+			retry:            &query.RetryOptions{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			expectedAttempts: 2,
+		},
+		{
+			name:             "retries are exhausted",
+			err:              transientErr,
+			failures:         5,
+			retry:            &query.RetryOptions{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			expectedAttempts: 3,
+			expectedErr:      transientErr,
+		},
+		{
+			name:             "retries are disabled",
+			err:              transientErr,
+			failures:         1,
+			expectedAttempts: 1,
+			expectedErr:      transientErr,
+		},
+		{
+			name:             "context cancelled",
+			err:              context.Canceled,
+			failures:         1,
+			retry:            &query.RetryOptions{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			expectedAttempts: 1,
+			expectedErr:      context.Canceled,
+		},
+		{
+			name:     "permanent error",
+			err:      transientErr,
+			failures: 1,
+			retry: &query.RetryOptions{
+				MaxRetries:  3,
+				MinBackoff:  time.Millisecond,
+				MaxBackoff:  time.Millisecond,
+				IsPermanent: func(err error) bool { return errors.Is(err, transientErr) },
+			},
+			expectedAttempts: 1,
+			expectedErr:      transientErr,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			selector := &failingSelector{err: tcase.err, failures: tcase.failures}
+			opts := &query.Options{
+				Start:       time.Unix(600, 0),
+				End:         time.Unix(600, 0),
+				StepsBatch:  10,
+				SeriesRetry: tcase.retry,
+			}
+			op := NewVectorSelector(model.NewVectorPool(10), selector, opts, 0, 0, 1)
+
+			series, err := op.Series(context.Background())
+			testutil.Equals(t, tcase.expectedAttempts, selector.attempts)
+			if tcase.expectedErr != nil {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, errors.Is(err, tcase.expectedErr))
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, []labels.Labels{labels.FromStrings("pod", "nginx-1")}, series)
+
+			_, err = op.Next(context.Background())
+			testutil.Ok(t, err)
+		})
+	}
+}
+
+// failingSelector fails the first failures calls to GetSeries.
+type failingSelector struct {
+	err      error
+	failures int
+	attempts int
+}
+
+func (s *failingSelector) GetSeries(context.Context, int, int) ([]engstore.SignedSeries, error) {
+	s.attempts++
+	if s.attempts <= s.failures {
+		return nil, s.err
+	}
+	return []engstore.SignedSeries{{Series: storage.MockSeries(nil, nil, []string{"pod", "nginx-1"})}}, nil
+}
+
+func (s *failingSelector) Matchers() []*labels.Matcher {
+	return nil
+}
+
+type emptySelector struct{}
+
+func (emptySelector) GetSeries(context.Context, int, int) ([]engstore.SignedSeries, error) {
+	return nil, nil
+}
+
+func (emptySelector) Matchers() []*labels.Matcher {
+	return nil
+}
+
+func BenchmarkVectorSelectorSingleSeries(b *testing.B) {
+	const numSamples = 2880
+	timestamps := make([]int64, numSamples)
+	values := make([]float64, numSamples)
+	for i := range timestamps {
+		timestamps[i] = int64(i) * 30000
+		values[i] = float64(i)
+	}
+	selector := seriesSelector{series: []engstore.SignedSeries{
+		{Series: storage.MockSeries(timestamps, values, []string{"pod", "nginx-1"})},
+	}}
+	opts := &query.Options{
+		Start:         time.Unix(0, 0),
+		End:           time.UnixMilli(timestamps[numSamples-1]),
+		Step:          30 * time.Second,
+		LookbackDelta: 5 * time.Minute,
+		StepsBatch:    10,
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		selectFn func(o *vectorSelector, ts int64) []model.StepVector
+	}{
+		{name: "general", selectFn: (*vectorSelector).selectSeries},
+		{name: "single series", selectFn: (*vectorSelector).selectSingleSeries},
+	} {
+		b.Run(tcase.name, func(b *testing.B) {
+			pool := model.NewVectorPool(10)
+			o := NewVectorSelector(pool, selector, opts, 0, 0, 1).(*vectorSelector)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o.Reset()
+				testutil.Ok(b, o.loadSeries(context.Background()))
+				for ts := o.mint; ts <= o.maxt; ts += o.step * int64(o.numSteps) {
+					vectors := tcase.selectFn(o, ts)
+					for _, v := range vectors {
+						pool.PutStepVector(v)
+					}
+					pool.PutVectors(vectors)
+				}
+			}
+		})
+	}
+}
+
+type seriesSelector struct {
+	series []engstore.SignedSeries
+}
+
+func (s seriesSelector) GetSeries(context.Context, int, int) ([]engstore.SignedSeries, error) {
+	return s.series, nil
+}
+
+func (seriesSelector) Matchers() []*labels.Matcher {
+	return nil
+}
@@ -23,9 +23,18 @@ type stepInvariantOperator struct {
 
 	series []labels.Labels
 
-	mint int64
-	maxt int64
-	step int64
+	cacheOnce    sync.Once
+	cachedVector model.StepVector
+
+	mint        int64
+	maxt        int64
+	step        int64
+	currentStep int64
+	stepsBatch  int
+	totalSteps  int64
+
+	samples     *model.SamplesCounter
+	nextSamples *model.SamplesCounter
 }
 
 func (u *stepInvariantOperator) Explain() (me string, next []model.VectorOperator) {
@@ -37,6 +46,7 @@ func NewStepInvariantOperator(
 	next model.VectorOperator,
 	expr parser.Expr,
 	opts *query.Options,
+	nextSamples *model.SamplesCounter,
 ) (model.VectorOperator, error) {
 	interval := opts.Step.Milliseconds()
 	// We set interval to be at least 1.
@@ -49,6 +59,11 @@ func NewStepInvariantOperator(
 		mint:             opts.Start.UnixMilli(),
 		maxt:             opts.End.UnixMilli(),
 		step:             interval,
+		currentStep:      opts.Start.UnixMilli(),
+		stepsBatch:       int(opts.StepsBatch),
+		totalSteps:       opts.TotalSteps(),
+		samples:          opts.SamplesCounter,
+		nextSamples:      nextSamples,
 		duplicateResults: true,
 	}
 	// We do not duplicate results for range selectors since result is a matrix
@@ -76,38 +91,73 @@ func (u *stepInvariantOperator) GetPool() *model.VectorPool {
 	return u.next.GetPool()
 }
 
+func (u *stepInvariantOperator) Reset() {
+	u.next.Reset()
+	u.cacheOnce = sync.Once{}
+	u.cachedVector = model.StepVector{}
+	u.currentStep = u.mint
+}
+
 func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, error) {
-	in, err := u.next.Next(ctx)
-	if err != nil {
-		return nil, err
+	if !u.duplicateResults {
+		in, err := u.next.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(in) == 0 || len(in[0].Samples) == 0 {
+			return nil, nil
+		}
+		return in, nil
 	}
-	if len(in) == 0 || len(in[0].Samples) == 0 {
+
+	if u.currentStep > u.maxt {
 		return nil, nil
 	}
-	if !u.duplicateResults {
-		return in, nil
+
+	var err error
+	u.cacheOnce.Do(func() { err = u.cacheVector(ctx) })
+	if err != nil {
+		return nil, err
 	}
-	// Make sure we only have one step vector.
-	if len(in) != 1 {
-		return nil, errors.New("unexpected number of samples")
+	if len(u.cachedVector.Samples) == 0 {
+		return nil, nil
 	}
-	defer u.next.GetPool().PutVectors(in)
 
+	// The evaluated step vector is copied to every step,
+	// in batches of the same size as other operators produce.
 	result := u.vectorPool.GetVectorBatch()
-
-	// Copy the evaluated step vector.
-	sv := u.vectorPool.GetStepVector(in[0].T)
-	sv.Samples = append(sv.Samples, in[0].Samples...)
-	sv.SampleIDs = append(sv.SampleIDs, in[0].SampleIDs...)
-	result = append(result, sv)
-	u.next.GetPool().PutStepVector(in[0])
-
-	for ts := u.mint + u.step; ts <= u.maxt; ts += u.step {
-		sv := u.vectorPool.GetStepVector(ts)
-		sv.Samples = append(sv.Samples, result[0].Samples...)
-		sv.SampleIDs = append(sv.SampleIDs, result[0].SampleIDs...)
+	for i := 0; i < u.stepsBatch && u.currentStep <= u.maxt; i++ {
+		sv := u.vectorPool.GetStepVector(u.currentStep)
+		sv.Samples = append(sv.Samples, u.cachedVector.Samples...)
+		sv.SampleIDs = append(sv.SampleIDs, u.cachedVector.SampleIDs...)
 		result = append(result, sv)
+		u.currentStep += u.step
 	}
 
 	return result, nil
 }
+
+func (u *stepInvariantOperator) cacheVector(ctx context.Context) error {
+	// Same as in Prometheus, samples which the single evaluation processes are counted for every step.
+	processed := u.nextSamples.Total()
+	in, err := u.next.Next(ctx)
+	u.samples.Add((u.nextSamples.Total() - processed) * u.totalSteps)
+	if err != nil {
+		return err
+	}
+	if len(in) == 0 {
+		return nil
+	}
+	// Make sure we only have one step vector.
+	if len(in) != 1 {
+		return errors.New("unexpected number of samples")
+	}
+
+	u.cachedVector = model.StepVector{
+		Samples:   append([]float64{}, in[0].Samples...),
+		SampleIDs: append([]uint64{}, in[0].SampleIDs...),
+	}
+	u.next.GetPool().PutStepVector(in[0])
+	u.next.GetPool().PutVectors(in)
+	return nil
+}
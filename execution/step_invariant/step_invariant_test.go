@@ -0,0 +1,96 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package step_invariant
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestStepInvariantOperatorEvaluatesOnce(t *testing.T) {
+	opts := &query.Options{
+		Start:      time.Unix(0, 0),
+		End:        time.Unix(600, 0),
+		Step:       30 * time.Second,
+		StepsBatch: 10,
+	}
+	expr, err := parser.ParseExpr("foo @ 123 + bar @ 123")
+	testutil.Ok(t, err)
+
+	next := &countingOperator{pool: model.NewVectorPool(10)}
+	op, err := NewStepInvariantOperator(model.NewVectorPool(10), next, expr, opts, nil)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	var (
+		numSteps   int
+		batchSizes []int
+	)
+	for {
+		vectors, err := op.Next(ctx)
+		testutil.Ok(t, err)
+		if vectors == nil {
+			break
+		}
+		batchSizes = append(batchSizes, len(vectors))
+		for _, vector := range vectors {
+			testutil.Equals(t, int64(numSteps)*30000, vector.T)
+			testutil.Equals(t, []float64{123}, vector.Samples)
+			testutil.Equals(t, []uint64{0}, vector.SampleIDs)
+			numSteps++
+		}
+	}
+	testutil.Equals(t, []int{10, 10, 1}, batchSizes)
+	testutil.Equals(t, 1, next.calls)
+
+	// The expression is evaluated again after a reset.
+	op.Reset()
+	_, err = op.Next(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, next.calls)
+}
+
+// countingOperator returns a single step with one sample and counts how often it was evaluated.
+type countingOperator struct {
+	pool  *model.VectorPool
+	calls int
+	done  bool
+}
+
+func (o *countingOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*countingOperator]", nil
+}
+
+func (o *countingOperator) Series(_ context.Context) ([]labels.Labels, error) {
+	return []labels.Labels{labels.FromStrings("pod", "nginx-1")}, nil
+}
+
+func (o *countingOperator) GetPool() *model.VectorPool {
+	return o.pool
+}
+
+func (o *countingOperator) Reset() {
+	o.done = false
+}
+
+func (o *countingOperator) Next(_ context.Context) ([]model.StepVector, error) {
+	if o.done {
+		return nil, nil
+	}
+	o.done = true
+	o.calls++
+
+	vector := o.pool.GetStepVector(0)
+	vector.SampleIDs = append(vector.SampleIDs, 0)
+	vector.Samples = append(vector.Samples, 123)
+	return append(o.pool.GetVectorBatch(), vector), nil
+}
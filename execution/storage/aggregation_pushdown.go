@@ -0,0 +1,22 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// AggregationPushdownQuerier is implemented by queriers which can partially aggregate
+// series in storage, in order to reduce the number of series returned to the engine.
+type AggregationPushdownQuerier interface {
+	storage.Querier
+
+	// SelectAggregated returns the series matching matchers aggregated with hints.Func, grouped by
+	// or without hints.Grouping depending on hints.By. Aggregated series need to contain one sample at
+	// every step from hints.Start+lookbackDelta to hints.End, every hints.Step milliseconds, which aggregates
+	// the latest sample of each series within lookbackDelta before the step. More than one series can be
+	// returned for each group, for example one for each store, since the engine aggregates them again.
+	SelectAggregated(hints *storage.SelectHints, lookbackDelta int64, matchers ...*labels.Matcher) storage.SeriesSet
+}
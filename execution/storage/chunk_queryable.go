@@ -0,0 +1,180 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+type chunkQueryable struct {
+	queryable storage.ChunkQueryable
+}
+
+// NewChunkQueryable creates a queryable which selects chunks instead of samples from queryable.
+// Iterators of the selected series seek by skipping whole chunks which end before the sought
+// timestamp, so that only chunks containing needed samples are decoded. This is faster than iterating
+// samples for queries with wide ranges or large steps, where selectors skip most of the samples.
+func NewChunkQueryable(queryable storage.ChunkQueryable) storage.Queryable {
+	return &chunkQueryable{queryable: queryable}
+}
+
+func (q *chunkQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.queryable.ChunkQuerier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkQuerier{ChunkQuerier: querier}, nil
+}
+
+type chunkQuerier struct {
+	storage.ChunkQuerier
+}
+
+func (q *chunkQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	return &chunkSeriesSet{ChunkSeriesSet: q.ChunkQuerier.Select(sortSeries, hints, matchers...)}
+}
+
+type chunkSeriesSet struct {
+	storage.ChunkSeriesSet
+
+	current storage.Series
+	err     error
+}
+
+func (s *chunkSeriesSet) Next() bool {
+	if s.err != nil || !s.ChunkSeriesSet.Next() {
+		return false
+	}
+
+	series := s.ChunkSeriesSet.At()
+	var metas []chunks.Meta
+	it := series.Iterator()
+	for it.Next() {
+		metas = append(metas, it.At())
+	}
+	if err := it.Err(); err != nil {
+		s.err = err
+		return false
+	}
+	s.current = newChunkSeries(series.Labels(), metas)
+	return true
+}
+
+func (s *chunkSeriesSet) At() storage.Series {
+	return s.current
+}
+
+func (s *chunkSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.ChunkSeriesSet.Err()
+}
+
+// newChunkSeries creates a series which iterates over metas. Chunks are sorted by their min time,
+// but they can overlap, in which case their samples are merged the same way as in Prometheus.
+func newChunkSeries(lset labels.Labels, metas []chunks.Meta) storage.Series {
+	for i := 1; i < len(metas); i++ {
+		if metas[i].MinTime > metas[i-1].MaxTime {
+			continue
+		}
+
+		series := make([]storage.Series, 0, len(metas))
+		for _, meta := range metas {
+			chk := meta.Chunk
+			series = append(series, &storage.SeriesEntry{
+				Lset:             lset,
+				SampleIteratorFn: func() chunkenc.Iterator { return chk.Iterator(nil) },
+			})
+		}
+		return storage.ChainedSeriesMerge(series...)
+	}
+
+	return &storage.SeriesEntry{
+		Lset:             lset,
+		SampleIteratorFn: func() chunkenc.Iterator { return &chunksIterator{chunks: metas} },
+	}
+}
+
+// chunksIterator iterates over the samples of non-overlapping chunks.
+type chunksIterator struct {
+	chunks []chunks.Meta
+	// cur is the iterator of the chunk at index i, or nil if the chunk was not decoded yet.
+	cur   chunkenc.Iterator
+	i     int
+	valid bool
+	err   error
+
+	// buf is reused for decoding chunks.
+	buf chunkenc.Iterator
+}
+
+func (it *chunksIterator) Next() bool {
+	for it.err == nil && it.i < len(it.chunks) {
+		if it.cur == nil {
+			it.cur = it.decode()
+		}
+		if it.cur.Next() {
+			it.valid = true
+			return true
+		}
+		it.nextChunk()
+	}
+	it.valid = false
+	return false
+}
+
+func (it *chunksIterator) Seek(t int64) bool {
+	if it.valid {
+		if ts, _ := it.cur.At(); ts >= t {
+			return true
+		}
+	}
+
+	for it.err == nil && it.i < len(it.chunks) {
+		// Chunks which end before t are skipped without decoding them.
+		if it.chunks[it.i].MaxTime < t {
+			it.nextChunk()
+			continue
+		}
+		if it.cur == nil {
+			it.cur = it.decode()
+		}
+		if it.cur.Seek(t) {
+			it.valid = true
+			return true
+		}
+		it.nextChunk()
+	}
+	it.valid = false
+	return false
+}
+
+func (it *chunksIterator) At() (int64, float64) {
+	return it.cur.At()
+}
+
+func (it *chunksIterator) Err() error {
+	return it.err
+}
+
+func (it *chunksIterator) decode() chunkenc.Iterator {
+	it.buf = it.chunks[it.i].Chunk.Iterator(it.buf)
+	return it.buf
+}
+
+// nextChunk moves the iterator to the next chunk, keeping the error of the current one.
+func (it *chunksIterator) nextChunk() {
+	if it.cur != nil {
+		it.err = it.cur.Err()
+	}
+	it.cur = nil
+	it.valid = false
+	it.i++
+}
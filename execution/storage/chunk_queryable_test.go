@@ -0,0 +1,123 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+	"github.com/prometheus/prometheus/util/teststorage"
+)
+
+func TestChunkSeriesIterator(t *testing.T) {
+	for _, tcase := range []struct {
+		name   string
+		chunks [][]tsdbutil.Sample
+	}{
+		{name: "no chunks"},
+		{name: "single chunk", chunks: [][]tsdbutil.Sample{tsdbutil.GenerateSamples(0, 100)}},
+		{
+			name: "adjacent chunks",
+			chunks: [][]tsdbutil.Sample{
+				tsdbutil.GenerateSamples(0, 100),
+				tsdbutil.GenerateSamples(100, 100),
+				tsdbutil.GenerateSamples(250, 50),
+			},
+		},
+		{
+			name: "overlapping chunks",
+			chunks: [][]tsdbutil.Sample{
+				tsdbutil.GenerateSamples(0, 100),
+				tsdbutil.GenerateSamples(50, 100),
+				tsdbutil.GenerateSamples(250, 50),
+			},
+		},
+	} {
+		var (
+			metas    []chunks.Meta
+			expected []tsdbutil.Sample
+			seen     = make(map[int64]struct{})
+		)
+		for _, samples := range tcase.chunks {
+			metas = append(metas, tsdbutil.ChunkFromSamples(samples))
+			for _, s := range samples {
+				if _, ok := seen[s.T()]; !ok {
+					seen[s.T()] = struct{}{}
+					expected = append(expected, s)
+				}
+			}
+		}
+		expectedSeries := storage.NewListSeries(labels.EmptyLabels(), expected)
+		series := newChunkSeries(labels.EmptyLabels(), metas)
+
+		t.Run(tcase.name+"/next", func(t *testing.T) {
+			testutil.Equals(t, readSamples(expectedSeries.Iterator()), readSamples(series.Iterator()))
+		})
+		for _, step := range []int64{1, 7, 99, 100, 101, 500} {
+			t.Run(fmt.Sprintf("%s/seek step %d", tcase.name, step), func(t *testing.T) {
+				testutil.Equals(t, seekSamples(expectedSeries.Iterator(), step), seekSamples(series.Iterator(), step))
+			})
+		}
+	}
+}
+
+func TestChunkQueryableSelectsSameSamples(t *testing.T) {
+	db := teststorage.New(t)
+	defer db.Close()
+
+	app := db.Appender(context.Background())
+	for i := 0; i < 10; i++ {
+		lbls := labels.FromStrings(labels.MetricName, "foo", "i", fmt.Sprint(i))
+		for ts := int64(0); ts < 1000*30000; ts += 30000 {
+			_, err := app.Append(0, lbls, ts, float64(ts*int64(i)))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	matcher := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	selectSamples := func(queryable storage.Queryable) map[string][][2]float64 {
+		querier, err := queryable.Querier(context.Background(), 0, 1000*30000)
+		testutil.Ok(t, err)
+		defer querier.Close()
+
+		result := make(map[string][][2]float64)
+		set := querier.Select(false, nil, matcher)
+		for set.Next() {
+			result[set.At().Labels().String()] = seekSamples(set.At().Iterator(), 3600000)
+		}
+		testutil.Ok(t, set.Err())
+		return result
+	}
+
+	expected := selectSamples(db)
+	testutil.Equals(t, 10, len(expected))
+	testutil.Equals(t, expected, selectSamples(NewChunkQueryable(db)))
+}
+
+func readSamples(it chunkenc.Iterator) [][2]float64 {
+	var samples [][2]float64
+	for it.Next() {
+		t, v := it.At()
+		samples = append(samples, [2]float64{float64(t), v})
+	}
+	return samples
+}
+
+// seekSamples seeks it in steps of step and returns the sample found by each seek.
+func seekSamples(it chunkenc.Iterator, step int64) [][2]float64 {
+	var samples [][2]float64
+	for ts := int64(0); it.Seek(ts); ts += step {
+		t, v := it.At()
+		samples = append(samples, [2]float64{float64(t), v})
+	}
+	return samples
+}
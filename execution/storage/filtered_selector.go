@@ -14,7 +14,8 @@ type filteredSelector struct {
 	selector *seriesSelector
 	filter   Filter
 
-	once   sync.Once
+	mu     sync.Mutex
+	loaded bool
 	series []SignedSeries
 }
 
@@ -30,13 +31,20 @@ func (f *filteredSelector) Matchers() []*labels.Matcher {
 }
 
 func (f *filteredSelector) GetSeries(ctx context.Context, shard, numShards int) ([]SignedSeries, error) {
-	var err error
-	f.once.Do(func() { err = f.loadSeries(ctx) })
-	if err != nil {
-		return nil, err
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Same as for the underlying selector, series are only cached
+	// after loading them succeeded so that failed loads can be retried.
+	if !f.loaded {
+		if err := f.loadSeries(ctx); err != nil {
+			f.series = nil
+			return nil, err
+		}
+		f.loaded = true
 	}
 
-	return seriesShard(f.series, shard, numShards), nil
+	return seriesShard(f.series, shard, numShards)
 }
 
 func (f *filteredSelector) loadSeries(ctx context.Context) error {
@@ -29,15 +29,29 @@ func NewSelectorPool(queryable storage.Queryable) *SelectorPool {
 }
 
 func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
-	key := hashMatchers(matchers, mint, maxt, hints)
+	key := hashMatchers(matchers, mint, maxt, hints, false)
 	if _, ok := p.selectors[key]; !ok {
 		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
 	}
 	return p.selectors[key]
 }
 
+// GetAggregatedSelector returns a selector which pushes down the aggregation in hints to queriers
+// implementing AggregationPushdownQuerier. Other queriers return the selected series unaggregated,
+// so the aggregation always needs to be evaluated over the returned series as well.
+func (p *SelectorPool) GetAggregatedSelector(mint, maxt, step, lookbackDelta int64, matchers []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
+	key := hashMatchers(matchers, mint, maxt, hints, true)
+	if _, ok := p.selectors[key]; !ok {
+		selector := newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+		selector.aggregated = true
+		selector.lookbackDelta = lookbackDelta
+		p.selectors[key] = selector
+	}
+	return p.selectors[key]
+}
+
 func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, filters []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
-	key := hashMatchers(matchers, mint, maxt, hints)
+	key := hashMatchers(matchers, mint, maxt, hints, false)
 	if _, ok := p.selectors[key]; !ok {
 		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
 	}
@@ -45,7 +59,7 @@ func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, fil
 	return NewFilteredSelector(p.selectors[key], NewFilter(filters))
 }
 
-func hashMatchers(matchers []*labels.Matcher, mint, maxt int64, hints storage.SelectHints) uint64 {
+func hashMatchers(matchers []*labels.Matcher, mint, maxt int64, hints storage.SelectHints, aggregated bool) uint64 {
 	sb := xxhash.New()
 	for _, m := range matchers {
 		writeMatcher(sb, m)
@@ -56,6 +70,7 @@ func hashMatchers(matchers []*labels.Matcher, mint, maxt int64, hints storage.Se
 	writeString(sb, hints.Func)
 	writeString(sb, strings.Join(hints.Grouping, ";"))
 	writeBool(sb, hints.By)
+	writeBool(sb, aggregated)
 
 	key := sb.Sum64()
 	return key
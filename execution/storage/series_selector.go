@@ -5,10 +5,15 @@ package storage
 
 import (
 	"context"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+	"golang.org/x/exp/slices"
 )
 
 type SeriesSelector interface {
@@ -29,7 +34,12 @@ type seriesSelector struct {
 	matchers []*labels.Matcher
 	hints    storage.SelectHints
 
-	once   sync.Once
+	// aggregated is set when series can be aggregated by queriers implementing AggregationPushdownQuerier.
+	aggregated    bool
+	lookbackDelta int64
+
+	mu     sync.Mutex
+	loaded bool
 	series []SignedSeries
 }
 
@@ -49,13 +59,20 @@ func (o *seriesSelector) Matchers() []*labels.Matcher {
 }
 
 func (o *seriesSelector) GetSeries(ctx context.Context, shard int, numShards int) ([]SignedSeries, error) {
-	var err error
-	o.once.Do(func() { err = o.loadSeries(ctx) })
-	if err != nil {
-		return nil, err
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Series are only cached after loading them succeeded,
+	// so that failed loads can be retried by callers.
+	if !o.loaded {
+		if err := o.loadSeries(ctx); err != nil {
+			o.series = nil
+			return nil, err
+		}
+		o.loaded = true
 	}
 
-	return seriesShard(o.series, shard, numShards), nil
+	return seriesShard(o.series, shard, numShards)
 }
 
 func (o *seriesSelector) loadSeries(ctx context.Context) error {
@@ -65,25 +82,119 @@ func (o *seriesSelector) loadSeries(ctx context.Context) error {
 	}
 	defer querier.Close()
 
-	seriesSet := querier.Select(false, &o.hints, o.matchers...)
+	var seriesSet storage.SeriesSet
+	if q, ok := querier.(AggregationPushdownQuerier); ok && o.aggregated {
+		seriesSet = q.SelectAggregated(&o.hints, o.lookbackDelta, o.matchers...)
+	} else {
+		seriesSet = selectSeries(querier, &o.hints, o.matchers)
+	}
 	i := 0
 	for seriesSet.Next() {
 		s := seriesSet.At()
 		o.series = append(o.series, SignedSeries{
-			Series:    s,
+			Series:    withSortedLabels(s),
 			Signature: uint64(i),
 		})
 		i++
 	}
 
-	return nil
+	return seriesSet.Err()
+}
+
+// sortedLabelsSeries is a series with sorted labels.
+type sortedLabelsSeries struct {
+	storage.Series
+	labels labels.Labels
+}
+
+func (s sortedLabelsSeries) Labels() labels.Labels {
+	return s.labels
+}
+
+// withSortedLabels returns s with its labels sorted by name. Operators hash labels assuming that they are
+// sorted, which storages usually guarantee, but custom storages might return series with unsorted labels.
+func withSortedLabels(s storage.Series) storage.Series {
+	lbls := s.Labels()
+	if sort.IsSorted(lbls) {
+		return s
+	}
+	sorted := lbls.Copy()
+	sort.Sort(sorted)
+	return sortedLabelsSeries{Series: s, labels: sorted}
+}
+
+// selectSeries selects the series matching matchers from querier. A regex matcher for the metric
+// name which only consists of alternated names, like {__name__=~"a|b|c"}, is expanded into one
+// select with an equality matcher per name, since storages can usually look up names faster than
+// they can match them against a regex. Equality matchers for the metric name are passed first.
+func selectSeries(querier storage.Querier, hints *storage.SelectHints, matchers []*labels.Matcher) storage.SeriesSet {
+	idx, names := nameAlternatives(matchers)
+	if names == nil {
+		return querier.Select(false, hints, nameEqualityFirst(matchers)...)
+	}
+
+	sets := make([]storage.SeriesSet, 0, len(names))
+	for _, name := range names {
+		expanded := make([]*labels.Matcher, len(matchers))
+		copy(expanded, matchers)
+		expanded[idx] = labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name)
+		// Sets need to be sorted in order to be merged.
+		sets = append(sets, querier.Select(true, hints, nameEqualityFirst(expanded)...))
+	}
+	return storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+}
+
+// nameEqualityFirst returns matchers with the first equality matcher for the metric name moved to the front.
+// The TSDB looks up all matchers in its index regardless of their order, but storages which evaluate matchers
+// in order can then look up series by their name before applying the remaining matchers.
+func nameEqualityFirst(matchers []*labels.Matcher) []*labels.Matcher {
+	for i, m := range matchers {
+		if m.Name != labels.MetricName || m.Type != labels.MatchEqual {
+			continue
+		}
+		if i == 0 {
+			return matchers
+		}
+		reordered := make([]*labels.Matcher, 0, len(matchers))
+		reordered = append(reordered, m)
+		reordered = append(reordered, matchers[:i]...)
+		return append(reordered, matchers[i+1:]...)
+	}
+	return matchers
 }
 
-func seriesShard(series []SignedSeries, shard int, numShards int) []SignedSeries {
+// nameAlternatives returns the index of the first regex matcher for the metric name in matchers
+// and the names it matches, if its regex is an alternation of literal names.
+func nameAlternatives(matchers []*labels.Matcher) (int, []string) {
+	for i, m := range matchers {
+		if m.Name != labels.MetricName || m.Type != labels.MatchRegexp {
+			continue
+		}
+
+		names := strings.Split(m.Value, "|")
+		for _, name := range names {
+			// Empty alternatives match series without a metric name.
+			if name == "" || regexp.QuoteMeta(name) != name {
+				return -1, nil
+			}
+		}
+		slices.Sort(names)
+		return i, slices.Compact(names)
+	}
+	return -1, nil
+}
+
+// seriesShard returns the series of a shard. Shards are disjoint, which guarantees that
+// each series, and therefore each of its iterators, is owned by a single shard.
+func seriesShard(series []SignedSeries, shard int, numShards int) ([]SignedSeries, error) {
+	if numShards < 1 || shard < 0 || shard >= numShards {
+		return nil, errors.Newf("invalid shard %d for %d shards", shard, numShards)
+	}
+
 	start := shard * len(series) / numShards
 	end := (shard + 1) * len(series) / numShards
 	if end > len(series) {
 		end = len(series)
 	}
-	return series[start:end]
+	return series[start:end], nil
 }
@@ -0,0 +1,301 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/teststorage"
+)
+
+func TestSeriesShardsAreDisjoint(t *testing.T) {
+	for numSeries := 0; numSeries < 20; numSeries++ {
+		series := make([]SignedSeries, numSeries)
+		for i := range series {
+			series[i].Signature = uint64(i)
+		}
+
+		for numShards := 1; numShards < 10; numShards++ {
+			t.Run(fmt.Sprintf("series=%d/shards=%d", numSeries, numShards), func(t *testing.T) {
+				owners := make([]int, numSeries)
+				for shard := 0; shard < numShards; shard++ {
+					shardSeries, err := seriesShard(series, shard, numShards)
+					testutil.Ok(t, err)
+					for _, s := range shardSeries {
+						owners[s.Signature]++
+					}
+				}
+				for i, n := range owners {
+					testutil.Equals(t, 1, n, "series %d is owned by %d shards", i, n)
+				}
+			})
+		}
+	}
+}
+
+func TestSeriesShardRejectsInvalidShards(t *testing.T) {
+	for _, tcase := range []struct {
+		shard     int
+		numShards int
+	}{
+		{shard: 0, numShards: 0},
+		{shard: -1, numShards: 2},
+		{shard: 2, numShards: 2},
+	} {
+		t.Run(fmt.Sprintf("%d of %d", tcase.shard, tcase.numShards), func(t *testing.T) {
+			_, err := seriesShard(make([]SignedSeries, 4), tcase.shard, tcase.numShards)
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+func TestFilteredSelectorRetriesFailedLoads(t *testing.T) {
+	var selects int
+	queryable := &storage.MockQueryable{MockQuerier: &storage.MockQuerier{
+		SelectMockFunction: func(bool, *storage.SelectHints, ...*labels.Matcher) storage.SeriesSet {
+			selects++
+			if selects == 1 {
+				return storage.ErrSeriesSet(errors.New("unavailable"))
+			}
+			return &sliceSeriesSet{series: []storage.Series{
+				storage.MockSeries(nil, nil, []string{"pod", "nginx-1"}),
+				storage.MockSeries(nil, nil, []string{"pod", "nginx-2"}),
+			}}
+		},
+	}}
+	filters := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "nginx-1")}
+	selector := NewSelectorPool(queryable).GetFilteredSelector(0, 1000, 0, nil, filters, storage.SelectHints{})
+
+	_, err := selector.GetSeries(context.Background(), 0, 1)
+	testutil.NotOk(t, err)
+
+	series, err := selector.GetSeries(context.Background(), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(series))
+	testutil.Equals(t, 2, selects)
+}
+
+func TestSelectSeriesExpandsNameAlternations(t *testing.T) {
+	db := teststorage.New(t)
+	defer db.Close()
+
+	app := db.Appender(context.Background())
+	for _, name := range []string{"a", "b", "c", "ab", "a_total"} {
+		for _, job := range []string{"api", "db"} {
+			_, err := app.Append(0, labels.FromStrings(labels.MetricName, name, "job", job), 0, 1)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	for _, tcase := range []struct {
+		matchers        []*labels.Matcher
+		expectedSelects int
+	}{
+		{
+			matchers:        []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "a|b|c")},
+			expectedSelects: 3,
+		},
+		{
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "job", "api"),
+				labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "c|a|c"),
+			},
+			expectedSelects: 2,
+		},
+		{
+			matchers:        []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "a_total")},
+			expectedSelects: 1,
+		},
+		{
+			matchers:        []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "a|b.*")},
+			expectedSelects: 1,
+		},
+		{
+			matchers:        []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "a|")},
+			expectedSelects: 1,
+		},
+		{
+			matchers:        []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "job", "api|db")},
+			expectedSelects: 1,
+		},
+	} {
+		t.Run(fmt.Sprintf("%v", tcase.matchers), func(t *testing.T) {
+			querier, err := db.Querier(context.Background(), 0, 1000)
+			testutil.Ok(t, err)
+			defer querier.Close()
+
+			expected := seriesLabels(t, querier.Select(false, nil, tcase.matchers...))
+			testutil.Assert(t, len(expected) > 0)
+
+			counting := &selectCountingQuerier{Querier: querier}
+			testutil.Equals(t, expected, seriesLabels(t, selectSeries(counting, nil, tcase.matchers)))
+			testutil.Equals(t, tcase.expectedSelects, counting.selects)
+		})
+	}
+}
+
+// BenchmarkSelectSeriesWithNameAlternation compares selecting series with a regex for the
+// metric name against selecting them by name, from a querier which looks up names in an index
+// and otherwise matches all series against the matchers.
+func BenchmarkSelectSeriesWithNameAlternation(b *testing.B) {
+	querier := &nameIndexQuerier{series: make(map[string][]storage.Series)}
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("metric_%d", i)
+		for j := 0; j < 10; j++ {
+			querier.series[name] = append(querier.series[name], storage.MockSeries(nil, nil, []string{labels.MetricName, name, "pod", fmt.Sprintf("pod-%d", j)}))
+		}
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "metric_1|metric_20|metric_300")}
+
+	b.Run("regex", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			testutil.Equals(b, 30, len(seriesLabels(b, querier.Select(false, nil, matchers...))))
+		}
+	})
+	b.Run("expanded", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			testutil.Equals(b, 30, len(seriesLabels(b, selectSeries(querier, nil, matchers))))
+		}
+	})
+}
+
+// BenchmarkSelectSeriesWithNameEquality compares selecting series with matchers in the order
+// of the query against selecting them with the equality matcher for the metric name first.
+func BenchmarkSelectSeriesWithNameEquality(b *testing.B) {
+	querier := &nameIndexQuerier{series: make(map[string][]storage.Series)}
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("metric_%d", i)
+		for j := 0; j < 10; j++ {
+			querier.series[name] = append(querier.series[name], storage.MockSeries(nil, nil, []string{labels.MetricName, name, "pod", fmt.Sprintf("pod-%d", j)}))
+		}
+	}
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1"),
+		labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "metric_20"),
+	}
+
+	b.Run("query order", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			testutil.Equals(b, 1, len(seriesLabels(b, querier.Select(false, nil, matchers...))))
+		}
+	})
+	b.Run("name equality first", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			testutil.Equals(b, 1, len(seriesLabels(b, selectSeries(querier, nil, matchers))))
+		}
+	})
+}
+
+func TestNameEqualityFirst(t *testing.T) {
+	var (
+		name  = labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "a")
+		regex = labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "a.*")
+		pod   = labels.MustNewMatcher(labels.MatchEqual, "pod", "nginx-1")
+		job   = labels.MustNewMatcher(labels.MatchNotEqual, "job", "api")
+	)
+	for _, tcase := range []struct {
+		matchers []*labels.Matcher
+		expected []*labels.Matcher
+	}{
+		{matchers: []*labels.Matcher{name, pod}, expected: []*labels.Matcher{name, pod}},
+		{matchers: []*labels.Matcher{pod, job, name}, expected: []*labels.Matcher{name, pod, job}},
+		{matchers: []*labels.Matcher{pod, regex}, expected: []*labels.Matcher{pod, regex}},
+		{matchers: []*labels.Matcher{pod, job}, expected: []*labels.Matcher{pod, job}},
+	} {
+		t.Run(fmt.Sprintf("%v", tcase.matchers), func(t *testing.T) {
+			original := append([]*labels.Matcher{}, tcase.matchers...)
+			testutil.Equals(t, tcase.expected, nameEqualityFirst(tcase.matchers))
+			testutil.Equals(t, original, tcase.matchers)
+		})
+	}
+}
+
+func seriesLabels(t testing.TB, set storage.SeriesSet) []labels.Labels {
+	var result []labels.Labels
+	for set.Next() {
+		result = append(result, set.At().Labels())
+	}
+	testutil.Ok(t, set.Err())
+	sort.Slice(result, func(i, j int) bool { return labels.Compare(result[i], result[j]) < 0 })
+	return result
+}
+
+type selectCountingQuerier struct {
+	storage.Querier
+	selects int
+}
+
+func (q *selectCountingQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	q.selects++
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+// nameIndexQuerier evaluates matchers in order, like storages without a full index. Series are only
+// looked up by their metric name if the first matcher is an equality matcher for the name, otherwise
+// all series are matched against the matchers.
+type nameIndexQuerier struct {
+	storage.Querier
+	series map[string][]storage.Series
+}
+
+func (q *nameIndexQuerier) Select(_ bool, _ *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	var candidates []storage.Series
+	if m := matchers[0]; m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+		candidates = q.series[m.Value]
+	} else {
+		names := make([]string, 0, len(q.series))
+		for name := range q.series {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			candidates = append(candidates, q.series[name]...)
+		}
+	}
+
+	set := &sliceSeriesSet{}
+	for _, s := range candidates {
+		if matchesAll(s.Labels(), matchers) {
+			set.series = append(set.series, s)
+		}
+	}
+	return set
+}
+
+func matchesAll(lbls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+type sliceSeriesSet struct {
+	series []storage.Series
+	i      int
+}
+
+func (s *sliceSeriesSet) Next() bool {
+	s.i++
+	return s.i <= len(s.series)
+}
+
+func (s *sliceSeriesSet) At() storage.Series { return s.series[s.i-1] }
+
+func (s *sliceSeriesSet) Err() error { return nil }
+
+func (s *sliceSeriesSet) Warnings() storage.Warnings { return nil }
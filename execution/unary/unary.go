@@ -11,6 +11,7 @@ import (
 	"gonum.org/v1/gonum/floats"
 
 	"github.com/thanos-community/promql-engine/execution/model"
+	"github.com/thanos-community/promql-engine/query"
 	"github.com/thanos-community/promql-engine/worker"
 )
 
@@ -20,7 +21,8 @@ type unaryNegation struct {
 
 	series []labels.Labels
 
-	workers worker.Group
+	workers        worker.Group
+	keepMetricName bool
 }
 
 func (u *unaryNegation) Explain() (me string, next []model.VectorOperator) {
@@ -29,13 +31,14 @@ func (u *unaryNegation) Explain() (me string, next []model.VectorOperator) {
 
 func NewUnaryNegation(
 	next model.VectorOperator,
-	stepsBatch int,
+	opts *query.Options,
 ) (model.VectorOperator, error) {
 	u := &unaryNegation{
-		next: next,
+		next:           next,
+		keepMetricName: opts.KeepMetricNames,
 	}
 
-	u.workers = worker.NewGroup(stepsBatch, u.workerTask)
+	u.workers = worker.NewGroup(int(opts.StepsBatch), u.workerTask)
 	return u, nil
 }
 
@@ -55,7 +58,10 @@ func (u *unaryNegation) loadSeries(ctx context.Context) error {
 	}
 	u.series = make([]labels.Labels, len(vectorSeries))
 	for i := range vectorSeries {
-		lbls := labels.NewBuilder(vectorSeries[i]).Del(labels.MetricName).Labels(nil)
+		lbls := vectorSeries[i]
+		if !u.keepMetricName {
+			lbls = model.DropMetricName(lbls)
+		}
 		u.series[i] = lbls
 	}
 
@@ -63,6 +69,10 @@ func (u *unaryNegation) loadSeries(ctx context.Context) error {
 	return nil
 }
 
+func (u *unaryNegation) Reset() {
+	u.next.Reset()
+}
+
 func (u *unaryNegation) GetPool() *model.VectorPool {
 	return u.next.GetPool()
 }
@@ -0,0 +1,57 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package warnings
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/prometheus/storage"
+)
+
+type warningKey string
+
+const key warningKey = "promql-warnings"
+
+type warnings struct {
+	mu       sync.Mutex
+	warnings storage.Warnings
+}
+
+func (w *warnings) add(warns ...error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, warns...)
+}
+
+func (w *warnings) get() storage.Warnings {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.warnings
+}
+
+// NewContext returns a context which collects the warnings
+// added by operators during query execution.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, key, &warnings{})
+}
+
+// AddToContext adds a warning to the context. The warning is
+// dropped if the context was not created with NewContext.
+func AddToContext(ctx context.Context, warn error) {
+	w, ok := ctx.Value(key).(*warnings)
+	if !ok {
+		return
+	}
+	w.add(warn)
+}
+
+// FromContext returns all warnings which were added to the context.
+func FromContext(ctx context.Context) storage.Warnings {
+	w, ok := ctx.Value(key).(*warnings)
+	if !ok {
+		return nil
+	}
+	return w.get()
+}
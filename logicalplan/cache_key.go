@@ -0,0 +1,94 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/query"
+)
+
+var sep = []byte{'\xff'}
+
+// CacheKey returns a key which can be used for caching the result of
+// evaluating the plan with the given query options.
+// The key takes into account the resolved @ timestamps and offsets of all
+// selectors and subqueries in the plan, as well as the query range, evaluation timestamps and lookback delta.
+// Plans should be optimized with SortMatchers so that queries which only differ
+// in the order of label matchers produce the same key.
+func CacheKey(plan Plan, opts *query.Options) uint64 {
+	sb := xxhash.New()
+	writeString(sb, plan.Expr().String())
+	writeModifiers(sb, plan.Expr())
+
+	writeInt64(sb, opts.Start.UnixMilli())
+	writeInt64(sb, opts.End.UnixMilli())
+	writeInt64(sb, opts.Step.Milliseconds())
+	writeInt64(sb, opts.LookbackDelta.Milliseconds())
+	for _, ts := range opts.Timestamps {
+		writeInt64(sb, ts)
+	}
+
+	return sb.Sum64()
+}
+
+func writeModifiers(sb *xxhash.Digest, expr parser.Expr) {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		writeSelectorModifiers(sb, e)
+	case *FilteredSelector:
+		writeSelectorModifiers(sb, e.VectorSelector)
+	case *parser.MatrixSelector:
+		writeModifiers(sb, e.VectorSelector)
+		writeInt64(sb, e.Range.Milliseconds())
+	case *parser.SubqueryExpr:
+		writeTimestamp(sb, e.Timestamp)
+		writeInt64(sb, e.Offset.Milliseconds())
+		writeInt64(sb, e.Range.Milliseconds())
+		writeInt64(sb, e.Step.Milliseconds())
+		writeModifiers(sb, e.Expr)
+	case *parser.StepInvariantExpr:
+		writeModifiers(sb, e.Expr)
+	case *parser.AggregateExpr:
+		writeModifiers(sb, e.Param)
+		writeModifiers(sb, e.Expr)
+	case *parser.Call:
+		for _, arg := range e.Args {
+			writeModifiers(sb, arg)
+		}
+	case *parser.BinaryExpr:
+		writeModifiers(sb, e.LHS)
+		writeModifiers(sb, e.RHS)
+	case *parser.UnaryExpr:
+		writeModifiers(sb, e.Expr)
+	case *parser.ParenExpr:
+		writeModifiers(sb, e.Expr)
+	}
+}
+
+func writeSelectorModifiers(sb *xxhash.Digest, vs *parser.VectorSelector) {
+	writeTimestamp(sb, vs.Timestamp)
+	writeInt64(sb, vs.Offset.Milliseconds())
+}
+
+func writeTimestamp(sb *xxhash.Digest, ts *int64) {
+	if ts == nil {
+		writeString(sb, "")
+		return
+	}
+	writeInt64(sb, *ts)
+}
+
+func writeInt64(sb *xxhash.Digest, val int64) {
+	_, _ = sb.WriteString(fmt.Sprintf("%d", val))
+	_, _ = sb.Write(sep)
+}
+
+func writeString(sb *xxhash.Digest, val string) {
+	_, _ = sb.WriteString(val)
+	_, _ = sb.Write(sep)
+}
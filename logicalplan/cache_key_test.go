@@ -0,0 +1,106 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/query"
+)
+
+func TestCacheKey(t *testing.T) {
+	cases := []struct {
+		name      string
+		exprA     string
+		timeA     time.Time
+		exprB     string
+		timeB     time.Time
+		sameValue bool
+	}{
+		{
+			name:      "same query",
+			exprA:     `sum(rate(http_requests_total[5m]))`,
+			exprB:     `sum(rate(http_requests_total[5m]))`,
+			sameValue: true,
+		},
+		{
+			name:      "different matcher order",
+			exprA:     `http_requests_total{pod="nginx-1", container="nginx"}`,
+			exprB:     `http_requests_total{container="nginx", pod="nginx-1"}`,
+			sameValue: true,
+		},
+		{
+			name:      "different formatting",
+			exprA:     `sum by (pod) (http_requests_total @ 100)`,
+			exprB:     `sum(http_requests_total@100) by (pod)`,
+			sameValue: true,
+		},
+		{
+			name:  "different @ timestamp",
+			exprA: `http_requests_total @ 100`,
+			exprB: `http_requests_total @ 200`,
+		},
+		{
+			name:  "@ modifier and plain query",
+			exprA: `http_requests_total @ 100`,
+			exprB: `http_requests_total`,
+		},
+		{
+			name:  "@ start() at different times",
+			exprA: `http_requests_total @ start()`,
+			timeA: time.Unix(100, 0),
+			exprB: `http_requests_total @ start()`,
+			timeB: time.Unix(200, 0),
+		},
+		{
+			name:  "different offsets",
+			exprA: `http_requests_total offset 1m`,
+			exprB: `http_requests_total offset 2m`,
+		},
+		{
+			name:  "different evaluation time",
+			exprA: `http_requests_total`,
+			timeA: time.Unix(100, 0),
+			exprB: `http_requests_total`,
+			timeB: time.Unix(200, 0),
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			keyA := cacheKeyForInstantQuery(t, tcase.exprA, tcase.timeA)
+			keyB := cacheKeyForInstantQuery(t, tcase.exprB, tcase.timeB)
+			testutil.Equals(t, tcase.sameValue, keyA == keyB)
+
+			// Keys must be stable across invocations.
+			testutil.Equals(t, keyA, cacheKeyForInstantQuery(t, tcase.exprA, tcase.timeA))
+		})
+	}
+}
+
+func TestCacheKeyLookbackDelta(t *testing.T) {
+	expr, err := parser.ParseExpr(`http_requests_total`)
+	testutil.Ok(t, err)
+
+	plan := New(expr, time.Unix(0, 0), time.Unix(0, 0)).Optimize(DefaultOptimizers)
+	keyA := CacheKey(plan, &query.Options{LookbackDelta: 5 * time.Minute})
+	keyB := CacheKey(plan, &query.Options{LookbackDelta: 10 * time.Minute})
+	testutil.Assert(t, keyA != keyB)
+}
+
+func cacheKeyForInstantQuery(t *testing.T, q string, ts time.Time) uint64 {
+	expr, err := parser.ParseExpr(q)
+	testutil.Ok(t, err)
+
+	plan := New(expr, ts, ts).Optimize(DefaultOptimizers)
+	return CacheKey(plan, &query.Options{
+		Start:         ts,
+		End:           ts,
+		LookbackDelta: 5 * time.Minute,
+	})
+}
@@ -28,6 +28,8 @@ type plan struct {
 	expr parser.Expr
 }
 
+// New creates a plan for evaluating expr between mint and maxt. The @ start() and @ end()
+// modifiers are resolved to mint and maxt, so for instant queries both resolve to the evaluation time.
 func New(expr parser.Expr, mint, maxt time.Time) Plan {
 	expr = promql.PreprocessExpr(expr, mint, maxt)
 	setOffsetForAtModifier(mint.UnixMilli(), expr)
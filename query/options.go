@@ -4,7 +4,12 @@
 package query
 
 import (
+	"math"
 	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-community/promql-engine/execution/model"
 )
 
 type Options struct {
@@ -14,19 +19,144 @@ type Options struct {
 	LookbackDelta time.Duration
 
 	StepsBatch int64
+
+	// Timestamps optionally contains an ascending list of timestamps in milliseconds
+	// at which the query is evaluated, instead of evaluating it at every Step from Start to End.
+	Timestamps []int64
+
+	// KeepMetricNames disables dropping the metric name in operations
+	// which would drop it according to PromQL semantics.
+	// It should only be used for debugging.
+	KeepMetricNames bool
+
+	// DisableRateExtrapolation makes rate, increase and delta return the change between
+	// the first and the last sample of each range, instead of extrapolating it to the
+	// boundaries of the range. It should only be used for debugging.
+	DisableRateExtrapolation bool
+
+	// EnableExperimentalFunctions contains the names of experimental functions which can be used in the query.
+	// Queries using other experimental functions fail with parse.ErrExperimentalFunction.
+	EnableExperimentalFunctions []string
+
+	// MaxSeries is the maximum number of series which the query can return.
+	// Queries returning more series fail before they are evaluated.
+	// If zero, the number of series is not limited.
+	MaxSeries int
+
+	// MaxSteps is the maximum number of steps at which the query is evaluated.
+	// Queries with more steps fail with execution.ErrTooManySteps before they are evaluated.
+	// If zero, the number of steps is not limited.
+	MaxSteps int64
+
+	// MaxSamplesPerWindow is the maximum number of samples which a range selector can buffer
+	// for one series in a single step. Queries exceeding it fail with scan.ErrTooManySamplesInWindow.
+	// If zero, the number of samples in a window is not limited.
+	MaxSamplesPerWindow int
+
+	// SnapshotTime optionally is the latest timestamp of samples which selectors read. Later samples are
+	// ignored, so that queries evaluated against the same snapshot see the same samples even while new
+	// samples are ingested. If zero, samples are read up to the end of the query.
+	SnapshotTime time.Time
+
+	// EnableAggregationPushdown pushes sum, min, max and group aggregations over selectors
+	// down to queriers implementing storage.AggregationPushdownQuerier.
+	EnableAggregationPushdown bool
+
+	// CustomFunctions contains factories for operators of functions which are not part of PromQL, by function name.
+	// Calls of functions which the engine does not implement are evaluated with them.
+	CustomFunctions map[string]FunctionFactory
+
+	// MemoryTracker accounts for memory checked out from vector pools during execution.
+	// If nil, memory is not tracked.
+	MemoryTracker *model.MemoryTracker
+
+	// SamplesCounter optionally counts the samples which are processed by selectors.
+	// If nil, samples are not counted.
+	SamplesCounter *model.SamplesCounter
+
+	// LabelsInterner optionally deduplicates the names and values of labels
+	// of selected series and of series produced by binary operators.
+	// If nil, labels are not interned.
+	LabelsInterner model.LabelsInterner
+
+	// NoStepSubqueryIntervalFn returns the step in milliseconds for subqueries without an explicit step.
+	// If nil, subqueries without a step are not supported.
+	NoStepSubqueryIntervalFn func(rangeMillis int64) int64
+
+	// SeriesRetry optionally retries selecting series from storage after transient errors.
+	// If nil, the first error fails the query.
+	SeriesRetry *RetryOptions
+}
+
+// FunctionFactory creates the operator which evaluates call. The args contain the operators of the
+// arguments of call in order, and are nil for string arguments which can be read from call instead.
+type FunctionFactory func(call *parser.Call, args []model.VectorOperator, opts *Options) (model.VectorOperator, error)
+
+// RetryOptions configures retries with exponential backoff.
+type RetryOptions struct {
+	// MaxRetries is the number of retries after the first attempt failed.
+	MaxRetries int
+	// MinBackoff is the time to wait before the first retry. It is doubled
+	// for every following retry, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// IsPermanent optionally returns true for errors which can not be fixed by retrying,
+	// for example because matchers are rejected by storage. Errors caused by the
+	// context being cancelled or exceeding its deadline are never retried.
+	IsPermanent func(error) bool
+}
+
+// defaultRangeSteps is the number of steps which range queries
+// without an explicit step are split into.
+const defaultRangeSteps = 250
+
+// DefaultStep returns the step for evaluating a range query without an explicit step.
+// Similar to the Prometheus UI, the range is split into 250 steps and the step is at least one second.
+func DefaultStep(start, end time.Time) time.Duration {
+	step := (end.Sub(start) / defaultRangeSteps).Truncate(time.Second)
+	if step < time.Second {
+		return time.Second
+	}
+	return step
 }
 
 func (o *Options) NumSteps() int {
+	totalSteps := o.TotalSteps()
+	if o.StepsBatch < totalSteps {
+		return int(o.StepsBatch)
+	}
+	return int(totalSteps)
+}
+
+// TotalSteps returns the number of steps at which the query is evaluated.
+func (o *Options) TotalSteps() int64 {
+	if len(o.Timestamps) > 0 {
+		return int64(len(o.Timestamps))
+	}
+
 	// Instant evaluation is executed as a range evaluation with one step.
 	if o.Step.Milliseconds() == 0 {
 		return 1
 	}
+	return (o.End.UnixMilli()-o.Start.UnixMilli())/o.Step.Milliseconds() + 1
+}
 
-	totalSteps := (o.End.UnixMilli()-o.Start.UnixMilli())/o.Step.Milliseconds() + 1
-	if o.StepsBatch < totalSteps {
-		return int(o.StepsBatch)
+// MaxSampleTime returns the latest timestamp in milliseconds of samples which selectors read.
+func (o *Options) MaxSampleTime() int64 {
+	if o.SnapshotTime.IsZero() {
+		return math.MaxInt64
 	}
-	return int(totalSteps)
+	return o.SnapshotTime.UnixMilli()
+}
+
+// ExperimentalFunctionEnabled returns true if the experimental function name can be used.
+func (o *Options) ExperimentalFunctionEnabled(name string) bool {
+	for _, f := range o.EnableExperimentalFunctions {
+		if f == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (o *Options) WithEndTime(end time.Time) *Options {